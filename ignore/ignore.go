@@ -0,0 +1,158 @@
+// Package ignore matches paths against gitignore-style patterns.
+package ignore
+
+import (
+	"bufio"
+	"io"
+	"path"
+	"strings"
+)
+
+// Result is the outcome of matching a path against a Matcher.
+type Result int
+
+const (
+	// NoMatch means no pattern matched the path.
+	NoMatch Result = iota
+	// Ignored means the last matching pattern excludes the path.
+	Ignored
+	// Included means the last matching pattern was a negated ("!") pattern that re-includes the path.
+	Included
+)
+
+type pattern struct {
+	// Slash-separated directory (relative to the matcher's root) that an anchored pattern is relative to, and whose contents the pattern is limited to. Empty for the root.
+	base     string
+	segments []string
+	negated  bool
+	dirOnly  bool
+	// Anchored patterns are matched against the path relative to base. Others are matched against the last path component only.
+	anchored bool
+}
+
+// Matcher holds an ordered list of patterns in which later patterns take precedence over earlier ones.
+type Matcher struct {
+	patterns []pattern
+}
+
+// NewMatcher creates an empty Matcher.
+func NewMatcher() *Matcher {
+	return &Matcher{}
+}
+
+// AddPattern adds a single line in gitignore syntax. base is the slash-separated directory, relative to the root, that the pattern applies within.
+// Blank lines and comments are accepted and ignored.
+func (m *Matcher) AddPattern(base, line string) {
+	p, ok := parsePattern(base, line)
+	if ok {
+		m.patterns = append(m.patterns, p)
+	}
+}
+
+// AddReader adds all patterns read from r, one per line, which apply within base.
+func (m *Matcher) AddReader(base string, r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		m.AddPattern(base, scanner.Text())
+	}
+	return scanner.Err()
+}
+
+// Match matches the slash-separated relPath, relative to the root, against the patterns.
+func (m *Matcher) Match(relPath string, isDir bool) Result {
+	for i := len(m.patterns) - 1; i >= 0; i-- {
+		p := &m.patterns[i]
+		if p.matches(relPath, isDir) {
+			if p.negated {
+				return Included
+			}
+			return Ignored
+		}
+	}
+	return NoMatch
+}
+
+func parsePattern(base, line string) (pattern, bool) {
+	line = strings.TrimSuffix(line, "\r")
+	line = trimUnescapedTrailingSpaces(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return pattern{}, false
+	}
+	p := pattern{base: base}
+	if strings.HasPrefix(line, "!") {
+		p.negated = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, `\!`) || strings.HasPrefix(line, `\#`) {
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		p.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	// A slash anywhere but at the end anchors the pattern to base
+	if strings.Contains(line, "/") {
+		p.anchored = true
+		line = strings.TrimPrefix(line, "/")
+	}
+	if line == "" {
+		return pattern{}, false
+	}
+	for _, segment := range strings.Split(line, "/") {
+		// gitignore negates character classes with "[!...]" while path.Match uses "[^...]"
+		segment = strings.Replace(segment, "[!", "[^", -1)
+		p.segments = append(p.segments, segment)
+	}
+	return p, true
+}
+
+func trimUnescapedTrailingSpaces(line string) string {
+	for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, `\ `) {
+		line = line[:len(line)-1]
+	}
+	return strings.Replace(line, `\ `, " ", -1)
+}
+
+func (p *pattern) matches(relPath string, isDir bool) bool {
+	if p.dirOnly && !isDir {
+		return false
+	}
+	if p.base != "" {
+		if !strings.HasPrefix(relPath, p.base+"/") {
+			return false
+		}
+		relPath = relPath[len(p.base)+1:]
+	}
+	if !p.anchored {
+		return matchSegment(p.segments[0], path.Base(relPath))
+	}
+	return matchSegments(p.segments, strings.Split(relPath, "/"))
+}
+
+// matchSegments matches path components against pattern segments, where a "**" segment matches zero or more components.
+func matchSegments(segments, components []string) bool {
+	for len(segments) > 0 {
+		if segments[0] == "**" {
+			// A trailing "**" matches everything inside, but not the directory itself
+			if len(segments) == 1 {
+				return len(components) > 0
+			}
+			for i := 0; i <= len(components); i++ {
+				if matchSegments(segments[1:], components[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(components) == 0 || !matchSegment(segments[0], components[0]) {
+			return false
+		}
+		segments = segments[1:]
+		components = components[1:]
+	}
+	return len(components) == 0
+}
+
+func matchSegment(segment, component string) bool {
+	matched, err := path.Match(segment, component)
+	return err == nil && matched
+}
@@ -0,0 +1,77 @@
+package ignore
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		name     string
+		base     string
+		patterns string
+		relPath  string
+		isDir    bool
+		result   Result
+	}{
+		{"no patterns", "", "", "a", false, NoMatch},
+		{"comment", "", "# a", "# a", false, NoMatch},
+		{"name anywhere", "", "*.log", "x/y/z.log", false, Ignored},
+		{"name at the root", "", "*.log", "z.log", false, Ignored},
+		{"other name", "", "*.log", "z.txt", false, NoMatch},
+		{"escaped trailing space", "", `a\ `, "a ", false, Ignored},
+		{"trailing space", "", "a  ", "a", false, Ignored},
+
+		{"negated", "", "*.log\n!keep.log", "x/keep.log", false, Included},
+		{"negation then pattern", "", "!keep.log\n*.log", "keep.log", false, Ignored},
+		{"escaped bang", "", `\!a`, "!a", false, Ignored},
+		{"negated class", "", "[!a]", "b", false, Ignored},
+		{"negated class, excluded", "", "[!a]", "a", false, NoMatch},
+
+		{"anchored", "", "/build", "build", true, Ignored},
+		{"anchored, nested", "", "/build", "x/build", true, NoMatch},
+		{"slash in the middle anchors", "", "doc/*.txt", "doc/a.txt", false, Ignored},
+		{"slash in the middle, nested", "", "doc/*.txt", "x/doc/a.txt", false, NoMatch},
+		{"star doesn't cross slashes", "", "doc/*.txt", "doc/x/a.txt", false, NoMatch},
+
+		{"dir only, dir", "", "build/", "x/build", true, Ignored},
+		{"dir only, file", "", "build/", "x/build", false, NoMatch},
+		{"anchored dir only", "", "/out/", "out", true, Ignored},
+
+		{"leading **", "", "**/foo", "a/b/foo", false, Ignored},
+		{"leading ** at the root", "", "**/foo", "foo", false, Ignored},
+		{"trailing **", "", "abc/**", "abc/x/y", false, Ignored},
+		{"trailing ** doesn't match the folder", "", "abc/**", "abc", true, NoMatch},
+		{"middle **", "", "a/**/b", "a/b", false, Ignored},
+		{"middle **, deep", "", "a/**/b", "a/x/y/b", false, Ignored},
+		{"middle **, wrong end", "", "a/**/b", "a/x/c", false, NoMatch},
+
+		{"base", "sub", "*.o", "sub/x/a.o", false, Ignored},
+		{"outside base", "sub", "*.o", "other/a.o", false, NoMatch},
+		{"anchored to base", "sub", "/a.o", "sub/a.o", false, Ignored},
+		{"anchored to base, nested", "sub", "/a.o", "sub/x/a.o", false, NoMatch},
+		{"base itself", "sub", "*", "sub", true, NoMatch},
+	}
+	for _, test := range tests {
+		m := NewMatcher()
+		err := m.AddReader(test.base, strings.NewReader(test.patterns))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result := m.Match(test.relPath, test.isDir); result != test.result {
+			t.Errorf("%s: %q against %q in %q: got %v, expected %v", test.name, test.relPath, test.patterns, test.base, result, test.result)
+		}
+	}
+}
+
+func TestLaterMatchersTakePrecedence(t *testing.T) {
+	m := NewMatcher()
+	m.AddPattern("", "*.log")
+	m.AddPattern("sub", "!*.log")
+	if result := m.Match("sub/a.log", false); result != Included {
+		t.Errorf("sub/a.log: got %v, expected it to be re-included", result)
+	}
+	if result := m.Match("a.log", false); result != Ignored {
+		t.Errorf("a.log: got %v, expected it to be ignored", result)
+	}
+}
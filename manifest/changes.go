@@ -0,0 +1,225 @@
+package manifest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+)
+
+// ErrFileChanged is wrapped by every FileChangedError, for use with errors.Is.
+var ErrFileChanged = errors.New("File changed since the manifest was generated")
+
+// FileChangedError reports that a shared file no longer matches its entry in the manifest, so its chunks can't be served as advertised.
+// The sharer can either give up on the file or call Rehash and send receivers the updated entry.
+type FileChangedError struct {
+	Path   string
+	FileId uint32
+	Reason string
+}
+
+func (e *FileChangedError) Error() string {
+	return fmt.Sprintf("%s changed since the manifest was generated: %s", e.Path, e.Reason)
+}
+
+func (e *FileChangedError) Unwrap() error {
+	return ErrFileChanged
+}
+
+// ReadVerifiedChunk is ReadChunk for sharers. It checks that the file still has the size and, if the manifest holds metadata, the modification
+// time it had when the manifest was generated, and that the data read still matches the chunk's hash. Any difference is a *FileChangedError,
+// so receivers are never sent data that fails verification on their end.
+func (m *Manifest) ReadVerifiedChunk(rootPath string, fileId uint32, index int) ([]byte, error) {
+	localPath, _ := m.LocalPath(rootPath, fileId)
+	file, err := m.fileById(fileId)
+	if err != nil {
+		return nil, err
+	}
+	metadata := file.metadata
+	if file.isHardLink {
+		// Hard links carry no metadata of their own, but share their target's
+		target, _ := m.fileById(file.hardLinkOf)
+		metadata = target.metadata
+	}
+	return file.readVerifiedChunk(localPath, metadata, index)
+}
+
+// ReadVerifiedChunk is Manifest.ReadVerifiedChunk for a file on its own at filePath, such as one from a manifest stream that hasn't ended yet.
+// The file must not be a hard link, since those only get their content once the whole manifest is assembled.
+func (mf *ManifestFile) ReadVerifiedChunk(filePath string, index int) ([]byte, error) {
+	if mf.isHardLink {
+		return nil, fmt.Errorf("file %d is a hard link", mf.id)
+	}
+	return mf.readVerifiedChunk(filePath, mf.metadata, index)
+}
+
+func (mf *ManifestFile) readVerifiedChunk(localPath string, metadata *Metadata, index int) ([]byte, error) {
+	chunk, err := mf.Chunk(index)
+	if err != nil {
+		return nil, err
+	}
+	f, err := osSource{}.open(localPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fileInfo, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	err = mf.checkUnchanged(localPath, metadata, fileInfo)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, chunk.Length)
+	err = readAtFrom(f, data, int64(chunk.Offset))
+	if err == io.ErrUnexpectedEOF {
+		return nil, &FileChangedError{Path: localPath, FileId: mf.id, Reason: "it got shorter while being read"}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if mf.VerifyChunk(index, data) != nil {
+		return nil, &FileChangedError{Path: localPath, FileId: mf.id, Reason: fmt.Sprintf("chunk %d no longer matches its hash", index)}
+	}
+	return data, nil
+}
+
+// checkUnchanged compares fileInfo, from the file at localPath, with the size recorded for the file and the modification time in metadata.
+func (mf *ManifestFile) checkUnchanged(localPath string, metadata *Metadata, fileInfo fs.FileInfo) error {
+	if uint64(fileInfo.Size()) != mf.fileSize {
+		return &FileChangedError{
+			Path:   localPath,
+			FileId: mf.id,
+			Reason: fmt.Sprintf("its size is now %d bytes instead of %d", fileInfo.Size(), mf.fileSize),
+		}
+	}
+	if metadata != nil && !fileInfo.ModTime().Equal(metadata.ModTime) {
+		return &FileChangedError{
+			Path:   localPath,
+			FileId: mf.id,
+			Reason: fmt.Sprintf("it was modified at %v", fileInfo.ModTime()),
+		}
+	}
+	return nil
+}
+
+// Rehash hashes the file with the given id again, from below rootPath, and returns a copy of the manifest in which the file and its hard links
+// describe its current content and metadata. Ids and paths stay the same, so receivers can be sent the new entry from MarshalFileUpdate.
+// The file must not change while it is being hashed, or a *FileChangedError is returned.
+func (m *Manifest) Rehash(ctx context.Context, rootPath string, fileId uint32) (*Manifest, error) {
+	file, err := m.fileById(fileId)
+	if err != nil {
+		return nil, err
+	}
+	if file.isHardLink {
+		file, _ = m.fileById(file.hardLinkOf)
+	}
+	localPath, _ := m.LocalPath(rootPath, file.id)
+	src := osSource{}
+	before, err := src.stat(localPath)
+	if err != nil {
+		return nil, err
+	}
+	if !before.Mode().IsRegular() {
+		return nil, fmt.Errorf("%s is no longer a regular file", localPath)
+	}
+	fh := &fileHasher{
+		src:           src,
+		hashAlgorithm: m.hashAlgorithm,
+		chunking:      m.chunking,
+	}
+	chunks, err := fh.hashFile(ctx, localPath, make([]byte, m.chunking.maxChunkSize()), &progressTracker{})
+	if err != nil {
+		return nil, err
+	}
+	after, err := src.stat(localPath)
+	if err != nil {
+		return nil, err
+	}
+	if chunks.size != uint64(after.Size()) || !after.ModTime().Equal(before.ModTime()) {
+		return nil, &FileChangedError{Path: localPath, FileId: file.id, Reason: "it is still being modified"}
+	}
+	updated := *file
+	updated.setChunks(chunks)
+	if file.metadata != nil {
+		updated.metadata, err = metadataFromFileInfo(src, localPath, after)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return m.withFile(&updated)
+}
+
+// MarshalFileUpdate encodes the entry of the file with the given id, which must not be a hard link, for ApplyFileUpdate.
+// Sharers send it to receivers after Rehash. The encoding isn't signed by itself, so it should be signed along with what identifies the share
+// and the update, as the transfer package does, and only applied once that signature checks out.
+func (m *Manifest) MarshalFileUpdate(fileId uint32) ([]byte, error) {
+	file, err := m.fileById(fileId)
+	if err != nil {
+		return nil, err
+	}
+	if file.isHardLink {
+		return nil, fmt.Errorf("file %d is a hard link", fileId)
+	}
+	enc := &encoder{}
+	enc.writeEntity(file)
+	return enc.buf.Bytes(), nil
+}
+
+// ApplyFileUpdate returns a copy of the manifest in which the file entry encoded by MarshalFileUpdate replaces the file with the same id and name.
+// Hard links to the file are updated along with it. The receiver's manifest is left as it was.
+func (m *Manifest) ApplyFileUpdate(data []byte) (*Manifest, error) {
+	dec := &decoder{
+		r:             bytes.NewReader(data),
+		hashAlgorithm: m.hashAlgorithm,
+		chunking:      m.chunking,
+	}
+	entity, err := dec.readEntity(0)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding file update: %v", err)
+	}
+	if dec.r.Len() != 0 {
+		return nil, fmt.Errorf("error decoding file update: %d trailing bytes", dec.r.Len())
+	}
+	updated, ok := entity.(*ManifestFile)
+	if !ok || updated.isHardLink {
+		return nil, fmt.Errorf("file update must hold a regular file")
+	}
+	file, err := m.fileById(updated.id)
+	if err != nil {
+		return nil, err
+	}
+	if file.isHardLink || file.name != updated.name {
+		return nil, fmt.Errorf("file update for %d doesn't match the file it replaces", updated.id)
+	}
+	return m.withFile(updated)
+}
+
+// withFile returns a copy of the manifest with the file of the same id replaced by updated. Entities are copied rather than shared, since
+// indexing the copy writes to them.
+func (m *Manifest) withFile(updated *ManifestFile) (*Manifest, error) {
+	return newManifest(m.hashAlgorithm, m.chunking, copyEntity(m.rootEntity, updated))
+}
+
+func copyEntity(entity ManifestEntity, updated *ManifestFile) ManifestEntity {
+	switch e := entity.(type) {
+	case *ManifestFolder:
+		folder := *e
+		folder.contents = make([]ManifestEntity, len(e.contents))
+		for i, child := range e.contents {
+			folder.contents[i] = copyEntity(child, updated)
+		}
+		return &folder
+	case *ManifestFile:
+		if e.id == updated.id {
+			return updated
+		}
+		file := *e
+		return &file
+	default:
+		return entity
+	}
+}
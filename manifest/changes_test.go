@@ -0,0 +1,210 @@
+package manifest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// changesTestShare writes a share holding a file "a" with data and a hard link "b" to it, and returns the share's path and manifest.
+func changesTestShare(t *testing.T, data []byte, opts *GenerateOptions) (string, *Manifest) {
+	t.Helper()
+	tempDir, err := ioutil.TempDir("", "changes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tempDir) })
+	root := filepath.Join(tempDir, "share")
+	err = os.Mkdir(root, 0755)
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(root, "a"), data, 0644)
+	}
+	if err == nil {
+		err = os.Link(filepath.Join(root, "a"), filepath.Join(root, "b"))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := GenerateManifest(context.Background(), root, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return root, m
+}
+
+// rewriteKeepingModTime writes data to the file at path and sets its modification time back, as an edit that keeps the size and the
+// modification time would look.
+func rewriteKeepingModTime(t *testing.T, path string, data []byte) {
+	t.Helper()
+	fileInfo, err := os.Stat(path)
+	if err == nil {
+		err = ioutil.WriteFile(path, data, 0644)
+	}
+	if err == nil {
+		err = os.Chtimes(path, fileInfo.ModTime(), fileInfo.ModTime())
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadVerifiedChunkDetectsChanges(t *testing.T) {
+	data := randomData(1, 4096)
+	tests := []struct {
+		name string
+		// change modifies the file at path, whose content was data
+		change func(t *testing.T, path string)
+		reason string
+	}{
+		{
+			name: "chunk modified",
+			change: func(t *testing.T, path string) {
+				modified := append([]byte(nil), data...)
+				modified[0] ^= 1
+				rewriteKeepingModTime(t, path, modified)
+			},
+			reason: "chunk 0 no longer matches its hash",
+		},
+		{
+			// The first chunk is intact, so only the size can give the change away
+			name: "appended to",
+			change: func(t *testing.T, path string) {
+				rewriteKeepingModTime(t, path, append(append([]byte(nil), data...), 'x'))
+			},
+			reason: "its size is now 4097 bytes instead of 4096",
+		},
+		{
+			name: "touched",
+			change: func(t *testing.T, path string) {
+				modTime := time.Now().Add(time.Hour)
+				err := os.Chtimes(path, modTime, modTime)
+				if err != nil {
+					t.Fatal(err)
+				}
+			},
+			reason: "it was modified at",
+		},
+	}
+	for _, test := range tests {
+		root, m := changesTestShare(t, data, &GenerateOptions{Chunking: smallChunks})
+		a, _ := m.EntityByPath("a")
+		b, _ := m.EntityByPath("b")
+		file := a.(*ManifestFile)
+		first, _ := file.Chunk(0)
+		chunk, err := m.ReadVerifiedChunk(root, file.Id(), 0)
+		if err != nil || !bytes.Equal(chunk, data[:first.Length]) {
+			t.Fatalf("%s: before the change: got %d bytes, %v", test.name, len(chunk), err)
+		}
+		test.change(t, filepath.Join(root, "a"))
+		// Hard links are checked against the metadata of their target
+		for _, id := range []uint32{file.Id(), b.Id()} {
+			chunk, err = m.ReadVerifiedChunk(root, id, 0)
+			var changed *FileChangedError
+			if !errors.As(err, &changed) || !errors.Is(err, ErrFileChanged) {
+				t.Errorf("%s: file %d: got %d bytes, %v", test.name, id, len(chunk), err)
+				continue
+			}
+			if chunk != nil || changed.FileId != id || !strings.HasPrefix(changed.Reason, test.reason) {
+				t.Errorf("%s: file %d: got %d bytes, %+v", test.name, id, len(chunk), changed)
+			}
+		}
+	}
+}
+
+func TestReadVerifiedChunkWithoutMetadata(t *testing.T) {
+	data := randomData(2, 2000)
+	root, m := changesTestShare(t, data, &GenerateOptions{Chunking: smallChunks, SkipMetadata: true})
+	a, _ := m.EntityByPath("a")
+	modTime := time.Now().Add(time.Hour)
+	err := os.Chtimes(filepath.Join(root, "a"), modTime, modTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Without a modification time to compare, only the content can tell, and it didn't change
+	for index := 0; index < a.(*ManifestFile).NumChunks(); index++ {
+		if _, err := m.ReadVerifiedChunk(root, a.Id(), index); err != nil {
+			t.Errorf("chunk %d: %v", index, err)
+		}
+	}
+}
+
+func TestRehashAndFileUpdates(t *testing.T) {
+	root, m := changesTestShare(t, randomData(3, 4096), &GenerateOptions{Chunking: smallChunks})
+	oldRoot := m.MerkleRoot()
+	a, _ := m.EntityByPath("a")
+	b, _ := m.EntityByPath("b")
+	changed := randomData(4, 3000)
+	err := ioutil.WriteFile(filepath.Join(root, "a"), changed, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.ReadVerifiedChunk(root, a.Id(), 0); !errors.Is(err, ErrFileChanged) {
+		t.Fatalf("before rehashing: got %v", err)
+	}
+	// Rehashing through the hard link updates its target
+	rehashed, err := m.Rehash(context.Background(), root, b.Id())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(m.MerkleRoot(), oldRoot) {
+		t.Error("rehashing changed the original manifest")
+	}
+	regenerated, err := GenerateManifest(context.Background(), root, &GenerateOptions{Chunking: smallChunks})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(rehashed.MerkleRoot(), regenerated.MerkleRoot()) {
+		t.Error("the rehashed manifest doesn't match one generated from scratch")
+	}
+	for _, id := range []uint32{a.Id(), b.Id()} {
+		entity, _ := rehashed.EntityById(id)
+		file := entity.(*ManifestFile)
+		if file.Size() != uint64(len(changed)) {
+			t.Errorf("file %d: size %d", id, file.Size())
+		}
+		var content []byte
+		for index := 0; index < file.NumChunks(); index++ {
+			chunk, err := rehashed.ReadVerifiedChunk(root, id, index)
+			if err != nil {
+				t.Fatalf("file %d: chunk %d: %v", id, index, err)
+			}
+			content = append(content, chunk...)
+		}
+		if !bytes.Equal(content, changed) {
+			t.Errorf("file %d: the chunks don't add up to the new content", id)
+		}
+	}
+
+	// Receivers apply the update to the manifest they have and end up with the sharer's
+	update, err := rehashed.MarshalFileUpdate(a.Id())
+	if err != nil {
+		t.Fatal(err)
+	}
+	applied, err := m.ApplyFileUpdate(update)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(applied.MerkleRoot(), rehashed.MerkleRoot()) {
+		t.Error("applying the update doesn't give the rehashed manifest")
+	}
+	entity, _ := applied.EntityById(a.Id())
+	current, _ := regenerated.EntityByPath("a")
+	if !entity.(*ManifestFile).Metadata().ModTime.Equal(current.(*ManifestFile).Metadata().ModTime) {
+		t.Error("the update doesn't carry the new modification time")
+	}
+	if !bytes.Equal(m.MerkleRoot(), oldRoot) {
+		t.Error("applying the update changed the receiver's manifest")
+	}
+	if _, err := rehashed.MarshalFileUpdate(b.Id()); err == nil {
+		t.Error("a hard link was marshaled as a file update")
+	}
+	if _, err := m.ApplyFileUpdate(append(update, 0)); err == nil {
+		t.Error("an update with trailing bytes was applied")
+	}
+}
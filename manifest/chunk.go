@@ -0,0 +1,163 @@
+package manifest
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"path/filepath"
+)
+
+// ChunkSize is the size of every chunk of a file except the last one, which holds the remaining 1 to ChunkSize bytes,
+// unless the manifest uses content-defined chunking (see Chunking). An empty file has no chunks.
+const ChunkSize uint32 = 4 * 1024 * 1024 // 4 MB
+
+// Errors
+var (
+	ErrChunkIndexOutOfRange = errors.New("Chunk index out of range")
+	ErrChunkHashMismatch    = errors.New("Chunk data does not match its hash")
+	ErrChunkLengthMismatch  = errors.New("Chunk data has the wrong length")
+	ErrNotAFile             = errors.New("Entity is not a file")
+)
+
+// Chunk describes the location and expected hash of one chunk of a ManifestFile.
+type Chunk struct {
+	Index  int
+	Offset uint64
+	Length uint32
+	Hash   []byte
+}
+
+// numChunksForSize returns how many chunks a file of the given size is split into.
+func numChunksForSize(fileSize uint64) int {
+	return int((fileSize + uint64(ChunkSize) - 1) / uint64(ChunkSize))
+}
+
+func (mf *ManifestFile) computeChunkOffsets() {
+	if mf.chunkLengths == nil {
+		return
+	}
+	mf.chunkOffsets = make([]uint64, len(mf.chunkLengths))
+	var offset uint64 = 0
+	for i, length := range mf.chunkLengths {
+		mf.chunkOffsets[i] = offset
+		offset += uint64(length)
+	}
+}
+
+// NumChunks returns the number of chunks in this file.
+func (mf *ManifestFile) NumChunks() int {
+	return len(mf.hashes)
+}
+
+// Chunk returns the chunk at the given index.
+func (mf *ManifestFile) Chunk(index int) (Chunk, error) {
+	if index < 0 || index >= len(mf.hashes) {
+		return Chunk{}, ErrChunkIndexOutOfRange
+	}
+	if mf.chunkOffsets != nil {
+		return Chunk{
+			Index:  index,
+			Offset: mf.chunkOffsets[index],
+			Length: mf.chunkLengths[index],
+			Hash:   mf.hashes[index],
+		}, nil
+	}
+	offset := uint64(index) * uint64(ChunkSize)
+	length := ChunkSize
+	if remaining := mf.fileSize - offset; remaining < uint64(length) {
+		length = uint32(remaining)
+	}
+	return Chunk{
+		Index:  index,
+		Offset: offset,
+		Length: length,
+		Hash:   mf.hashes[index],
+	}, nil
+}
+
+// Chunks returns all chunks of this file in order.
+func (mf *ManifestFile) Chunks() []Chunk {
+	chunks := make([]Chunk, len(mf.hashes))
+	for i := range chunks {
+		chunks[i], _ = mf.Chunk(i)
+	}
+	return chunks
+}
+
+// VerifyChunk checks that data is exactly the content of the chunk at the given index.
+func (mf *ManifestFile) VerifyChunk(index int, data []byte) error {
+	chunk, err := mf.Chunk(index)
+	if err != nil {
+		return err
+	}
+	if len(data) != int(chunk.Length) {
+		return ErrChunkLengthMismatch
+	}
+	if !bytes.Equal(mf.hashAlgorithm.Sum(data), chunk.Hash) {
+		return ErrChunkHashMismatch
+	}
+	return nil
+}
+
+// LocalPath returns where the entity with the given id lives on disk, given the local path of the root entity.
+// Names are used as they are, so receivers should use SafeLocalPaths for manifests that came from a peer.
+func (m *Manifest) LocalPath(rootPath string, id uint32) (string, bool) {
+	relPath, ok := m.PathOf(id)
+	if !ok {
+		return "", false
+	}
+	return filepath.Join(rootPath, filepath.FromSlash(relPath)), true
+}
+
+// ReadChunk reads the chunk at the given index of the file with the given id, where rootPath is the local path of the root entity.
+// The data is not verified against the chunk's hash.
+func (m *Manifest) ReadChunk(rootPath string, fileId uint32, index int) ([]byte, error) {
+	localPath, _ := m.LocalPath(rootPath, fileId)
+	return m.readChunk(osSource{}, localPath, fileId, index)
+}
+
+// ReadChunkFS is like ReadChunk for manifests generated with GenerateManifestFromFS, where root is the slash-separated path of the root entity within fsys.
+func (m *Manifest) ReadChunkFS(fsys fs.FS, root string, fileId uint32, index int) ([]byte, error) {
+	relPath, _ := m.PathOf(fileId)
+	return m.readChunk(fsSource{fsys}, path.Join(root, relPath), fileId, index)
+}
+
+func (m *Manifest) readChunk(src source, filePath string, fileId uint32, index int) ([]byte, error) {
+	file, err := m.fileById(fileId)
+	if err != nil {
+		return nil, err
+	}
+	chunk, err := file.Chunk(index)
+	if err != nil {
+		return nil, err
+	}
+	f, err := src.open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	data := make([]byte, chunk.Length)
+	err = readAtFrom(f, data, int64(chunk.Offset))
+	if err == io.ErrUnexpectedEOF {
+		return nil, fmt.Errorf("%s is shorter than expected: %v", filePath, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (m *Manifest) fileById(fileId uint32) (*ManifestFile, error) {
+	entity, ok := m.entityMap[fileId]
+	if !ok {
+		return nil, fmt.Errorf("no entity with id %d", fileId)
+	}
+	file, ok := entity.(*ManifestFile)
+	if !ok {
+		return nil, ErrNotAFile
+	}
+	return file, nil
+}
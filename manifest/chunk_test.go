@@ -0,0 +1,116 @@
+package manifest
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestChunkLayout(t *testing.T) {
+	type span struct {
+		offset uint64
+		length uint32
+	}
+	tests := []struct {
+		name   string
+		size   uint64
+		chunks []span
+	}{
+		{"empty", 0, nil},
+		{"one short chunk", 10, []span{{0, 10}}},
+		{"exactly one chunk", uint64(ChunkSize), []span{{0, ChunkSize}}},
+		{"exact multiple", 2 * uint64(ChunkSize), []span{{0, ChunkSize}, {uint64(ChunkSize), ChunkSize}}},
+		{"short last chunk", uint64(ChunkSize) + 10, []span{{0, ChunkSize}, {uint64(ChunkSize), 10}}},
+	}
+	for _, test := range tests {
+		file := &ManifestFile{id: 1, name: "f", fileSize: test.size, hashes: make([][]byte, numChunksForSize(test.size))}
+		if file.NumChunks() != len(test.chunks) {
+			t.Errorf("%s: got %d chunks, expected %d", test.name, file.NumChunks(), len(test.chunks))
+			continue
+		}
+		for i, chunk := range file.Chunks() {
+			if chunk.Index != i || chunk.Offset != test.chunks[i].offset || chunk.Length != test.chunks[i].length {
+				t.Errorf("%s: chunk %d is %+v, expected offset %d and length %d", test.name, i, chunk, test.chunks[i].offset, test.chunks[i].length)
+			}
+		}
+		for _, index := range []int{-1, len(test.chunks)} {
+			if _, err := file.Chunk(index); err != ErrChunkIndexOutOfRange {
+				t.Errorf("%s: chunk %d: got %v", test.name, index, err)
+			}
+		}
+	}
+}
+
+func TestReadAndVerifyChunk(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "chunk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	root := filepath.Join(tempDir, "share")
+	data := make([]byte, ChunkSize+100)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	err = os.Mkdir(root, 0755)
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(root, "big"), data, 0644)
+	}
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(root, "empty"), nil, 0644)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := GenerateManifest(context.Background(), root, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	big, _ := m.EntityByPath("big")
+	empty, _ := m.EntityByPath("empty")
+	file := big.(*ManifestFile)
+
+	for i, want := range [][]byte{data[:ChunkSize], data[ChunkSize:]} {
+		chunk, err := m.ReadChunk(root, file.Id(), i)
+		if err != nil || !bytes.Equal(chunk, want) {
+			t.Errorf("chunk %d: got %d bytes, %v", i, len(chunk), err)
+		}
+		if err := file.VerifyChunk(i, chunk); err != nil {
+			t.Errorf("chunk %d: %v", i, err)
+		}
+	}
+	wrong := append([]byte(nil), data[ChunkSize:]...)
+	wrong[0] ^= 1
+	if err := file.VerifyChunk(1, wrong); err != ErrChunkHashMismatch {
+		t.Errorf("wrong data: got %v", err)
+	}
+	if err := file.VerifyChunk(1, data[ChunkSize+1:]); err != ErrChunkLengthMismatch {
+		t.Errorf("short data: got %v", err)
+	}
+	if err := file.VerifyChunk(1, data[:ChunkSize]); err != ErrChunkLengthMismatch {
+		t.Errorf("the other chunk's data: got %v", err)
+	}
+	if err := file.VerifyChunk(2, nil); err != ErrChunkIndexOutOfRange {
+		t.Errorf("chunk 2: got %v", err)
+	}
+	if _, err := m.ReadChunk(root, file.Id(), 2); err != ErrChunkIndexOutOfRange {
+		t.Errorf("reading chunk 2: got %v", err)
+	}
+	if _, err := m.ReadChunk(root, empty.Id(), 0); err != ErrChunkIndexOutOfRange {
+		t.Errorf("reading a chunk of an empty file: got %v", err)
+	}
+	if _, err := m.ReadChunk(root, m.Root().Id(), 0); err != ErrNotAFile {
+		t.Errorf("reading a chunk of a folder: got %v", err)
+	}
+
+	err = os.Truncate(filepath.Join(root, "big"), int64(ChunkSize)+10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.ReadChunk(root, file.Id(), 1); err == nil {
+		t.Error("read the last chunk of a file that got shorter")
+	}
+}
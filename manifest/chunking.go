@@ -0,0 +1,151 @@
+package manifest
+
+import (
+	"context"
+	"fmt"
+	"io"
+)
+
+// Chunking describes how files are split into chunks.
+type Chunking struct {
+	// ContentDefined selects FastCDC, where chunk boundaries depend on the content so that inserting or removing bytes only changes the chunks around the edit.
+	// Otherwise files are split into fixed ChunkSize chunks and the sizes below are unused.
+	ContentDefined bool
+	// MinSize and MaxSize bound every chunk but the last, which may be shorter than MinSize. AvgSize is the targeted average and must be a power of two.
+	MinSize uint32
+	AvgSize uint32
+	MaxSize uint32
+}
+
+// FixedChunking splits files into ChunkSize chunks.
+var FixedChunking = Chunking{}
+
+// DefaultContentDefinedChunking is a reasonable FastCDC configuration for large files.
+var DefaultContentDefinedChunking = Chunking{
+	ContentDefined: true,
+	MinSize:        512 * 1024,      // 512 KB
+	AvgSize:        2 * 1024 * 1024, // 2 MB
+	MaxSize:        8 * 1024 * 1024, // 8 MB
+}
+
+// Chunks are sent in a single frame, so they can't be arbitrarily large.
+const maxContentDefinedChunkSize = 64 * 1024 * 1024 // 64 MB
+
+// Validate checks that the chunk sizes are usable.
+func (c Chunking) Validate() error {
+	if !c.ContentDefined {
+		return nil
+	}
+	if c.MinSize < 64 || c.MinSize > c.AvgSize || c.AvgSize > c.MaxSize || c.MaxSize > maxContentDefinedChunkSize {
+		return fmt.Errorf("chunk sizes must satisfy 64 <= min (%d) <= avg (%d) <= max (%d) <= %d", c.MinSize, c.AvgSize, c.MaxSize, maxContentDefinedChunkSize)
+	}
+	if c.AvgSize&(c.AvgSize-1) != 0 {
+		return fmt.Errorf("average chunk size %d is not a power of two", c.AvgSize)
+	}
+	return nil
+}
+
+func (c Chunking) String() string {
+	if !c.ContentDefined {
+		return fmt.Sprintf("fixed %d", ChunkSize)
+	}
+	return fmt.Sprintf("fastcdc %d/%d/%d", c.MinSize, c.AvgSize, c.MaxSize)
+}
+
+// maxChunkSize returns the size of the largest possible chunk.
+func (c Chunking) maxChunkSize() uint32 {
+	if !c.ContentDefined {
+		return ChunkSize
+	}
+	return c.MaxSize
+}
+
+// splitChunks reads r to the end, calling onChunk with each chunk in order. buf must hold at least maxChunkSize bytes and is reused between calls.
+// It returns the total number of bytes read.
+func (c Chunking) splitChunks(ctx context.Context, r io.Reader, buf []byte, onChunk func(data []byte) error) (uint64, error) {
+	buf = buf[:c.maxChunkSize()]
+	var totalRead uint64 = 0
+	filled := 0
+	eof := false
+	for {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+		if !eof {
+			// ReadFull guarantees buf is only partially filled at the end of the file, even if the OS returns short reads
+			n, err := io.ReadFull(r, buf[filled:])
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				eof = true
+			} else if err != nil {
+				return 0, err
+			}
+			filled += n
+			totalRead += uint64(n)
+		}
+		if filled == 0 {
+			return totalRead, nil
+		}
+		cut := filled
+		if c.ContentDefined {
+			cut = c.fastCdcCut(buf[:filled])
+		}
+		err := onChunk(buf[:cut])
+		if err != nil {
+			return 0, err
+		}
+		filled = copy(buf, buf[cut:filled])
+	}
+}
+
+// fastCdcCut returns the length of the next chunk at the start of data, following the FastCDC algorithm with normalized chunking:
+// a stricter mask is used before the average size is reached and a looser one after, which narrows the spread of chunk sizes.
+func (c Chunking) fastCdcCut(data []byte) int {
+	n := len(data)
+	if n <= int(c.MinSize) {
+		return n
+	}
+	if n > int(c.MaxSize) {
+		n = int(c.MaxSize)
+	}
+	normalSize := int(c.AvgSize)
+	if n < normalSize {
+		normalSize = n
+	}
+	bits := uint(0)
+	for 1<<bits < c.AvgSize {
+		bits++
+	}
+	// The gear hash shifts left, so its high bits depend on the most recent bytes
+	maskStrict := ^uint64(0) << (64 - (bits + 1))
+	maskLoose := ^uint64(0) << (64 - (bits - 1))
+	var fingerprint uint64 = 0
+	i := int(c.MinSize)
+	for ; i < normalSize; i++ {
+		fingerprint = (fingerprint << 1) + gearTable[data[i]]
+		if fingerprint&maskStrict == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		fingerprint = (fingerprint << 1) + gearTable[data[i]]
+		if fingerprint&maskLoose == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
+
+// gearTable maps each byte value to a random 64-bit number. Chunk boundaries depend on it, so it must never change;
+// it is derived from a fixed seed with SplitMix64 rather than spelled out.
+var gearTable = func() [256]uint64 {
+	var table [256]uint64
+	var state uint64 = 0x566f72746578 // "Vortex"
+	for i := range table {
+		state += 0x9e3779b97f4a7c15
+		z := state
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}()
@@ -0,0 +1,118 @@
+package manifest
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"testing"
+)
+
+var testChunking = Chunking{ContentDefined: true, MinSize: 1024, AvgSize: 4096, MaxSize: 16384}
+
+func randomData(seed int64, n int) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+func splitAll(t *testing.T, c Chunking, data []byte) [][]byte {
+	t.Helper()
+	var chunks [][]byte
+	total, err := c.splitChunks(context.Background(), bytes.NewReader(data), make([]byte, c.maxChunkSize()), func(chunk []byte) error {
+		chunks = append(chunks, append([]byte(nil), chunk...))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != uint64(len(data)) {
+		t.Fatalf("read %d bytes of %d", total, len(data))
+	}
+	return chunks
+}
+
+func TestFastCDCChunkSizes(t *testing.T) {
+	data := randomData(1, 1<<20)
+	chunks := splitAll(t, testChunking, data)
+	if !bytes.Equal(bytes.Join(chunks, nil), data) {
+		t.Fatal("chunks don't add up to the data")
+	}
+	for i, chunk := range chunks {
+		last := i == len(chunks)-1
+		if len(chunk) > int(testChunking.MaxSize) || (!last && len(chunk) < int(testChunking.MinSize)) {
+			t.Errorf("chunk %d of %d has %d bytes", i, len(chunks), len(chunk))
+		}
+	}
+	// Normalized chunking keeps the average near AvgSize
+	average := len(data) / len(chunks)
+	if average < int(testChunking.AvgSize)/2 || average > int(testChunking.AvgSize)*2 {
+		t.Errorf("average chunk size is %d, expected about %d", average, testChunking.AvgSize)
+	}
+}
+
+func TestFastCDCBoundariesFollowContent(t *testing.T) {
+	data := randomData(2, 1<<20)
+	edited := append(append(append([]byte(nil), data[:1000]...), "inserted"...), data[1000:]...)
+	before := make(map[string]bool)
+	for _, chunk := range splitAll(t, testChunking, data) {
+		before[string(chunk)] = true
+	}
+	after := splitAll(t, testChunking, edited)
+	changed := 0
+	for _, chunk := range after {
+		if !before[string(chunk)] {
+			changed++
+		}
+	}
+	// Only the chunks around the insertion should differ
+	if changed > 2 {
+		t.Errorf("%d of %d chunks changed after inserting bytes near the start", changed, len(after))
+	}
+	fixed := make(map[string]bool)
+	for _, chunk := range splitAll(t, FixedChunking, data) {
+		fixed[string(chunk)] = true
+	}
+	for _, chunk := range splitAll(t, FixedChunking, edited) {
+		if fixed[string(chunk)] {
+			t.Fatal("fixed chunking kept a chunk after an insertion, so the data is too small to tell the two apart")
+		}
+	}
+}
+
+func TestFastCDCBoundariesDontChange(t *testing.T) {
+	// Boundaries are part of every content-defined manifest, so changing the gear table or the masks breaks existing manifests
+	var lengths []int
+	for _, chunk := range splitAll(t, testChunking, randomData(3, 64*1024))[:8] {
+		lengths = append(lengths, len(chunk))
+	}
+	want := []int{7794, 4236, 1345, 2903, 1447, 6812, 11432, 4162}
+	if len(lengths) != len(want) {
+		t.Fatalf("chunk lengths %v, expected %v", lengths, want)
+	}
+	for i := range want {
+		if lengths[i] != want[i] {
+			t.Fatalf("chunk lengths %v, expected %v", lengths, want)
+		}
+	}
+}
+
+func TestChunkingValidate(t *testing.T) {
+	valid := []Chunking{FixedChunking, DefaultContentDefinedChunking, testChunking}
+	for _, c := range valid {
+		if err := c.Validate(); err != nil {
+			t.Errorf("%v: %v", c, err)
+		}
+	}
+	invalid := []Chunking{
+		{ContentDefined: true, MinSize: 32, AvgSize: 4096, MaxSize: 16384},
+		{ContentDefined: true, MinSize: 8192, AvgSize: 4096, MaxSize: 16384},
+		{ContentDefined: true, MinSize: 1024, AvgSize: 4096, MaxSize: 2048},
+		{ContentDefined: true, MinSize: 1024, AvgSize: 3000, MaxSize: 16384},
+		{ContentDefined: true, MinSize: 1024, AvgSize: 4096, MaxSize: maxContentDefinedChunkSize + 1},
+	}
+	for _, c := range invalid {
+		if err := c.Validate(); err == nil {
+			t.Errorf("%v was accepted", c)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package manifest
+
+import "fmt"
+
+// ChunkLocation identifies one chunk of one file.
+type ChunkLocation struct {
+	FileId uint32
+	Index  int
+}
+
+// ChunkIndex maps chunk hashes to every location where the chunk occurs, in the order the files were added. Hard links are left out since
+// their content is never transferred on its own. Receivers use it to copy a chunk they already wrote instead of downloading it again.
+type ChunkIndex map[string][]ChunkLocation
+
+// ChunkIndex indexes the chunks of every file in the manifest, in Walk order.
+func (m *Manifest) ChunkIndex() ChunkIndex {
+	index := make(ChunkIndex)
+	m.Walk(func(relPath string, entity ManifestEntity) error {
+		if file, ok := entity.(*ManifestFile); ok {
+			index.Add(file)
+		}
+		return nil
+	})
+	return index
+}
+
+// Add appends the locations of file's chunks, such as when the file arrives in a manifest stream. Hard links are ignored.
+func (ci ChunkIndex) Add(file *ManifestFile) {
+	if file.isHardLink {
+		return
+	}
+	for _, chunk := range file.Chunks() {
+		ci[string(chunk.Hash)] = append(ci[string(chunk.Hash)], ChunkLocation{FileId: file.Id(), Index: chunk.Index})
+	}
+}
+
+// Locations returns where the chunk with hash occurs.
+func (ci ChunkIndex) Locations(hash []byte) []ChunkLocation {
+	return ci[string(hash)]
+}
+
+// DedupReport summarizes how much of a manifest's content is duplicated. Each distinct chunk only needs to be transferred once; receivers
+// copy the other occurrences locally through a ChunkIndex. Hard links are left out since their content is never transferred on its own.
+type DedupReport struct {
+	TotalChunks  int
+	UniqueChunks int
+	TotalBytes   uint64
+	UniqueBytes  uint64
+}
+
+// BytesSaved returns how many bytes don't need to be transferred thanks to deduplication.
+func (r DedupReport) BytesSaved() uint64 {
+	return r.TotalBytes - r.UniqueBytes
+}
+
+// String describes the report on one line.
+func (r DedupReport) String() string {
+	return fmt.Sprintf("%d of %d chunks are unique; deduplication saves %s of %s", r.UniqueChunks, r.TotalChunks, FormatSize(r.BytesSaved()),
+		FormatSize(r.TotalBytes))
+}
+
+// DedupReport counts the distinct chunks of every file in the manifest by their hashes.
+func (m *Manifest) DedupReport() DedupReport {
+	var report DedupReport
+	seen := make(map[string]bool)
+	m.Walk(func(relPath string, entity ManifestEntity) error {
+		file, ok := entity.(*ManifestFile)
+		if !ok || file.isHardLink {
+			return nil
+		}
+		for _, chunk := range file.Chunks() {
+			if !seen[string(chunk.Hash)] {
+				seen[string(chunk.Hash)] = true
+				report.UniqueChunks++
+				report.UniqueBytes += uint64(chunk.Length)
+			}
+			report.TotalChunks++
+			report.TotalBytes += uint64(chunk.Length)
+		}
+		return nil
+	})
+	return report
+}
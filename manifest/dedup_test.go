@@ -0,0 +1,103 @@
+package manifest
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDedupReport(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "dedup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	for name, data := range map[string]string{"a": "same", "b": "same", "c": "different"} {
+		err = ioutil.WriteFile(filepath.Join(tempDir, name), []byte(data), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	m, err := GenerateManifest(context.Background(), tempDir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := m.DedupReport()
+	want := DedupReport{TotalChunks: 3, UniqueChunks: 2, TotalBytes: 17, UniqueBytes: 13}
+	if report != want {
+		t.Errorf("got %+v, expected %+v", report, want)
+	}
+	if report.BytesSaved() != 4 {
+		t.Errorf("saves %d bytes, expected 4", report.BytesSaved())
+	}
+}
+
+func TestChunkIndex(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "dedup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	x, y, z := randomData(1, 64), randomData(2, 64), randomData(3, 64)
+	files := map[string][]byte{
+		// "a" repeats a region, "b" duplicates "a" and "c" shares a region with it
+		"a": append(append(append([]byte(nil), x...), y...), x...),
+		"b": append(append(append([]byte(nil), x...), y...), x...),
+		"c": append(append([]byte(nil), z...), y...),
+	}
+	for name, data := range files {
+		err = ioutil.WriteFile(filepath.Join(tempDir, name), data, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = os.Link(filepath.Join(tempDir, "a"), filepath.Join(tempDir, "d"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every chunk is exactly 64 bytes, so the regions line up with the chunks
+	chunking := Chunking{ContentDefined: true, MinSize: 64, AvgSize: 64, MaxSize: 64}
+	m, err := GenerateManifest(context.Background(), tempDir, &GenerateOptions{Chunking: chunking})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := make(map[string]uint32)
+	for _, name := range []string{"a", "b", "c"} {
+		entity, _ := m.EntityByPath(name)
+		ids[name] = entity.Id()
+	}
+	a, b, c := ids["a"], ids["b"], ids["c"]
+	tests := []struct {
+		name string
+		hash []byte
+		want []ChunkLocation
+	}{
+		{"repeated in a and b", hashOf(t, m, a, 0), []ChunkLocation{{a, 0}, {a, 2}, {b, 0}, {b, 2}}},
+		{"shared by a, b and c", hashOf(t, m, c, 1), []ChunkLocation{{a, 1}, {b, 1}, {c, 1}}},
+		{"only in c", hashOf(t, m, c, 0), []ChunkLocation{{c, 0}}},
+		{"nowhere", make([]byte, 32), nil},
+	}
+	index := m.ChunkIndex()
+	if len(index) != 3 {
+		t.Errorf("%d distinct chunks, expected 3", len(index))
+	}
+	for _, test := range tests {
+		if got := index.Locations(test.hash); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, expected %v", test.name, got, test.want)
+		}
+	}
+
+}
+
+func hashOf(t *testing.T, m *Manifest, fileId uint32, index int) []byte {
+	t.Helper()
+	entity, _ := m.EntityById(fileId)
+	chunk, err := entity.(*ManifestFile).Chunk(index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return chunk.Hash
+}
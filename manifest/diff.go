@@ -0,0 +1,160 @@
+package manifest
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ManifestDiff describes how the files of one manifest differ from those of another. All paths are relative to the root entity.
+type ManifestDiff struct {
+	Added    []string
+	Removed  []string
+	Renamed  []Rename
+	Modified []Modification
+}
+
+// Rename is a file that exists with identical content under a new path. Empty files are never matched as renames.
+type Rename struct {
+	OldPath string
+	NewPath string
+}
+
+// Modification is a file that exists at the same path with different content.
+type Modification struct {
+	Path    string
+	OldSize uint64
+	NewSize uint64
+	// ChangedChunks are the indexes of the chunks in the new file whose content doesn't appear anywhere in the old file.
+	// The content of every other chunk can be copied from the old file.
+	ChangedChunks []int
+}
+
+// Diff compares the files of two manifests, matching files that moved without changing content as renames.
+// Both manifests must use the same hash algorithm and chunking.
+func Diff(oldManifest, newManifest *Manifest) (*ManifestDiff, error) {
+	if oldManifest.hashAlgorithm != newManifest.hashAlgorithm {
+		return nil, fmt.Errorf("can't diff a %v manifest against a %v manifest", oldManifest.hashAlgorithm, newManifest.hashAlgorithm)
+	}
+	if oldManifest.chunking != newManifest.chunking {
+		return nil, fmt.Errorf("can't diff a manifest chunked with %v against one chunked with %v", oldManifest.chunking, newManifest.chunking)
+	}
+	oldFiles := filesByPath(oldManifest)
+	newFiles := filesByPath(newManifest)
+	diff := &ManifestDiff{}
+	var removedPaths, addedPaths []string
+	for relPath, oldFile := range oldFiles {
+		newFile, ok := newFiles[relPath]
+		if !ok {
+			removedPaths = append(removedPaths, relPath)
+			continue
+		}
+		if changedChunks, changed := diffFileChunks(oldFile, newFile); changed {
+			diff.Modified = append(diff.Modified, Modification{
+				Path:          relPath,
+				OldSize:       oldFile.fileSize,
+				NewSize:       newFile.fileSize,
+				ChangedChunks: changedChunks,
+			})
+		}
+	}
+	for relPath := range newFiles {
+		if _, ok := oldFiles[relPath]; !ok {
+			addedPaths = append(addedPaths, relPath)
+		}
+	}
+	sort.Strings(removedPaths)
+	sort.Strings(addedPaths)
+	// Pair up removed and added files with identical content, in path order. Empty files all have the same content, so matching them would
+	// turn unrelated files into renames.
+	removedByContent := make(map[string][]string)
+	for _, relPath := range removedPaths {
+		if oldFiles[relPath].fileSize == 0 {
+			continue
+		}
+		key := contentKey(oldFiles[relPath])
+		removedByContent[key] = append(removedByContent[key], relPath)
+	}
+	renamedFrom := make(map[string]bool)
+	for _, relPath := range addedPaths {
+		key := contentKey(newFiles[relPath])
+		if candidates := removedByContent[key]; len(candidates) > 0 && newFiles[relPath].fileSize > 0 {
+			diff.Renamed = append(diff.Renamed, Rename{
+				OldPath: candidates[0],
+				NewPath: relPath,
+			})
+			renamedFrom[candidates[0]] = true
+			removedByContent[key] = candidates[1:]
+		} else {
+			diff.Added = append(diff.Added, relPath)
+		}
+	}
+	for _, relPath := range removedPaths {
+		if !renamedFrom[relPath] {
+			diff.Removed = append(diff.Removed, relPath)
+		}
+	}
+	sort.Slice(diff.Modified, func(i, j int) bool {
+		return diff.Modified[i].Path < diff.Modified[j].Path
+	})
+	return diff, nil
+}
+
+func filesByPath(m *Manifest) map[string]*ManifestFile {
+	files := make(map[string]*ManifestFile)
+	m.Walk(func(relPath string, entity ManifestEntity) error {
+		if file, ok := entity.(*ManifestFile); ok {
+			files[relPath] = file
+		}
+		return nil
+	})
+	return files
+}
+
+// contentKey identifies a file's content for rename detection.
+func contentKey(file *ManifestFile) string {
+	return fmt.Sprintf("%d:%x", file.fileSize, file.MerkleRoot())
+}
+
+func diffFileChunks(oldFile, newFile *ManifestFile) ([]int, bool) {
+	oldHashes := make(map[string]bool, len(oldFile.hashes))
+	for _, hash := range oldFile.hashes {
+		oldHashes[string(hash)] = true
+	}
+	var changedChunks []int
+	reordered := len(oldFile.hashes) != len(newFile.hashes)
+	for i, hash := range newFile.hashes {
+		if !oldHashes[string(hash)] {
+			changedChunks = append(changedChunks, i)
+		} else if !reordered && !bytes.Equal(hash, oldFile.hashes[i]) {
+			reordered = true
+		}
+	}
+	// A file that only shrank or had chunks moved around has no changed chunks but is still modified
+	return changedChunks, len(changedChunks) > 0 || reordered || oldFile.fileSize != newFile.fileSize
+}
+
+// Empty reports whether the two manifests had identical files.
+func (d *ManifestDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Renamed) == 0 && len(d.Modified) == 0
+}
+
+// String returns a human-readable summary with one line per changed file followed by the totals.
+func (d *ManifestDiff) String() string {
+	var sb strings.Builder
+	for _, relPath := range d.Added {
+		fmt.Fprintf(&sb, "A  %s\n", relPath)
+	}
+	for _, relPath := range d.Removed {
+		fmt.Fprintf(&sb, "D  %s\n", relPath)
+	}
+	for _, rename := range d.Renamed {
+		fmt.Fprintf(&sb, "R  %s -> %s\n", rename.OldPath, rename.NewPath)
+	}
+	for _, mod := range d.Modified {
+		fmt.Fprintf(&sb, "M  %s (%d -> %d bytes, %d chunks changed)\n", mod.Path, mod.OldSize, mod.NewSize, len(mod.ChangedChunks))
+	}
+	fmt.Fprintf(&sb, "%d added, %d removed, %d renamed, %d modified\n", len(d.Added), len(d.Removed), len(d.Renamed), len(d.Modified))
+	return sb.String()
+}
@@ -0,0 +1,129 @@
+package manifest
+
+import (
+	"fmt"
+	"path"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// diffTestManifest builds a manifest with a file at each path, made of the given chunks. Folders are created as needed.
+func diffTestManifest(t *testing.T, files map[string][]string) *Manifest {
+	t.Helper()
+	nextId := uint32(1)
+	root := &ManifestFolder{id: 0, name: "root"}
+	folders := map[string]*ManifestFolder{"": root}
+	var folderOf func(relPath string) *ManifestFolder
+	folderOf = func(relPath string) *ManifestFolder {
+		if folder, ok := folders[relPath]; ok {
+			return folder
+		}
+		parent := folderOf(parentPath(relPath))
+		folder := &ManifestFolder{id: nextId, name: path.Base(relPath)}
+		nextId++
+		parent.contents = append(parent.contents, folder)
+		folders[relPath] = folder
+		return folder
+	}
+	relPaths := make([]string, 0, len(files))
+	for relPath := range files {
+		relPaths = append(relPaths, relPath)
+	}
+	sort.Strings(relPaths)
+	for _, relPath := range relPaths {
+		file := &ManifestFile{id: nextId, name: path.Base(relPath)}
+		nextId++
+		for _, chunk := range files[relPath] {
+			file.fileSize += uint64(len(chunk))
+			file.hashes = append(file.hashes, HashSHA256.Sum([]byte(chunk)))
+		}
+		folder := folderOf(parentPath(relPath))
+		folder.contents = append(folder.contents, file)
+	}
+	m, err := newManifest(HashSHA256, FixedChunking, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// parentPath returns the path of the folder holding relPath, which is empty for the root.
+func parentPath(relPath string) string {
+	if dir := path.Dir(relPath); dir != "." {
+		return dir
+	}
+	return ""
+}
+
+func TestDiff(t *testing.T) {
+	oldManifest := diffTestManifest(t, map[string][]string{
+		"same":      {"unchanged"},
+		"removed":   {"gone"},
+		"moved":     {"moving", "content"},
+		"modified":  {"a", "b", "c"},
+		"shrunk":    {"kept", "dropped"},
+		"reordered": {"first", "second"},
+		"empty1":    nil,
+	})
+	newManifest := diffTestManifest(t, map[string][]string{
+		"same":      {"unchanged"},
+		"added":     {"new"},
+		"sub/moved": {"moving", "content"},
+		"modified":  {"a", "x", "c", "d"},
+		"shrunk":    {"kept"},
+		"reordered": {"second", "first"},
+		"empty2":    nil,
+	})
+	diff, err := Diff(oldManifest, newManifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &ManifestDiff{
+		// Empty files are added and removed rather than renamed
+		Added:   []string{"added", "empty2"},
+		Removed: []string{"empty1", "removed"},
+		Renamed: []Rename{{OldPath: "moved", NewPath: "sub/moved"}},
+		Modified: []Modification{
+			{Path: "modified", OldSize: 3, NewSize: 4, ChangedChunks: []int{1, 3}},
+			{Path: "reordered", OldSize: 11, NewSize: 11},
+			{Path: "shrunk", OldSize: 11, NewSize: 4},
+		},
+	}
+	if !reflect.DeepEqual(diff, want) {
+		t.Errorf("got\n%v\nexpected\n%v", diff, want)
+	}
+	if diff.Empty() {
+		t.Error("the diff is empty")
+	}
+
+	diff, err = Diff(oldManifest, oldManifest)
+	if err != nil || !diff.Empty() {
+		t.Errorf("a manifest differs from itself: %v, %v", diff, err)
+	}
+}
+
+func TestDiffRenamesInPathOrder(t *testing.T) {
+	oldManifest := diffTestManifest(t, map[string][]string{"a": {"same"}, "b": {"same"}})
+	newManifest := diffTestManifest(t, map[string][]string{"c": {"same"}, "d": {"same"}, "e": {"same"}})
+	diff, err := Diff(oldManifest, newManifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := fmt.Sprint(diff.Renamed, diff.Added, diff.Removed)
+	if want := "[{a c} {b d}] [e] []"; got != want {
+		t.Errorf("got %s, expected %s", got, want)
+	}
+}
+
+func TestDiffRequiresTheSameHashing(t *testing.T) {
+	m := diffTestManifest(t, map[string][]string{"a": {"x"}})
+	other := &Manifest{hashAlgorithm: HashBLAKE3, chunking: m.chunking, rootEntity: m.rootEntity}
+	if _, err := Diff(m, other); err == nil {
+		t.Error("diffed manifests with different hash algorithms")
+	}
+	other = &Manifest{hashAlgorithm: m.hashAlgorithm, chunking: Chunking{ContentDefined: true, MinSize: 64, AvgSize: 128, MaxSize: 256}, rootEntity: m.rootEntity}
+	if _, err := Diff(m, other); err == nil {
+		t.Error("diffed manifests with different chunking")
+	}
+}
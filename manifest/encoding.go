@@ -0,0 +1,447 @@
+package manifest
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Encoded manifest layout (all integers are unsigned varints unless noted):
+//
+//	magic "VXMF" | version (1 byte) | hash algorithm (1 byte) | chunking | root entity
+//
+// Chunking is a flag byte which, if 1 for content-defined chunking, is followed by the minimum, average and maximum chunk sizes.
+//
+// Each entity starts with a kind byte followed by its id and name (length-prefixed).
+// Folders are followed by the number of children and the children themselves.
+// Files are followed by the file size, the number of hashes and each hash (length-prefixed).
+// With content-defined chunking, each hash is instead preceded by the length of its chunk.
+// Symlinks are followed by the link target (length-prefixed).
+// Hard links are followed by the id of the file they link to and carry no hashes of their own.
+// Folders and files end with a metadata flag byte. If it is 1, it is followed by the permission bits, the modification time (Unix
+// nanoseconds, signed), the number of extended attributes and each attribute's name and value (both length-prefixed).
+
+const (
+	encodingMagic   = "VXMF"
+	encodingVersion = 1
+)
+
+const (
+	entityKindFolder   byte = 0
+	entityKindFile     byte = 1
+	entityKindSymlink  byte = 2
+	entityKindHardLink byte = 3
+)
+
+// Errors
+var (
+	ErrBadManifestMagic           = errors.New("Data does not start with the manifest magic")
+	ErrUnsupportedManifestVersion = errors.New("Unsupported manifest encoding version")
+)
+
+// Marshal encodes the manifest into its compact binary form.
+func (m *Manifest) Marshal() []byte {
+	enc := &encoder{}
+	enc.buf.WriteString(encodingMagic)
+	enc.buf.WriteByte(encodingVersion)
+	enc.buf.WriteByte(byte(m.hashAlgorithm))
+	enc.writeChunking(m.chunking)
+	enc.writeEntity(m.rootEntity)
+	return enc.buf.Bytes()
+}
+
+// Unmarshal decodes a manifest produced by Marshal and rebuilds its index.
+func Unmarshal(data []byte) (*Manifest, error) {
+	if !bytes.HasPrefix(data, []byte(encodingMagic)) {
+		return nil, ErrBadManifestMagic
+	}
+	dec := &decoder{r: bytes.NewReader(data[len(encodingMagic):])}
+	version, err := dec.r.ReadByte()
+	if err != nil {
+		return nil, fmt.Errorf("error reading manifest version: %v", err)
+	}
+	if version != encodingVersion {
+		return nil, ErrUnsupportedManifestVersion
+	}
+	alg, err := dec.r.ReadByte()
+	if err != nil {
+		return nil, fmt.Errorf("error reading hash algorithm: %v", err)
+	}
+	dec.hashAlgorithm = HashAlgorithm(alg)
+	if dec.hashAlgorithm == HashSHA1 {
+		return nil, ErrSHA1NotSupported
+	}
+	if !dec.hashAlgorithm.Valid() {
+		return nil, fmt.Errorf("unknown hash algorithm %d", alg)
+	}
+	dec.chunking, err = dec.readChunking()
+	if err != nil {
+		return nil, fmt.Errorf("error reading chunking: %v", err)
+	}
+	rootEntity, err := dec.readEntity(0)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding manifest: %v", err)
+	}
+	if dec.r.Len() != 0 {
+		return nil, fmt.Errorf("error decoding manifest: %d trailing bytes", dec.r.Len())
+	}
+	return newManifest(dec.hashAlgorithm, dec.chunking, rootEntity)
+}
+
+type encoder struct {
+	buf bytes.Buffer
+}
+
+func (enc *encoder) writeUvarint(v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(b[:], v)
+	enc.buf.Write(b[:n])
+}
+
+func (enc *encoder) writeVarint(v int64) {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(b[:], v)
+	enc.buf.Write(b[:n])
+}
+
+func (enc *encoder) writeBytes(b []byte) {
+	enc.writeUvarint(uint64(len(b)))
+	enc.buf.Write(b)
+}
+
+func (enc *encoder) writeEntity(entity ManifestEntity) {
+	switch e := entity.(type) {
+	case *ManifestFolder:
+		enc.buf.WriteByte(entityKindFolder)
+		enc.writeUvarint(uint64(e.id))
+		enc.writeBytes([]byte(e.name))
+		enc.writeUvarint(uint64(len(e.contents)))
+		for _, child := range e.contents {
+			enc.writeEntity(child)
+		}
+		enc.writeMetadata(e.metadata)
+	case *ManifestFile:
+		if e.isHardLink {
+			enc.buf.WriteByte(entityKindHardLink)
+			enc.writeUvarint(uint64(e.id))
+			enc.writeBytes([]byte(e.name))
+			enc.writeUvarint(uint64(e.hardLinkOf))
+			return
+		}
+		enc.buf.WriteByte(entityKindFile)
+		enc.writeUvarint(uint64(e.id))
+		enc.writeBytes([]byte(e.name))
+		enc.writeUvarint(e.fileSize)
+		enc.writeUvarint(uint64(len(e.hashes)))
+		for i, hash := range e.hashes {
+			if e.chunkLengths != nil {
+				enc.writeUvarint(uint64(e.chunkLengths[i]))
+			}
+			enc.writeBytes(hash)
+		}
+		enc.writeMetadata(e.metadata)
+	case *ManifestSymlink:
+		enc.buf.WriteByte(entityKindSymlink)
+		enc.writeUvarint(uint64(e.id))
+		enc.writeBytes([]byte(e.name))
+		enc.writeBytes([]byte(e.target))
+	default:
+		panic(fmt.Sprintf("writeEntity: unexpected entity type %T", entity))
+	}
+}
+
+func (enc *encoder) writeChunking(chunking Chunking) {
+	if !chunking.ContentDefined {
+		enc.buf.WriteByte(0)
+		return
+	}
+	enc.buf.WriteByte(1)
+	enc.writeUvarint(uint64(chunking.MinSize))
+	enc.writeUvarint(uint64(chunking.AvgSize))
+	enc.writeUvarint(uint64(chunking.MaxSize))
+}
+
+func (enc *encoder) writeMetadata(metadata *Metadata) {
+	if metadata == nil {
+		enc.buf.WriteByte(0)
+		return
+	}
+	enc.buf.WriteByte(1)
+	enc.writeUvarint(uint64(metadata.Mode.Perm()))
+	enc.writeVarint(metadata.ModTime.UnixNano())
+	// Sort the names so that encoding is deterministic
+	names := make([]string, 0, len(metadata.Xattrs))
+	for name := range metadata.Xattrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	enc.writeUvarint(uint64(len(names)))
+	for _, name := range names {
+		enc.writeBytes([]byte(name))
+		enc.writeBytes(metadata.Xattrs[name])
+	}
+}
+
+// Folders can nest arbitrarily on disk, but an encoded manifest deeper than this is rejected to bound recursion.
+const maxDecodeDepth = 1024
+
+type decoder struct {
+	r *bytes.Reader
+	// Only used when decoding manifests and file updates
+	hashAlgorithm HashAlgorithm
+	chunking      Chunking
+}
+
+func (dec *decoder) readUvarint() (uint64, error) {
+	v, err := binary.ReadUvarint(dec.r)
+	if err == io.EOF {
+		return 0, io.ErrUnexpectedEOF
+	}
+	return v, err
+}
+
+func (dec *decoder) readVarint() (int64, error) {
+	v, err := binary.ReadVarint(dec.r)
+	if err == io.EOF {
+		return 0, io.ErrUnexpectedEOF
+	}
+	return v, err
+}
+
+func (dec *decoder) readUint32() (uint32, error) {
+	v, err := dec.readUvarint()
+	if err != nil {
+		return 0, err
+	}
+	if v > uint64(^uint32(0)) {
+		return 0, fmt.Errorf("value %d overflows 32 bits", v)
+	}
+	return uint32(v), nil
+}
+
+// readCount reads an element count, rejecting counts that could not possibly fit in the remaining data (each element takes at least one byte).
+func (dec *decoder) readCount() (int, error) {
+	v, err := dec.readUvarint()
+	if err != nil {
+		return 0, err
+	}
+	if v > uint64(dec.r.Len()) {
+		return 0, fmt.Errorf("count %d exceeds the remaining %d bytes", v, dec.r.Len())
+	}
+	return int(v), nil
+}
+
+func (dec *decoder) readBytes() ([]byte, error) {
+	n, err := dec.readCount()
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, n)
+	_, err = io.ReadFull(dec.r, b)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (dec *decoder) readChunking() (Chunking, error) {
+	contentDefined, err := dec.r.ReadByte()
+	if err != nil {
+		return Chunking{}, io.ErrUnexpectedEOF
+	}
+	if contentDefined == 0 {
+		return FixedChunking, nil
+	}
+	chunking := Chunking{ContentDefined: true}
+	for _, size := range []*uint32{&chunking.MinSize, &chunking.AvgSize, &chunking.MaxSize} {
+		*size, err = dec.readUint32()
+		if err != nil {
+			return Chunking{}, err
+		}
+	}
+	err = chunking.Validate()
+	if err != nil {
+		return Chunking{}, err
+	}
+	return chunking, nil
+}
+
+func (dec *decoder) readMetadata() (*Metadata, error) {
+	present, err := dec.r.ReadByte()
+	if err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if present == 0 {
+		return nil, nil
+	}
+	mode, err := dec.readUvarint()
+	if err != nil {
+		return nil, err
+	}
+	if mode&^uint64(os.ModePerm) != 0 {
+		return nil, fmt.Errorf("invalid permission bits %o", mode)
+	}
+	modTime, err := dec.readVarint()
+	if err != nil {
+		return nil, err
+	}
+	metadata := &Metadata{
+		Mode:    os.FileMode(mode),
+		ModTime: time.Unix(0, modTime),
+	}
+	numXattrs, err := dec.readCount()
+	if err != nil {
+		return nil, err
+	}
+	if numXattrs > 0 {
+		metadata.Xattrs = make(map[string][]byte, numXattrs)
+	}
+	for i := 0; i < numXattrs; i++ {
+		name, err := dec.readBytes()
+		if err != nil {
+			return nil, err
+		}
+		value, err := dec.readBytes()
+		if err != nil {
+			return nil, err
+		}
+		metadata.Xattrs[string(name)] = value
+	}
+	return metadata, nil
+}
+
+func (dec *decoder) readEntity(depth int) (ManifestEntity, error) {
+	if depth > maxDecodeDepth {
+		return nil, fmt.Errorf("folders nested deeper than %d levels", maxDecodeDepth)
+	}
+	kind, err := dec.r.ReadByte()
+	if err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	id, err := dec.readUint32()
+	if err != nil {
+		return nil, err
+	}
+	name, err := dec.readBytes()
+	if err != nil {
+		return nil, err
+	}
+	switch kind {
+	case entityKindFolder:
+		numChildren, err := dec.readCount()
+		if err != nil {
+			return nil, err
+		}
+		contents := make([]ManifestEntity, 0, numChildren)
+		for i := 0; i < numChildren; i++ {
+			child, err := dec.readEntity(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			err = checkChildName(child.Name())
+			if err != nil {
+				return nil, fmt.Errorf("folder %d: %v", id, err)
+			}
+			contents = append(contents, child)
+		}
+		metadata, err := dec.readMetadata()
+		if err != nil {
+			return nil, err
+		}
+		return &ManifestFolder{
+			id:       id,
+			name:     string(name),
+			contents: contents,
+			metadata: metadata,
+		}, nil
+	case entityKindFile:
+		fileSize, err := dec.readUvarint()
+		if err != nil {
+			return nil, err
+		}
+		numHashes, err := dec.readCount()
+		if err != nil {
+			return nil, err
+		}
+		if !dec.chunking.ContentDefined && numHashes != numChunksForSize(fileSize) {
+			return nil, fmt.Errorf("file %d has %d hashes but its size requires %d", id, numHashes, numChunksForSize(fileSize))
+		}
+		hashes := make([][]byte, 0, numHashes)
+		var chunkLengths []uint32
+		var totalLength uint64 = 0
+		for i := 0; i < numHashes; i++ {
+			if dec.chunking.ContentDefined {
+				length, err := dec.readUint32()
+				if err != nil {
+					return nil, err
+				}
+				if length == 0 || length > dec.chunking.MaxSize {
+					return nil, fmt.Errorf("file %d has a chunk of invalid length %d", id, length)
+				}
+				chunkLengths = append(chunkLengths, length)
+				totalLength += uint64(length)
+			}
+			hash, err := dec.readBytes()
+			if err != nil {
+				return nil, err
+			}
+			if len(hash) != dec.hashAlgorithm.Size() {
+				return nil, fmt.Errorf("file %d has a %d-byte hash, expected %d for %v", id, len(hash), dec.hashAlgorithm.Size(), dec.hashAlgorithm)
+			}
+			hashes = append(hashes, hash)
+		}
+		if dec.chunking.ContentDefined && totalLength != fileSize {
+			return nil, fmt.Errorf("file %d has chunks totalling %d bytes but a size of %d", id, totalLength, fileSize)
+		}
+		metadata, err := dec.readMetadata()
+		if err != nil {
+			return nil, err
+		}
+		return &ManifestFile{
+			id:           id,
+			name:         string(name),
+			fileSize:     fileSize,
+			hashes:       hashes,
+			chunkLengths: chunkLengths,
+			metadata:     metadata,
+		}, nil
+	case entityKindSymlink:
+		target, err := dec.readBytes()
+		if err != nil {
+			return nil, err
+		}
+		return &ManifestSymlink{
+			id:     id,
+			name:   string(name),
+			target: string(target),
+		}, nil
+	case entityKindHardLink:
+		hardLinkOf, err := dec.readUint32()
+		if err != nil {
+			return nil, err
+		}
+		// Size and hashes are filled in from the target once the whole tree is indexed
+		return &ManifestFile{
+			id:         id,
+			name:       string(name),
+			isHardLink: true,
+			hardLinkOf: hardLinkOf,
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown entity kind %d", kind)
+}
+
+// checkChildName rejects names that can't be a single component of a manifest path. Whether a name is safe to use locally is up to the safename
+// package, but paths within the manifest must at least be unambiguous.
+func checkChildName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\\\x00") {
+		return fmt.Errorf("invalid entity name %q", name)
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package manifest
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// testTree builds a tree with every kind of entity. Indexing writes to entities, so every call builds a new one.
+func testTree(alg HashAlgorithm, chunking Chunking) ManifestEntity {
+	file := func(id uint32, name, data string) *ManifestFile {
+		if !chunking.ContentDefined {
+			return &ManifestFile{id: id, name: name, fileSize: uint64(len(data)), hashes: [][]byte{alg.Sum([]byte(data))}}
+		}
+		// Two chunks, to check that their lengths survive
+		half := len(data) / 2
+		return &ManifestFile{
+			id:           id,
+			name:         name,
+			fileSize:     uint64(len(data)),
+			hashes:       [][]byte{alg.Sum([]byte(data[:half])), alg.Sum([]byte(data[half:]))},
+			chunkLengths: []uint32{uint32(half), uint32(len(data) - half)},
+		}
+	}
+	modTime := time.Unix(1600000000, 123456789)
+	a := file(2, "a", "first file")
+	a.metadata = &Metadata{Mode: 0640, ModTime: modTime, Xattrs: map[string][]byte{"user.b": []byte("2"), "user.a": []byte("1")}}
+	sub := &ManifestFolder{id: 1, name: "sub", contents: []ManifestEntity{a}, metadata: &Metadata{Mode: 0755, ModTime: modTime}}
+	return &ManifestFolder{id: 0, name: "root", contents: []ManifestEntity{
+		sub,
+		file(3, "b", "second file"),
+		&ManifestSymlink{id: 4, name: "link", target: "sub/a"},
+		&ManifestFile{id: 5, name: "hardlink", isHardLink: true, hardLinkOf: a.id},
+	}}
+}
+
+// documentedEncoding encodes a tree following the layout documented in encoding.go, with the given version and hash algorithm bytes.
+func documentedEncoding(version byte, alg HashAlgorithm, chunking Chunking, root ManifestEntity) []byte {
+	enc := &encoder{}
+	enc.buf.WriteString(encodingMagic)
+	enc.buf.WriteByte(version)
+	enc.buf.WriteByte(byte(alg))
+	enc.writeChunking(chunking)
+	enc.writeEntity(root)
+	return enc.buf.Bytes()
+}
+
+func TestEncodingRoundTrips(t *testing.T) {
+	cdc := Chunking{ContentDefined: true, MinSize: 64, AvgSize: 128, MaxSize: 256}
+	tests := []struct {
+		alg      HashAlgorithm
+		chunking Chunking
+	}{
+		{HashSHA256, FixedChunking},
+		{HashBLAKE3, FixedChunking},
+		{HashBLAKE3, cdc},
+	}
+	for _, test := range tests {
+		m, err := newManifest(test.alg, test.chunking, testTree(test.alg, test.chunking))
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := m.Marshal()
+		if !bytes.Equal(data, documentedEncoding(encodingVersion, test.alg, test.chunking, testTree(test.alg, test.chunking))) {
+			t.Errorf("%v, %v: Marshal differs from the documented layout", test.alg, test.chunking)
+		}
+		decoded, err := Unmarshal(data)
+		if err != nil {
+			t.Errorf("%v, %v: %v", test.alg, test.chunking, err)
+			continue
+		}
+		if decoded.HashAlgorithm() != test.alg || decoded.Chunking() != test.chunking {
+			t.Errorf("%v, %v: decoded with %v and %v", test.alg, test.chunking, decoded.HashAlgorithm(), decoded.Chunking())
+		}
+		if !bytes.Equal(decoded.MerkleRoot(), m.MerkleRoot()) || !bytes.Equal(decoded.Marshal(), data) {
+			t.Errorf("%v, %v: decoded manifest differs from the encoded one", test.alg, test.chunking)
+		}
+	}
+}
+
+func TestEncodingRejects(t *testing.T) {
+	valid := documentedEncoding(encodingVersion, HashSHA256, FixedChunking, testTree(HashSHA256, FixedChunking))
+	duplicate := testTree(HashSHA256, FixedChunking)
+	duplicate.(*ManifestFolder).contents[1].(*ManifestFile).id = 2
+	unknownKind := append([]byte(nil), valid...)
+	unknownKind[len(encodingMagic)+3] = 9
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"bad magic", append([]byte("VXMX"), valid[4:]...)},
+		{"future version", documentedEncoding(encodingVersion+1, HashSHA256, FixedChunking, testTree(HashSHA256, FixedChunking))},
+		{"unknown hash algorithm", documentedEncoding(encodingVersion, 9, FixedChunking, testTree(HashSHA256, FixedChunking))},
+		{"SHA-1", documentedEncoding(encodingVersion, HashSHA1, FixedChunking, testTree(HashSHA256, FixedChunking))},
+		{"unknown entity kind", unknownKind},
+		{"duplicate ids", documentedEncoding(encodingVersion, HashSHA256, FixedChunking, duplicate)},
+		{"truncated", valid[:len(valid)-1]},
+		{"trailing bytes", append(append([]byte(nil), valid...), 0)},
+	}
+	for _, test := range tests {
+		if _, err := Unmarshal(test.data); err == nil {
+			t.Errorf("%s: decoded without an error", test.name)
+		}
+	}
+	if _, err := Unmarshal(valid); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,225 @@
+package manifest
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+)
+
+// WriteTree writes a human-readable listing of the manifest to w, with one line per entity, indented by depth, and the total size of each folder.
+func (m *Manifest) WriteTree(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	folderSizes := make(map[uint32]uint64)
+	m.folderSize(m.rootEntity, folderSizes)
+	m.writeTreeEntity(bw, m.rootEntity, "", "", folderSizes)
+	return bw.Flush()
+}
+
+// folderSize returns the total size of the files in entity, recording the size of every folder in sizes. Hard links are only counted once.
+func (m *Manifest) folderSize(entity ManifestEntity, sizes map[uint32]uint64) uint64 {
+	switch e := entity.(type) {
+	case *ManifestFolder:
+		var total uint64 = 0
+		for _, child := range e.contents {
+			total += m.folderSize(child, sizes)
+		}
+		sizes[e.id] = total
+		return total
+	case *ManifestFile:
+		if e.isHardLink {
+			return 0
+		}
+		return e.fileSize
+	default:
+		return 0
+	}
+}
+
+func (m *Manifest) writeTreeEntity(w io.Writer, entity ManifestEntity, linePrefix, childPrefix string, folderSizes map[uint32]uint64) {
+	switch e := entity.(type) {
+	case *ManifestFolder:
+		fmt.Fprintf(w, "%s%s/  %s\n", linePrefix, e.name, FormatSize(folderSizes[e.id]))
+		for i, child := range e.contents {
+			if i == len(e.contents)-1 {
+				m.writeTreeEntity(w, child, childPrefix+"└── ", childPrefix+"    ", folderSizes)
+			} else {
+				m.writeTreeEntity(w, child, childPrefix+"├── ", childPrefix+"│   ", folderSizes)
+			}
+		}
+	case *ManifestFile:
+		if e.isHardLink {
+			targetPath, _ := m.PathOf(e.hardLinkOf)
+			fmt.Fprintf(w, "%s%s  %s (hard link to %s)\n", linePrefix, e.name, FormatSize(e.fileSize), targetPath)
+			return
+		}
+		fmt.Fprintf(w, "%s%s  %s\n", linePrefix, e.name, FormatSize(e.fileSize))
+	case *ManifestSymlink:
+		fmt.Fprintf(w, "%s%s -> %s\n", linePrefix, e.name, e.target)
+	}
+}
+
+// FormatSize formats a byte count for humans, such as "512 B" or "4.0 MiB".
+func FormatSize(size uint64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := uint64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
+
+type jsonManifest struct {
+	HashAlgorithm string      `json:"hashAlgorithm"`
+	Chunking      string      `json:"chunking"`
+	MerkleRoot    string      `json:"merkleRoot"`
+	Root          *jsonEntity `json:"root"`
+}
+
+type jsonEntity struct {
+	Id         uint32        `json:"id"`
+	Name       string        `json:"name"`
+	Path       string        `json:"path"`
+	Type       string        `json:"type"`
+	Size       *uint64       `json:"size,omitempty"`
+	MerkleRoot string        `json:"merkleRoot,omitempty"`
+	Chunks     []jsonChunk   `json:"chunks,omitempty"`
+	HardLinkOf *uint32       `json:"hardLinkOf,omitempty"`
+	Target     string        `json:"target,omitempty"`
+	Metadata   *jsonMetadata `json:"metadata,omitempty"`
+	Contents   []*jsonEntity `json:"contents,omitempty"`
+}
+
+type jsonChunk struct {
+	Offset uint64 `json:"offset"`
+	Length uint32 `json:"length"`
+	Hash   string `json:"hash"`
+}
+
+type jsonMetadata struct {
+	Mode    string            `json:"mode"`
+	ModTime time.Time         `json:"modTime"`
+	Xattrs  map[string]string `json:"xattrs,omitempty"`
+}
+
+// WriteJSON writes the whole manifest to w as indented JSON. Hashes are hex-encoded, as are extended attribute values.
+func (m *Manifest) WriteJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(&jsonManifest{
+		HashAlgorithm: m.hashAlgorithm.String(),
+		Chunking:      m.chunking.String(),
+		MerkleRoot:    hex.EncodeToString(m.MerkleRoot()),
+		Root:          jsonEntityOf(m.rootEntity, ""),
+	})
+}
+
+func jsonEntityOf(entity ManifestEntity, relPath string) *jsonEntity {
+	je := &jsonEntity{
+		Id:   entity.Id(),
+		Name: entity.Name(),
+		Path: relPath,
+	}
+	switch e := entity.(type) {
+	case *ManifestFolder:
+		je.Type = "folder"
+		je.Metadata = jsonMetadataOf(e.metadata)
+		je.Contents = make([]*jsonEntity, 0, len(e.contents))
+		for _, child := range e.contents {
+			je.Contents = append(je.Contents, jsonEntityOf(child, path.Join(relPath, child.Name())))
+		}
+	case *ManifestFile:
+		je.Size = &e.fileSize
+		if e.isHardLink {
+			je.Type = "hardlink"
+			je.HardLinkOf = &e.hardLinkOf
+			break
+		}
+		je.Type = "file"
+		je.MerkleRoot = hex.EncodeToString(e.MerkleRoot())
+		for _, chunk := range e.Chunks() {
+			je.Chunks = append(je.Chunks, jsonChunk{
+				Offset: chunk.Offset,
+				Length: chunk.Length,
+				Hash:   hex.EncodeToString(chunk.Hash),
+			})
+		}
+		je.Metadata = jsonMetadataOf(e.metadata)
+	case *ManifestSymlink:
+		je.Type = "symlink"
+		je.Target = e.target
+	}
+	return je
+}
+
+func jsonMetadataOf(metadata *Metadata) *jsonMetadata {
+	if metadata == nil {
+		return nil
+	}
+	jm := &jsonMetadata{
+		Mode:    fmt.Sprintf("%04o", uint32(metadata.Mode.Perm())),
+		ModTime: metadata.ModTime,
+	}
+	if len(metadata.Xattrs) > 0 {
+		jm.Xattrs = make(map[string]string, len(metadata.Xattrs))
+		for name, value := range metadata.Xattrs {
+			jm.Xattrs[name] = hex.EncodeToString(value)
+		}
+	}
+	return jm
+}
+
+// WriteChecksums writes a checksum list for every file in the manifest to w in the format of sha256sum, or b3sum for HashBLAKE3, so that it can
+// be checked with "sha256sum -c" from inside the root folder (or from the folder containing a single shared file).
+// Whole-file checksums aren't part of the manifest, so the files are read from rootPath, the local path of the root entity. Each chunk is verified
+// against the manifest on the way, so the list describes the manifest's content rather than whatever happens to be on disk.
+func (m *Manifest) WriteChecksums(w io.Writer, rootPath string, alg HashAlgorithm) error {
+	if !alg.Valid() {
+		return fmt.Errorf("unknown hash algorithm %v", alg)
+	}
+	bw := bufio.NewWriter(w)
+	err := m.Walk(func(relPath string, entity ManifestEntity) error {
+		file, ok := entity.(*ManifestFile)
+		if !ok {
+			return nil
+		}
+		if relPath == "" {
+			relPath = file.name
+		}
+		h := alg.New()
+		for i := 0; i < file.NumChunks(); i++ {
+			data, err := m.ReadChunk(rootPath, file.id, i)
+			if err != nil {
+				return err
+			}
+			err = file.VerifyChunk(i, data)
+			if err != nil {
+				return fmt.Errorf("%s: chunk %d: %v", relPath, i, err)
+			}
+			h.Write(data)
+		}
+		fmt.Fprintln(bw, checksumLine(hex.EncodeToString(h.Sum(nil)), relPath))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// checksumLine formats a line the way sha256sum does, escaping backslashes and newlines in the path and marking such lines with a leading backslash.
+func checksumLine(hexSum, relPath string) string {
+	if !strings.ContainsAny(relPath, "\\\n\r") {
+		return hexSum + "  " + relPath
+	}
+	escaped := strings.NewReplacer(`\`, `\\`, "\n", `\n`, "\r", `\r`).Replace(relPath)
+	return `\` + hexSum + "  " + escaped
+}
@@ -0,0 +1,392 @@
+package manifest
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// GenerateOptions controls how a manifest is generated. A nil *GenerateOptions means the defaults.
+type GenerateOptions struct {
+	// Concurrency is the maximum number of files hashed at once. Zero means runtime.NumCPU().
+	Concurrency int
+	// Progress, if non-nil, is called each time another chunk has been hashed. Calls are never concurrent.
+	Progress func(Progress)
+	// HashAlgorithm is used for chunk hashes. Zero means DefaultHashAlgorithm. HashSHA1 is rejected with ErrSHA1NotSupported.
+	HashAlgorithm HashAlgorithm
+	// Chunking decides how files are split into chunks. The zero value means FixedChunking.
+	Chunking Chunking
+	// HashCache, if non-nil, is consulted before hashing each file and updated with newly computed hashes.
+	// The caller is responsible for saving it afterwards.
+	HashCache *HashCache
+	// UseDefaultHashCache makes GenerateManifest and StreamManifest use the per-user hash cache (see OpenDefaultHashCache) if HashCache is nil,
+	// pruning and saving it afterwards. A cache that can't be opened or saved only makes generation slower, so such errors are ignored.
+	UseDefaultHashCache bool
+	// Exclude and Include are gitignore-style patterns relative to the shared folder, typically from the command line.
+	// Include patterns re-include paths that would otherwise be excluded. These take precedence over patterns from ignore files.
+	Exclude []string
+	Include []string
+	// UseGitignore makes generation honor .gitignore files and skip .git folders, like git itself would.
+	// IgnoreFileName files are always honored and take precedence over .gitignore files in the same folder.
+	UseGitignore bool
+	// SymlinkPolicy decides what happens to symbolic links inside the shared folder.
+	SymlinkPolicy SymlinkPolicy
+	// SkipMetadata leaves permissions, modification times and extended attributes out of the manifest.
+	SkipMetadata bool
+	// Warn, if non-nil, is called for every entity that is skipped because it can't be shared, such as FIFOs, devices, broken symlinks
+	// and symlinks leading outside the shared folder. If nil, such entities are left out silently.
+	Warn func(relPath string, err error)
+	// RootName, if not empty, replaces the name of the root entity. Useful with GenerateManifestFromFS, where the root is often ".".
+	RootName string
+}
+
+// SymlinkPolicy decides what happens to symbolic links during manifest generation.
+type SymlinkPolicy int
+
+const (
+	// SymlinksFollowWithinRoot shares what a symlink points to as if it were a regular file or folder, as long as it resolves to somewhere inside the shared folder.
+	// Links leading outside of it, broken links and links forming loops are skipped with a warning.
+	SymlinksFollowWithinRoot SymlinkPolicy = iota
+	// SymlinksPreserve shares symlinks as ManifestSymlink entities holding the link target.
+	SymlinksPreserve
+	// SymlinksSkip leaves symlinks out of the manifest.
+	SymlinksSkip
+)
+
+// Progress describes how far along manifest generation is.
+type Progress struct {
+	FilesHashed int
+	FilesTotal  int
+	BytesHashed uint64
+	BytesTotal  uint64
+}
+
+func (opts *GenerateOptions) concurrency() int {
+	if opts == nil || opts.Concurrency <= 0 {
+		return runtime.NumCPU()
+	}
+	return opts.Concurrency
+}
+
+func (opts *GenerateOptions) hashAlgorithm() HashAlgorithm {
+	if opts == nil || opts.HashAlgorithm == 0 {
+		return DefaultHashAlgorithm
+	}
+	return opts.HashAlgorithm
+}
+
+func (opts *GenerateOptions) chunking() Chunking {
+	if opts == nil {
+		return FixedChunking
+	}
+	return opts.Chunking
+}
+
+func (opts *GenerateOptions) hashCache() *HashCache {
+	if opts == nil {
+		return nil
+	}
+	return opts.HashCache
+}
+
+func (opts *GenerateOptions) progressFunc() func(Progress) {
+	if opts == nil {
+		return nil
+	}
+	return opts.Progress
+}
+
+// withDefaultHashCache returns the options to generate with, holding the per-user hash cache if UseDefaultHashCache asks for it, and a function
+// saving the cache once generation succeeded.
+func (opts *GenerateOptions) withDefaultHashCache() (*GenerateOptions, func()) {
+	if opts == nil || !opts.UseDefaultHashCache || opts.HashCache != nil {
+		return opts, func() {}
+	}
+	hashCache, err := OpenDefaultHashCache()
+	if err != nil {
+		return opts, func() {}
+	}
+	withCache := *opts
+	withCache.HashCache = hashCache
+	return &withCache, func() {
+		hashCache.Prune()
+		hashCache.Save()
+	}
+}
+
+// GenerateManifestFromPath generates the manifest for the file or folder at p using the default options.
+func GenerateManifestFromPath(p string) (*Manifest, error) {
+	return GenerateManifest(context.Background(), p, nil)
+}
+
+// GenerateManifest generates the manifest for the file or folder at p.
+// The folder structure is scanned first and file contents are then hashed by a pool of workers, so ids are assigned exactly as in a serial scan.
+// Cancelling ctx aborts hashing and returns ctx.Err().
+func GenerateManifest(ctx context.Context, p string, opts *GenerateOptions) (*Manifest, error) {
+	opts, saveHashCache := opts.withDefaultHashCache()
+	m, err := generate(ctx, osSource{}, p, opts)
+	if err != nil {
+		return nil, err
+	}
+	saveHashCache()
+	return m, nil
+}
+
+// GenerateManifestFromFS generates the manifest for the file or folder at root, a slash-separated path within fsys, such as an archive opened with
+// archive/zip or the tarfs package. Symlinks are only recognized if fsys implements ReadLinkFS. Extended attributes and the hash cache are not used.
+// Read chunks back with ReadChunkFS.
+func GenerateManifestFromFS(ctx context.Context, fsys fs.FS, root string, opts *GenerateOptions) (*Manifest, error) {
+	if !fs.ValidPath(root) {
+		return nil, &fs.PathError{Op: "generate", Path: root, Err: fs.ErrInvalid}
+	}
+	return generate(ctx, fsSource{fsys}, root, opts)
+}
+
+func generate(ctx context.Context, src source, p string, opts *GenerateOptions) (*Manifest, error) {
+	scanner, hasher, fileInfo, err := prepareGeneration(src, p, opts)
+	if err != nil {
+		return nil, err
+	}
+	rootEntity, err := scanner.scan(p, "", fileInfo)
+	if err != nil {
+		return nil, err
+	}
+	if rootEntity == nil {
+		return nil, fmt.Errorf("%s is neither a regular file nor a folder", p)
+	}
+	err = hasher.hashPendingFiles(ctx, scanner.pending, opts)
+	if err != nil {
+		return nil, err
+	}
+	return newManifest(hasher.hashAlgorithm, hasher.chunking, rootEntity)
+}
+
+// prepareGeneration validates the options and sets up scanning and hashing of the file or folder at p.
+func prepareGeneration(src source, p string, opts *GenerateOptions) (*treeScanner, *fileHasher, fs.FileInfo, error) {
+	hashAlgorithm := opts.hashAlgorithm()
+	if hashAlgorithm == HashSHA1 {
+		return nil, nil, nil, ErrSHA1NotSupported
+	}
+	if !hashAlgorithm.Valid() {
+		return nil, nil, nil, fmt.Errorf("unknown hash algorithm %v", hashAlgorithm)
+	}
+	chunking := opts.chunking()
+	err := chunking.Validate()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	fileInfo, err := src.stat(p)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if opts != nil && opts.RootName != "" {
+		fileInfo = renamedFileInfo{fileInfo, opts.RootName}
+	}
+	scanner, err := newTreeScanner(src, p, opts)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	hasher := &fileHasher{
+		src:           src,
+		hashAlgorithm: hashAlgorithm,
+		chunking:      chunking,
+		hashCache:     opts.hashCache(),
+	}
+	return scanner, hasher, fileInfo, nil
+}
+
+// renamedFileInfo overrides the name of a FileInfo while keeping everything else, including Sys.
+type renamedFileInfo struct {
+	fs.FileInfo
+	name string
+}
+
+func (fi renamedFileInfo) Name() string {
+	return fi.name
+}
+
+// pendingFile is a ManifestFile whose size and hashes are yet to be filled in.
+type pendingFile struct {
+	file     *ManifestFile
+	filePath string
+	statSize uint64
+	modTime  time.Time
+	inode    uint64
+}
+
+// progressTracker serializes progress updates coming from the hashing workers.
+type progressTracker struct {
+	mutex    sync.Mutex
+	progress Progress
+	report   func(Progress)
+}
+
+func (pt *progressTracker) addBytes(n uint64) {
+	if pt.report == nil {
+		return
+	}
+	pt.mutex.Lock()
+	defer pt.mutex.Unlock()
+	pt.progress.BytesHashed += n
+	pt.report(pt.progress)
+}
+
+// fileFound accounts for a file discovered while hashing is already under way.
+func (pt *progressTracker) fileFound(size uint64) {
+	if pt.report == nil {
+		return
+	}
+	pt.mutex.Lock()
+	defer pt.mutex.Unlock()
+	pt.progress.FilesTotal++
+	pt.progress.BytesTotal += size
+}
+
+func (pt *progressTracker) fileDone(cachedBytes uint64) {
+	if pt.report == nil {
+		return
+	}
+	pt.mutex.Lock()
+	defer pt.mutex.Unlock()
+	pt.progress.FilesHashed++
+	pt.progress.BytesHashed += cachedBytes
+	pt.report(pt.progress)
+}
+
+// fileHasher computes the chunk hashes of pending files.
+type fileHasher struct {
+	src           source
+	hashAlgorithm HashAlgorithm
+	chunking      Chunking
+	hashCache     *HashCache
+}
+
+// fileChunks is the result of hashing one file.
+type fileChunks struct {
+	size   uint64
+	hashes [][]byte
+	// Only set for content-defined chunking
+	lengths []uint32
+}
+
+func (fh *fileHasher) hashPendingFiles(ctx context.Context, pending []pendingFile, opts *GenerateOptions) error {
+	tracker := &progressTracker{
+		progress: Progress{FilesTotal: len(pending)},
+		report:   opts.progressFunc(),
+	}
+	for _, pf := range pending {
+		tracker.progress.BytesTotal += pf.statSize
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	jobs := make(chan pendingFile)
+	var firstErr error
+	var errOnce sync.Once
+	var wg sync.WaitGroup
+	for i := 0; i < opts.concurrency(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Each worker reuses a single chunk buffer for all of its files
+			buf := make([]byte, fh.chunking.maxChunkSize())
+			for pf := range jobs {
+				err := fh.hashPendingFile(ctx, pf, buf, tracker)
+				if err != nil {
+					errOnce.Do(func() {
+						firstErr = err
+						cancel()
+					})
+				}
+			}
+		}()
+	}
+feedLoop:
+	for _, pf := range pending {
+		select {
+		case jobs <- pf:
+		case <-ctx.Done():
+			break feedLoop
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+	// Covers cancellation of the parent context while no worker was mid-file
+	return ctx.Err()
+}
+
+func (fh *fileHasher) hashPendingFile(ctx context.Context, pf pendingFile, buf []byte, tracker *progressTracker) error {
+	hashCache := fh.hashCache
+	cacheKey, ok := fh.src.cacheKey(pf.filePath)
+	if !ok {
+		hashCache = nil
+	}
+	if hashCache != nil {
+		if chunks, ok := hashCache.lookup(cacheKey, fh.hashAlgorithm, fh.chunking, pf.statSize, pf.modTime, pf.inode); ok {
+			pf.file.setChunks(chunks)
+			tracker.fileDone(pf.statSize)
+			return nil
+		}
+	}
+	chunks, err := fh.hashFile(ctx, pf.filePath, buf, tracker)
+	if err != nil {
+		return err
+	}
+	pf.file.setChunks(chunks)
+	if hashCache != nil && fh.unchangedSinceScan(pf, chunks) {
+		hashCache.store(cacheKey, fh.hashAlgorithm, fh.chunking, pf.modTime, pf.inode, chunks)
+	}
+	tracker.fileDone(0)
+	return nil
+}
+
+// unchangedSinceScan reports whether the file still has the size, modification time and inode it was scanned with, now that chunks were read
+// from it. Otherwise it changed while it was being hashed, and the hashes may describe content that never existed as a whole.
+func (fh *fileHasher) unchangedSinceScan(pf pendingFile, chunks *fileChunks) bool {
+	if chunks.size != pf.statSize {
+		return false
+	}
+	fileInfo, err := fh.src.stat(pf.filePath)
+	if err != nil {
+		return false
+	}
+	return uint64(fileInfo.Size()) == pf.statSize && fileInfo.ModTime().Equal(pf.modTime) && inodeOf(fileInfo) == pf.inode
+}
+
+func (fh *fileHasher) hashFile(ctx context.Context, filePath string, buf []byte, tracker *progressTracker) (*fileChunks, error) {
+	f, err := fh.src.open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	chunks := &fileChunks{}
+	chunks.size, err = fh.chunking.splitChunks(ctx, f, buf, func(data []byte) error {
+		chunks.hashes = append(chunks.hashes, fh.hashAlgorithm.Sum(data))
+		if fh.chunking.ContentDefined {
+			chunks.lengths = append(chunks.lengths, uint32(len(data)))
+		}
+		tracker.addBytes(uint64(len(data)))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return chunks, nil
+}
+
+func (mf *ManifestFile) setChunks(chunks *fileChunks) {
+	mf.fileSize = chunks.size
+	mf.hashes = chunks.hashes
+	mf.chunkLengths = chunks.lengths
+}
+
+func takeId(nextId *uint32) uint32 {
+	id := *nextId
+	*nextId = *nextId + 1
+	return id
+}
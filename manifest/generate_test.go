@@ -0,0 +1,106 @@
+package manifest
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// testFolder writes count files of random data, of varying sizes up to maxSize, and returns the folder and their total size.
+func testFolder(t *testing.T, count, maxSize int) (string, uint64) {
+	t.Helper()
+	tempDir, err := ioutil.TempDir("", "generate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tempDir) })
+	rng := rand.New(rand.NewSource(1))
+	var total uint64
+	for i := 0; i < count; i++ {
+		data := make([]byte, rng.Intn(maxSize)+1)
+		rng.Read(data)
+		total += uint64(len(data))
+		err = ioutil.WriteFile(filepath.Join(tempDir, fmt.Sprintf("file%02d", i)), data, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return tempDir, total
+}
+
+// Small chunks make for many progress reports and cancellation points per file
+var smallChunks = Chunking{ContentDefined: true, MinSize: 64, AvgSize: 256, MaxSize: 1024}
+
+func TestGenerateProgress(t *testing.T) {
+	root, total := testFolder(t, 40, 64*1024)
+	var reports []Progress
+	opts := &GenerateOptions{
+		Concurrency: 4,
+		Chunking:    smallChunks,
+		Progress:    func(p Progress) { reports = append(reports, p) },
+	}
+	_, err := GenerateManifest(context.Background(), root, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reports) == 0 {
+		t.Fatal("no progress was reported")
+	}
+	for i, p := range reports {
+		if p.FilesTotal != 40 || p.BytesTotal != total {
+			t.Fatalf("report %d has totals of %d files and %d bytes, expected 40 and %d", i, p.FilesTotal, p.BytesTotal, total)
+		}
+		if p.FilesHashed > p.FilesTotal || p.BytesHashed > p.BytesTotal {
+			t.Fatalf("report %d is past the totals: %+v", i, p)
+		}
+		if i > 0 && (p.FilesHashed < reports[i-1].FilesHashed || p.BytesHashed < reports[i-1].BytesHashed) {
+			t.Fatalf("report %d went backwards: %+v after %+v", i, p, reports[i-1])
+		}
+	}
+	last := reports[len(reports)-1]
+	if last.FilesHashed != 40 || last.BytesHashed != total {
+		t.Errorf("the last report is %+v, expected all 40 files and %d bytes", last, total)
+	}
+}
+
+func TestGenerateCancel(t *testing.T) {
+	root, _ := testFolder(t, 40, 64*1024)
+	before := runtime.NumGoroutine()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	reports := 0
+	opts := &GenerateOptions{
+		Concurrency: 4,
+		Chunking:    smallChunks,
+		Progress: func(p Progress) {
+			// Cancel once hashing is well under way but far from done
+			if reports++; reports == 20 {
+				cancel()
+			}
+		},
+	}
+	m, err := GenerateManifest(ctx, root, opts)
+	if err != context.Canceled {
+		t.Fatalf("got %v, %v, expected context.Canceled", m, err)
+	}
+	// Workers exit before GenerateManifest returns, but give the runtime a moment to account for them
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > before {
+		t.Errorf("%d goroutines are left running, %d were before", n, before)
+	}
+
+	// Cancelling before anything is hashed works too
+	_, err = GenerateManifest(ctx, root, &GenerateOptions{Chunking: smallChunks})
+	if err != context.Canceled {
+		t.Errorf("with a context cancelled up front: got %v, expected context.Canceled", err)
+	}
+}
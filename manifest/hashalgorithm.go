@@ -0,0 +1,99 @@
+package manifest
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+
+	"github.com/zeebo/blake3"
+)
+
+// HashAlgorithm identifies the hash function used for chunk hashes. The numeric values are part of the encoding.
+type HashAlgorithm byte
+
+const (
+	// HashSHA1 is what chunk hashes were before the algorithm was recorded. It's broken, so manifests can neither be generated nor decoded
+	// with it, and it only keeps its number so that it's rejected as such rather than as an unknown algorithm.
+	HashSHA1   HashAlgorithm = 1
+	HashSHA256 HashAlgorithm = 2
+	HashBLAKE3 HashAlgorithm = 3
+)
+
+// DefaultHashAlgorithm is used for new manifests unless GenerateOptions says otherwise.
+const DefaultHashAlgorithm = HashSHA256
+
+// Errors
+var (
+	ErrSHA1NotSupported = errors.New("SHA-1 is no longer supported for chunk hashes")
+)
+
+// ParseHashAlgorithm returns the algorithm with the given name, as produced by String, for generating a manifest. "sha1" gets
+// ErrSHA1NotSupported.
+func ParseHashAlgorithm(name string) (HashAlgorithm, error) {
+	if name == HashSHA1.String() {
+		return 0, ErrSHA1NotSupported
+	}
+	for _, alg := range []HashAlgorithm{HashSHA256, HashBLAKE3} {
+		if alg.String() == name {
+			return alg, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown hash algorithm %q", name)
+}
+
+func (alg HashAlgorithm) String() string {
+	switch alg {
+	case HashSHA1:
+		return "sha1"
+	case HashSHA256:
+		return "sha256"
+	case HashBLAKE3:
+		return "blake3"
+	default:
+		return fmt.Sprintf("HashAlgorithm(%d)", byte(alg))
+	}
+}
+
+// Valid reports whether this is a supported algorithm, which HashSHA1 isn't.
+func (alg HashAlgorithm) Valid() bool {
+	return alg == HashSHA256 || alg == HashBLAKE3
+}
+
+// Size returns the length in bytes of hashes produced by this algorithm.
+func (alg HashAlgorithm) Size() int {
+	switch alg {
+	case HashSHA256:
+		return sha256.Size
+	case HashBLAKE3:
+		return 32
+	default:
+		panic(fmt.Sprintf("Size called on invalid %v", alg))
+	}
+}
+
+// New returns a new hash.Hash computing this algorithm.
+func (alg HashAlgorithm) New() hash.Hash {
+	switch alg {
+	case HashSHA256:
+		return sha256.New()
+	case HashBLAKE3:
+		return blake3.New()
+	default:
+		panic(fmt.Sprintf("New called on invalid %v", alg))
+	}
+}
+
+// Sum returns the hash of data.
+func (alg HashAlgorithm) Sum(data []byte) []byte {
+	switch alg {
+	case HashSHA256:
+		hash := sha256.Sum256(data)
+		return hash[:]
+	case HashBLAKE3:
+		hash := blake3.Sum256(data)
+		return hash[:]
+	default:
+		panic(fmt.Sprintf("Sum called on invalid %v", alg))
+	}
+}
@@ -0,0 +1,39 @@
+package manifest
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSHA1IsRejected(t *testing.T) {
+	_, err := ParseHashAlgorithm("sha1")
+	if err != ErrSHA1NotSupported {
+		t.Errorf("parsing sha1: got %v, expected ErrSHA1NotSupported", err)
+	}
+	for _, alg := range []HashAlgorithm{HashSHA256, HashBLAKE3} {
+		parsed, err := ParseHashAlgorithm(alg.String())
+		if err != nil || parsed != alg {
+			t.Errorf("parsing %v: got %v, %v", alg, parsed, err)
+		}
+	}
+	tempDir, err := ioutil.TempDir("", "sha1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	err = ioutil.WriteFile(filepath.Join(tempDir, "a"), []byte("hello"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = GenerateManifest(context.Background(), tempDir, &GenerateOptions{HashAlgorithm: HashSHA1})
+	if err != ErrSHA1NotSupported {
+		t.Errorf("generating with SHA-1: got %v, expected ErrSHA1NotSupported", err)
+	}
+	encoded := documentedEncoding(encodingVersion, HashSHA1, FixedChunking, testTree(HashSHA256, FixedChunking))
+	if _, err := Unmarshal(encoded); err != ErrSHA1NotSupported {
+		t.Errorf("decoding with SHA-1: got %v, expected ErrSHA1NotSupported", err)
+	}
+}
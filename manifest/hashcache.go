@@ -0,0 +1,273 @@
+package manifest
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Encoded hash cache layout (integers are varints):
+//
+//	magic "VXHC" | version (1 byte) | entry count | entries
+//
+// Each entry is the absolute path, hash algorithm, chunking, size, mtime (Unix nanoseconds), inode, hash count and the hashes,
+// followed by the chunk lengths for content-defined chunking (all length-prefixed where variable).
+
+const (
+	hashCacheMagic   = "VXHC"
+	hashCacheVersion = 1
+)
+
+// HashCache remembers the chunk hashes of previously hashed files so that unchanged files don't have to be read again.
+// A file is considered unchanged if its absolute path, size, modification time and inode all match the cached entry.
+// Only one set of hashes is kept per path, so hashing with a different algorithm or chunking replaces the entry.
+// It is safe for concurrent use.
+type HashCache struct {
+	cachePath string
+	mutex     sync.Mutex
+	entries   map[string]*hashCacheEntry
+	dirty     bool
+}
+
+type hashCacheEntry struct {
+	hashAlgorithm HashAlgorithm
+	chunking      Chunking
+	modTime       int64
+	inode         uint64
+	chunks        *fileChunks
+}
+
+// DefaultHashCachePath returns the location of the per-user hash cache.
+func DefaultHashCachePath() (string, error) {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(cacheDir, "vortex", "hashcache"), nil
+}
+
+// OpenDefaultHashCache loads the per-user hash cache at DefaultHashCachePath.
+func OpenDefaultHashCache() (*HashCache, error) {
+	cachePath, err := DefaultHashCachePath()
+	if err != nil {
+		return nil, err
+	}
+	return OpenHashCache(cachePath)
+}
+
+// OpenHashCache loads the hash cache stored at cachePath.
+// A missing, outdated or unreadable cache file results in an empty cache rather than an error, since its contents can always be regenerated.
+func OpenHashCache(cachePath string) (*HashCache, error) {
+	hc := &HashCache{
+		cachePath: cachePath,
+		entries:   make(map[string]*hashCacheEntry),
+	}
+	data, err := ioutil.ReadFile(cachePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return hc, nil
+		}
+		return nil, err
+	}
+	entries, dropped, err := decodeHashCache(data)
+	if err != nil {
+		// Start over; the next Save will replace the bad file
+		hc.dirty = true
+		return hc, nil
+	}
+	hc.entries = entries
+	hc.dirty = dropped > 0
+	return hc, nil
+}
+
+// Save writes the cache back to disk if it has changed since it was opened.
+func (hc *HashCache) Save() error {
+	hc.mutex.Lock()
+	defer hc.mutex.Unlock()
+	if !hc.dirty {
+		return nil
+	}
+	err := os.MkdirAll(filepath.Dir(hc.cachePath), 0700)
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file and rename it into place so that a crash never leaves a truncated cache behind
+	tmpFile, err := ioutil.TempFile(filepath.Dir(hc.cachePath), filepath.Base(hc.cachePath)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmpFile.Write(hc.encode())
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpFile.Name(), hc.cachePath)
+	}
+	if err != nil {
+		os.Remove(tmpFile.Name())
+		return err
+	}
+	hc.dirty = false
+	return nil
+}
+
+// Prune drops the entries of files that no longer exist, so that the cache doesn't keep growing as files are moved or deleted.
+func (hc *HashCache) Prune() {
+	hc.mutex.Lock()
+	defer hc.mutex.Unlock()
+	for absPath := range hc.entries {
+		if _, err := os.Lstat(absPath); os.IsNotExist(err) {
+			delete(hc.entries, absPath)
+			hc.dirty = true
+		}
+	}
+}
+
+func (hc *HashCache) lookup(absPath string, hashAlgorithm HashAlgorithm, chunking Chunking, size uint64, modTime time.Time, inode uint64) (*fileChunks, bool) {
+	hc.mutex.Lock()
+	defer hc.mutex.Unlock()
+	entry, ok := hc.entries[absPath]
+	if !ok || entry.hashAlgorithm != hashAlgorithm || entry.chunking != chunking || entry.chunks.size != size || entry.modTime != modTime.UnixNano() || entry.inode != inode {
+		return nil, false
+	}
+	return entry.chunks, true
+}
+
+func (hc *HashCache) store(absPath string, hashAlgorithm HashAlgorithm, chunking Chunking, modTime time.Time, inode uint64, chunks *fileChunks) {
+	hc.mutex.Lock()
+	defer hc.mutex.Unlock()
+	hc.entries[absPath] = &hashCacheEntry{
+		hashAlgorithm: hashAlgorithm,
+		chunking:      chunking,
+		modTime:       modTime.UnixNano(),
+		inode:         inode,
+		chunks:        chunks,
+	}
+	hc.dirty = true
+}
+
+func (hc *HashCache) encode() []byte {
+	enc := &encoder{}
+	enc.buf.WriteString(hashCacheMagic)
+	enc.buf.WriteByte(hashCacheVersion)
+	enc.writeUvarint(uint64(len(hc.entries)))
+	for absPath, entry := range hc.entries {
+		enc.writeBytes([]byte(absPath))
+		enc.buf.WriteByte(byte(entry.hashAlgorithm))
+		enc.writeChunking(entry.chunking)
+		enc.writeUvarint(entry.chunks.size)
+		enc.writeVarint(entry.modTime)
+		enc.writeUvarint(entry.inode)
+		enc.writeUvarint(uint64(len(entry.chunks.hashes)))
+		for _, hash := range entry.chunks.hashes {
+			enc.writeBytes(hash)
+		}
+		if entry.chunking.ContentDefined {
+			for _, length := range entry.chunks.lengths {
+				enc.writeUvarint(uint64(length))
+			}
+		}
+	}
+	return enc.buf.Bytes()
+}
+
+// valid reports whether the entry's hashes could have been produced by hashing a file of its size, so that a corrupt cache file is only a cache
+// miss rather than the source of an invalid manifest.
+func (entry *hashCacheEntry) valid() bool {
+	if !entry.hashAlgorithm.Valid() || entry.chunking.Validate() != nil {
+		return false
+	}
+	for _, hash := range entry.chunks.hashes {
+		if len(hash) != entry.hashAlgorithm.Size() {
+			return false
+		}
+	}
+	if !entry.chunking.ContentDefined {
+		return len(entry.chunks.hashes) == numChunksForSize(entry.chunks.size)
+	}
+	var total uint64 = 0
+	for _, length := range entry.chunks.lengths {
+		if length == 0 || length > entry.chunking.MaxSize {
+			return false
+		}
+		total += uint64(length)
+	}
+	return len(entry.chunks.lengths) == len(entry.chunks.hashes) && total == entry.chunks.size
+}
+
+// decodeHashCache decodes a hash cache file, leaving out invalid entries and returning how many there were. An error means the file as a
+// whole can't be decoded.
+func decodeHashCache(data []byte) (map[string]*hashCacheEntry, int, error) {
+	if !bytes.HasPrefix(data, []byte(hashCacheMagic)) {
+		return nil, 0, fmt.Errorf("bad hash cache magic")
+	}
+	dec := &decoder{r: bytes.NewReader(data[len(hashCacheMagic):])}
+	version, err := dec.r.ReadByte()
+	if err != nil {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	if version != hashCacheVersion {
+		return nil, 0, fmt.Errorf("unsupported hash cache version %d", version)
+	}
+	numEntries, err := dec.readCount()
+	if err != nil {
+		return nil, 0, err
+	}
+	dropped := 0
+	entries := make(map[string]*hashCacheEntry, numEntries)
+	for i := 0; i < numEntries; i++ {
+		absPath, err := dec.readBytes()
+		if err != nil {
+			return nil, 0, err
+		}
+		entry := &hashCacheEntry{chunks: &fileChunks{}}
+		alg, err := dec.r.ReadByte()
+		if err != nil {
+			return nil, 0, io.ErrUnexpectedEOF
+		}
+		entry.hashAlgorithm = HashAlgorithm(alg)
+		if entry.chunking, err = dec.readChunking(); err != nil {
+			return nil, 0, err
+		}
+		if entry.chunks.size, err = dec.readUvarint(); err != nil {
+			return nil, 0, err
+		}
+		if entry.modTime, err = dec.readVarint(); err != nil {
+			return nil, 0, err
+		}
+		if entry.inode, err = dec.readUvarint(); err != nil {
+			return nil, 0, err
+		}
+		numHashes, err := dec.readCount()
+		if err != nil {
+			return nil, 0, err
+		}
+		for j := 0; j < numHashes; j++ {
+			hash, err := dec.readBytes()
+			if err != nil {
+				return nil, 0, err
+			}
+			entry.chunks.hashes = append(entry.chunks.hashes, hash)
+		}
+		if entry.chunking.ContentDefined {
+			for j := 0; j < numHashes; j++ {
+				length, err := dec.readUint32()
+				if err != nil {
+					return nil, 0, err
+				}
+				entry.chunks.lengths = append(entry.chunks.lengths, length)
+			}
+		}
+		if !entry.valid() {
+			dropped++
+			continue
+		}
+		entries[string(absPath)] = entry
+	}
+	return entries, dropped, nil
+}
@@ -0,0 +1,217 @@
+package manifest
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHashCache(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "hashcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	root := filepath.Join(tempDir, "share")
+	err = os.Mkdir(root, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keptPath := filepath.Join(root, "kept")
+	deletedPath := filepath.Join(root, "deleted")
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, filePath := range []string{keptPath, deletedPath} {
+		err = ioutil.WriteFile(filePath, []byte("original"), 0644)
+		if err == nil {
+			err = os.Chtimes(filePath, modTime, modTime)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	cachePath := filepath.Join(tempDir, "cache")
+	generate := func() *Manifest {
+		t.Helper()
+		hashCache, err := OpenHashCache(cachePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m, err := GenerateManifest(context.Background(), root, &GenerateOptions{HashCache: hashCache})
+		if err != nil {
+			t.Fatal(err)
+		}
+		hashCache.Prune()
+		err = hashCache.Save()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+	first := generate()
+
+	// Same size, time and inode, so the file looks unchanged and its hashes come from the cache
+	f, err := os.OpenFile(keptPath, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.WriteAt([]byte("ORIGINAL"), 0)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chtimes(keptPath, modTime, modTime)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Remove(deletedPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second := generate()
+	firstEntity, _ := first.EntityByPath("kept")
+	secondEntity, _ := second.EntityByPath("kept")
+	if !bytes.Equal(firstEntity.(*ManifestFile).hashes[0], secondEntity.(*ManifestFile).hashes[0]) {
+		t.Error("the unchanged-looking file was hashed again")
+	}
+
+	hashCache, err := OpenHashCache(cachePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	absKept, _ := filepath.Abs(keptPath)
+	absDeleted, _ := filepath.Abs(deletedPath)
+	if _, ok := hashCache.entries[absKept]; !ok {
+		t.Error("the cache lost the entry of a file that still exists")
+	}
+	if _, ok := hashCache.entries[absDeleted]; ok {
+		t.Error("the entry of the deleted file wasn't pruned")
+	}
+}
+
+func TestHashCacheDropsInvalidEntries(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "hashcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	cachePath := filepath.Join(tempDir, "cache")
+	hashCache, err := OpenHashCache(cachePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cdc := Chunking{ContentDefined: true, MinSize: 64, AvgSize: 128, MaxSize: 256}
+	hash := HashSHA256.Sum([]byte("x"))
+	entries := map[string]struct {
+		chunking Chunking
+		chunks   *fileChunks
+		valid    bool
+	}{
+		"/valid":           {FixedChunking, &fileChunks{size: 10, hashes: [][]byte{hash}}, true},
+		"/valid cdc":       {cdc, &fileChunks{size: 300, hashes: [][]byte{hash, hash}, lengths: []uint32{200, 100}}, true},
+		"/short hash":      {FixedChunking, &fileChunks{size: 10, hashes: [][]byte{hash[:20]}}, false},
+		"/too many hashes": {FixedChunking, &fileChunks{size: 10, hashes: [][]byte{hash, hash}}, false},
+		"/lengths too big": {cdc, &fileChunks{size: 300, hashes: [][]byte{hash, hash}, lengths: []uint32{200, 101}}, false},
+		"/chunk too long":  {cdc, &fileChunks{size: 300, hashes: [][]byte{hash}, lengths: []uint32{300}}, false},
+	}
+	for absPath, entry := range entries {
+		hashCache.store(absPath, HashSHA256, entry.chunking, time.Now(), 1, entry.chunks)
+	}
+	err = hashCache.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashCache, err = OpenHashCache(cachePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for absPath, entry := range entries {
+		if _, ok := hashCache.entries[absPath]; ok != entry.valid {
+			t.Errorf("%s kept: %v, expected %v", absPath, ok, entry.valid)
+		}
+	}
+	if !hashCache.dirty {
+		t.Error("the cache isn't saved again without the invalid entries")
+	}
+}
+
+func TestHashCacheOnlyStoresFilesUnchangedWhileHashed(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "hashcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	filePath := filepath.Join(tempDir, "file")
+	err = ioutil.WriteFile(filePath, []byte("content"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileInfo, err := os.Stat(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fh := &fileHasher{src: osSource{}}
+	chunks := &fileChunks{size: 7}
+	pf := pendingFile{filePath: filePath, statSize: 7, modTime: fileInfo.ModTime(), inode: inodeOf(fileInfo)}
+	if !fh.unchangedSinceScan(pf, chunks) {
+		t.Error("an unchanged file doesn't count as unchanged")
+	}
+	// Written to while hashing: same size, but a different modification time
+	later := fileInfo.ModTime().Add(time.Second)
+	err = os.Chtimes(filePath, later, later)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fh.unchangedSinceScan(pf, chunks) {
+		t.Error("a file modified while hashing counts as unchanged")
+	}
+	if fh.unchangedSinceScan(pf, &fileChunks{size: 6}) {
+		t.Error("a file that was read with a different size counts as unchanged")
+	}
+}
+
+func TestDefaultHashCacheIsOptIn(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "hashcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	// Where os.UserCacheDir looks on each platform
+	for _, name := range []string{"XDG_CACHE_HOME", "HOME", "LocalAppData"} {
+		t.Setenv(name, tempDir)
+	}
+	cachePath, err := DefaultHashCachePath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := filepath.Join(tempDir, "share")
+	err = os.Mkdir(root, 0755)
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(root, "file"), []byte("content"), 0644)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = GenerateManifestFromPath(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(cachePath); !os.IsNotExist(err) {
+		t.Fatalf("generating with the default options touched the per-user hash cache: %v", err)
+	}
+	_, err = GenerateManifest(context.Background(), root, &GenerateOptions{UseDefaultHashCache: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashCache, err := OpenHashCache(cachePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hashCache.entries) != 1 {
+		t.Errorf("the per-user hash cache has %d entries, expected 1", len(hashCache.entries))
+	}
+}
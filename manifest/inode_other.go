@@ -0,0 +1,15 @@
+//go:build !unix
+
+package manifest
+
+import "os"
+
+// Inodes aren't exposed through os.FileInfo on this platform, so the hash cache relies on path, size and mtime alone.
+func inodeOf(fileInfo os.FileInfo) uint64 {
+	return 0
+}
+
+// Hard links can't be detected through os.FileInfo on this platform, so they are shared as independent files.
+func hardLinkKeyOf(fileInfo os.FileInfo) (hardLinkKey, bool) {
+	return hardLinkKey{}, false
+}
@@ -0,0 +1,27 @@
+//go:build unix
+
+package manifest
+
+import (
+	"os"
+	"syscall"
+)
+
+func inodeOf(fileInfo os.FileInfo) uint64 {
+	if stat, ok := fileInfo.Sys().(*syscall.Stat_t); ok {
+		return uint64(stat.Ino)
+	}
+	return 0
+}
+
+// hardLinkKeyOf returns the key identifying the file's content on disk if the file has more than one hard link.
+func hardLinkKeyOf(fileInfo os.FileInfo) (hardLinkKey, bool) {
+	stat, ok := fileInfo.Sys().(*syscall.Stat_t)
+	if !ok || stat.Nlink <= 1 {
+		return hardLinkKey{}, false
+	}
+	return hardLinkKey{
+		device: uint64(stat.Dev),
+		inode:  uint64(stat.Ino),
+	}, true
+}
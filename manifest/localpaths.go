@@ -0,0 +1,139 @@
+package manifest
+
+import (
+	"errors"
+	"path"
+	"path/filepath"
+
+	"github.com/pavben/Vortex/safename"
+)
+
+// LocalPaths maps the entities of a manifest received from a peer to safe local paths. See Manifest.SafeLocalPaths.
+type LocalPaths struct {
+	rootPath string
+	// Slash-separated local paths relative to rootPath, by entity id. Skipped entities are absent.
+	relPaths map[uint32]string
+}
+
+// SafeLocalPaths checks every name in the manifest with the safename package and decides where each entity goes under rootPath, the local path of
+// the root entity. Unlike LocalPath, it never produces a path outside of rootPath, whatever names the sharer sent. Names are normalized to NFC and
+// names colliding within a folder are handled according to opts. Entities inside a skipped folder are skipped along with it.
+// The root entity's own name is not used.
+func (m *Manifest) SafeLocalPaths(rootPath string, opts *safename.Options) (*LocalPaths, error) {
+	lp := &LocalPaths{
+		rootPath: rootPath,
+		relPaths: make(map[uint32]string, len(m.entityMap)),
+	}
+	lp.relPaths[m.rootEntity.Id()] = ""
+	err := lp.addContents(m, m.rootEntity, opts)
+	if err != nil {
+		return nil, err
+	}
+	return lp, nil
+}
+
+// addContents decides the local paths of everything in entity, if it's a folder. Every folder gets its own set of used names, so that
+// collisions are only ever detected between siblings.
+func (lp *LocalPaths) addContents(m *Manifest, entity ManifestEntity, opts *safename.Options) error {
+	folder, ok := entity.(*ManifestFolder)
+	if !ok {
+		return nil
+	}
+	names := safename.NewFolder(opts)
+	for _, child := range folder.contents {
+		localName, err := names.Add(child.Name())
+		if err != nil {
+			return &safename.Error{Path: m.pathMap[child.Id()], Err: err}
+		}
+		if localName == "" {
+			continue
+		}
+		lp.relPaths[child.Id()] = path.Join(lp.relPaths[folder.Id()], localName)
+		err = lp.addContents(m, child, opts)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Path returns where the entity with the given id goes on disk, or false if it was skipped.
+func (lp *LocalPaths) Path(id uint32) (string, bool) {
+	relPath, ok := lp.relPaths[id]
+	if !ok {
+		return "", false
+	}
+	return filepath.Join(lp.rootPath, filepath.FromSlash(relPath)), true
+}
+
+// StreamLocalPaths decides where the entities of a manifest stream go as they arrive, giving the same paths that SafeLocalPaths gives for the
+// assembled manifest.
+type StreamLocalPaths struct {
+	lp   *LocalPaths
+	opts *safename.Options
+	// The folders the stream is currently inside of, outermost first
+	folders []streamFolderPaths
+}
+
+type streamFolderPaths struct {
+	// Nil if the folder is skipped, along with everything in it
+	names   *safename.Folder
+	relPath string
+}
+
+// NewStreamLocalPaths prepares to place the entities of a stream under rootPath, the local path of the root entity.
+func NewStreamLocalPaths(rootPath string, opts *safename.Options) *StreamLocalPaths {
+	return &StreamLocalPaths{
+		lp: &LocalPaths{
+			rootPath: rootPath,
+			relPaths: make(map[uint32]string),
+		},
+		opts: opts,
+	}
+}
+
+// Add decides where the entity of the next event of the stream goes, returning false if it is skipped. Folders get their path with their start
+// event, since it's needed for their contents, but are only known by id once their end event comes.
+func (sp *StreamLocalPaths) Add(event StreamEvent) (string, bool, error) {
+	relPath, ok := "", true
+	if event.Kind != StreamFolderEnd && len(sp.folders) > 0 {
+		parent := sp.folders[len(sp.folders)-1]
+		if parent.names == nil {
+			ok = false
+		} else {
+			localName, err := parent.names.Add(event.Entity.Name())
+			if err != nil {
+				return "", false, &safename.Error{Path: event.Path, Err: err}
+			}
+			ok = localName != ""
+			relPath = path.Join(parent.relPath, localName)
+		}
+	}
+	switch event.Kind {
+	case StreamFolderStart:
+		folder := streamFolderPaths{relPath: relPath}
+		if ok {
+			folder.names = safename.NewFolder(sp.opts)
+		}
+		sp.folders = append(sp.folders, folder)
+	case StreamFolderEnd:
+		if len(sp.folders) == 0 {
+			return "", false, errors.New("folder end without a matching start")
+		}
+		folder := sp.folders[len(sp.folders)-1]
+		sp.folders = sp.folders[:len(sp.folders)-1]
+		relPath, ok = folder.relPath, folder.names != nil
+	}
+	if !ok {
+		return "", false, nil
+	}
+	if event.Kind != StreamFolderStart {
+		sp.lp.relPaths[event.Entity.Id()] = relPath
+	}
+	return filepath.Join(sp.lp.rootPath, filepath.FromSlash(relPath)), true, nil
+}
+
+// LocalPaths returns the paths of every entity added so far, which once the stream has ended are those of the whole manifest.
+func (sp *StreamLocalPaths) LocalPaths() *LocalPaths {
+	return sp.lp
+}
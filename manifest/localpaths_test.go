@@ -0,0 +1,182 @@
+package manifest
+
+import (
+	"errors"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pavben/Vortex/safename"
+)
+
+// folderManifest builds a manifest whose root folder holds a symlink with each of the given names, bypassing any checks on the names.
+func folderManifest(t *testing.T, names ...string) *Manifest {
+	t.Helper()
+	root := &ManifestFolder{id: 0, name: "root"}
+	for i, name := range names {
+		root.contents = append(root.contents, &ManifestSymlink{id: uint32(i + 1), name: name, target: "target"})
+	}
+	m, err := newManifest(HashSHA256, FixedChunking, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestUnmarshalRejectsInvalidNames(t *testing.T) {
+	for _, name := range []string{"", ".", "..", "a/b", "/etc", "a\\b", "a\x00b"} {
+		_, err := Unmarshal(folderManifest(t, name).Marshal())
+		if err == nil {
+			t.Errorf("Unmarshal accepted the name %q", name)
+		}
+	}
+	_, err := Unmarshal(folderManifest(t, "fine", "...", "a b").Marshal())
+	if err != nil {
+		t.Errorf("Unmarshal rejected valid names: %v", err)
+	}
+}
+
+func TestSafeLocalPaths(t *testing.T) {
+	const rootPath = "/dest/root"
+	tests := []struct {
+		desc  string
+		names []string
+		opts  *safename.Options
+		// Expected local names by entity id, "" for skipped ones. Ignored if err is set.
+		want []string
+		// Whether an error is expected, and the error it must wrap if not nil
+		fails bool
+		err   error
+	}{
+		{desc: "plain names", names: []string{"a", "b.txt"}, want: []string{"a", "b.txt"}},
+		{desc: "invalid name", names: []string{"ok", ".."}, fails: true, err: safename.ErrDotName},
+		{desc: "invalid names skipped", names: []string{"..", "a/b", "ok"}, opts: &safename.Options{SkipInvalid: true}, want: []string{"", "", "ok"}},
+		{desc: "collision", names: []string{"Readme", "README"}, fails: true, err: safename.ErrNameCollision},
+		{desc: "collision renamed", names: []string{"x.txt", "x.txt"}, opts: &safename.Options{Collisions: safename.CollisionRename}, want: []string{"x.txt", "x (1).txt"}},
+		{desc: "collision skipped", names: []string{"x", "x"}, opts: &safename.Options{Collisions: safename.CollisionSkip}, want: []string{"x", ""}},
+	}
+	for _, test := range tests {
+		m := folderManifest(t, test.names...)
+		lp, err := m.SafeLocalPaths(rootPath, test.opts)
+		if test.fails {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.desc)
+			} else if test.err != nil && !errors.Is(err, test.err) {
+				t.Errorf("%s: got %v, expected %v", test.desc, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.desc, err)
+			continue
+		}
+		for i, want := range test.want {
+			localPath, ok := lp.Path(uint32(i + 1))
+			if want == "" {
+				if ok {
+					t.Errorf("%s: entity %d should be skipped but goes to %s", test.desc, i+1, localPath)
+				}
+				continue
+			}
+			if !ok || localPath != filepath.Join(rootPath, want) {
+				t.Errorf("%s: entity %d goes to %q, expected %q", test.desc, i+1, localPath, filepath.Join(rootPath, want))
+			}
+		}
+	}
+}
+
+func TestSafeLocalPathsNested(t *testing.T) {
+	// The same names in different folders don't collide, and a sibling named like a nested path can't reach into another folder
+	root := &ManifestFolder{id: 0, name: "root", contents: []ManifestEntity{
+		&ManifestFolder{id: 1, name: "a", contents: []ManifestEntity{&ManifestSymlink{id: 2, name: "x", target: "t"}}},
+		&ManifestFolder{id: 3, name: "b", contents: []ManifestEntity{&ManifestSymlink{id: 4, name: "x", target: "t"}}},
+		&ManifestSymlink{id: 5, name: "a/x", target: "t"},
+	}}
+	m, err := newManifest(HashSHA256, FixedChunking, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lp, err := m.SafeLocalPaths("/dest", &safename.Options{SkipInvalid: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id, want := range map[uint32]string{1: "a", 2: "a/x", 3: "b", 4: "b/x"} {
+		localPath, ok := lp.Path(id)
+		if !ok || localPath != filepath.Join("/dest", filepath.FromSlash(want)) {
+			t.Errorf("entity %d goes to %q, expected %q", id, localPath, want)
+		}
+	}
+	if localPath, ok := lp.Path(5); ok {
+		t.Errorf("entity named a/x goes to %q", localPath)
+	}
+	for id := uint32(0); id <= 4; id++ {
+		localPath, _ := lp.Path(id)
+		if !strings.HasPrefix(localPath, filepath.Clean("/dest")) {
+			t.Errorf("entity %d escapes the destination: %q", id, localPath)
+		}
+	}
+}
+
+// streamEvents returns the events a manifest stream would carry for entity, whose path is relPath.
+func streamEvents(entity ManifestEntity, relPath string) []StreamEvent {
+	folder, ok := entity.(*ManifestFolder)
+	if !ok {
+		return []StreamEvent{{Kind: StreamEntity, Path: relPath, Entity: entity}}
+	}
+	events := []StreamEvent{{Kind: StreamFolderStart, Path: relPath, Entity: &ManifestFolder{name: folder.name}}}
+	for _, child := range folder.contents {
+		events = append(events, streamEvents(child, path.Join(relPath, child.Name()))...)
+	}
+	return append(events, StreamEvent{Kind: StreamFolderEnd, Path: relPath, Entity: &ManifestFolder{id: folder.id, name: folder.name}})
+}
+
+func TestStreamLocalPathsMatchSafeLocalPaths(t *testing.T) {
+	symlink := func(id uint32, name string) *ManifestSymlink {
+		return &ManifestSymlink{id: id, name: name, target: "t"}
+	}
+	root := &ManifestFolder{id: 11, name: "root", contents: []ManifestEntity{
+		&ManifestFolder{id: 2, name: "a", contents: []ManifestEntity{symlink(0, "x"), symlink(1, "X")}},
+		&ManifestFolder{id: 4, name: "A", contents: []ManifestEntity{symlink(3, "x")}},
+		&ManifestFolder{id: 6, name: "..", contents: []ManifestEntity{symlink(5, "x")}},
+		symlink(7, "a/x"),
+		symlink(8, "café"),
+		symlink(9, "café"),
+		symlink(10, "b"),
+	}}
+	m, err := newManifest(HashSHA256, FixedChunking, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := &safename.Options{SkipInvalid: true, Collisions: safename.CollisionRename}
+	want, err := m.SafeLocalPaths("/dest/root", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sp := NewStreamLocalPaths("/dest/root", opts)
+	for _, event := range streamEvents(root, "") {
+		_, _, err := sp.Add(event)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	got := sp.LocalPaths()
+	for id := uint32(0); id <= 11; id++ {
+		wantPath, wantOk := want.Path(id)
+		gotPath, gotOk := got.Path(id)
+		if gotPath != wantPath || gotOk != wantOk {
+			t.Errorf("entity %d: got %q, %v, expected %q, %v", id, gotPath, gotOk, wantPath, wantOk)
+		}
+	}
+
+	// Without renaming, the first collision fails the stream as it fails SafeLocalPaths
+	sp = NewStreamLocalPaths("/dest/root", &safename.Options{SkipInvalid: true})
+	for _, event := range streamEvents(root, "") {
+		if _, _, err = sp.Add(event); err != nil {
+			break
+		}
+	}
+	if !errors.Is(err, safename.ErrNameCollision) {
+		t.Errorf("colliding names: got %v", err)
+	}
+}
@@ -1,11 +1,11 @@
 package manifest
 
 import (
-	"crypto/sha1"
-	"io"
-	"io/ioutil"
-	"os"
+	"errors"
+	"fmt"
+	"path"
 	"path/filepath"
+	"strings"
 )
 
 type ManifestEntity interface {
@@ -14,15 +14,157 @@ type ManifestEntity interface {
 }
 
 type Manifest struct {
-	rootEntity ManifestEntity
+	hashAlgorithm HashAlgorithm
+	chunking      Chunking
+	rootEntity    ManifestEntity
 	// Generated entityMap (index) keyed by ID
 	entityMap map[uint32]ManifestEntity
+	// Generated slash-separated paths relative to the root entity, keyed by ID
+	pathMap map[uint32]string
+}
+
+// SkipFolder can be returned from a WalkFunc to skip the contents of the folder being visited.
+var SkipFolder = errors.New("skip this folder")
+
+// WalkFunc is called by Walk for each entity. relPath is slash-separated and relative to the root entity, which itself has an empty relPath.
+type WalkFunc func(relPath string, entity ManifestEntity) error
+
+func newManifest(hashAlgorithm HashAlgorithm, chunking Chunking, rootEntity ManifestEntity) (*Manifest, error) {
+	m := &Manifest{
+		hashAlgorithm: hashAlgorithm,
+		chunking:      chunking,
+		rootEntity:    rootEntity,
+		entityMap:     make(map[uint32]ManifestEntity),
+		pathMap:       make(map[uint32]string),
+	}
+	err := m.index(rootEntity, "")
+	if err != nil {
+		return nil, err
+	}
+	err = m.resolveHardLinks()
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// resolveHardLinks gives every hard link the size and hashes of the file it links to.
+func (m *Manifest) resolveHardLinks() error {
+	for _, entity := range m.entityMap {
+		file, ok := entity.(*ManifestFile)
+		if !ok || !file.isHardLink {
+			continue
+		}
+		target, ok := m.entityMap[file.hardLinkOf].(*ManifestFile)
+		if !ok || target.isHardLink {
+			return fmt.Errorf("hard link %d must refer to a regular file, not entity %d", file.id, file.hardLinkOf)
+		}
+		file.fileSize = target.fileSize
+		file.hashes = target.hashes
+		file.chunkLengths = target.chunkLengths
+		file.chunkOffsets = target.chunkOffsets
+	}
+	return nil
+}
+
+func (m *Manifest) index(entity ManifestEntity, relPath string) error {
+	if _, exists := m.entityMap[entity.Id()]; exists {
+		return fmt.Errorf("duplicate entity id %d in manifest", entity.Id())
+	}
+	m.entityMap[entity.Id()] = entity
+	m.pathMap[entity.Id()] = relPath
+	if file, ok := entity.(*ManifestFile); ok {
+		file.hashAlgorithm = m.hashAlgorithm
+		file.computeChunkOffsets()
+	}
+	if folder, ok := entity.(*ManifestFolder); ok {
+		for _, child := range folder.contents {
+			err := m.index(child, path.Join(relPath, child.Name()))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// HashAlgorithm returns the algorithm used for all chunk hashes in this manifest.
+func (m *Manifest) HashAlgorithm() HashAlgorithm {
+	return m.hashAlgorithm
+}
+
+// Chunking returns how the files in this manifest were split into chunks.
+func (m *Manifest) Chunking() Chunking {
+	return m.chunking
+}
+
+// Root returns the root entity, which is a *ManifestFolder when sharing a folder or a *ManifestFile when sharing a single file.
+func (m *Manifest) Root() ManifestEntity {
+	return m.rootEntity
+}
+
+// EntityById returns the entity with the given id.
+func (m *Manifest) EntityById(id uint32) (ManifestEntity, bool) {
+	entity, ok := m.entityMap[id]
+	return entity, ok
+}
+
+// PathOf returns the slash-separated path of the entity with the given id, relative to the root entity.
+func (m *Manifest) PathOf(id uint32) (string, bool) {
+	relPath, ok := m.pathMap[id]
+	return relPath, ok
+}
+
+// EntityByPath returns the entity at the given slash-separated path relative to the root entity. An empty path refers to the root.
+func (m *Manifest) EntityByPath(relPath string) (ManifestEntity, bool) {
+	entity := m.rootEntity
+	if relPath == "" {
+		return entity, true
+	}
+	for _, component := range strings.Split(relPath, "/") {
+		folder, ok := entity.(*ManifestFolder)
+		if !ok {
+			return nil, false
+		}
+		entity = folder.child(component)
+		if entity == nil {
+			return nil, false
+		}
+	}
+	return entity, true
+}
+
+// Walk calls fn for every entity in the manifest in depth-first order, visiting each folder before its contents.
+// If fn returns SkipFolder for a folder, its contents are skipped. Any other error stops the walk and is returned.
+func (m *Manifest) Walk(fn WalkFunc) error {
+	err := walkEntity(m.rootEntity, "", fn)
+	if err == SkipFolder {
+		return nil
+	}
+	return err
+}
+
+func walkEntity(entity ManifestEntity, relPath string, fn WalkFunc) error {
+	err := fn(relPath, entity)
+	if err != nil {
+		return err
+	}
+	if folder, ok := entity.(*ManifestFolder); ok {
+		for _, child := range folder.contents {
+			err := walkEntity(child, path.Join(relPath, child.Name()), fn)
+			if err != nil && err != SkipFolder {
+				return err
+			}
+		}
+	}
+	return nil
 }
 
 type ManifestFolder struct {
 	id       uint32
 	name     string
 	contents []ManifestEntity
+	metadata *Metadata
 }
 
 func (mf *ManifestFolder) Id() uint32 {
@@ -33,11 +175,39 @@ func (mf *ManifestFolder) Name() string {
 	return mf.name
 }
 
+// Metadata returns the folder's attributes, or nil if they weren't captured.
+func (mf *ManifestFolder) Metadata() *Metadata {
+	return mf.metadata
+}
+
+// Children returns the entities directly inside this folder.
+func (mf *ManifestFolder) Children() []ManifestEntity {
+	return mf.contents
+}
+
+func (mf *ManifestFolder) child(name string) ManifestEntity {
+	for _, child := range mf.contents {
+		if child.Name() == name {
+			return child
+		}
+	}
+	return nil
+}
+
 type ManifestFile struct {
 	id       uint32
 	name     string
 	fileSize uint64
 	hashes   [][]byte
+	// Only set for content-defined chunking, where chunk lengths vary. chunkOffsets is derived from chunkLengths.
+	chunkLengths []uint32
+	chunkOffsets []uint64
+	metadata     *Metadata
+	// Copied from the owning Manifest so that chunks can be verified through the file alone
+	hashAlgorithm HashAlgorithm
+	// Hard links share the size and hashes of the file with id hardLinkOf and carry no content of their own
+	isHardLink bool
+	hardLinkOf uint32
 }
 
 func (mf *ManifestFile) Id() uint32 {
@@ -56,88 +226,64 @@ func (mf *ManifestFile) Hashes() [][]byte {
 	return mf.hashes
 }
 
-func GenerateManifestFromPath(p string) (*Manifest, error) {
-	fileInfo, err := os.Stat(p)
-	if err != nil {
-		return nil, err
-	}
-	var nextId uint32 = 0
-	entityMap := make(map[uint32]ManifestEntity)
-	rootEntity, err := generateManifestEntityTree(p, fileInfo, entityMap, &nextId)
-	if err != nil {
-		return nil, err
-	}
-	return &Manifest{
-		rootEntity: rootEntity,
-		entityMap:  entityMap,
-	}, nil
+// Metadata returns the file's attributes, or nil if they weren't captured. Hard links never carry metadata of their own.
+func (mf *ManifestFile) Metadata() *Metadata {
+	return mf.metadata
 }
 
-func generateManifestEntityTree(currentPath string, fileInfo os.FileInfo, entityMap map[uint32]ManifestEntity, nextId *uint32) (ManifestEntity, error) {
-	if fileInfo.IsDir() {
-		var contents []ManifestEntity
-		childrenFileInfos, err := ioutil.ReadDir(currentPath)
-		if err != nil {
-			return nil, err
-		}
-		for _, fileInfo := range childrenFileInfos {
-			childEntity, err := generateManifestEntityTree(filepath.Join(currentPath, fileInfo.Name()), fileInfo, entityMap, nextId)
-			if err != nil {
-				return nil, err
-			}
-			contents = append(contents, childEntity)
-		}
-		return indexAndReturn(entityMap, &ManifestFolder{
-			id:       takeId(nextId),
-			name:     fileInfo.Name(),
-			contents: contents,
-		}), nil
-	} else {
-		fileSize, hashes, err := getFileSizeAndHashes(currentPath)
-		if err != nil {
-			return nil, err
-		}
-		return indexAndReturn(entityMap, &ManifestFile{
-			id:       takeId(nextId),
-			name:     fileInfo.Name(),
-			fileSize: fileSize,
-			hashes:   hashes,
-		}), nil
-	}
+// HardLinkOf returns the id of the file this file is a hard link to.
+// The content only needs to be transferred for that file; this one should then be linked to it.
+func (mf *ManifestFile) HardLinkOf() (uint32, bool) {
+	return mf.hardLinkOf, mf.isHardLink
 }
 
-func getFileSizeAndHashes(filePath string) (uint64, [][]byte, error) {
-	const chunkSize uint32 = 4 * 1024 * 1024 // 4 MB
-	f, err := os.Open(filePath)
-	if err != nil {
-		return 0, nil, err
-	}
-	defer f.Close()
-	var bytesRead uint64 = 0
-	var hashes [][]byte
-	buf := make([]byte, chunkSize)
-	for {
-		n, err := f.Read(buf)
-		if err != nil && err != io.EOF {
-			return 0, nil, err
-		}
-		if n <= 0 {
-			break
-		}
-		bytesRead += uint64(n)
-		hash := sha1.Sum(buf[:n])
-		hashes = append(hashes, hash[:])
-	}
-	return bytesRead, hashes, nil
+// ManifestSymlink is a symbolic link preserved as a link rather than followed.
+type ManifestSymlink struct {
+	id     uint32
+	name   string
+	target string
+}
+
+func (ms *ManifestSymlink) Id() uint32 {
+	return ms.id
+}
+
+func (ms *ManifestSymlink) Name() string {
+	return ms.name
 }
 
-func indexAndReturn(entityMap map[uint32]ManifestEntity, mf ManifestEntity) ManifestEntity {
-	entityMap[mf.Id()] = mf
-	return mf
+// Target returns the link's target exactly as it was read from the sharer's filesystem.
+func (ms *ManifestSymlink) Target() string {
+	return ms.target
 }
 
-func takeId(nextId *uint32) uint32 {
-	id := *nextId
-	*nextId = *nextId + 1
-	return id
+// SymlinkStaysInside reports whether the symlink with the given id points somewhere inside the root folder when the tree is created locally,
+// however the other symlinks in the tree are set up. Targets are only trusted if they're relative and climb with leading ".." components,
+// no higher than the root. Others, such as absolute targets or "a/../..", might reach outside through another symlink.
+func (m *Manifest) SymlinkStaysInside(id uint32) bool {
+	symlink, ok := m.entityMap[id].(*ManifestSymlink)
+	if !ok || symlink == m.rootEntity {
+		return false
+	}
+	target := symlink.target
+	if target == "" || path.IsAbs(target) || filepath.IsAbs(target) || filepath.VolumeName(target) != "" || strings.HasPrefix(target, "\\") {
+		return false
+	}
+	// How many folders the symlink can climb before leaving the root
+	depth := strings.Count(m.pathMap[id], "/")
+	descended := false
+	// Backslashes separate components on Windows, so they're treated as separators everywhere
+	for _, component := range strings.FieldsFunc(target, func(r rune) bool { return r == '/' || r == '\\' }) {
+		switch component {
+		case ".":
+		case "..":
+			if descended || depth == 0 {
+				return false
+			}
+			depth--
+		default:
+			descended = true
+		}
+	}
+	return true
 }
@@ -0,0 +1,185 @@
+package manifest
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// traversalManifest returns a manifest of root/{a/{x, y}, b}.
+func traversalManifest(t *testing.T) *Manifest {
+	t.Helper()
+	file := func(id uint32, name string) *ManifestFile {
+		return &ManifestFile{id: id, name: name, fileSize: 1, hashes: [][]byte{HashSHA256.Sum([]byte(name))}}
+	}
+	a := &ManifestFolder{id: 1, name: "a", contents: []ManifestEntity{file(2, "x"), file(3, "y")}}
+	root := &ManifestFolder{id: 0, name: "root", contents: []ManifestEntity{a, file(4, "b")}}
+	m, err := newManifest(HashSHA256, FixedChunking, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// walkPaths returns the paths Walk visits while fn returns nil, SkipFolder or another error for each.
+func walkPaths(m *Manifest, fn func(relPath string) error) ([]string, error) {
+	var paths []string
+	err := m.Walk(func(relPath string, entity ManifestEntity) error {
+		paths = append(paths, relPath)
+		return fn(relPath)
+	})
+	return paths, err
+}
+
+func TestWalk(t *testing.T) {
+	errStop := errors.New("stop")
+	tests := []struct {
+		name  string
+		fn    func(relPath string) error
+		paths []string
+		err   error
+	}{
+		{"everything", func(string) error { return nil }, []string{"", "a", "a/x", "a/y", "b"}, nil},
+		{"skip a", func(relPath string) error {
+			if relPath == "a" {
+				return SkipFolder
+			}
+			return nil
+		}, []string{"", "a", "b"}, nil},
+		{"skip the root", func(string) error { return SkipFolder }, []string{""}, nil},
+		{"skip a file", func(relPath string) error {
+			if relPath == "a/x" {
+				return SkipFolder
+			}
+			return nil
+		}, []string{"", "a", "a/x", "a/y", "b"}, nil},
+		{"stop at a/x", func(relPath string) error {
+			if relPath == "a/x" {
+				return errStop
+			}
+			return nil
+		}, []string{"", "a", "a/x"}, errStop},
+	}
+	m := traversalManifest(t)
+	for _, test := range tests {
+		paths, err := walkPaths(m, test.fn)
+		if err != test.err || strings.Join(paths, ",") != strings.Join(test.paths, ",") {
+			t.Errorf("%s: visited %q with %v, expected %q with %v", test.name, paths, err, test.paths, test.err)
+		}
+	}
+}
+
+func TestLookups(t *testing.T) {
+	m := traversalManifest(t)
+	tests := []struct {
+		relPath string
+		id      uint32
+		ok      bool
+	}{
+		{"", 0, true},
+		{"a", 1, true},
+		{"a/x", 2, true},
+		{"a/y", 3, true},
+		{"b", 4, true},
+		{"a/z", 0, false},
+		{"b/x", 0, false},
+		{"a/x/y", 0, false},
+		{"x", 0, false},
+	}
+	for _, test := range tests {
+		entity, ok := m.EntityByPath(test.relPath)
+		if ok != test.ok || (ok && entity.Id() != test.id) {
+			t.Errorf("EntityByPath(%q): got %v, %v, expected id %d, %v", test.relPath, entity, ok, test.id, test.ok)
+		}
+		if !test.ok {
+			continue
+		}
+		if relPath, ok := m.PathOf(test.id); !ok || relPath != test.relPath {
+			t.Errorf("PathOf(%d): got %q, %v, expected %q", test.id, relPath, ok, test.relPath)
+		}
+		if byId, ok := m.EntityById(test.id); !ok || byId != entity {
+			t.Errorf("EntityById(%d) differs from EntityByPath(%q)", test.id, test.relPath)
+		}
+	}
+	if _, ok := m.PathOf(5); ok {
+		t.Error("PathOf found an id that isn't in the manifest")
+	}
+	a, _ := m.EntityByPath("a")
+	var names []string
+	for _, child := range a.(*ManifestFolder).Children() {
+		names = append(names, child.Name())
+	}
+	if strings.Join(names, ",") != "x,y" {
+		t.Errorf("children of a: got %q", names)
+	}
+}
+
+func TestSingleFileRoot(t *testing.T) {
+	file := &ManifestFile{id: 0, name: "file", fileSize: 1, hashes: [][]byte{HashSHA256.Sum([]byte("f"))}}
+	m, err := newManifest(HashSHA256, FixedChunking, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths, err := walkPaths(m, func(string) error { return nil })
+	if err != nil || len(paths) != 1 || paths[0] != "" {
+		t.Errorf("visited %q with %v, expected only the root", paths, err)
+	}
+	if entity, ok := m.EntityByPath(""); !ok || entity != m.Root() || m.Root() != ManifestEntity(file) {
+		t.Error("the root isn't the file")
+	}
+	if _, ok := m.EntityByPath("file"); ok {
+		t.Error("found the root file under its own name")
+	}
+	if relPath, ok := m.PathOf(0); !ok || relPath != "" {
+		t.Errorf("PathOf the root file: got %q, %v", relPath, ok)
+	}
+}
+
+func TestSymlinkStaysInside(t *testing.T) {
+	tests := []struct {
+		target string
+		// At the root, and in root/a/b
+		atRoot, nested bool
+	}{
+		{"x", true, true},
+		{"./x/y", true, true},
+		{"..", false, true},
+		{"../..", false, true},
+		{"../../..", false, false},
+		{"../../x/y", false, true},
+		{"x/../..", false, false},
+		{"x/..", false, false},
+		{"/etc/passwd", false, false},
+		{"\\etc", false, false},
+		{"..\\..\\..", false, false},
+		{"..\\x", false, true},
+		{"", false, false},
+	}
+	for _, test := range tests {
+		rootLink := &ManifestSymlink{id: 3, name: "link", target: test.target}
+		nestedLink := &ManifestSymlink{id: 4, name: "link", target: test.target}
+		root := &ManifestFolder{id: 0, name: "root", contents: []ManifestEntity{
+			&ManifestFolder{id: 1, name: "a", contents: []ManifestEntity{
+				&ManifestFolder{id: 2, name: "b", contents: []ManifestEntity{nestedLink}},
+			}},
+			rootLink,
+		}}
+		m, err := newManifest(HashSHA256, FixedChunking, root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := m.SymlinkStaysInside(rootLink.id); got != test.atRoot {
+			t.Errorf("%q at the root: got %v, expected %v", test.target, got, test.atRoot)
+		}
+		if got := m.SymlinkStaysInside(nestedLink.id); got != test.nested {
+			t.Errorf("%q in a/b: got %v, expected %v", test.target, got, test.nested)
+		}
+	}
+	m, err := newManifest(HashSHA256, FixedChunking, &ManifestSymlink{id: 0, name: "link", target: "x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.SymlinkStaysInside(0) {
+		t.Error("a symlink shared as the root entity points outside the download")
+	}
+}
@@ -0,0 +1,198 @@
+package manifest
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// Merkle trees here follow RFC 6962 in spirit: leaf and interior nodes are hashed with distinct prefixes so that one can't be passed off as the other.
+// A level with an odd number of nodes promotes its last node unchanged to the next level.
+// The leaf values of a file's tree are its chunk hashes. The leaf values of a manifest's tree are the entity hashes (see EntityHash) in Walk order.
+
+const (
+	merkleLeafPrefix     byte = 0
+	merkleInteriorPrefix byte = 1
+)
+
+// MerkleProof proves that a leaf value is part of a Merkle tree with a given root.
+type MerkleProof struct {
+	Index     int
+	NumLeaves int
+	// Siblings from the bottom of the tree to the top, skipping levels where the node was promoted without a sibling
+	Siblings [][]byte
+}
+
+func merkleLeafNode(alg HashAlgorithm, value []byte) []byte {
+	return alg.Sum(append([]byte{merkleLeafPrefix}, value...))
+}
+
+func merkleInteriorNode(alg HashAlgorithm, left, right []byte) []byte {
+	data := make([]byte, 0, 1+len(left)+len(right))
+	data = append(data, merkleInteriorPrefix)
+	data = append(data, left...)
+	data = append(data, right...)
+	return alg.Sum(data)
+}
+
+// merkleLevels returns every level of the tree built over values, starting with the leaf nodes and ending with the single root node.
+func merkleLevels(alg HashAlgorithm, values [][]byte) [][][]byte {
+	level := make([][]byte, len(values))
+	for i, value := range values {
+		level[i] = merkleLeafNode(alg, value)
+	}
+	levels := [][][]byte{level}
+	for len(level) > 1 {
+		next := make([][]byte, 0, (len(level)+1)/2)
+		for i := 0; i+1 < len(level); i += 2 {
+			next = append(next, merkleInteriorNode(alg, level[i], level[i+1]))
+		}
+		if len(level)%2 == 1 {
+			next = append(next, level[len(level)-1])
+		}
+		levels = append(levels, next)
+		level = next
+	}
+	return levels
+}
+
+// merkleRoot returns the root of the tree built over values. The root of an empty tree is the hash of no data.
+func merkleRoot(alg HashAlgorithm, values [][]byte) []byte {
+	if len(values) == 0 {
+		return alg.Sum(nil)
+	}
+	levels := merkleLevels(alg, values)
+	return levels[len(levels)-1][0]
+}
+
+func merkleProof(alg HashAlgorithm, values [][]byte, index int) (*MerkleProof, error) {
+	if index < 0 || index >= len(values) {
+		return nil, fmt.Errorf("merkle leaf index %d out of range [0, %d)", index, len(values))
+	}
+	proof := &MerkleProof{
+		Index:     index,
+		NumLeaves: len(values),
+	}
+	levels := merkleLevels(alg, values)
+	for _, level := range levels[:len(levels)-1] {
+		siblingIndex := index ^ 1
+		if siblingIndex < len(level) {
+			proof.Siblings = append(proof.Siblings, level[siblingIndex])
+		}
+		index /= 2
+	}
+	return proof, nil
+}
+
+// VerifyMerkleProof checks that value is the leaf value at proof.Index of the tree with the given root.
+func VerifyMerkleProof(alg HashAlgorithm, root, value []byte, proof *MerkleProof) bool {
+	if proof == nil || proof.Index < 0 || proof.Index >= proof.NumLeaves {
+		return false
+	}
+	node := merkleLeafNode(alg, value)
+	index, levelSize := proof.Index, proof.NumLeaves
+	siblings := proof.Siblings
+	for levelSize > 1 {
+		siblingIndex := index ^ 1
+		if siblingIndex < levelSize {
+			if len(siblings) == 0 {
+				return false
+			}
+			if index%2 == 0 {
+				node = merkleInteriorNode(alg, node, siblings[0])
+			} else {
+				node = merkleInteriorNode(alg, siblings[0], node)
+			}
+			siblings = siblings[1:]
+		}
+		index /= 2
+		levelSize = (levelSize + 1) / 2
+	}
+	return len(siblings) == 0 && bytes.Equal(node, root)
+}
+
+// MerkleRoot returns the root of the Merkle tree over this file's chunk hashes.
+func (mf *ManifestFile) MerkleRoot() []byte {
+	return merkleRoot(mf.hashAlgorithm, mf.hashes)
+}
+
+// ChunkProof returns the proof that the chunk at the given index belongs to this file's Merkle root.
+func (mf *ManifestFile) ChunkProof(index int) (*MerkleProof, error) {
+	if index < 0 || index >= len(mf.hashes) {
+		return nil, ErrChunkIndexOutOfRange
+	}
+	return merkleProof(mf.hashAlgorithm, mf.hashes, index)
+}
+
+// EntityHash returns the leaf value of the entity with the given id in the manifest's Merkle tree.
+// It covers the entity's kind, id and path, for files also the size and the file's Merkle root, for hard links the id of the linked file
+// and for symlinks the target.
+func (m *Manifest) EntityHash(id uint32) ([]byte, bool) {
+	entity, ok := m.entityMap[id]
+	if !ok {
+		return nil, false
+	}
+	return m.entityHash(m.pathMap[id], entity), true
+}
+
+func (m *Manifest) entityHash(relPath string, entity ManifestEntity) []byte {
+	enc := &encoder{}
+	switch e := entity.(type) {
+	case *ManifestFolder:
+		enc.buf.WriteByte(entityKindFolder)
+		enc.writeUvarint(uint64(e.id))
+		enc.writeBytes([]byte(relPath))
+	case *ManifestFile:
+		if e.isHardLink {
+			enc.buf.WriteByte(entityKindHardLink)
+			enc.writeUvarint(uint64(e.id))
+			enc.writeBytes([]byte(relPath))
+			enc.writeUvarint(uint64(e.hardLinkOf))
+			break
+		}
+		enc.buf.WriteByte(entityKindFile)
+		enc.writeUvarint(uint64(e.id))
+		enc.writeBytes([]byte(relPath))
+		enc.writeUvarint(e.fileSize)
+		enc.writeBytes(e.MerkleRoot())
+	case *ManifestSymlink:
+		enc.buf.WriteByte(entityKindSymlink)
+		enc.writeUvarint(uint64(e.id))
+		enc.writeBytes([]byte(relPath))
+		enc.writeBytes([]byte(e.target))
+	default:
+		panic(fmt.Sprintf("entityHash: unexpected entity type %T", entity))
+	}
+	return m.hashAlgorithm.Sum(enc.buf.Bytes())
+}
+
+// entityHashes returns the leaf values of the manifest's Merkle tree along with the leaf index of each entity id.
+func (m *Manifest) entityHashes() ([][]byte, map[uint32]int) {
+	var values [][]byte
+	leafIndexes := make(map[uint32]int, len(m.entityMap))
+	m.Walk(func(relPath string, entity ManifestEntity) error {
+		leafIndexes[entity.Id()] = len(values)
+		values = append(values, m.entityHash(relPath, entity))
+		return nil
+	})
+	return values, leafIndexes
+}
+
+// MerkleRoot returns the root of the Merkle tree over all entities in the manifest.
+// Two manifests with the same root have the same entities, with the same ids, paths, kinds, sizes and content (see EntityHash), so it can be
+// used to compare manifests cheaply. Metadata and the name of the root entity aren't covered, and neither are the hash algorithm and chunking
+// beyond what they do to the chunk hashes. It is recomputed on every call.
+func (m *Manifest) MerkleRoot() []byte {
+	values, _ := m.entityHashes()
+	return merkleRoot(m.hashAlgorithm, values)
+}
+
+// EntityProof returns the proof that the entity with the given id belongs to the manifest's tree.
+// Verify it with VerifyMerkleProof, passing MerkleRoot as the root and EntityHash as the value.
+func (m *Manifest) EntityProof(id uint32) (*MerkleProof, error) {
+	values, leafIndexes := m.entityHashes()
+	index, ok := leafIndexes[id]
+	if !ok {
+		return nil, fmt.Errorf("no entity with id %d", id)
+	}
+	return merkleProof(m.hashAlgorithm, values, index)
+}
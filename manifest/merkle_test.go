@@ -0,0 +1,124 @@
+package manifest
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func merkleTestValues(n int) [][]byte {
+	values := make([][]byte, n)
+	for i := range values {
+		values[i] = HashSHA256.Sum([]byte(fmt.Sprint(i)))
+	}
+	return values
+}
+
+func TestMerkleRootShape(t *testing.T) {
+	alg := HashSHA256
+	leaf := func(values [][]byte, i int) []byte { return merkleLeafNode(alg, values[i]) }
+	node := func(left, right []byte) []byte { return merkleInteriorNode(alg, left, right) }
+	v := merkleTestValues(5)
+	tests := []struct {
+		name string
+		n    int
+		root []byte
+	}{
+		{"empty", 0, alg.Sum(nil)},
+		{"single chunk", 1, leaf(v, 0)},
+		{"two", 2, node(leaf(v, 0), leaf(v, 1))},
+		// The last node of an odd level is promoted as it is
+		{"three", 3, node(node(leaf(v, 0), leaf(v, 1)), leaf(v, 2))},
+		{"five", 5, node(node(node(leaf(v, 0), leaf(v, 1)), node(leaf(v, 2), leaf(v, 3))), leaf(v, 4))},
+	}
+	for _, test := range tests {
+		if root := merkleRoot(alg, v[:test.n]); !bytes.Equal(root, test.root) {
+			t.Errorf("%s: got root %x, expected %x", test.name, root, test.root)
+		}
+	}
+}
+
+func TestMerkleProofs(t *testing.T) {
+	alg := HashBLAKE3
+	for n := 1; n <= 9; n++ {
+		values := merkleTestValues(n)
+		root := merkleRoot(alg, values)
+		for i := range values {
+			proof, err := merkleProof(alg, values, i)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !VerifyMerkleProof(alg, root, values[i], proof) {
+				t.Errorf("%d leaves: the proof of leaf %d doesn't verify", n, i)
+			}
+			if VerifyMerkleProof(alg, root, values[(i+1)%n], proof) && n > 1 {
+				t.Errorf("%d leaves: the proof of leaf %d verifies another value", n, i)
+			}
+			for j := range proof.Siblings {
+				tampered := *proof
+				tampered.Siblings = append([][]byte(nil), proof.Siblings...)
+				tampered.Siblings[j] = append([]byte(nil), proof.Siblings[j]...)
+				tampered.Siblings[j][0] ^= 1
+				if VerifyMerkleProof(alg, root, values[i], &tampered) {
+					t.Errorf("%d leaves: the proof of leaf %d verifies with sibling %d tampered with", n, i, j)
+				}
+			}
+			if len(proof.Siblings) > 0 {
+				short := *proof
+				short.Siblings = proof.Siblings[:len(proof.Siblings)-1]
+				if VerifyMerkleProof(alg, root, values[i], &short) {
+					t.Errorf("%d leaves: the proof of leaf %d verifies without its last sibling", n, i)
+				}
+			}
+			moved := *proof
+			moved.Index = (i + 1) % n
+			if n > 1 && VerifyMerkleProof(alg, root, values[i], &moved) {
+				t.Errorf("%d leaves: the proof of leaf %d verifies at index %d", n, i, moved.Index)
+			}
+		}
+		if _, err := merkleProof(alg, values, n); err == nil {
+			t.Errorf("%d leaves: made a proof for leaf %d", n, n)
+		}
+	}
+}
+
+func TestManifestMerkleProofs(t *testing.T) {
+	m, err := newManifest(HashSHA256, FixedChunking, testTree(HashSHA256, FixedChunking))
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := m.MerkleRoot()
+	m.Walk(func(relPath string, entity ManifestEntity) error {
+		proof, err := m.EntityProof(entity.Id())
+		if err != nil {
+			t.Fatalf("%s: %v", relPath, err)
+		}
+		value, _ := m.EntityHash(entity.Id())
+		if !VerifyMerkleProof(m.HashAlgorithm(), root, value, proof) {
+			t.Errorf("%s: the entity proof doesn't verify", relPath)
+		}
+		if file, ok := entity.(*ManifestFile); ok {
+			for _, chunk := range file.Chunks() {
+				proof, err := file.ChunkProof(chunk.Index)
+				if err != nil || !VerifyMerkleProof(m.HashAlgorithm(), file.MerkleRoot(), chunk.Hash, proof) {
+					t.Errorf("%s: the proof of chunk %d doesn't verify: %v", relPath, chunk.Index, err)
+				}
+			}
+		}
+		return nil
+	})
+	if _, err := m.EntityProof(100); err == nil {
+		t.Error("made a proof for an entity that isn't in the manifest")
+	}
+
+	// Any change to an entity changes the root
+	changed, err := newManifest(HashSHA256, FixedChunking, testTree(HashSHA256, FixedChunking))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := changed.EntityByPath("b")
+	b.(*ManifestFile).hashes[0] = HashSHA256.Sum([]byte("changed"))
+	if bytes.Equal(changed.MerkleRoot(), root) {
+		t.Error("changing a file's content didn't change the root")
+	}
+}
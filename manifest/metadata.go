@@ -0,0 +1,64 @@
+package manifest
+
+import (
+	"os"
+	"strings"
+	"time"
+)
+
+// Only extended attributes in this namespace are captured or applied. The others (security, system, trusted) are host-specific or need
+// privileges to set, and letting a sharer set them, such as security.capability, would be unsafe.
+const xattrNamespace = "user."
+
+// Metadata holds the file system attributes of a file or folder captured at generation time.
+// It is not covered by Merkle roots, so touching a file doesn't make manifests compare unequal.
+type Metadata struct {
+	// Mode holds the permission bits only
+	Mode    os.FileMode
+	ModTime time.Time
+	// Xattrs holds extended attributes by name. It is only captured on platforms that support them.
+	Xattrs map[string][]byte
+}
+
+func metadataFromFileInfo(src source, filePath string, fileInfo os.FileInfo) (*Metadata, error) {
+	xattrs, err := src.readXattrs(filePath)
+	if err != nil {
+		return nil, err
+	}
+	return &Metadata{
+		Mode:    fileInfo.Mode().Perm(),
+		ModTime: fileInfo.ModTime(),
+		Xattrs:  xattrs,
+	}, nil
+}
+
+// ApplyMetadata applies the metadata of entity, if it has any, to the file or folder at localPath. Extended attributes outside the user
+// namespace are ignored.
+// Since writing into a folder updates its modification time, folders should only be handled after everything inside them is in place.
+func ApplyMetadata(localPath string, entity ManifestEntity) error {
+	var metadata *Metadata
+	switch e := entity.(type) {
+	case *ManifestFile:
+		metadata = e.metadata
+	case *ManifestFolder:
+		metadata = e.metadata
+	}
+	if metadata == nil {
+		return nil
+	}
+	for name, value := range metadata.Xattrs {
+		// Manifests can come from anyone, so the namespace is checked again rather than trusting the sharer to have captured only these
+		if !strings.HasPrefix(name, xattrNamespace) {
+			continue
+		}
+		err := writeXattr(localPath, name, value)
+		if err != nil {
+			return err
+		}
+	}
+	err := os.Chmod(localPath, metadata.Mode)
+	if err != nil {
+		return err
+	}
+	return os.Chtimes(localPath, metadata.ModTime, metadata.ModTime)
+}
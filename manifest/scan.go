@@ -0,0 +1,301 @@
+package manifest
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+
+	"github.com/pavben/Vortex/ignore"
+)
+
+// IgnoreFileName is the name of the per-folder file listing gitignore-style patterns to leave out of the manifest.
+const IgnoreFileName = ".vortexignore"
+
+// hardLinkKey identifies a file's content on disk independently of its path.
+type hardLinkKey struct {
+	device uint64
+	inode  uint64
+}
+
+// treeScanner builds the entity tree for manifest generation, leaving file contents to be hashed afterwards.
+type treeScanner struct {
+	src  source
+	opts *GenerateOptions
+	// In streaming mode, entities are handed to stream as they are scanned instead of being collected into folders and pending
+	stream  *streamEmitter
+	nextId  uint32
+	pending []pendingFile
+	// Patterns given in GenerateOptions, which take precedence over fileRules
+	optionRules *ignore.Matcher
+	// Patterns collected from ignore files in the folders scanned so far
+	fileRules *ignore.Matcher
+	// Id of the first file seen for each multiply-linked inode
+	hardLinks map[hardLinkKey]uint32
+	// Only used with SymlinksFollowWithinRoot: the fully resolved root path and the resolved paths of the folders currently being scanned
+	realRootPath   string
+	activeRealDirs map[string]bool
+}
+
+func newTreeScanner(src source, rootPath string, opts *GenerateOptions) (*treeScanner, error) {
+	ts := &treeScanner{
+		src:            src,
+		opts:           opts,
+		optionRules:    ignore.NewMatcher(),
+		fileRules:      ignore.NewMatcher(),
+		hardLinks:      make(map[hardLinkKey]uint32),
+		activeRealDirs: make(map[string]bool),
+	}
+	if opts != nil {
+		for _, line := range opts.Exclude {
+			ts.optionRules.AddPattern("", line)
+		}
+		for _, line := range opts.Include {
+			ts.optionRules.AddPattern("", "!"+line)
+		}
+		if opts.UseGitignore {
+			ts.optionRules.AddPattern("", ".git/")
+		}
+	}
+	if ts.symlinkPolicy() == SymlinksFollowWithinRoot {
+		var err error
+		ts.realRootPath, err = src.evalSymlinks(rootPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ts, nil
+}
+
+func (ts *treeScanner) useGitignore() bool {
+	return ts.opts != nil && ts.opts.UseGitignore
+}
+
+func (ts *treeScanner) symlinkPolicy() SymlinkPolicy {
+	if ts.opts == nil {
+		return SymlinksFollowWithinRoot
+	}
+	return ts.opts.SymlinkPolicy
+}
+
+func (ts *treeScanner) captureMetadata(currentPath string, fileInfo os.FileInfo) (*Metadata, error) {
+	if ts.opts != nil && ts.opts.SkipMetadata {
+		return nil, nil
+	}
+	return metadataFromFileInfo(ts.src, currentPath, fileInfo)
+}
+
+func (ts *treeScanner) warn(relPath string, err error) {
+	if ts.opts != nil && ts.opts.Warn != nil {
+		ts.opts.Warn(relPath, err)
+	}
+}
+
+// ignored reports whether the entity at relPath should be left out. The root is never ignored.
+func (ts *treeScanner) ignored(relPath string, isDir bool) bool {
+	if relPath == "" {
+		return false
+	}
+	result := ts.optionRules.Match(relPath, isDir)
+	if result == ignore.NoMatch {
+		result = ts.fileRules.Match(relPath, isDir)
+	}
+	return result == ignore.Ignored
+}
+
+// scansAsFolder reports whether the entity at currentPath, whose Lstat info is fileInfo, becomes a folder, which is what patterns ending
+// with a slash match. Followed symlinks become whatever they point to, while preserved ones are never folders, just like in git.
+func (ts *treeScanner) scansAsFolder(currentPath string, fileInfo os.FileInfo) bool {
+	if fileInfo.Mode()&os.ModeSymlink == 0 || ts.symlinkPolicy() != SymlinksFollowWithinRoot {
+		return fileInfo.IsDir()
+	}
+	// A broken link is skipped with a warning by scanSymlink
+	targetInfo, err := ts.src.stat(currentPath)
+	return err == nil && targetInfo.IsDir()
+}
+
+// scan returns the entity for currentPath, whose slash-separated path relative to the root is relPath, or nil if it is skipped.
+// fileInfo must come from Lstat, except for the root.
+// Ids are assigned in post-order, so every folder's id is greater than the ids of its contents.
+func (ts *treeScanner) scan(currentPath, relPath string, fileInfo os.FileInfo) (ManifestEntity, error) {
+	switch {
+	case fileInfo.Mode()&os.ModeSymlink != 0:
+		return ts.scanSymlink(currentPath, relPath, fileInfo)
+	case fileInfo.IsDir():
+		return ts.scanFolder(currentPath, relPath, fileInfo)
+	case fileInfo.Mode().IsRegular():
+		return ts.scanFile(currentPath, relPath, fileInfo)
+	default:
+		ts.warn(relPath, fmt.Errorf("special file of type %v", fileInfo.Mode().Type()))
+		return nil, nil
+	}
+}
+
+func (ts *treeScanner) scanFolder(currentPath, relPath string, fileInfo os.FileInfo) (ManifestEntity, error) {
+	if ts.symlinkPolicy() == SymlinksFollowWithinRoot {
+		realPath, err := ts.src.evalSymlinks(currentPath)
+		if err != nil {
+			return nil, err
+		}
+		if ts.activeRealDirs[realPath] {
+			ts.warn(relPath, fmt.Errorf("symlink loop back to %s", realPath))
+			return nil, nil
+		}
+		ts.activeRealDirs[realPath] = true
+		defer delete(ts.activeRealDirs, realPath)
+	}
+	if ts.useGitignore() {
+		err := ts.addIgnoreFile(relPath, ts.src.join(currentPath, ".gitignore"))
+		if err != nil {
+			return nil, err
+		}
+	}
+	err := ts.addIgnoreFile(relPath, ts.src.join(currentPath, IgnoreFileName))
+	if err != nil {
+		return nil, err
+	}
+	if ts.stream != nil {
+		err := ts.stream.enqueue(StreamEvent{
+			Kind:   StreamFolderStart,
+			Path:   relPath,
+			Entity: &ManifestFolder{name: fileInfo.Name()},
+		}, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var contents []ManifestEntity
+	childrenFileInfos, err := ts.src.readDir(currentPath)
+	if err != nil {
+		return nil, err
+	}
+	for _, fileInfo := range childrenFileInfos {
+		childPath := ts.src.join(currentPath, fileInfo.Name())
+		childRelPath := path.Join(relPath, fileInfo.Name())
+		if ts.ignored(childRelPath, ts.scansAsFolder(childPath, fileInfo)) {
+			continue
+		}
+		childEntity, err := ts.scan(childPath, childRelPath, fileInfo)
+		if err != nil {
+			return nil, err
+		}
+		if childEntity != nil && ts.stream == nil {
+			contents = append(contents, childEntity)
+		}
+	}
+	metadata, err := ts.captureMetadata(currentPath, fileInfo)
+	if err != nil {
+		return nil, err
+	}
+	return ts.emit(relPath, &ManifestFolder{
+		id:       takeId(&ts.nextId),
+		name:     fileInfo.Name(),
+		contents: contents,
+		metadata: metadata,
+	}, nil)
+}
+
+func (ts *treeScanner) scanFile(currentPath, relPath string, fileInfo os.FileInfo) (ManifestEntity, error) {
+	key, multiplyLinked := hardLinkKeyOf(fileInfo)
+	if multiplyLinked {
+		if primaryId, seen := ts.hardLinks[key]; seen {
+			return ts.emit(relPath, &ManifestFile{
+				id:         takeId(&ts.nextId),
+				name:       fileInfo.Name(),
+				isHardLink: true,
+				hardLinkOf: primaryId,
+			}, nil)
+		}
+	}
+	metadata, err := ts.captureMetadata(currentPath, fileInfo)
+	if err != nil {
+		return nil, err
+	}
+	file := &ManifestFile{
+		id:       takeId(&ts.nextId),
+		name:     fileInfo.Name(),
+		metadata: metadata,
+	}
+	if multiplyLinked {
+		ts.hardLinks[key] = file.id
+	}
+	return ts.emit(relPath, file, &pendingFile{
+		file:     file,
+		filePath: currentPath,
+		statSize: uint64(fileInfo.Size()),
+		modTime:  fileInfo.ModTime(),
+		inode:    inodeOf(fileInfo),
+	})
+}
+
+func (ts *treeScanner) scanSymlink(currentPath, relPath string, fileInfo os.FileInfo) (ManifestEntity, error) {
+	switch ts.symlinkPolicy() {
+	case SymlinksSkip:
+		return nil, nil
+	case SymlinksPreserve:
+		target, err := ts.src.readLink(currentPath)
+		if err != nil {
+			ts.warn(relPath, err)
+			return nil, nil
+		}
+		return ts.emit(relPath, &ManifestSymlink{
+			id:     takeId(&ts.nextId),
+			name:   fileInfo.Name(),
+			target: target,
+		}, nil)
+	case SymlinksFollowWithinRoot:
+		realPath, err := ts.src.evalSymlinks(currentPath)
+		if err != nil {
+			ts.warn(relPath, fmt.Errorf("unresolvable symlink: %v", err))
+			return nil, nil
+		}
+		if !ts.src.within(ts.realRootPath, realPath) {
+			ts.warn(relPath, fmt.Errorf("symlink leads outside the shared folder to %s", realPath))
+			return nil, nil
+		}
+		targetInfo, err := ts.src.stat(currentPath)
+		if err != nil {
+			return nil, err
+		}
+		return ts.scan(currentPath, relPath, targetInfo)
+	default:
+		return nil, fmt.Errorf("unknown symlink policy %d", ts.symlinkPolicy())
+	}
+}
+
+// emit records a newly scanned entity, along with the file to hash for it if there is one, and returns the entity.
+func (ts *treeScanner) emit(relPath string, entity ManifestEntity, pf *pendingFile) (ManifestEntity, error) {
+	if ts.stream == nil {
+		if pf != nil {
+			ts.pending = append(ts.pending, *pf)
+		}
+		return entity, nil
+	}
+	kind := StreamEntity
+	if _, ok := entity.(*ManifestFolder); ok {
+		kind = StreamFolderEnd
+	}
+	err := ts.stream.enqueue(StreamEvent{
+		Kind:   kind,
+		Path:   relPath,
+		Entity: entity,
+	}, pf)
+	if err != nil {
+		return nil, err
+	}
+	return entity, nil
+}
+
+// addIgnoreFile adds the patterns from the ignore file at filePath, if there is one.
+func (ts *treeScanner) addIgnoreFile(relPath, filePath string) error {
+	f, err := ts.src.open(filePath)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+	return ts.fileRules.AddReader(relPath, f)
+}
@@ -0,0 +1,53 @@
+package manifest
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFolderPatternsMatchFollowedSymlinks(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "scan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	root := filepath.Join(tempDir, "share")
+	err = os.MkdirAll(filepath.Join(root, "real", "build"), 0755)
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(root, "real", "build", "out"), []byte("x"), 0644)
+	}
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(root, "file"), []byte("x"), 0644)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	for link, target := range map[string]string{"linkdir": "real/build", "linkfile": "file"} {
+		if err := os.Symlink(target, filepath.Join(root, link)); err != nil {
+			t.Skip("can't create symlinks:", err)
+		}
+	}
+	opts := &GenerateOptions{Exclude: []string{"build/", "linkdir/", "linkfile/"}, Warn: func(relPath string, err error) { t.Log(relPath, err) }}
+	m, err := GenerateManifest(context.Background(), root, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for relPath, want := range map[string]bool{"real/build": false, "linkdir": false, "linkfile": true, "file": true} {
+		if _, ok := m.EntityByPath(relPath); ok != want {
+			t.Errorf("%s in the manifest: %v, expected %v", relPath, ok, want)
+		}
+	}
+
+	// Preserved symlinks aren't folders, so folder patterns don't match them
+	opts.SymlinkPolicy = SymlinksPreserve
+	m, err = GenerateManifest(context.Background(), root, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := m.EntityByPath("linkdir"); !ok {
+		t.Error("linkdir/ matched a preserved symlink")
+	}
+}
@@ -0,0 +1,122 @@
+package manifest
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/pavben/Vortex/pubkeycrypto"
+)
+
+// Signed manifest layout:
+//
+//	magic "VXSM" | version (1 byte) | signer public key | encoded manifest | signature
+//
+// The last three are length-prefixed with unsigned varints. The public key is in X509 PKIX format, as produced by PublicKey.ToBytes.
+// The signature is made with PrivateKey.Sign over the magic and version followed by the encoded manifest, so that it can't be mistaken
+// for a signature over anything else.
+
+const (
+	signedEncodingMagic   = "VXSM"
+	signedEncodingVersion = 1
+)
+
+// Errors
+var (
+	ErrBadSignedManifestMagic  = errors.New("Data does not start with the signed manifest magic")
+	ErrUnsupportedSignedFormat = errors.New("Unsupported signed manifest version")
+	ErrUnexpectedSigner        = errors.New("Manifest was signed by a different key than expected")
+	ErrBadManifestSignature    = errors.New("Manifest signature is invalid")
+)
+
+// Sign encodes the manifest and signs it with the sharer's private key. The result can be saved and verified again later with OpenSigned,
+// with no connection to the sharer needed.
+func (m *Manifest) Sign(privateKey *pubkeycrypto.PrivateKey) ([]byte, error) {
+	manifestBytes := m.Marshal()
+	signature, err := privateKey.Sign(signedMessage(manifestBytes))
+	if err != nil {
+		return nil, err
+	}
+	return signedEncoding(privateKey.GetPublicKey(), manifestBytes, signature), nil
+}
+
+// Signature signs the manifest as Sign does but returns only the signature, for sending along with a manifest the receiver already has,
+// such as one assembled from a manifest stream.
+func (m *Manifest) Signature(privateKey *pubkeycrypto.PrivateKey) ([]byte, error) {
+	return privateKey.Sign(signedMessage(m.Marshal()))
+}
+
+// AttachSignature checks that signature, from Signature, was made over the manifest by the private key of publicKey, and returns the manifest
+// as Sign would have, ready for OpenSigned.
+func (m *Manifest) AttachSignature(publicKey *pubkeycrypto.PublicKey, signature []byte) ([]byte, error) {
+	manifestBytes := m.Marshal()
+	err := publicKey.VerifySignature(signedMessage(manifestBytes), signature)
+	if err != nil {
+		return nil, ErrBadManifestSignature
+	}
+	return signedEncoding(publicKey, manifestBytes, signature), nil
+}
+
+func signedEncoding(publicKey *pubkeycrypto.PublicKey, manifestBytes, signature []byte) []byte {
+	enc := &encoder{}
+	enc.buf.WriteString(signedEncodingMagic)
+	enc.buf.WriteByte(signedEncodingVersion)
+	enc.writeBytes(publicKey.ToBytes())
+	enc.writeBytes(manifestBytes)
+	enc.writeBytes(signature)
+	return enc.buf.Bytes()
+}
+
+// OpenSigned checks that data was produced by Sign with the private key whose public key hashes to signerHash, as returned by
+// PublicKey.Sha1Hash and carried in the share key, and then decodes the manifest. It also returns the signer's public key.
+func OpenSigned(data []byte, signerHash string) (*Manifest, *pubkeycrypto.PublicKey, error) {
+	if !bytes.HasPrefix(data, []byte(signedEncodingMagic)) {
+		return nil, nil, ErrBadSignedManifestMagic
+	}
+	dec := &decoder{r: bytes.NewReader(data[len(signedEncodingMagic):])}
+	version, err := dec.r.ReadByte()
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading signed manifest version: %v", err)
+	}
+	if version != signedEncodingVersion {
+		return nil, nil, ErrUnsupportedSignedFormat
+	}
+	publicKeyBytes, err := dec.readBytes()
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading signer public key: %v", err)
+	}
+	manifestBytes, err := dec.readBytes()
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading signed manifest: %v", err)
+	}
+	signature, err := dec.readBytes()
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading manifest signature: %v", err)
+	}
+	if dec.r.Len() != 0 {
+		return nil, nil, fmt.Errorf("error decoding signed manifest: %d trailing bytes", dec.r.Len())
+	}
+	publicKey, err := pubkeycrypto.PublicKeyFromBytes(publicKeyBytes)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error parsing signer public key: %v", err)
+	}
+	if publicKey.Sha1Hash() != signerHash {
+		return nil, nil, ErrUnexpectedSigner
+	}
+	err = publicKey.VerifySignature(signedMessage(manifestBytes), signature)
+	if err != nil {
+		return nil, nil, ErrBadManifestSignature
+	}
+	m, err := Unmarshal(manifestBytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	return m, publicKey, nil
+}
+
+func signedMessage(manifestBytes []byte) []byte {
+	message := make([]byte, 0, len(signedEncodingMagic)+1+len(manifestBytes))
+	message = append(message, signedEncodingMagic...)
+	message = append(message, signedEncodingVersion)
+	return append(message, manifestBytes...)
+}
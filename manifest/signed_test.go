@@ -0,0 +1,81 @@
+package manifest
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/pavben/Vortex/pubkeycrypto"
+)
+
+func TestSignedManifests(t *testing.T) {
+	keyPair, err := pubkeycrypto.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := pubkeycrypto.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := newManifest(HashSHA256, FixedChunking, testTree(HashSHA256, FixedChunking))
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid, err := m.Sign(keyPair.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opened, publicKey, err := OpenSigned(valid, keyPair.PublicKey.Sha1Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(opened.MerkleRoot(), m.MerkleRoot()) || publicKey.Sha1Hash() != keyPair.PublicKey.Sha1Hash() {
+		t.Fatal("the opened manifest differs from the signed one")
+	}
+
+	manifestBytes := m.Marshal()
+	signature, err := m.Signature(keyPair.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tamperedBytes := append([]byte(nil), manifestBytes...)
+	tamperedBytes[len(tamperedBytes)-1] ^= 1
+	badSignature := append([]byte(nil), signature...)
+	badSignature[0] ^= 1
+	otherSignature, err := other.PrivateKey.Sign(signedMessage(manifestBytes))
+	if err != nil {
+		t.Fatal(err)
+	}
+	attached, err := m.AttachSignature(keyPair.PublicKey, signature)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := OpenSigned(attached, keyPair.PublicKey.Sha1Hash()); err != nil {
+		t.Errorf("attached signature: %v", err)
+	}
+	if _, err := m.AttachSignature(keyPair.PublicKey, otherSignature); err != ErrBadManifestSignature {
+		t.Errorf("attaching another key's signature: got %v", err)
+	}
+	tests := []struct {
+		name   string
+		data   []byte
+		signer string
+		err    error
+	}{
+		{"wrong signer", valid, other.PublicKey.Sha1Hash(), ErrUnexpectedSigner},
+		{"signed by another key", signedEncoding(other.PublicKey, manifestBytes, otherSignature), keyPair.PublicKey.Sha1Hash(), ErrUnexpectedSigner},
+		{"key swapped in", signedEncoding(keyPair.PublicKey, manifestBytes, otherSignature), keyPair.PublicKey.Sha1Hash(), ErrBadManifestSignature},
+		{"tampered manifest", signedEncoding(keyPair.PublicKey, tamperedBytes, signature), keyPair.PublicKey.Sha1Hash(), ErrBadManifestSignature},
+		{"bad signature", signedEncoding(keyPair.PublicKey, manifestBytes, badSignature), keyPair.PublicKey.Sha1Hash(), ErrBadManifestSignature},
+		{"bad magic", append([]byte("VXSX"), valid[4:]...), keyPair.PublicKey.Sha1Hash(), ErrBadSignedManifestMagic},
+		{"future version", append([]byte(signedEncodingMagic+"\x02"), valid[5:]...), keyPair.PublicKey.Sha1Hash(), ErrUnsupportedSignedFormat},
+		{"unsigned", manifestBytes, keyPair.PublicKey.Sha1Hash(), ErrBadSignedManifestMagic},
+		{"truncated", valid[:len(valid)-1], keyPair.PublicKey.Sha1Hash(), nil},
+		{"trailing bytes", append(append([]byte(nil), valid...), 0), keyPair.PublicKey.Sha1Hash(), nil},
+	}
+	for _, test := range tests {
+		_, _, err := OpenSigned(test.data, test.signer)
+		if err == nil || (test.err != nil && err != test.err) {
+			t.Errorf("%s: got %v, expected %v", test.name, err, test.err)
+		}
+	}
+}
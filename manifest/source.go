@@ -0,0 +1,229 @@
+package manifest
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// source is the file system a manifest is generated from and chunks are read from.
+// Paths are OS paths for osSource and slash-separated io/fs paths for fsSource.
+type source interface {
+	join(dir, name string) string
+	stat(p string) (fs.FileInfo, error)
+	// readDir returns the Lstat info of every entry in the folder, sorted by name
+	readDir(p string) ([]fs.FileInfo, error)
+	open(p string) (fs.File, error)
+	readLink(p string) (string, error)
+	// evalSymlinks returns p with all symlinks resolved, in a form suitable for within
+	evalSymlinks(p string) (string, error)
+	// within reports whether the resolved path p is parent or inside it
+	within(parent, p string) bool
+	readXattrs(p string) (map[string][]byte, error)
+	// cacheKey returns the key identifying p in a HashCache, if files from this source can be cached
+	cacheKey(p string) (string, bool)
+}
+
+type osSource struct{}
+
+func (osSource) join(dir, name string) string {
+	return filepath.Join(dir, name)
+}
+
+func (osSource) stat(p string) (fs.FileInfo, error) {
+	fileInfo, err := os.Stat(p)
+	if err != nil {
+		return nil, err
+	}
+	// Stat reports the name as given, so a root of "." or ".." would otherwise be named that way
+	if name := fileInfo.Name(); name == "." || name == ".." {
+		absPath, err := filepath.Abs(p)
+		if err != nil {
+			return nil, err
+		}
+		return renamedFileInfo{fileInfo, filepath.Base(absPath)}, nil
+	}
+	return fileInfo, nil
+}
+
+func (osSource) readDir(p string) ([]fs.FileInfo, error) {
+	return ioutil.ReadDir(p)
+}
+
+func (osSource) open(p string) (fs.File, error) {
+	return os.Open(p)
+}
+
+func (osSource) readLink(p string) (string, error) {
+	return os.Readlink(p)
+}
+
+func (osSource) evalSymlinks(p string) (string, error) {
+	realPath, err := filepath.EvalSymlinks(p)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Abs(realPath)
+}
+
+func (osSource) within(parent, p string) bool {
+	rel, err := filepath.Rel(parent, p)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+func (osSource) readXattrs(p string) (map[string][]byte, error) {
+	return readXattrs(p)
+}
+
+func (osSource) cacheKey(p string) (string, bool) {
+	absPath, err := filepath.Abs(p)
+	return absPath, err == nil
+}
+
+// ReadLinkFS is implemented by file systems that support symbolic links. Its methods match io/fs.ReadLinkFS from newer Go releases.
+// Symlinks in file systems that don't implement it are skipped with a warning.
+type ReadLinkFS interface {
+	fs.FS
+	ReadLink(name string) (string, error)
+	Lstat(name string) (fs.FileInfo, error)
+}
+
+type fsSource struct {
+	fsys fs.FS
+}
+
+func (fsSource) join(dir, name string) string {
+	return path.Join(dir, name)
+}
+
+func (s fsSource) stat(p string) (fs.FileInfo, error) {
+	return fs.Stat(s.fsys, p)
+}
+
+func (s fsSource) readDir(p string) ([]fs.FileInfo, error) {
+	entries, err := fs.ReadDir(s.fsys, p)
+	if err != nil {
+		return nil, err
+	}
+	fileInfos := make([]fs.FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		fileInfo, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		fileInfos = append(fileInfos, fileInfo)
+	}
+	sort.Slice(fileInfos, func(i, j int) bool {
+		return fileInfos[i].Name() < fileInfos[j].Name()
+	})
+	return fileInfos, nil
+}
+
+func (s fsSource) open(p string) (fs.File, error) {
+	return s.fsys.Open(p)
+}
+
+func (s fsSource) readLink(p string) (string, error) {
+	linkFS, ok := s.fsys.(ReadLinkFS)
+	if !ok {
+		return "", errors.New("file system doesn't support symlinks")
+	}
+	return linkFS.ReadLink(p)
+}
+
+// Symlinks resolving through more hops than this are treated as loops, as on Linux
+const maxSymlinkHops = 40
+
+// evalSymlinks resolves p one component at a time. Targets must stay within the file system: absolute targets and targets climbing above its root are errors.
+func (s fsSource) evalSymlinks(p string) (string, error) {
+	linkFS, ok := s.fsys.(ReadLinkFS)
+	if !ok {
+		// Without symlink support, every path already is its own resolved form
+		return p, nil
+	}
+	resolved := "."
+	remaining := strings.Split(p, "/")
+	hops := 0
+	for len(remaining) > 0 {
+		component := remaining[0]
+		remaining = remaining[1:]
+		if component == "." || component == "" {
+			continue
+		}
+		next := path.Join(resolved, component)
+		fileInfo, err := linkFS.Lstat(next)
+		if err != nil {
+			return "", err
+		}
+		if fileInfo.Mode()&fs.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+		hops++
+		if hops > maxSymlinkHops {
+			return "", fmt.Errorf("too many levels of symlinks resolving %s", p)
+		}
+		target, err := linkFS.ReadLink(next)
+		if err != nil {
+			return "", err
+		}
+		if path.IsAbs(target) {
+			return "", fmt.Errorf("symlink %s has absolute target %s", next, target)
+		}
+		joined := path.Join(resolved, target)
+		if !fs.ValidPath(joined) {
+			return "", fmt.Errorf("symlink %s leads outside the file system", next)
+		}
+		// Restart from the root with the link target spliced in front of what is left
+		remaining = append(strings.Split(joined, "/"), remaining...)
+		resolved = "."
+	}
+	return resolved, nil
+}
+
+func (fsSource) within(parent, p string) bool {
+	return parent == "." || p == parent || strings.HasPrefix(p, parent+"/")
+}
+
+func (fsSource) readXattrs(p string) (map[string][]byte, error) {
+	return nil, nil
+}
+
+func (fsSource) cacheKey(p string) (string, bool) {
+	return "", false
+}
+
+// readAtFrom reads len(buf) bytes at offset from f, using ReadAt or Seek when f supports them and skipping ahead otherwise.
+func readAtFrom(f fs.File, buf []byte, offset int64) error {
+	var err error
+	switch r := f.(type) {
+	case io.ReaderAt:
+		var n int
+		n, err = r.ReadAt(buf, offset)
+		// ReadAt may report io.EOF along with a full read that ends exactly at the end of the file
+		if n == len(buf) {
+			err = nil
+		}
+	case io.Seeker:
+		_, err = r.Seek(offset, io.SeekStart)
+		if err == nil {
+			_, err = io.ReadFull(f, buf)
+		}
+	default:
+		_, err = io.CopyN(ioutil.Discard, f, offset)
+		if err == nil {
+			_, err = io.ReadFull(f, buf)
+		}
+	}
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,108 @@
+package manifest
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+// sourceTestFiles are the files of the tree generated both from disk and from an fs.FS, by slash-separated path
+var sourceTestFiles = map[string]string{
+	"a":            "first file",
+	"sub/b":        "second file",
+	"sub/c":        "",
+	"sub/deeper/d": "fourth file",
+	".ignored":     "hidden, but shared",
+}
+
+func TestGenerateManifestFromFSMatchesDisk(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "source")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	fsys := fstest.MapFS{"share/empty": {Mode: os.ModeDir | 0755}}
+	err = os.MkdirAll(filepath.Join(tempDir, "share", "empty"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for relPath, data := range sourceTestFiles {
+		fsys["share/"+relPath] = &fstest.MapFile{Data: []byte(data), Mode: 0644}
+		localPath := filepath.Join(tempDir, "share", filepath.FromSlash(relPath))
+		err = os.MkdirAll(filepath.Dir(localPath), 0755)
+		if err == nil {
+			err = ioutil.WriteFile(localPath, []byte(data), 0644)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	opts := &GenerateOptions{Chunking: Chunking{ContentDefined: true, MinSize: 64, AvgSize: 128, MaxSize: 256}, SkipMetadata: true}
+	fromDisk, err := GenerateManifest(context.Background(), filepath.Join(tempDir, "share"), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromFS, err := GenerateManifestFromFS(context.Background(), fsys, "share", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The same ids, paths, kinds and content
+	if !bytes.Equal(fromFS.MerkleRoot(), fromDisk.MerkleRoot()) || fromFS.Root().Name() != "share" {
+		t.Errorf("the manifest generated from the FS differs from the one generated from disk:\n%s\n%s", treeOf(fromFS), treeOf(fromDisk))
+	}
+	for relPath, data := range sourceTestFiles {
+		entity, ok := fromFS.EntityByPath(relPath)
+		if !ok {
+			t.Errorf("%s is missing", relPath)
+			continue
+		}
+		var content []byte
+		for _, chunk := range entity.(*ManifestFile).Chunks() {
+			chunkData, err := fromFS.ReadChunkFS(fsys, "share", entity.Id(), chunk.Index)
+			if err != nil {
+				t.Fatal(err)
+			}
+			content = append(content, chunkData...)
+		}
+		if string(content) != data {
+			t.Errorf("%s: read %q, expected %q", relPath, content, data)
+		}
+	}
+
+	// The FS root itself takes RootName, or keeps the name "."
+	fromRoot, err := GenerateManifestFromFS(context.Background(), fsys, ".", &GenerateOptions{RootName: "renamed"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fromRoot.EntityByPath("share/sub/deeper/d"); !ok || fromRoot.Root().Name() != "renamed" {
+		t.Errorf("generating from the root of the FS: got root %q", fromRoot.Root().Name())
+	}
+	single, err := GenerateManifestFromFS(context.Background(), fsys, "share/sub/b", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if file, ok := single.Root().(*ManifestFile); !ok || file.Name() != "b" || file.Size() != uint64(len(sourceTestFiles["sub/b"])) {
+		t.Errorf("generating from a single file: got root %#v", single.Root())
+	}
+	for _, root := range []string{"../share", "/share", "share/", "missing"} {
+		if _, err := GenerateManifestFromFS(context.Background(), fsys, root, nil); err == nil {
+			t.Errorf("generated a manifest from %q", root)
+		}
+	}
+}
+
+// treeOf lists the ids and paths of the entities in m, for error messages.
+func treeOf(m *Manifest) string {
+	var sb strings.Builder
+	m.Walk(func(relPath string, entity ManifestEntity) error {
+		fmt.Fprintf(&sb, "%d %T %q\n", entity.Id(), entity, relPath)
+		return nil
+	})
+	return sb.String()
+}
@@ -0,0 +1,214 @@
+package manifest
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"sync"
+)
+
+// StreamEventKind tells what a StreamEvent describes.
+type StreamEventKind int
+
+const (
+	// StreamFolderStart comes before the contents of a folder. Its Entity is a *ManifestFolder holding only the name, since folder ids are assigned after their contents.
+	StreamFolderStart StreamEventKind = iota
+	// StreamEntity carries a file, hard link or symlink.
+	StreamEntity
+	// StreamFolderEnd comes after the contents of a folder. Its Entity is the *ManifestFolder with its id and metadata but without its contents.
+	StreamFolderEnd
+)
+
+// StreamEvent is one step of a streamed manifest. Events come in the order of a depth-first walk, so a receiver only needs to keep track of the folders
+// it is currently inside of. Ids are the same as in the manifest that GenerateManifest would produce for the same tree.
+type StreamEvent struct {
+	Kind StreamEventKind
+	// Path is the slash-separated path of the entity relative to the root entity, which is "" for the root itself
+	Path   string
+	Entity ManifestEntity
+}
+
+// Each file takes a hashing worker, so this many files per worker can wait for their turn to be emitted
+const streamQueueLengthPerWorker = 4
+
+// StreamManifest generates the manifest for the file or folder at p incrementally, calling emit for each entity as soon as it and everything before it
+// are ready. Files are hashed by a pool of workers as in GenerateManifest, but only a bounded number of them are held in memory at a time, so memory
+// use doesn't grow with the size of the tree. Folders passed to emit don't hold their contents and hard links aren't resolved to their targets.
+// Calls to emit are never concurrent. An error from emit aborts generation and is returned.
+// Progress totals only cover the files found so far. Streams aren't signed by themselves; the transfer package signs them in batches to share them.
+func StreamManifest(ctx context.Context, p string, opts *GenerateOptions, emit func(StreamEvent) error) error {
+	opts, saveHashCache := opts.withDefaultHashCache()
+	err := stream(ctx, osSource{}, p, opts, emit)
+	if err != nil {
+		return err
+	}
+	saveHashCache()
+	return nil
+}
+
+// StreamManifestFromFS is like StreamManifest for a file or folder within fsys, as GenerateManifestFromFS is to GenerateManifest.
+func StreamManifestFromFS(ctx context.Context, fsys fs.FS, root string, opts *GenerateOptions, emit func(StreamEvent) error) error {
+	if !fs.ValidPath(root) {
+		return &fs.PathError{Op: "generate", Path: root, Err: fs.ErrInvalid}
+	}
+	return stream(ctx, fsSource{fsys}, root, opts, emit)
+}
+
+// WriteManifestStream generates the manifest for the file or folder at p with StreamManifest and encodes it to w with a StreamWriter.
+func WriteManifestStream(ctx context.Context, p string, opts *GenerateOptions, w io.Writer) error {
+	sw, err := NewStreamWriterFor(w, opts)
+	if err != nil {
+		return err
+	}
+	err = StreamManifest(ctx, p, opts, sw.WriteEvent)
+	if err != nil {
+		return err
+	}
+	return sw.Close()
+}
+
+// NewStreamWriterFor writes the header of the stream that StreamManifest generates with opts to w, for encoding its events as they come.
+func NewStreamWriterFor(w io.Writer, opts *GenerateOptions) (*StreamWriter, error) {
+	return NewStreamWriter(w, opts.hashAlgorithm(), opts.chunking())
+}
+
+func stream(ctx context.Context, src source, p string, opts *GenerateOptions, emit func(StreamEvent) error) error {
+	scanner, hasher, fileInfo, err := prepareGeneration(src, p, opts)
+	if err != nil {
+		return err
+	}
+	se := newStreamEmitter(ctx, hasher, opts, emit)
+	scanner.stream = se
+	rootEntity, err := scanner.scan(p, "", fileInfo)
+	if err == nil && rootEntity == nil {
+		err = fmt.Errorf("%s is neither a regular file nor a folder", p)
+	}
+	return se.finish(err)
+}
+
+// streamEmitter hashes files in parallel while handing entities to emit strictly in the order they were scanned.
+type streamEmitter struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	hasher  *fileHasher
+	tracker *progressTracker
+	emit    func(StreamEvent) error
+	// Files waiting for a worker
+	jobs chan *streamSlot
+	// Everything scanned but not yet emitted, in order
+	slots       chan *streamSlot
+	workers     sync.WaitGroup
+	emitterDone chan struct{}
+	firstErr    error
+	errOnce     sync.Once
+}
+
+type streamSlot struct {
+	event StreamEvent
+	pf    *pendingFile
+	// Closed once the file is hashed. Nil for entities that are ready right away.
+	done chan struct{}
+}
+
+func newStreamEmitter(ctx context.Context, hasher *fileHasher, opts *GenerateOptions, emit func(StreamEvent) error) *streamEmitter {
+	ctx, cancel := context.WithCancel(ctx)
+	se := &streamEmitter{
+		ctx:    ctx,
+		cancel: cancel,
+		hasher: hasher,
+		tracker: &progressTracker{
+			report: opts.progressFunc(),
+		},
+		emit:        emit,
+		jobs:        make(chan *streamSlot),
+		slots:       make(chan *streamSlot, streamQueueLengthPerWorker*opts.concurrency()),
+		emitterDone: make(chan struct{}),
+	}
+	for i := 0; i < opts.concurrency(); i++ {
+		se.workers.Add(1)
+		go se.hashFiles()
+	}
+	go se.emitInOrder()
+	return se
+}
+
+func (se *streamEmitter) fail(err error) {
+	se.errOnce.Do(func() {
+		se.firstErr = err
+		se.cancel()
+	})
+}
+
+func (se *streamEmitter) hashFiles() {
+	defer se.workers.Done()
+	buf := make([]byte, se.hasher.chunking.maxChunkSize())
+	for slot := range se.jobs {
+		err := se.hasher.hashPendingFile(se.ctx, *slot.pf, buf, se.tracker)
+		if err != nil {
+			se.fail(err)
+		}
+		close(slot.done)
+	}
+}
+
+func (se *streamEmitter) emitInOrder() {
+	defer close(se.emitterDone)
+	for slot := range se.slots {
+		if slot.done != nil {
+			<-slot.done
+		}
+		// Keep draining after a failure so that the scanner never blocks
+		if se.ctx.Err() != nil {
+			continue
+		}
+		if file, ok := slot.event.Entity.(*ManifestFile); ok {
+			file.hashAlgorithm = se.hasher.hashAlgorithm
+			file.computeChunkOffsets()
+		}
+		err := se.emit(slot.event)
+		if err != nil {
+			se.fail(err)
+		}
+	}
+}
+
+// enqueue queues event for emission, first handing pf, if not nil, to the hashing workers.
+func (se *streamEmitter) enqueue(event StreamEvent, pf *pendingFile) error {
+	slot := &streamSlot{
+		event: event,
+		pf:    pf,
+	}
+	if pf != nil {
+		slot.done = make(chan struct{})
+		se.tracker.fileFound(pf.statSize)
+		select {
+		case se.jobs <- slot:
+		case <-se.ctx.Done():
+			return se.ctx.Err()
+		}
+	}
+	select {
+	case se.slots <- slot:
+		return nil
+	case <-se.ctx.Done():
+		return se.ctx.Err()
+	}
+}
+
+// finish waits for everything queued to be hashed and emitted and returns the first error. After a scan error nothing more is emitted.
+func (se *streamEmitter) finish(scanErr error) error {
+	defer se.cancel()
+	if scanErr != nil {
+		se.fail(scanErr)
+	}
+	close(se.jobs)
+	close(se.slots)
+	se.workers.Wait()
+	<-se.emitterDone
+	if se.firstErr != nil {
+		return se.firstErr
+	}
+	// Covers cancellation of the parent context between files
+	return se.ctx.Err()
+}
@@ -0,0 +1,51 @@
+package manifest
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestManifestStreamMatchesManifest(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	for name, data := range map[string]string{"a": "first", "sub/b": "second", "sub/deeper/c": "third", "z": ""} {
+		filePath := filepath.Join(tempDir, filepath.FromSlash(name))
+		err = os.MkdirAll(filepath.Dir(filePath), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(filePath, []byte(data), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx := context.Background()
+	opts := &GenerateOptions{Chunking: DefaultContentDefinedChunking}
+	m, err := GenerateManifest(ctx, tempDir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	err = WriteManifestStream(ctx, tempDir, opts, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	streamed, err := ReadManifestStream(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(streamed.MerkleRoot(), m.MerkleRoot()) {
+		t.Error("the streamed manifest differs from the generated one")
+	}
+	_, err = ReadManifestStream(bytes.NewReader(buf.Bytes()[:buf.Len()-1]))
+	if err == nil {
+		t.Error("a stream without its end record was accepted")
+	}
+}
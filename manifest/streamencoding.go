@@ -0,0 +1,423 @@
+package manifest
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+)
+
+// Encoded manifest stream layout (all integers are unsigned varints unless noted):
+//
+//	magic "VXMS" | version (1 byte) | hash algorithm (1 byte) | chunking | records
+//
+// Chunking is encoded as in manifests. Each record is its length followed by a record kind byte and the record's data:
+// folder starts hold the folder name (length-prefixed), entities hold a file, hard link or symlink encoded as in the current manifest version,
+// folder ends hold the folder id and metadata, and the end record holds nothing.
+//
+// Manifest streams carry no signature of their own, since the Merkle root is only known once the whole tree has been hashed. Written to a
+// file, such as by vortex ls -format stream for trees too large to hold in memory, they're meant to stay local. A sharer that streams its
+// manifest to receivers cuts the stream into batches that the transfer package signs and chains one by one, and signs the assembled manifest
+// as Sign does once the stream ends.
+
+const (
+	streamEncodingMagic   = "VXMS"
+	streamEncodingVersion = 1
+)
+
+const (
+	streamRecordFolderStart byte = 0
+	streamRecordEntity      byte = 1
+	streamRecordFolderEnd   byte = 2
+	streamRecordEnd         byte = 3
+)
+
+// Large enough for the hashes of a multi-terabyte file. Longer records are rejected so that a bad length can't exhaust memory.
+const maxStreamRecordSize = 256 * 1024 * 1024
+
+// Errors
+var (
+	ErrBadStreamMagic           = errors.New("Data does not start with the manifest stream magic")
+	ErrUnsupportedStreamVersion = errors.New("Unsupported manifest stream encoding version")
+)
+
+// StreamWriter encodes StreamEvents as they come. Nothing is buffered, so wrap slow writers in a bufio.Writer.
+type StreamWriter struct {
+	w io.Writer
+}
+
+// NewStreamWriter writes the stream header to w.
+func NewStreamWriter(w io.Writer, hashAlgorithm HashAlgorithm, chunking Chunking) (*StreamWriter, error) {
+	enc := &encoder{}
+	enc.buf.WriteString(streamEncodingMagic)
+	enc.buf.WriteByte(streamEncodingVersion)
+	enc.buf.WriteByte(byte(hashAlgorithm))
+	enc.writeChunking(chunking)
+	_, err := w.Write(enc.buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	return &StreamWriter{w: w}, nil
+}
+
+// WriteEvent encodes a single event. It can be passed directly to StreamManifest.
+func (sw *StreamWriter) WriteEvent(event StreamEvent) error {
+	enc := &encoder{}
+	switch event.Kind {
+	case StreamFolderStart:
+		enc.buf.WriteByte(streamRecordFolderStart)
+		enc.writeBytes([]byte(event.Entity.Name()))
+	case StreamEntity:
+		if _, ok := event.Entity.(*ManifestFolder); ok {
+			return errors.New("folders must be streamed as a start and an end event")
+		}
+		enc.buf.WriteByte(streamRecordEntity)
+		enc.writeEntity(event.Entity)
+	case StreamFolderEnd:
+		folder, ok := event.Entity.(*ManifestFolder)
+		if !ok {
+			return fmt.Errorf("folder end event holds a %T", event.Entity)
+		}
+		enc.buf.WriteByte(streamRecordFolderEnd)
+		enc.writeUvarint(uint64(folder.id))
+		enc.writeMetadata(folder.metadata)
+	default:
+		return fmt.Errorf("unknown stream event kind %d", event.Kind)
+	}
+	return sw.writeRecord(enc.buf.Bytes())
+}
+
+// Close writes the end record, which tells the receiver that the stream is complete. It doesn't close the underlying writer.
+func (sw *StreamWriter) Close() error {
+	return sw.writeRecord([]byte{streamRecordEnd})
+}
+
+func (sw *StreamWriter) writeRecord(record []byte) error {
+	enc := &encoder{}
+	enc.writeBytes(record)
+	_, err := sw.w.Write(enc.buf.Bytes())
+	return err
+}
+
+// StreamReader decodes a manifest stream one event at a time, keeping only the folders it is currently inside of in memory.
+type StreamReader struct {
+	r             *bufio.Reader
+	hashAlgorithm HashAlgorithm
+	chunking      Chunking
+	// Names and paths of the open folders, outermost first
+	folderNames []string
+	folderPaths []string
+	rootDone    bool
+	ended       bool
+}
+
+// NewStreamReader reads the stream header from r.
+func NewStreamReader(r io.Reader) (*StreamReader, error) {
+	sr := &StreamReader{
+		r: bufio.NewReader(r),
+	}
+	magic := make([]byte, len(streamEncodingMagic))
+	_, err := io.ReadFull(sr.r, magic)
+	if err != nil {
+		return nil, fmt.Errorf("error reading stream magic: %v", err)
+	}
+	if string(magic) != streamEncodingMagic {
+		return nil, ErrBadStreamMagic
+	}
+	version, err := sr.r.ReadByte()
+	if err != nil {
+		return nil, fmt.Errorf("error reading stream version: %v", err)
+	}
+	if version != streamEncodingVersion {
+		return nil, ErrUnsupportedStreamVersion
+	}
+	alg, err := sr.r.ReadByte()
+	if err != nil {
+		return nil, fmt.Errorf("error reading hash algorithm: %v", err)
+	}
+	sr.hashAlgorithm = HashAlgorithm(alg)
+	if sr.hashAlgorithm == HashSHA1 {
+		return nil, ErrSHA1NotSupported
+	}
+	if !sr.hashAlgorithm.Valid() {
+		return nil, fmt.Errorf("unknown hash algorithm %d", alg)
+	}
+	sr.chunking, err = sr.readChunking()
+	if err != nil {
+		return nil, fmt.Errorf("error reading chunking: %v", err)
+	}
+	return sr, nil
+}
+
+// readChunking decodes the chunking straight from the stream, since reading ahead could wait on records that the sender hasn't written yet.
+func (sr *StreamReader) readChunking() (Chunking, error) {
+	contentDefined, err := sr.r.ReadByte()
+	if err != nil {
+		return Chunking{}, io.ErrUnexpectedEOF
+	}
+	if contentDefined == 0 {
+		return FixedChunking, nil
+	}
+	chunking := Chunking{ContentDefined: true}
+	for _, size := range []*uint32{&chunking.MinSize, &chunking.AvgSize, &chunking.MaxSize} {
+		v, err := binary.ReadUvarint(sr.r)
+		if err == io.EOF {
+			return Chunking{}, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return Chunking{}, err
+		}
+		if v > uint64(^uint32(0)) {
+			return Chunking{}, fmt.Errorf("value %d overflows 32 bits", v)
+		}
+		*size = uint32(v)
+	}
+	err = chunking.Validate()
+	if err != nil {
+		return Chunking{}, err
+	}
+	return chunking, nil
+}
+
+// HashAlgorithm returns the algorithm used for all chunk hashes in the stream.
+func (sr *StreamReader) HashAlgorithm() HashAlgorithm {
+	return sr.hashAlgorithm
+}
+
+// Chunking returns how the files in the stream were split into chunks.
+func (sr *StreamReader) Chunking() Chunking {
+	return sr.chunking
+}
+
+// Next decodes the next event. It returns io.EOF once the end record has been read, and io.ErrUnexpectedEOF if the stream ends before that.
+// Files are ready for Chunk and VerifyChunk, while hard links only carry the id of the file they link to.
+func (sr *StreamReader) Next() (StreamEvent, error) {
+	if sr.ended {
+		return StreamEvent{}, io.EOF
+	}
+	record, err := sr.readRecord()
+	if err != nil {
+		return StreamEvent{}, err
+	}
+	dec := &decoder{
+		r:             bytes.NewReader(record),
+		hashAlgorithm: sr.hashAlgorithm,
+		chunking:      sr.chunking,
+	}
+	kind, err := dec.r.ReadByte()
+	if err != nil {
+		return StreamEvent{}, errors.New("empty stream record")
+	}
+	if kind != streamRecordEnd && sr.rootDone {
+		return StreamEvent{}, errors.New("stream continues after the root entity")
+	}
+	var event StreamEvent
+	switch kind {
+	case streamRecordFolderStart:
+		if len(sr.folderNames) >= maxDecodeDepth {
+			return StreamEvent{}, fmt.Errorf("folders nested deeper than %d levels", maxDecodeDepth)
+		}
+		name, err := dec.readBytes()
+		if err != nil {
+			return StreamEvent{}, err
+		}
+		err = sr.checkName(string(name))
+		if err != nil {
+			return StreamEvent{}, err
+		}
+		event = StreamEvent{
+			Kind:   StreamFolderStart,
+			Path:   sr.childPath(string(name)),
+			Entity: &ManifestFolder{name: string(name)},
+		}
+		sr.folderNames = append(sr.folderNames, string(name))
+		sr.folderPaths = append(sr.folderPaths, event.Path)
+	case streamRecordEntity:
+		if len(record) > 1 && record[1] == entityKindFolder {
+			return StreamEvent{}, errors.New("folder encoded as a single stream record")
+		}
+		entity, err := dec.readEntity(0)
+		if err != nil {
+			return StreamEvent{}, err
+		}
+		err = sr.checkName(entity.Name())
+		if err != nil {
+			return StreamEvent{}, err
+		}
+		if file, ok := entity.(*ManifestFile); ok {
+			file.hashAlgorithm = sr.hashAlgorithm
+			file.computeChunkOffsets()
+		}
+		event = StreamEvent{
+			Kind:   StreamEntity,
+			Path:   sr.childPath(entity.Name()),
+			Entity: entity,
+		}
+		sr.rootDone = len(sr.folderNames) == 0
+	case streamRecordFolderEnd:
+		if len(sr.folderNames) == 0 {
+			return StreamEvent{}, errors.New("folder end without a matching start")
+		}
+		id, err := dec.readUint32()
+		if err != nil {
+			return StreamEvent{}, err
+		}
+		metadata, err := dec.readMetadata()
+		if err != nil {
+			return StreamEvent{}, err
+		}
+		last := len(sr.folderNames) - 1
+		event = StreamEvent{
+			Kind: StreamFolderEnd,
+			Path: sr.folderPaths[last],
+			Entity: &ManifestFolder{
+				id:       id,
+				name:     sr.folderNames[last],
+				metadata: metadata,
+			},
+		}
+		sr.folderNames = sr.folderNames[:last]
+		sr.folderPaths = sr.folderPaths[:last]
+		sr.rootDone = last == 0
+	case streamRecordEnd:
+		if !sr.rootDone {
+			return StreamEvent{}, errors.New("stream ended before the root entity was complete")
+		}
+		sr.ended = true
+		return StreamEvent{}, io.EOF
+	default:
+		return StreamEvent{}, fmt.Errorf("unknown stream record kind %d", kind)
+	}
+	if dec.r.Len() != 0 {
+		return StreamEvent{}, fmt.Errorf("%d trailing bytes in stream record", dec.r.Len())
+	}
+	return event, nil
+}
+
+func (sr *StreamReader) readRecord() ([]byte, error) {
+	length, err := binary.ReadUvarint(sr.r)
+	if err == io.EOF {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, err
+	}
+	if length > maxStreamRecordSize {
+		return nil, fmt.Errorf("stream record of %d bytes exceeds the limit of %d", length, maxStreamRecordSize)
+	}
+	record := make([]byte, length)
+	_, err = io.ReadFull(sr.r, record)
+	if err == io.EOF {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// checkName checks the name of an entity in the innermost open folder. The root entity's name is never part of a path.
+func (sr *StreamReader) checkName(name string) error {
+	if len(sr.folderPaths) == 0 {
+		return nil
+	}
+	return checkChildName(name)
+}
+
+// childPath returns the path of an entity in the innermost open folder, or "" for the root.
+func (sr *StreamReader) childPath(name string) string {
+	if len(sr.folderPaths) == 0 {
+		return ""
+	}
+	return path.Join(sr.folderPaths[len(sr.folderPaths)-1], name)
+}
+
+// ReadManifestStream reads a whole manifest stream and assembles the complete Manifest, which takes as much memory as a non-streamed manifest.
+func ReadManifestStream(r io.Reader) (*Manifest, error) {
+	sr, err := NewStreamReader(r)
+	if err != nil {
+		return nil, err
+	}
+	sa := NewStreamAssembler(sr.hashAlgorithm, sr.chunking)
+	for {
+		event, err := sr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error decoding manifest stream: %v", err)
+		}
+		err = sa.Add(event)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return sa.Manifest()
+}
+
+// StreamAssembler puts the events of a manifest stream back together into the complete Manifest, for those who need all of it in the end
+// but want to act on entities as they arrive.
+type StreamAssembler struct {
+	hashAlgorithm HashAlgorithm
+	chunking      Chunking
+	rootEntity    ManifestEntity
+	openFolders   []*ManifestFolder
+}
+
+// NewStreamAssembler prepares to assemble a stream with the given hash algorithm and chunking, as reported by its StreamReader.
+func NewStreamAssembler(hashAlgorithm HashAlgorithm, chunking Chunking) *StreamAssembler {
+	return &StreamAssembler{
+		hashAlgorithm: hashAlgorithm,
+		chunking:      chunking,
+	}
+}
+
+// Add adds the next event of the stream. Events must come in the order of the stream, as from StreamReader.Next or StreamManifest.
+func (sa *StreamAssembler) Add(event StreamEvent) error {
+	if sa.rootEntity != nil {
+		return errors.New("stream continues after the root entity")
+	}
+	switch event.Kind {
+	case StreamFolderStart:
+		start, ok := event.Entity.(*ManifestFolder)
+		if !ok {
+			return fmt.Errorf("folder start event holds a %T", event.Entity)
+		}
+		sa.openFolders = append(sa.openFolders, &ManifestFolder{name: start.name})
+	case StreamEntity:
+		sa.addEntity(event.Entity)
+	case StreamFolderEnd:
+		end, ok := event.Entity.(*ManifestFolder)
+		if !ok || len(sa.openFolders) == 0 {
+			return errors.New("folder end without a matching start")
+		}
+		folder := sa.openFolders[len(sa.openFolders)-1]
+		folder.id = end.id
+		folder.metadata = end.metadata
+		sa.openFolders = sa.openFolders[:len(sa.openFolders)-1]
+		sa.addEntity(folder)
+	default:
+		return fmt.Errorf("unknown stream event kind %d", event.Kind)
+	}
+	return nil
+}
+
+func (sa *StreamAssembler) addEntity(entity ManifestEntity) {
+	if len(sa.openFolders) == 0 {
+		sa.rootEntity = entity
+		return
+	}
+	parent := sa.openFolders[len(sa.openFolders)-1]
+	parent.contents = append(parent.contents, entity)
+}
+
+// Manifest returns the assembled manifest once the root entity is complete.
+func (sa *StreamAssembler) Manifest() (*Manifest, error) {
+	if sa.rootEntity == nil {
+		return nil, errors.New("stream ended before the root entity was complete")
+	}
+	return newManifest(sa.hashAlgorithm, sa.chunking, sa.rootEntity)
+}
@@ -0,0 +1,293 @@
+package manifest
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pavben/Vortex/safename"
+)
+
+// VerifyReport lists every way a local tree differs from a manifest. Paths are slash-separated and relative to the root entity.
+type VerifyReport struct {
+	// Missing are entities with nothing at their local path
+	Missing []string
+	// Extra are local files and folders that aren't in the manifest. Only the topmost extra folder is listed, not its contents.
+	Extra []string
+	// Mismatched are entities whose local counterpart is of the wrong kind, such as a folder where a file should be, or a symlink with the wrong target
+	Mismatched []string
+	// Truncated are files whose local size differs from the manifest, usually because a transfer was interrupted
+	Truncated []SizeMismatch
+	// Corrupted are chunks whose local data doesn't match its hash
+	Corrupted []ChunkLocation
+	// MissingChunks are chunks of missing or short files that have no local data at all
+	MissingChunks []ChunkLocation
+}
+
+// SizeMismatch is a file whose local size differs from the size in the manifest.
+type SizeMismatch struct {
+	Path         string
+	FileId       uint32
+	ExpectedSize uint64
+	ActualSize   uint64
+}
+
+// OK reports whether the local tree matches the manifest exactly.
+func (r *VerifyReport) OK() bool {
+	return len(r.Missing) == 0 && len(r.Extra) == 0 && len(r.Mismatched) == 0 && len(r.Truncated) == 0 && len(r.Corrupted) == 0 &&
+		len(r.MissingChunks) == 0
+}
+
+// Verify re-hashes the local copy of the manifest at rootPath, the local path of the root entity, and reports how it differs.
+// Local paths are decided by SafeLocalPaths with names, so pass the same options the tree was downloaded with. Metadata is not compared.
+func (m *Manifest) Verify(ctx context.Context, rootPath string, names *safename.Options) (*VerifyReport, error) {
+	// Keeps the paths from filepath.Walk comparable with those from LocalPaths
+	rootPath = filepath.Clean(rootPath)
+	localPaths, err := m.SafeLocalPaths(rootPath, names)
+	if err != nil {
+		return nil, err
+	}
+	report := &VerifyReport{}
+	expected := make(map[string]bool)
+	var buf []byte
+	err = m.Walk(func(relPath string, entity ManifestEntity) error {
+		localPath, ok := localPaths.Path(entity.Id())
+		if !ok {
+			return SkipFolder
+		}
+		expected[localPath] = true
+		fileInfo, err := os.Lstat(localPath)
+		if os.IsNotExist(err) {
+			report.Missing = append(report.Missing, relPath)
+			if file, ok := entity.(*ManifestFile); ok {
+				report.addMissingChunks(file, 0)
+			}
+			// The contents of a missing folder are listed as missing too, so that Repair recreates them
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch e := entity.(type) {
+		case *ManifestFolder:
+			if !fileInfo.IsDir() {
+				report.Mismatched = append(report.Mismatched, relPath)
+				return SkipFolder
+			}
+		case *ManifestSymlink:
+			target, err := os.Readlink(localPath)
+			if err != nil || target != e.target {
+				report.Mismatched = append(report.Mismatched, relPath)
+			}
+		case *ManifestFile:
+			if !fileInfo.Mode().IsRegular() {
+				report.Mismatched = append(report.Mismatched, relPath)
+				return nil
+			}
+			if uint64(fileInfo.Size()) != e.fileSize {
+				report.Truncated = append(report.Truncated, SizeMismatch{
+					Path:         relPath,
+					FileId:       e.id,
+					ExpectedSize: e.fileSize,
+					ActualSize:   uint64(fileInfo.Size()),
+				})
+			}
+			if buf == nil {
+				buf = make([]byte, m.chunking.maxChunkSize())
+			}
+			return report.verifyFile(ctx, e, localPath, uint64(fileInfo.Size()), buf)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if _, isFolder := m.rootEntity.(*ManifestFolder); isFolder {
+		err = report.findExtra(rootPath, expected)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return report, nil
+}
+
+// verifyFile checks every chunk of file that lies within the localSize bytes of the local file.
+func (r *VerifyReport) verifyFile(ctx context.Context, file *ManifestFile, localPath string, localSize uint64, buf []byte) error {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	for _, chunk := range file.Chunks() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if chunk.Offset+uint64(chunk.Length) > localSize {
+			r.addMissingChunks(file, chunk.Index)
+			return nil
+		}
+		data := buf[:chunk.Length]
+		_, err := io.ReadFull(f, data)
+		if err != nil {
+			return fmt.Errorf("error reading %s: %v", localPath, err)
+		}
+		if file.VerifyChunk(chunk.Index, data) != nil {
+			r.Corrupted = append(r.Corrupted, ChunkLocation{
+				FileId: file.id,
+				Index:  chunk.Index,
+			})
+		}
+	}
+	return nil
+}
+
+// addMissingChunks records every chunk of file from index on as missing.
+func (r *VerifyReport) addMissingChunks(file *ManifestFile, from int) {
+	for i := from; i < file.NumChunks(); i++ {
+		r.MissingChunks = append(r.MissingChunks, ChunkLocation{
+			FileId: file.id,
+			Index:  i,
+		})
+	}
+}
+
+func (r *VerifyReport) findExtra(rootPath string, expected map[string]bool) error {
+	err := filepath.Walk(rootPath, func(localPath string, fileInfo os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if expected[localPath] {
+			return nil
+		}
+		relPath, err := filepath.Rel(rootPath, localPath)
+		if err != nil {
+			return err
+		}
+		r.Extra = append(r.Extra, filepath.ToSlash(relPath))
+		if fileInfo.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	sort.Strings(r.Extra)
+	return err
+}
+
+// String returns a human-readable summary with one line per problem.
+func (r *VerifyReport) String() string {
+	var sb strings.Builder
+	for _, relPath := range r.Missing {
+		fmt.Fprintf(&sb, "missing     %s\n", relPath)
+	}
+	for _, relPath := range r.Extra {
+		fmt.Fprintf(&sb, "extra       %s\n", relPath)
+	}
+	for _, relPath := range r.Mismatched {
+		fmt.Fprintf(&sb, "mismatched  %s\n", relPath)
+	}
+	for _, sm := range r.Truncated {
+		fmt.Fprintf(&sb, "truncated   %s (%d of %d bytes)\n", sm.Path, sm.ActualSize, sm.ExpectedSize)
+	}
+	fmt.Fprintf(&sb, "%d corrupted chunks, %d missing chunks\n", len(r.Corrupted), len(r.MissingChunks))
+	return sb.String()
+}
+
+// FetchFunc returns the data of the given chunk, typically by requesting it from the sharer.
+type FetchFunc func(fileId uint32, index int) ([]byte, error)
+
+// Repair fixes the problems in report, which Verify produced for the same rootPath and names, by creating missing folders, files and symlinks,
+// resizing truncated files and writing every corrupted or missing chunk fetched with fetch. Each fetched chunk is verified before it is written.
+// Extra and mismatched entities are left alone so that nothing is ever deleted, as are symlinks that could point outside the root folder (see
+// SymlinkStaysInside); run Verify again afterwards to see what remains.
+func (m *Manifest) Repair(ctx context.Context, rootPath string, names *safename.Options, report *VerifyReport, fetch FetchFunc) error {
+	localPaths, err := m.SafeLocalPaths(rootPath, names)
+	if err != nil {
+		return err
+	}
+	// Missing paths are in Walk order, so folders are created before their contents
+	for _, relPath := range report.Missing {
+		entity, _ := m.EntityByPath(relPath)
+		localPath, _ := localPaths.Path(entity.Id())
+		switch e := entity.(type) {
+		case *ManifestFolder:
+			err = os.MkdirAll(localPath, 0755)
+		case *ManifestFile:
+			err = CreateSizedFile(localPath, e.fileSize)
+		case *ManifestSymlink:
+			if !m.SymlinkStaysInside(e.id) {
+				continue
+			}
+			err = os.Symlink(e.target, localPath)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	for _, sm := range report.Truncated {
+		localPath, _ := localPaths.Path(sm.FileId)
+		err = os.Truncate(localPath, int64(sm.ExpectedSize))
+		if err != nil {
+			return err
+		}
+	}
+	badChunks := append(append([]ChunkLocation(nil), report.Corrupted...), report.MissingChunks...)
+	for _, location := range badChunks {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		err = m.repairChunk(localPaths, location, fetch)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Manifest) repairChunk(localPaths *LocalPaths, location ChunkLocation, fetch FetchFunc) error {
+	file, err := m.fileById(location.FileId)
+	if err != nil {
+		return err
+	}
+	chunk, err := file.Chunk(location.Index)
+	if err != nil {
+		return err
+	}
+	data, err := fetch(location.FileId, location.Index)
+	if err != nil {
+		return err
+	}
+	err = file.VerifyChunk(location.Index, data)
+	if err != nil {
+		return fmt.Errorf("fetched chunk %d of file %d: %v", location.Index, location.FileId, err)
+	}
+	localPath, _ := localPaths.Path(location.FileId)
+	f, err := os.OpenFile(localPath, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteAt(data, int64(chunk.Offset))
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// CreateSizedFile creates a file at localPath, where nothing may exist yet, with the given size, so that chunks can be written to it in any
+// order. Receivers and Repair use it for files that aren't there yet.
+func CreateSizedFile(localPath string, size uint64) error {
+	f, err := os.OpenFile(localPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	err = f.Truncate(int64(size))
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,248 @@
+package manifest
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// copyTree copies the files and folders under src to dst, which mustn't exist yet.
+func copyTree(t *testing.T, src, dst string) {
+	t.Helper()
+	err := filepath.Walk(src, func(path string, fileInfo os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		if fileInfo.IsDir() {
+			return os.MkdirAll(filepath.Join(dst, relPath), 0755)
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(filepath.Join(dst, relPath), data, 0644)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerifyAndRepair(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "verify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	original := filepath.Join(tempDir, "original", "share")
+	files := map[string][]byte{
+		"a":     randomData(1, 4096),
+		"b":     randomData(2, 1500),
+		"sub/c": randomData(3, 2000),
+		"sub/d": []byte("small file"),
+	}
+	for relPath, data := range files {
+		path := filepath.Join(original, filepath.FromSlash(relPath))
+		err = os.MkdirAll(filepath.Dir(path), 0755)
+		if err == nil {
+			err = ioutil.WriteFile(path, data, 0644)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	m, err := GenerateManifest(context.Background(), original, &GenerateOptions{Chunking: smallChunks})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileAt := func(relPath string) *ManifestFile {
+		entity, _ := m.EntityByPath(relPath)
+		return entity.(*ManifestFile)
+	}
+	if fileAt("a").NumChunks() < 3 {
+		t.Fatalf("a has %d chunks, the corrupted chunk case needs at least 3", fileAt("a").NumChunks())
+	}
+	// chunksPast lists the chunks of a file that don't fit in size bytes, which is how Verify reports the chunks of short or missing files
+	chunksPast := func(relPath string, size uint64) []ChunkLocation {
+		var locations []ChunkLocation
+		for _, chunk := range fileAt(relPath).Chunks() {
+			if chunk.Offset+uint64(chunk.Length) > size {
+				locations = append(locations, ChunkLocation{FileId: fileAt(relPath).Id(), Index: chunk.Index})
+			}
+		}
+		return locations
+	}
+	sizeOf := func(relPath string) uint64 {
+		return uint64(len(files[relPath]))
+	}
+	secondChunk, _ := fileAt("a").Chunk(1)
+	tests := []struct {
+		name   string
+		change func(root string) error
+		want   VerifyReport
+	}{
+		{
+			name:   "unchanged",
+			change: func(root string) error { return nil },
+		},
+		{
+			name:   "missing file",
+			change: func(root string) error { return os.Remove(filepath.Join(root, "b")) },
+			want:   VerifyReport{Missing: []string{"b"}, MissingChunks: chunksPast("b", 0)},
+		},
+		{
+			name: "missing folder",
+			change: func(root string) error {
+				return os.RemoveAll(filepath.Join(root, "sub"))
+			},
+			want: VerifyReport{
+				Missing:       []string{"sub", "sub/c", "sub/d"},
+				MissingChunks: append(chunksPast("sub/c", 0), chunksPast("sub/d", 0)...),
+			},
+		},
+		{
+			name: "extra file and folder",
+			change: func(root string) error {
+				err := ioutil.WriteFile(filepath.Join(root, "sub", "extra"), []byte("extra"), 0644)
+				if err == nil {
+					err = os.MkdirAll(filepath.Join(root, "new", "nested"), 0755)
+				}
+				return err
+			},
+			want: VerifyReport{Extra: []string{"new", "sub/extra"}},
+		},
+		{
+			name: "folder where a file should be",
+			change: func(root string) error {
+				err := os.Remove(filepath.Join(root, "b"))
+				if err == nil {
+					err = os.Mkdir(filepath.Join(root, "b"), 0755)
+				}
+				return err
+			},
+			want: VerifyReport{Mismatched: []string{"b"}},
+		},
+		{
+			name: "file where a folder should be",
+			change: func(root string) error {
+				err := os.RemoveAll(filepath.Join(root, "sub"))
+				if err == nil {
+					err = ioutil.WriteFile(filepath.Join(root, "sub"), []byte("not a folder"), 0644)
+				}
+				return err
+			},
+			want: VerifyReport{Mismatched: []string{"sub"}},
+		},
+		{
+			name:   "truncated file",
+			change: func(root string) error { return os.Truncate(filepath.Join(root, "a"), 100) },
+			want: VerifyReport{
+				Truncated:     []SizeMismatch{{Path: "a", FileId: fileAt("a").Id(), ExpectedSize: sizeOf("a"), ActualSize: 100}},
+				MissingChunks: chunksPast("a", 100),
+			},
+		},
+		{
+			name: "oversized file",
+			change: func(root string) error {
+				f, err := os.OpenFile(filepath.Join(root, "b"), os.O_WRONLY|os.O_APPEND, 0)
+				if err != nil {
+					return err
+				}
+				_, err = f.Write([]byte("trailing data"))
+				if err != nil {
+					f.Close()
+					return err
+				}
+				return f.Close()
+			},
+			want: VerifyReport{
+				Truncated: []SizeMismatch{{Path: "b", FileId: fileAt("b").Id(), ExpectedSize: sizeOf("b"), ActualSize: sizeOf("b") + 13}},
+			},
+		},
+		{
+			name: "corrupted chunk",
+			change: func(root string) error {
+				data := append([]byte(nil), files["a"]...)
+				data[secondChunk.Offset] ^= 1
+				return ioutil.WriteFile(filepath.Join(root, "a"), data, 0644)
+			},
+			want: VerifyReport{Corrupted: []ChunkLocation{{FileId: fileAt("a").Id(), Index: 1}}},
+		},
+	}
+	fetch := func(fileId uint32, index int) ([]byte, error) {
+		return m.ReadChunk(original, fileId, index)
+	}
+	for i, test := range tests {
+		root := filepath.Join(tempDir, "copies", string(rune('a'+i)), "share")
+		copyTree(t, original, root)
+		err := test.change(root)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		report, err := m.Verify(context.Background(), root, nil)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(*report, test.want) {
+			t.Errorf("%s: got %+v, expected %+v", test.name, *report, test.want)
+			continue
+		}
+		if report.OK() != reflect.DeepEqual(test.want, VerifyReport{}) {
+			t.Errorf("%s: OK() is %v", test.name, report.OK())
+		}
+		err = m.Repair(context.Background(), root, nil, report, fetch)
+		if err != nil {
+			t.Errorf("%s: repair: %v", test.name, err)
+			continue
+		}
+		// Repair never deletes anything, so extra and mismatched entities remain
+		remaining := VerifyReport{Extra: test.want.Extra, Mismatched: test.want.Mismatched}
+		report, err = m.Verify(context.Background(), root, nil)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		} else if !reflect.DeepEqual(*report, remaining) {
+			t.Errorf("%s: after repairing, got %+v, expected %+v", test.name, *report, remaining)
+		}
+	}
+}
+
+func TestRepairRejectsBadChunks(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "verify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	root := filepath.Join(tempDir, "share")
+	err = os.Mkdir(root, 0755)
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(root, "a"), []byte("original data"), 0644)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := GenerateManifest(context.Background(), root, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Remove(filepath.Join(root, "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := m.Verify(context.Background(), root, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.Repair(context.Background(), root, nil, report, func(fileId uint32, index int) ([]byte, error) {
+		return []byte("altered data!"), nil
+	})
+	if err == nil {
+		t.Error("repaired with a chunk that doesn't match its hash")
+	}
+}
@@ -0,0 +1,48 @@
+//go:build linux
+
+package manifest
+
+import (
+	"bytes"
+	"syscall"
+)
+
+// readXattrs returns the extended attributes in the user namespace.
+func readXattrs(filePath string) (map[string][]byte, error) {
+	size, err := syscall.Listxattr(filePath, nil)
+	if err != nil {
+		if err == syscall.ENOTSUP {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if size == 0 {
+		return nil, nil
+	}
+	namesBuf := make([]byte, size)
+	size, err = syscall.Listxattr(filePath, namesBuf)
+	if err != nil {
+		return nil, err
+	}
+	xattrs := make(map[string][]byte)
+	for _, name := range bytes.Split(namesBuf[:size], []byte{0}) {
+		if !bytes.HasPrefix(name, []byte(xattrNamespace)) {
+			continue
+		}
+		valueSize, err := syscall.Getxattr(filePath, string(name), nil)
+		if err != nil {
+			return nil, err
+		}
+		value := make([]byte, valueSize)
+		valueSize, err = syscall.Getxattr(filePath, string(name), value)
+		if err != nil {
+			return nil, err
+		}
+		xattrs[string(name)] = value[:valueSize]
+	}
+	return xattrs, nil
+}
+
+func writeXattr(filePath, name string, value []byte) error {
+	return syscall.Setxattr(filePath, name, value, 0)
+}
@@ -0,0 +1,62 @@
+//go:build linux
+
+package manifest
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestApplyMetadataOnlyAppliesUserXattrs(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "metadata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	filePath := filepath.Join(tempDir, "f")
+	err = ioutil.WriteFile(filePath, nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeXattr(filePath, "user.probe", []byte("x")); err != nil {
+		t.Skip("the file system doesn't support extended attributes:", err)
+	}
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	file := &ManifestFile{id: 0, name: "f", metadata: &Metadata{
+		Mode:    0600,
+		ModTime: modTime,
+		Xattrs: map[string][]byte{
+			"user.comment":        []byte("hello"),
+			"trusted.evil":        []byte("x"),
+			"security.capability": []byte("x"),
+		},
+	}}
+	err = ApplyMetadata(filePath, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	xattrs, err := readXattrs(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(xattrs["user.comment"]) != "hello" {
+		t.Errorf("user.comment is %q", xattrs["user.comment"])
+	}
+	for _, name := range []string{"trusted.evil", "security.capability"} {
+		buf := make([]byte, 16)
+		if _, err := syscall.Getxattr(filePath, name, buf); err == nil {
+			t.Errorf("%s was applied", name)
+		}
+	}
+	fileInfo, err := os.Stat(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fileInfo.Mode().Perm() != 0600 || !fileInfo.ModTime().Equal(modTime) {
+		t.Errorf("got mode %v and time %v", fileInfo.Mode(), fileInfo.ModTime())
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package manifest
+
+// Extended attributes are only supported on Linux. Elsewhere they are neither captured nor applied.
+func readXattrs(filePath string) (map[string][]byte, error) {
+	return nil, nil
+}
+
+func writeXattr(filePath, name string, value []byte) error {
+	return nil
+}
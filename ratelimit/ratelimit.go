@@ -0,0 +1,161 @@
+// Package ratelimit limits how fast bytes flow, such as through a connection. A Limiter is a token bucket: it fills at the rate up to the
+// burst, and every byte takes a token. Limits can be changed while bytes are flowing, and waiters pick up the change right away.
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limiter limits a rate in bytes per second. It is safe for concurrent use, and a single Limiter can be shared by several connections to
+// limit their total. A nil *Limiter, like a rate of zero, doesn't limit anything.
+type Limiter struct {
+	mutex  sync.Mutex
+	rate   int
+	burst  int
+	tokens float64
+	last   time.Time
+	// Closed and replaced whenever the limits change, waking up waiters
+	changed chan struct{}
+}
+
+// New returns a Limiter allowing rate bytes per second, with bursts of up to burst bytes after it was idle. A burst of zero means a tenth of
+// a second's worth of bytes at the rate.
+func New(rate, burst int) *Limiter {
+	l := &Limiter{
+		last:    time.Now(),
+		changed: make(chan struct{}),
+	}
+	l.SetLimits(rate, burst)
+	l.tokens = float64(l.burst)
+	return l
+}
+
+// SetLimits changes the rate and burst, which take effect immediately. See New. It does nothing on a nil *Limiter, which has no limits to
+// change.
+func (l *Limiter) SetLimits(rate, burst int) {
+	if l == nil {
+		return
+	}
+	if rate < 0 {
+		rate = 0
+	}
+	if burst <= 0 {
+		burst = rate / 10
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.refill(time.Now())
+	l.rate = rate
+	l.burst = burst
+	if l.tokens > float64(burst) {
+		l.tokens = float64(burst)
+	}
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// Limits returns the rate and burst.
+func (l *Limiter) Limits() (rate, burst int) {
+	if l == nil {
+		return 0, 0
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.rate, l.burst
+}
+
+// Wait blocks until n bytes may pass. Requests larger than the burst wait for a full bucket and then leave it in debt, so callers should pass
+// bytes in pieces no larger than the burst to keep the flow smooth.
+func (l *Limiter) Wait(n int) {
+	if l == nil {
+		return
+	}
+	l.mutex.Lock()
+	for {
+		if l.rate == 0 {
+			l.mutex.Unlock()
+			return
+		}
+		now := time.Now()
+		l.refill(now)
+		need := float64(n)
+		if need > float64(l.burst) {
+			need = float64(l.burst)
+		}
+		if l.tokens >= need {
+			l.tokens -= float64(n)
+			l.mutex.Unlock()
+			return
+		}
+		delay := time.Duration((need - l.tokens) / float64(l.rate) * float64(time.Second))
+		changed := l.changed
+		l.mutex.Unlock()
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-changed:
+			timer.Stop()
+		}
+		l.mutex.Lock()
+	}
+}
+
+// refill adds the tokens earned since the last refill. It must be called with the mutex held.
+func (l *Limiter) refill(now time.Time) {
+	l.tokens += now.Sub(l.last).Seconds() * float64(l.rate)
+	if l.tokens > float64(l.burst) {
+		l.tokens = float64(l.burst)
+	}
+	l.last = now
+}
+
+// ParseRate parses a number of bytes such as "500K", "2.5M" or "1G", with binary multiples and an optional "B" or "iB" suffix. Zero and "off"
+// mean no limit.
+func ParseRate(s string) (int, error) {
+	s = strings.TrimSpace(s)
+	if strings.EqualFold(s, "off") {
+		return 0, nil
+	}
+	invalid := fmt.Errorf("invalid rate %q: expected a number of bytes such as 500K or 2M", s)
+	trimmed := strings.ToUpper(s)
+	if unit, ok := strings.CutSuffix(trimmed, "IB"); ok && unit != "" && strings.ContainsRune("KMG", rune(unit[len(unit)-1])) {
+		trimmed = unit
+	} else {
+		trimmed = strings.TrimSuffix(trimmed, "B")
+	}
+	multiple := 1.0
+	if trimmed != "" {
+		switch trimmed[len(trimmed)-1] {
+		case 'K':
+			multiple = 1 << 10
+		case 'M':
+			multiple = 1 << 20
+		case 'G':
+			multiple = 1 << 30
+		}
+		if multiple != 1 {
+			trimmed = trimmed[:len(trimmed)-1]
+		}
+	}
+	v, err := strconv.ParseFloat(trimmed, 64)
+	if err != nil || math.IsNaN(v) || math.IsInf(v, 0) || v < 0 {
+		return 0, invalid
+	}
+	v *= multiple
+	if v >= math.MaxInt {
+		return 0, fmt.Errorf("invalid rate %q: too large", s)
+	}
+	rate := int(v)
+	if rate == 0 && v != 0 {
+		return 0, fmt.Errorf("invalid rate %q: less than one byte per second", s)
+	}
+	return rate, nil
+}
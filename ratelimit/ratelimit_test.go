@@ -0,0 +1,83 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		s    string
+		rate int
+	}{
+		{"off", 0},
+		{"OFF", 0},
+		{"0", 0},
+		{"1000", 1000},
+		{"500K", 500 << 10},
+		{"500k", 500 << 10},
+		{"2.5M", 5 << 19},
+		{"2MiB", 2 << 20},
+		{"1G", 1 << 30},
+		{" 64KB ", 64 << 10},
+		{"64kib", 64 << 10},
+		{"100B", 100},
+		{"0.5K", 512},
+		{"0.0", 0},
+	}
+	for _, test := range tests {
+		rate, err := ParseRate(test.s)
+		if err != nil || rate != test.rate {
+			t.Errorf("%q: got %d, %v, expected %d", test.s, rate, err, test.rate)
+		}
+	}
+	for _, s := range []string{"", "fast", "-1K", "K", "1T", "inf", "+Inf", "NaN", "infK", "1e300", "1e19", "9000000000G", "1BIBI", "1BB", "1iB", "0.5", "0.0001K"} {
+		if _, err := ParseRate(s); err == nil {
+			t.Errorf("%q was accepted", s)
+		}
+	}
+}
+
+func TestWaitPacesBytes(t *testing.T) {
+	const rate = 100 << 10
+	l := New(rate, 0)
+	start := time.Now()
+	// The first burst is free, the rest takes half a second
+	for i := 0; i < 6; i++ {
+		l.Wait(rate / 10)
+	}
+	elapsed := time.Since(start)
+	if elapsed < 400*time.Millisecond || elapsed > 900*time.Millisecond {
+		t.Errorf("took %v, expected about 500ms", elapsed)
+	}
+}
+
+func TestSetLimitsWakesWaiters(t *testing.T) {
+	l := New(1, 1)
+	l.Wait(1)
+	done := make(chan struct{})
+	go func() {
+		// At a byte per second, this would take a long time
+		l.Wait(1000)
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	l.SetLimits(0, 0)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("removing the limit didn't wake up the waiter")
+	}
+	if rate, _ := l.Limits(); rate != 0 {
+		t.Errorf("rate is %d after removing the limit", rate)
+	}
+}
+
+func TestNilLimiter(t *testing.T) {
+	var l *Limiter
+	l.SetLimits(100, 10)
+	l.Wait(1 << 30)
+	if rate, burst := l.Limits(); rate != 0 || burst != 0 {
+		t.Errorf("got %d, %d", rate, burst)
+	}
+}
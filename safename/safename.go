@@ -0,0 +1,223 @@
+// Package safename checks entity names received from other peers before they are used on the local file system.
+// A name is a single path component: anything that could climb out of the destination folder or be interpreted specially by the file system is rejected.
+package safename
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"runtime"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Most file systems don't allow longer names
+const maxNameBytes = 255
+
+// Errors
+var (
+	ErrEmptyName          = errors.New("Name is empty")
+	ErrDotName            = errors.New("Name refers to the current or parent folder")
+	ErrSeparator          = errors.New("Name contains a path separator")
+	ErrControlCharacter   = errors.New("Name contains a NUL byte or control character")
+	ErrInvalidUTF8        = errors.New("Name is not valid UTF-8")
+	ErrNameTooLong        = errors.New("Name is too long")
+	ErrReservedName       = errors.New("Name is reserved on Windows")
+	ErrInvalidCharacter   = errors.New("Name contains a character not allowed on Windows")
+	ErrTrailingDotOrSpace = errors.New("Name ends with a dot or space, which Windows strips")
+	ErrNameCollision      = errors.New("Name collides with another name in the same folder")
+)
+
+// CollisionPolicy decides what happens when two names in the same folder map to the same local name, which happens when they differ only by
+// Unicode normalization or, unless Options.CaseSensitive is set, by case.
+type CollisionPolicy int
+
+const (
+	// CollisionReject fails with ErrNameCollision.
+	CollisionReject CollisionPolicy = iota
+	// CollisionSkip keeps the first name and leaves out the later ones.
+	CollisionSkip
+	// CollisionRename keeps the first name and renames later ones to "name (1).ext", "name (2).ext" and so on.
+	CollisionRename
+)
+
+// Options controls how names are checked. A nil *Options means the defaults.
+type Options struct {
+	// Collisions decides what happens to names that collide with an earlier name in the same folder.
+	Collisions CollisionPolicy
+	// CaseSensitive treats names differing only by case as distinct. Leave it unset when the destination may be on a case-insensitive file system,
+	// as is the default on Windows and macOS.
+	CaseSensitive bool
+	// Portable rejects names that aren't valid on Windows even when running elsewhere, such as "CON", "aux.txt" or "a:b".
+	// These are always rejected on Windows.
+	Portable bool
+	// SkipInvalid leaves out entities with invalid names instead of failing.
+	SkipInvalid bool
+}
+
+// Error reports a rejected name along with its path within the manifest.
+type Error struct {
+	Path string
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("unsafe name %q: %v", e.Path, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func (opts *Options) collisions() CollisionPolicy {
+	if opts == nil {
+		return CollisionReject
+	}
+	return opts.Collisions
+}
+
+func (opts *Options) caseSensitive() bool {
+	return opts != nil && opts.CaseSensitive
+}
+
+func (opts *Options) portable() bool {
+	return runtime.GOOS == "windows" || (opts != nil && opts.Portable)
+}
+
+func (opts *Options) skipInvalid() bool {
+	return opts != nil && opts.SkipInvalid
+}
+
+// Sanitize checks that name is safe to use as a single path component and returns it normalized to NFC.
+func (opts *Options) Sanitize(name string) (string, error) {
+	if !utf8.ValidString(name) {
+		return "", ErrInvalidUTF8
+	}
+	name = norm.NFC.String(name)
+	err := opts.validate(name)
+	if err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+func (opts *Options) validate(name string) error {
+	if name == "" {
+		return ErrEmptyName
+	}
+	if name == "." || name == ".." {
+		return ErrDotName
+	}
+	if len(name) > maxNameBytes {
+		return ErrNameTooLong
+	}
+	for _, r := range name {
+		switch {
+		case r == '/' || r == '\\':
+			// Backslashes separate paths on Windows and can't be told apart from separators once the name reaches a Windows peer
+			return ErrSeparator
+		case r < 0x20 || r == 0x7f:
+			return ErrControlCharacter
+		case opts.portable() && strings.ContainsRune(`<>:"|?*`, r):
+			return ErrInvalidCharacter
+		}
+	}
+	if opts.portable() {
+		if strings.HasSuffix(name, ".") || strings.HasSuffix(name, " ") {
+			return ErrTrailingDotOrSpace
+		}
+		if isReservedOnWindows(name) {
+			return ErrReservedName
+		}
+	}
+	return nil
+}
+
+// isReservedOnWindows reports whether name is a DOS device name, which Windows reserves with any extension and in any case.
+func isReservedOnWindows(name string) bool {
+	base := strings.ToUpper(strings.TrimRight(strings.SplitN(name, ".", 2)[0], " "))
+	switch base {
+	case "CON", "PRN", "AUX", "NUL", "CONIN$", "CONOUT$":
+		return true
+	}
+	if strings.HasPrefix(base, "COM") || strings.HasPrefix(base, "LPT") {
+		// Superscript digits count too
+		switch base[3:] {
+		case "1", "2", "3", "4", "5", "6", "7", "8", "9", "¹", "²", "³":
+			return true
+		}
+	}
+	return false
+}
+
+// Folder tracks the names already used in one destination folder so that colliding names can be detected.
+type Folder struct {
+	opts *Options
+	used map[string]bool
+	fold cases.Caser
+}
+
+// NewFolder creates a Folder with no names used yet.
+func NewFolder(opts *Options) *Folder {
+	return &Folder{
+		opts: opts,
+		used: make(map[string]bool),
+		fold: cases.Fold(),
+	}
+}
+
+// Add sanitizes name and claims it in the folder, returning the local name to use. An empty local name with a nil error means the entity should be
+// skipped because of CollisionSkip or Options.SkipInvalid.
+func (f *Folder) Add(name string) (string, error) {
+	localName, err := f.opts.Sanitize(name)
+	if err != nil {
+		if f.opts.skipInvalid() {
+			return "", nil
+		}
+		return "", err
+	}
+	if f.claim(localName) {
+		return localName, nil
+	}
+	switch f.opts.collisions() {
+	case CollisionReject:
+		return "", ErrNameCollision
+	case CollisionSkip:
+		return "", nil
+	case CollisionRename:
+		ext := path.Ext(localName)
+		if ext == localName {
+			// A dot file like ".profile" has no extension to keep
+			ext = ""
+		}
+		base := strings.TrimSuffix(localName, ext)
+		for i := 1; ; i++ {
+			candidate := fmt.Sprintf("%s (%d)%s", base, i, ext)
+			if f.opts.validate(candidate) != nil {
+				// The name is too long to rename
+				return "", ErrNameCollision
+			}
+			if f.claim(candidate) {
+				return candidate, nil
+			}
+		}
+	default:
+		return "", fmt.Errorf("unknown collision policy %d", f.opts.collisions())
+	}
+}
+
+// claim marks localName as used, reporting false if it, or a name that the file system would consider the same, already is.
+func (f *Folder) claim(localName string) bool {
+	key := localName
+	if !f.opts.caseSensitive() {
+		key = norm.NFC.String(f.fold.String(localName))
+	}
+	if f.used[key] {
+		return false
+	}
+	f.used[key] = true
+	return true
+}
@@ -0,0 +1,133 @@
+package safename
+
+import (
+	"errors"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestSanitize(t *testing.T) {
+	long := strings.Repeat("x", maxNameBytes)
+	tests := []struct {
+		name string
+		// The sanitized name, if there's no error
+		want string
+		// The error with the default options and with Portable set, which Windows always has
+		err, portableErr error
+	}{
+		{"a", "a", nil, nil},
+		{"...", "...", nil, ErrTrailingDotOrSpace},
+		{"a b.txt", "a b.txt", nil, nil},
+		{"cafe\u0301", "caf\u00e9", nil, nil},
+		{long, long, nil, nil},
+
+		{"", "", ErrEmptyName, ErrEmptyName},
+		{".", "", ErrDotName, ErrDotName},
+		{"..", "", ErrDotName, ErrDotName},
+		{"../x", "", ErrSeparator, ErrSeparator},
+		{"a/b", "", ErrSeparator, ErrSeparator},
+		{"/etc", "", ErrSeparator, ErrSeparator},
+		{"..\\evil", "", ErrSeparator, ErrSeparator},
+		{"C:\\x", "", ErrSeparator, ErrInvalidCharacter},
+		{"a\x00b", "", ErrControlCharacter, ErrControlCharacter},
+		{"a\nb", "", ErrControlCharacter, ErrControlCharacter},
+		{"a\x7f", "", ErrControlCharacter, ErrControlCharacter},
+		{"a\xffb", "", ErrInvalidUTF8, ErrInvalidUTF8},
+		{long + "x", "", ErrNameTooLong, ErrNameTooLong},
+
+		{"CON", "CON", nil, ErrReservedName},
+		{"con.txt", "con.txt", nil, ErrReservedName},
+		{"aux", "aux", nil, ErrReservedName},
+		{"NUL .tar.gz", "NUL .tar.gz", nil, ErrReservedName},
+		{"COM1", "COM1", nil, ErrReservedName},
+		{"lpt9.log", "lpt9.log", nil, ErrReservedName},
+		{"COM\u00b9", "COM\u00b9", nil, ErrReservedName},
+		{"CONIN$", "CONIN$", nil, ErrReservedName},
+		{"COM0", "COM0", nil, nil},
+		{"CONSOLE", "CONSOLE", nil, nil},
+		{"a:b", "a:b", nil, ErrInvalidCharacter},
+		{"a?b", "a?b", nil, ErrInvalidCharacter},
+		{"a.", "a.", nil, ErrTrailingDotOrSpace},
+		{"a ", "a ", nil, ErrTrailingDotOrSpace},
+	}
+	for _, test := range tests {
+		for _, portable := range []bool{false, true} {
+			want := test.err
+			if portable || runtime.GOOS == "windows" {
+				want = test.portableErr
+			}
+			got, err := (&Options{Portable: portable}).Sanitize(test.name)
+			if err != want || (err == nil && got != test.want) {
+				t.Errorf("%q (portable %v): got %q, %v, expected %q, %v", test.name, portable, got, err, test.want, want)
+			}
+		}
+	}
+	if _, err := (*Options)(nil).Sanitize(".."); err != ErrDotName {
+		t.Errorf("nil options: got %v", err)
+	}
+}
+
+func TestFolder(t *testing.T) {
+	long := strings.Repeat("x", maxNameBytes)
+	reject := &Options{}
+	skip := &Options{Collisions: CollisionSkip}
+	rename := &Options{Collisions: CollisionRename}
+	tests := []struct {
+		desc  string
+		opts  *Options
+		names []string
+		// The local names of the names added before err, "" for skipped ones
+		want []string
+		err  error
+	}{
+		{"distinct", reject, []string{"a", "b", "A b"}, []string{"a", "b", "A b"}, nil},
+		{"duplicate rejected", reject, []string{"x", "x"}, []string{"x"}, ErrNameCollision},
+		{"case rejected", reject, []string{"Readme", "README"}, []string{"Readme"}, ErrNameCollision},
+		{"case folding rejected", reject, []string{"Stra\u00dfe", "STRASSE"}, []string{"Stra\u00dfe"}, ErrNameCollision},
+		{"NFC rejected", reject, []string{"caf\u00e9", "cafe\u0301"}, []string{"caf\u00e9"}, ErrNameCollision},
+		{"NFC rejected case-sensitively", &Options{CaseSensitive: true}, []string{"caf\u00e9", "cafe\u0301"}, []string{"caf\u00e9"}, ErrNameCollision},
+		{"case kept case-sensitively", &Options{CaseSensitive: true}, []string{"Readme", "README"}, []string{"Readme", "README"}, nil},
+		{"nil options", nil, []string{"a", "A"}, []string{"a"}, ErrNameCollision},
+
+		{"duplicate skipped", skip, []string{"x", "x", "y"}, []string{"x", "", "y"}, nil},
+		{"case skipped", skip, []string{"Readme", "README"}, []string{"Readme", ""}, nil},
+		{"NFC skipped", skip, []string{"cafe\u0301", "caf\u00e9"}, []string{"caf\u00e9", ""}, nil},
+
+		{"duplicate renamed", rename, []string{"x.txt", "x.txt", "X.TXT"}, []string{"x.txt", "x (1).txt", "X (2).TXT"}, nil},
+		{"NFC renamed", rename, []string{"caf\u00e9", "cafe\u0301"}, []string{"caf\u00e9", "caf\u00e9 (1)"}, nil},
+		{"dot file renamed", rename, []string{".profile", ".profile"}, []string{".profile", ".profile (1)"}, nil},
+		{"renamed past a taken name", rename, []string{"x (1)", "x", "x"}, []string{"x (1)", "x", "x (2)"}, nil},
+		{"too long to rename", rename, []string{long, long}, []string{long}, ErrNameCollision},
+
+		{"traversal rejected", rename, []string{"a", ".."}, []string{"a"}, ErrDotName},
+		{"separator rejected", skip, []string{"a/b"}, nil, ErrSeparator},
+		{"NUL rejected", reject, []string{"a\x00b"}, nil, ErrControlCharacter},
+		{"reserved rejected", &Options{Portable: true}, []string{"aux.txt"}, nil, ErrReservedName},
+		{"invalid skipped", &Options{SkipInvalid: true}, []string{"..", "a/b", "a\x00b", "ok"}, []string{"", "", "", "ok"}, nil},
+		{"reserved skipped", &Options{Portable: true, SkipInvalid: true}, []string{"CON", "ok"}, []string{"", "ok"}, nil},
+	}
+	for _, test := range tests {
+		f := NewFolder(test.opts)
+		var got []string
+		var err error
+		for _, name := range test.names {
+			var localName string
+			localName, err = f.Add(name)
+			if err != nil {
+				break
+			}
+			got = append(got, localName)
+		}
+		if err != test.err || strings.Join(got, "|") != strings.Join(test.want, "|") {
+			t.Errorf("%s: got %q, %v, expected %q, %v", test.desc, got, err, test.want, test.err)
+		}
+	}
+}
+
+func TestError(t *testing.T) {
+	err := error(&Error{Path: "a/..", Err: ErrDotName})
+	if !errors.Is(err, ErrDotName) || !strings.Contains(err.Error(), `"a/.."`) {
+		t.Errorf("got %v", err)
+	}
+}
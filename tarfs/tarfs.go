@@ -0,0 +1,324 @@
+// Package tarfs exposes the contents of a tar archive as an io/fs.FS without extracting it, so manifests can be generated from archives.
+package tarfs
+
+import (
+	"archive/tar"
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Symlinks resolving through more hops than this are treated as loops, as on Linux
+const maxSymlinkHops = 40
+
+// Errors
+var (
+	ErrSymlinkLoop = errors.New("Too many levels of symlinks")
+)
+
+// FS is a read-only file system over the entries of a tar archive. It implements fs.ReadDirFS, fs.StatFS and the ReadLink and Lstat methods
+// of manifest.ReadLinkFS. File contents are read from the archive on demand, so the archive must stay readable for as long as the FS is used.
+// Hard links are presented as regular files sharing the content of their target. Sparse files and device nodes are left out.
+type FS struct {
+	r       io.ReaderAt
+	entries map[string]*entry
+}
+
+type entry struct {
+	header *tar.Header
+	// Offset of the file's content within the archive
+	offset int64
+	// Sorted names of the entries inside a folder
+	children []string
+}
+
+// countingReader tracks how far into the archive the tar reader has read, which after Next is where the entry's content starts.
+type countingReader struct {
+	r      io.Reader
+	offset int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.offset += int64(n)
+	return n, err
+}
+
+// New indexes the uncompressed tar archive of the given size read from r.
+func New(r io.ReaderAt, size int64) (*FS, error) {
+	fsys := &FS{
+		r: r,
+		entries: map[string]*entry{
+			".": {header: syntheticDirHeader(".")},
+		},
+	}
+	cr := &countingReader{r: io.NewSectionReader(r, 0, size)}
+	tr := tar.NewReader(cr)
+	var hardLinks []*tar.Header
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		name, ok := cleanName(header.Name)
+		if !ok || isSparse(header) {
+			continue
+		}
+		header.Name = name
+		switch header.Typeflag {
+		case tar.TypeReg, tar.TypeRegA, tar.TypeDir, tar.TypeSymlink:
+			fsys.add(name, &entry{header: header, offset: cr.offset})
+		case tar.TypeLink:
+			hardLinks = append(hardLinks, header)
+		}
+	}
+	// Hard links may only refer to entries that came before them, but resolving them last keeps things simple
+	for _, header := range hardLinks {
+		targetName, ok := cleanName(header.Linkname)
+		if !ok {
+			continue
+		}
+		target, ok := fsys.entries[targetName]
+		if !ok || !target.header.FileInfo().Mode().IsRegular() {
+			continue
+		}
+		linkHeader := *target.header
+		linkHeader.Name = header.Name
+		fsys.add(header.Name, &entry{header: &linkHeader, offset: target.offset})
+	}
+	for _, e := range fsys.entries {
+		sort.Strings(e.children)
+	}
+	return fsys, nil
+}
+
+// add adds the entry, creating any missing parent folders. A later entry with the same name replaces an earlier one, as when extracting.
+func (fsys *FS) add(name string, e *entry) {
+	if existing, ok := fsys.entries[name]; ok {
+		// Keep the contents of a folder that was listed more than once
+		if existing.header.Typeflag == tar.TypeDir && e.header.Typeflag == tar.TypeDir {
+			e.children = existing.children
+		}
+		fsys.entries[name] = e
+		return
+	}
+	fsys.entries[name] = e
+	for name != "." {
+		parentName := path.Dir(name)
+		parent, ok := fsys.entries[parentName]
+		if ok && parent.header.Typeflag == tar.TypeDir {
+			parent.children = append(parent.children, path.Base(name))
+			return
+		}
+		fsys.entries[parentName] = &entry{
+			header:   syntheticDirHeader(parentName),
+			children: []string{path.Base(name)},
+		}
+		if ok {
+			// A folder replacing a file of the same name, which its own parent already lists
+			return
+		}
+		name = parentName
+	}
+}
+
+func syntheticDirHeader(name string) *tar.Header {
+	return &tar.Header{
+		Typeflag: tar.TypeDir,
+		Name:     name,
+		Mode:     0755,
+		ModTime:  time.Unix(0, 0),
+	}
+}
+
+// cleanName turns an archive path into an fs.FS path, rejecting absolute paths and paths climbing out of the archive.
+func cleanName(name string) (string, bool) {
+	name = strings.TrimSuffix(name, "/")
+	if name == "" || strings.HasPrefix(name, "/") {
+		return "", false
+	}
+	name = path.Clean(name)
+	return name, fs.ValidPath(name)
+}
+
+func isSparse(header *tar.Header) bool {
+	if header.Typeflag == tar.TypeGNUSparse {
+		return true
+	}
+	for key := range header.PAXRecords {
+		if strings.HasPrefix(key, "GNU.sparse.") {
+			return true
+		}
+	}
+	return false
+}
+
+// resolve looks up name, following symlinks in every component and, if followLast is set, in the last one too.
+func (fsys *FS) resolve(op, name string, followLast bool) (string, *entry, error) {
+	if !fs.ValidPath(name) {
+		return "", nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	resolved := "."
+	remaining := strings.Split(name, "/")
+	hops := 0
+	for len(remaining) > 0 {
+		component := remaining[0]
+		remaining = remaining[1:]
+		if component == "." {
+			continue
+		}
+		next := path.Join(resolved, component)
+		e, ok := fsys.entries[next]
+		if !ok {
+			return "", nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
+		if e.header.Typeflag != tar.TypeSymlink || (len(remaining) == 0 && !followLast) {
+			resolved = next
+			continue
+		}
+		hops++
+		if hops > maxSymlinkHops {
+			return "", nil, &fs.PathError{Op: op, Path: name, Err: ErrSymlinkLoop}
+		}
+		target := e.header.Linkname
+		joined := path.Join(path.Dir(next), target)
+		if path.IsAbs(target) || !fs.ValidPath(joined) {
+			return "", nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
+		remaining = append(strings.Split(joined, "/"), remaining...)
+		resolved = "."
+	}
+	return resolved, fsys.entries[resolved], nil
+}
+
+// Open opens the named file or folder, following symlinks.
+func (fsys *FS) Open(name string) (fs.File, error) {
+	resolved, e, err := fsys.resolve("open", name, true)
+	if err != nil {
+		return nil, err
+	}
+	info := fileInfo{e.header.FileInfo(), path.Base(name)}
+	if e.header.Typeflag == tar.TypeDir {
+		return &dir{fsys: fsys, name: resolved, info: info, children: e.children}, nil
+	}
+	return &file{
+		SectionReader: io.NewSectionReader(fsys.r, e.offset, e.header.Size),
+		info:          info,
+	}, nil
+}
+
+// Stat returns information about the named file or folder, following symlinks.
+func (fsys *FS) Stat(name string) (fs.FileInfo, error) {
+	_, e, err := fsys.resolve("stat", name, true)
+	if err != nil {
+		return nil, err
+	}
+	return fileInfo{e.header.FileInfo(), path.Base(name)}, nil
+}
+
+// Lstat returns information about the named file or folder without following a symlink in the last component.
+func (fsys *FS) Lstat(name string) (fs.FileInfo, error) {
+	_, e, err := fsys.resolve("lstat", name, false)
+	if err != nil {
+		return nil, err
+	}
+	return fileInfo{e.header.FileInfo(), path.Base(name)}, nil
+}
+
+// ReadLink returns the target of the named symlink.
+func (fsys *FS) ReadLink(name string) (string, error) {
+	_, e, err := fsys.resolve("readlink", name, false)
+	if err != nil {
+		return "", err
+	}
+	if e.header.Typeflag != tar.TypeSymlink {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+	}
+	return e.header.Linkname, nil
+}
+
+// ReadDir returns the entries of the named folder, sorted by name. Entries describe symlinks themselves rather than their targets.
+func (fsys *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	resolved, e, err := fsys.resolve("readdir", name, true)
+	if err != nil {
+		return nil, err
+	}
+	if e.header.Typeflag != tar.TypeDir {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("Not a directory")}
+	}
+	return fsys.dirEntries(resolved, e.children), nil
+}
+
+func (fsys *FS) dirEntries(dirName string, children []string) []fs.DirEntry {
+	dirEntries := make([]fs.DirEntry, len(children))
+	for i, childName := range children {
+		child := fsys.entries[path.Join(dirName, childName)]
+		dirEntries[i] = fs.FileInfoToDirEntry(fileInfo{child.header.FileInfo(), childName})
+	}
+	return dirEntries
+}
+
+// fileInfo reports the name a file was opened by, which differs from the archive's name for the root and for symlink targets.
+type fileInfo struct {
+	fs.FileInfo
+	name string
+}
+
+func (fi fileInfo) Name() string {
+	return fi.name
+}
+
+type file struct {
+	*io.SectionReader
+	info fs.FileInfo
+}
+
+func (f *file) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *file) Close() error {
+	return nil
+}
+
+type dir struct {
+	fsys     *FS
+	name     string
+	info     fs.FileInfo
+	children []string
+	// How many entries ReadDir has returned so far
+	position int
+}
+
+func (d *dir) Stat() (fs.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *dir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: errors.New("Is a directory")}
+}
+
+func (d *dir) Close() error {
+	return nil
+}
+
+func (d *dir) ReadDir(n int) ([]fs.DirEntry, error) {
+	remaining := d.children[d.position:]
+	if n > 0 {
+		if len(remaining) == 0 {
+			return nil, io.EOF
+		}
+		if n < len(remaining) {
+			remaining = remaining[:n]
+		}
+	}
+	d.position += len(remaining)
+	return d.fsys.dirEntries(d.name, remaining), nil
+}
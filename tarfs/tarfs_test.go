@@ -0,0 +1,177 @@
+package tarfs
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+
+	"github.com/pavben/Vortex/manifest"
+)
+
+// testArchive returns a tar archive with the given entries, in order.
+func testArchive(t *testing.T, headers []*tar.Header, contents map[string]string) *bytes.Reader {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, header := range headers {
+		data := contents[header.Name]
+		if header.Typeflag == tar.TypeReg {
+			header.Size = int64(len(data))
+		}
+		if header.Mode == 0 {
+			header.Mode = 0644
+		}
+		err := tw.WriteHeader(header)
+		if err == nil {
+			_, err = tw.Write([]byte(data))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := tw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bytes.NewReader(buf.Bytes())
+}
+
+func testFS(t *testing.T) *FS {
+	t.Helper()
+	contents := map[string]string{
+		"top/a":               "first file",
+		"top/nested/deep/b":   "second file",
+		"../evil":             "escaped",
+		"/abs":                "absolute",
+		"top/replaced":        "old content",
+		"top/../top/replaced": "new content",
+	}
+	r := testArchive(t, []*tar.Header{
+		{Typeflag: tar.TypeDir, Name: "top/", Mode: 0755},
+		{Typeflag: tar.TypeReg, Name: "top/a"},
+		// No entries for top/nested and top/nested/deep
+		{Typeflag: tar.TypeReg, Name: "top/nested/deep/b"},
+		{Typeflag: tar.TypeSymlink, Name: "top/link", Linkname: "a"},
+		{Typeflag: tar.TypeSymlink, Name: "top/dirlink", Linkname: "nested/deep"},
+		{Typeflag: tar.TypeSymlink, Name: "broken/outside", Linkname: "../../etc/passwd"},
+		{Typeflag: tar.TypeSymlink, Name: "broken/loop", Linkname: "loop"},
+		{Typeflag: tar.TypeLink, Name: "top/hard", Linkname: "top/a"},
+		{Typeflag: tar.TypeReg, Name: "../evil"},
+		{Typeflag: tar.TypeReg, Name: "/abs"},
+		{Typeflag: tar.TypeReg, Name: "top/replaced"},
+		// A later entry replaces an earlier one, as when extracting
+		{Typeflag: tar.TypeReg, Name: "top/../top/replaced"},
+		{Typeflag: tar.TypeChar, Name: "top/device"},
+	}, contents)
+	fsys, err := New(r, r.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fsys
+}
+
+func TestFS(t *testing.T) {
+	fsys := testFS(t)
+	// fstest checks every entry it finds, so it only gets to see the folder without broken symlinks
+	top, err := fs.Sub(fsys, "top")
+	if err == nil {
+		err = fstest.TestFS(top, "a", "nested/deep/b", "link", "dirlink", "hard", "replaced")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		data string
+		err  error
+	}{
+		{"top/a", "first file", nil},
+		{"top/nested/deep/b", "second file", nil},
+		{"top/link", "first file", nil},
+		{"top/dirlink/b", "second file", nil},
+		{"top/hard", "first file", nil},
+		{"top/replaced", "new content", nil},
+		{"evil", "", fs.ErrNotExist},
+		{"abs", "", fs.ErrNotExist},
+		{"top/device", "", fs.ErrNotExist},
+		{"broken/outside", "", fs.ErrNotExist},
+		{"broken/loop", "", ErrSymlinkLoop},
+		{"../evil", "", fs.ErrInvalid},
+	}
+	for _, test := range tests {
+		data, err := fs.ReadFile(fsys, test.name)
+		if test.err != nil {
+			if !errors.Is(err, test.err) {
+				t.Errorf("%s: got %v, expected %v", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil || string(data) != test.data {
+			t.Errorf("%s: got %q, %v, expected %q", test.name, data, err, test.data)
+		}
+	}
+	rootEntries, err := fs.ReadDir(fsys, ".")
+	if err != nil || len(rootEntries) != 2 || rootEntries[0].Name() != "broken" || rootEntries[1].Name() != "top" {
+		t.Errorf("the root should only hold broken and top: %v, %v", rootEntries, err)
+	}
+	for _, name := range []string{"top/nested", "top/nested/deep"} {
+		fileInfo, err := fsys.Stat(name)
+		if err != nil || !fileInfo.IsDir() {
+			t.Errorf("%s should be an implicit folder: %v", name, err)
+		}
+	}
+	fileInfo, err := fsys.Lstat("top/link")
+	if err != nil || fileInfo.Mode()&fs.ModeSymlink == 0 {
+		t.Errorf("Lstat of top/link: %v, %v", fileInfo, err)
+	}
+	if target, err := fsys.ReadLink("top/dirlink"); err != nil || target != "nested/deep" {
+		t.Errorf("ReadLink of top/dirlink: %q, %v", target, err)
+	}
+	if _, err := fsys.ReadLink("top/a"); err == nil {
+		t.Error("ReadLink of a regular file succeeded")
+	}
+}
+
+func TestReadChunkFS(t *testing.T) {
+	fsys := testFS(t)
+	opts := &manifest.GenerateOptions{SymlinkPolicy: manifest.SymlinksPreserve}
+	m, err := manifest.GenerateManifestFromFS(context.Background(), fsys, "top", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for relPath, want := range map[string]string{"a": "first file", "nested/deep/b": "second file", "hard": "first file"} {
+		entity, ok := m.EntityByPath(relPath)
+		if !ok {
+			t.Errorf("%s is missing", relPath)
+			continue
+		}
+		data, err := m.ReadChunkFS(fsys, "top", entity.Id(), 0)
+		if err != nil || string(data) != want {
+			t.Errorf("%s: got %q, %v", relPath, data, err)
+		}
+		if err := entity.(*manifest.ManifestFile).VerifyChunk(0, data); err != nil {
+			t.Errorf("%s: %v", relPath, err)
+		}
+	}
+	if entity, ok := m.EntityByPath("link"); !ok {
+		t.Error("the symlink is missing")
+	} else if symlink, ok := entity.(*manifest.ManifestSymlink); !ok || symlink.Target() != "a" {
+		t.Errorf("link: got %#v", entity)
+	}
+	if _, ok := m.EntityByPath("device"); ok {
+		t.Error("the device node was shared")
+	}
+}
+
+func TestNewRejectsCorruptArchives(t *testing.T) {
+	data := []byte("not a tar archive, but long enough to look like a header block or two......")
+	data = append(data, make([]byte, 1024)...)
+	copy(data[100:], "garbage")
+	if _, err := New(bytes.NewReader(data), int64(len(data))); err == nil {
+		t.Error("indexed a corrupt archive")
+	}
+}
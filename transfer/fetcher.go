@@ -0,0 +1,67 @@
+package transfer
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/pavben/Vortex/manifest"
+)
+
+// Errors
+var (
+	ErrManifestMismatch = errors.New("The sharer's manifest differs from the local one")
+)
+
+// Fetcher requests single chunks from a sharer, such as for repairing a local copy with manifest.Manifest.Repair.
+type Fetcher struct {
+	conn     Conn
+	manifest *manifest.Manifest
+}
+
+// NewFetcher prepares to fetch chunks of the files in m from the sharer on conn. The sharer's manifest must be signed by the key whose hash
+// is signerHash, and it must match m exactly, since the sharer's files would be no use for repairing m's files otherwise.
+func NewFetcher(conn Conn, signerHash string, m *manifest.Manifest) (*Fetcher, error) {
+	sharerManifest, _, err := readManifest(conn, signerHash)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(sharerManifest.MerkleRoot(), m.MerkleRoot()) {
+		return nil, ErrManifestMismatch
+	}
+	return &Fetcher{conn: conn, manifest: m}, nil
+}
+
+// Fetch requests chunk index of the file with the given id and returns its data, which the caller must verify. It is a manifest.FetchFunc.
+func (f *Fetcher) Fetch(fileId uint32, index int) ([]byte, error) {
+	// The sharer serves hard links through the file they link to, which has the same chunks
+	requestedId := fileId
+	if entity, ok := f.manifest.EntityById(fileId); ok {
+		if file, ok := entity.(*manifest.ManifestFile); ok {
+			if targetId, isHardLink := file.HardLinkOf(); isHardLink {
+				requestedId = targetId
+			}
+		}
+	}
+	err := WriteMessage(f.conn, &ChunkRequest{FileId: requestedId, Index: index})
+	if err != nil {
+		return nil, err
+	}
+	msg, err := ReadMessage(f.conn)
+	if err != nil {
+		return nil, err
+	}
+	switch m := msg.(type) {
+	case *ChunkData:
+		if m.FileId != requestedId || m.Index != index {
+			return nil, fmt.Errorf("requested chunk %d of file %d but got chunk %d of file %d", index, requestedId, m.Index, m.FileId)
+		}
+		return m.Data, nil
+	case *FileUpdate:
+		return nil, fmt.Errorf("file %d changed on the sharer's side", requestedId)
+	case *Error:
+		return nil, fmt.Errorf("sharer can't serve chunk %d of file %d: %s", index, requestedId, m.Message)
+	default:
+		return nil, ErrUnexpectedMessage
+	}
+}
@@ -0,0 +1,75 @@
+package transfer
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pavben/Vortex/safename"
+)
+
+func TestRepairFromSharer(t *testing.T) {
+	files := map[string]string{"a": "first file", "Readme": "one", "README": "renamed on download", "d": "truncated"}
+	sender, shareKey := testShare(t, files)
+	names := &safename.Options{Portable: true, Collisions: safename.CollisionRename}
+	conn, stop := serve(sender)
+	defer stop()
+	result, err := Receive(context.Background(), conn, shareKey, tempDest(t), &ReceiveOptions{Names: names})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := result.Manifest
+	report, err := m.Verify(context.Background(), result.RootPath, names)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() {
+		t.Fatalf("a fresh download doesn't verify with the names it was downloaded with:\n%v", report)
+	}
+
+	err = ioutil.WriteFile(filepath.Join(result.RootPath, "a"), []byte("FIRST file"), 0644)
+	if err == nil {
+		err = os.Truncate(filepath.Join(result.RootPath, "d"), 3)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err = m.Verify(context.Background(), result.RootPath, names)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Corrupted) != 1 || len(report.Truncated) != 1 || len(report.Missing) != 0 || len(report.Extra) != 0 {
+		t.Fatalf("unexpected report:\n%v", report)
+	}
+	// Receive keeps reading from its connection until it's closed, so repairs need another one
+	conn, stopRepair := serve(sender)
+	defer stopRepair()
+	fetcher, err := NewFetcher(conn, shareKey, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.Repair(context.Background(), result.RootPath, names, report, fetcher.Fetch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err = m.Verify(context.Background(), result.RootPath, names)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() {
+		t.Fatalf("problems remain after repair:\n%v", report)
+	}
+}
+
+func TestFetcherRejectsOtherManifests(t *testing.T) {
+	sender, shareKey := testShare(t, map[string]string{"a": "first file"})
+	other, _ := testShare(t, map[string]string{"a": "other file"})
+	conn, stop := serve(sender)
+	defer stop()
+	_, err := NewFetcher(conn, shareKey, other.Manifest())
+	if err != ErrManifestMismatch {
+		t.Fatalf("got %v, expected ErrManifestMismatch", err)
+	}
+}
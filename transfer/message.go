@@ -0,0 +1,353 @@
+// Package transfer moves the content of a share between a sharer and a receiver. Each message is one frame of a Conn, starting with a type
+// byte. Integers are unsigned varints and byte strings are length-prefixed with one, except for chunk data, which takes up the rest of the frame.
+package transfer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Conn carries messages as frames. It is implemented by *vortexconn.Connection.
+type Conn interface {
+	Write(b []byte) error
+	Read() ([]byte, error)
+	// Close closes the connection, making a Read in progress return an error
+	Close() error
+}
+
+type messageType byte
+
+const (
+	typeManifestRequest messageType = 1
+	typeManifest        messageType = 2
+	typeChunkRequest    messageType = 3
+	typeChunkData       messageType = 4
+	typeFileUpdate      messageType = 5
+	typeError           messageType = 6
+	// Manifest streams
+	typeManifestStreamStart   messageType = 7
+	typeManifestBatch         messageType = 8
+	typeManifestStreamEnd     messageType = 9
+	typeManifestStreamRequest messageType = 10
+	typeManifestBatchAck      messageType = 11
+)
+
+// Errors
+var (
+	ErrUnknownMessage    = errors.New("Unknown message type")
+	ErrUnexpectedMessage = errors.New("Unexpected message")
+)
+
+// Message is one of the message types below.
+type Message interface {
+	messageType() messageType
+}
+
+// ManifestRequest asks the sharer for the signed manifest. It is the first message a receiver sends.
+type ManifestRequest struct{}
+
+// Manifest answers a ManifestRequest with the manifest signed by the sharer, as produced by manifest.Manifest.Sign. A sharer that is still
+// generating its manifest answers with a manifest stream instead, as it does a ManifestStreamRequest.
+type Manifest struct {
+	Signed []byte
+}
+
+// ManifestStreamRequest asks for the manifest as a stream, even if the sharer has finished generating it. Receivers send it after reconnecting
+// in the middle of a stream, and skip the batches they already have. A sharer that didn't stream its manifest answers with Manifest.
+type ManifestStreamRequest struct{}
+
+// ManifestStreamStart begins a manifest stream with the sharer's public key, which the batches and the final signature are checked against.
+// It is followed by ManifestBatch messages and then a ManifestStreamEnd, in between which the sharer also answers chunk requests for the files
+// in the batches sent so far.
+type ManifestStreamStart struct {
+	PublicKey []byte
+}
+
+// ManifestBatch carries the next part of the manifest stream, as written by manifest.StreamWriter: the stream header in the first batch, and
+// then Count whole records. Batches are numbered from 0 by Seq and chained, each signed along with the hash of the one before it (see
+// batchMessage), so that a receiver can act on the entities in a batch as soon as it arrives.
+type ManifestBatch struct {
+	Seq       int
+	Count     int
+	Data      []byte
+	Signature []byte
+}
+
+// ManifestBatchAck tells the sharer that the receiver took in the batch numbered Seq, which must be the next one it hasn't acknowledged. The
+// sharer sends at most streamBatchWindow batches ahead of the acknowledgements, which bounds what a receiver busy writing chunks has to hold.
+type ManifestBatchAck struct {
+	Seq int
+}
+
+// ManifestStreamEnd ends a manifest stream of Batches batches. Signature is the sharer's signature over the whole manifest, as made by
+// manifest.Manifest.Signature, which the receiver checks against the manifest assembled from the stream.
+type ManifestStreamEnd struct {
+	Batches   int
+	Signature []byte
+}
+
+// ChunkRequest asks for one chunk of a file. It is answered with ChunkData, a FileUpdate or an Error.
+type ChunkRequest struct {
+	FileId uint32
+	Index  int
+}
+
+// ChunkData carries the content of a requested chunk.
+type ChunkData struct {
+	FileId uint32
+	Index  int
+	Data   []byte
+}
+
+// FileUpdate replaces a file's entry in the manifest after the file changed on the sharer's side. Update is from MarshalFileUpdate and
+// Signature is the sharer's signature over it along with the share key, FileId and Version (see fileUpdateMessage). Chunks of the file
+// received before the update must be discarded.
+// Version counts the times the sharer updated the file, so that a receiver with several connections can tell which update is the latest.
+type FileUpdate struct {
+	FileId    uint32
+	Version   int
+	Update    []byte
+	Signature []byte
+}
+
+// Error reports that a chunk request can't be served, such as when the file changed and the sharer doesn't re-hash changed files.
+// The receiver should give up on the file.
+type Error struct {
+	FileId  uint32
+	Index   int
+	Message string
+}
+
+func (ManifestRequest) messageType() messageType { return typeManifestRequest }
+func (*Manifest) messageType() messageType       { return typeManifest }
+func (*ChunkRequest) messageType() messageType   { return typeChunkRequest }
+func (*ChunkData) messageType() messageType      { return typeChunkData }
+func (*FileUpdate) messageType() messageType     { return typeFileUpdate }
+func (*Error) messageType() messageType          { return typeError }
+
+func (*ManifestStreamStart) messageType() messageType  { return typeManifestStreamStart }
+func (*ManifestBatch) messageType() messageType        { return typeManifestBatch }
+func (*ManifestStreamEnd) messageType() messageType    { return typeManifestStreamEnd }
+func (ManifestStreamRequest) messageType() messageType { return typeManifestStreamRequest }
+func (*ManifestBatchAck) messageType() messageType     { return typeManifestBatchAck }
+
+// WriteMessage encodes msg and writes it to conn as a single frame.
+func WriteMessage(conn Conn, msg Message) error {
+	return conn.Write(encodeMessage(msg))
+}
+
+func encodeMessage(msg Message) []byte {
+	var buf bytes.Buffer
+	buf.WriteByte(byte(msg.messageType()))
+	switch m := msg.(type) {
+	case ManifestRequest:
+	case *Manifest:
+		writeBytes(&buf, m.Signed)
+	case *ChunkRequest:
+		writeUvarint(&buf, uint64(m.FileId))
+		writeUvarint(&buf, uint64(m.Index))
+	case *ChunkData:
+		writeUvarint(&buf, uint64(m.FileId))
+		writeUvarint(&buf, uint64(m.Index))
+		buf.Write(m.Data)
+	case *FileUpdate:
+		writeUvarint(&buf, uint64(m.FileId))
+		writeUvarint(&buf, uint64(m.Version))
+		writeBytes(&buf, m.Update)
+		writeBytes(&buf, m.Signature)
+	case *Error:
+		writeUvarint(&buf, uint64(m.FileId))
+		writeUvarint(&buf, uint64(m.Index))
+		writeBytes(&buf, []byte(m.Message))
+	case ManifestStreamRequest:
+	case *ManifestStreamStart:
+		writeBytes(&buf, m.PublicKey)
+	case *ManifestBatch:
+		writeUvarint(&buf, uint64(m.Seq))
+		writeUvarint(&buf, uint64(m.Count))
+		writeBytes(&buf, m.Data)
+		writeBytes(&buf, m.Signature)
+	case *ManifestStreamEnd:
+		writeUvarint(&buf, uint64(m.Batches))
+		writeBytes(&buf, m.Signature)
+	case *ManifestBatchAck:
+		writeUvarint(&buf, uint64(m.Seq))
+	default:
+		panic(fmt.Sprintf("WriteMessage: unexpected message type %T", msg))
+	}
+	return buf.Bytes()
+}
+
+// ReadMessage reads the next frame from conn and decodes it.
+func ReadMessage(conn Conn) (Message, error) {
+	frame, err := conn.Read()
+	if err != nil {
+		return nil, err
+	}
+	return decodeFrame(frame)
+}
+
+func decodeFrame(frame []byte) (Message, error) {
+	if len(frame) == 0 {
+		return nil, errors.New("empty message")
+	}
+	r := bytes.NewReader(frame[1:])
+	msg, err := decodeMessage(messageType(frame[0]), r)
+	if err != nil {
+		return nil, err
+	}
+	if r.Len() != 0 {
+		return nil, fmt.Errorf("message of type %d has %d trailing bytes", frame[0], r.Len())
+	}
+	return msg, nil
+}
+
+func decodeMessage(t messageType, r *bytes.Reader) (Message, error) {
+	switch t {
+	case typeManifestRequest:
+		return ManifestRequest{}, nil
+	case typeManifest:
+		signed, err := readBytes(r)
+		if err != nil {
+			return nil, err
+		}
+		return &Manifest{Signed: signed}, nil
+	case typeChunkRequest:
+		fileId, index, err := readChunkId(r)
+		if err != nil {
+			return nil, err
+		}
+		return &ChunkRequest{FileId: fileId, Index: index}, nil
+	case typeChunkData:
+		fileId, index, err := readChunkId(r)
+		if err != nil {
+			return nil, err
+		}
+		data := make([]byte, r.Len())
+		r.Read(data)
+		return &ChunkData{FileId: fileId, Index: index, Data: data}, nil
+	case typeFileUpdate:
+		fileId, err := readUint32(r)
+		if err != nil {
+			return nil, err
+		}
+		version, err := readUint32(r)
+		if err != nil {
+			return nil, err
+		}
+		update, err := readBytes(r)
+		if err != nil {
+			return nil, err
+		}
+		signature, err := readBytes(r)
+		if err != nil {
+			return nil, err
+		}
+		return &FileUpdate{FileId: fileId, Version: int(version), Update: update, Signature: signature}, nil
+	case typeError:
+		fileId, index, err := readChunkId(r)
+		if err != nil {
+			return nil, err
+		}
+		message, err := readBytes(r)
+		if err != nil {
+			return nil, err
+		}
+		return &Error{FileId: fileId, Index: index, Message: string(message)}, nil
+	case typeManifestStreamRequest:
+		return ManifestStreamRequest{}, nil
+	case typeManifestStreamStart:
+		publicKey, err := readBytes(r)
+		if err != nil {
+			return nil, err
+		}
+		return &ManifestStreamStart{PublicKey: publicKey}, nil
+	case typeManifestBatch:
+		seq, err := readUint32(r)
+		if err != nil {
+			return nil, err
+		}
+		count, err := readUint32(r)
+		if err != nil {
+			return nil, err
+		}
+		data, err := readBytes(r)
+		if err != nil {
+			return nil, err
+		}
+		signature, err := readBytes(r)
+		if err != nil {
+			return nil, err
+		}
+		return &ManifestBatch{Seq: int(seq), Count: int(count), Data: data, Signature: signature}, nil
+	case typeManifestStreamEnd:
+		batches, err := readUint32(r)
+		if err != nil {
+			return nil, err
+		}
+		signature, err := readBytes(r)
+		if err != nil {
+			return nil, err
+		}
+		return &ManifestStreamEnd{Batches: int(batches), Signature: signature}, nil
+	case typeManifestBatchAck:
+		seq, err := readUint32(r)
+		if err != nil {
+			return nil, err
+		}
+		return &ManifestBatchAck{Seq: int(seq)}, nil
+	default:
+		return nil, ErrUnknownMessage
+	}
+}
+
+func writeUvarint(buf *bytes.Buffer, v uint64) {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], v)
+	buf.Write(tmp[:n])
+}
+
+func writeBytes(buf *bytes.Buffer, b []byte) {
+	writeUvarint(buf, uint64(len(b)))
+	buf.Write(b)
+}
+
+func readUint32(r *bytes.Reader) (uint32, error) {
+	v, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, io.ErrUnexpectedEOF
+	}
+	if v > 0xFFFFFFFF {
+		return 0, fmt.Errorf("value %d overflows 32 bits", v)
+	}
+	return uint32(v), nil
+}
+
+func readChunkId(r *bytes.Reader) (uint32, int, error) {
+	fileId, err := readUint32(r)
+	if err != nil {
+		return 0, 0, err
+	}
+	// Chunk indexes are bounded by file sizes, which are far below 2^32 chunks
+	index, err := readUint32(r)
+	if err != nil {
+		return 0, 0, err
+	}
+	return fileId, int(index), nil
+}
+
+func readBytes(r *bytes.Reader) ([]byte, error) {
+	length, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if length > uint64(r.Len()) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	b := make([]byte, length)
+	r.Read(b)
+	return b, nil
+}
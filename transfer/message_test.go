@@ -0,0 +1,89 @@
+package transfer
+
+import (
+	"io"
+	"reflect"
+	"testing"
+)
+
+// frameQueue is a Conn that reads back the frames written to it, in order.
+type frameQueue struct {
+	frames [][]byte
+}
+
+func (q *frameQueue) Write(b []byte) error {
+	q.frames = append(q.frames, append([]byte(nil), b...))
+	return nil
+}
+
+func (q *frameQueue) Read() ([]byte, error) {
+	if len(q.frames) == 0 {
+		return nil, io.EOF
+	}
+	frame := q.frames[0]
+	q.frames = q.frames[1:]
+	return frame, nil
+}
+
+func (q *frameQueue) Close() error {
+	return nil
+}
+
+func TestMessageRoundTrips(t *testing.T) {
+	messages := []Message{
+		ManifestRequest{},
+		&Manifest{Signed: []byte("signed manifest")},
+		&ChunkRequest{FileId: 7, Index: 1 << 20},
+		&ChunkData{FileId: 0xFFFFFFFF, Index: 3, Data: []byte("chunk")},
+		&ChunkData{FileId: 1, Index: 0, Data: []byte{}},
+		&FileUpdate{FileId: 2, Version: 300, Update: []byte("update"), Signature: []byte("signature")},
+		&Error{FileId: 4, Index: 5, Message: "the file can't be read"},
+		ManifestStreamRequest{},
+		&ManifestStreamStart{PublicKey: []byte("public key")},
+		&ManifestBatch{Seq: 300, Count: 2, Data: []byte("records"), Signature: []byte("signature")},
+		&ManifestStreamEnd{Batches: 301, Signature: []byte("signature")},
+		&ManifestBatchAck{Seq: 300},
+	}
+	q := &frameQueue{}
+	for _, msg := range messages {
+		err := WriteMessage(q, msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, want := range messages {
+		got, err := ReadMessage(q)
+		if err != nil {
+			t.Fatalf("%T: %v", want, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got %#v, expected %#v", got, want)
+		}
+	}
+	if _, err := ReadMessage(q); err != io.EOF {
+		t.Errorf("reading past the end: got %v, expected io.EOF", err)
+	}
+}
+
+func TestMessageRejects(t *testing.T) {
+	valid := &frameQueue{}
+	WriteMessage(valid, &FileUpdate{FileId: 2, Version: 1, Update: []byte("update"), Signature: []byte("signature")})
+	update := valid.frames[0]
+	tests := []struct {
+		name  string
+		frame []byte
+	}{
+		{"empty", []byte{}},
+		{"unknown type", []byte{99}},
+		{"truncated", update[:len(update)-1]},
+		{"trailing bytes", append(append([]byte(nil), update...), 0)},
+		{"file id over 32 bits", []byte{byte(typeChunkRequest), 0x80, 0x80, 0x80, 0x80, 0x10, 0}},
+		{"length past the end", []byte{byte(typeManifest), 10, 'x'}},
+	}
+	for _, test := range tests {
+		_, err := ReadMessage(&frameQueue{frames: [][]byte{test.frame}})
+		if err == nil {
+			t.Errorf("%s: decoded without an error", test.name)
+		}
+	}
+}
@@ -0,0 +1,411 @@
+package transfer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+// Chunk requests are pipelined: every connection keeps a window of requests outstanding, which the sharer answers in order, so that downloads
+// over links with a long round-trip time aren't limited to one chunk per round trip. All connections feed their messages to the receiver,
+// which does the writing, so the receiver's state is only ever touched by one goroutine.
+
+const (
+	// The adaptive window starts at initialWindow requests and stays between minWindow and maxWindow
+	initialWindow = 4
+	minWindow     = 2
+	maxWindow     = 32
+)
+
+// windowSizer decides how many requests a connection keeps outstanding. Unless the size is fixed, it aims for twice the bandwidth-delay
+// product measured over the last round of responses. As long as requests don't queue up, round trips stay near the shortest one seen and the
+// window doubles every round. Once the link is saturated, the queueing delay holds it steady.
+type windowSizer struct {
+	size           int
+	fixed          bool
+	minRtt         time.Duration
+	roundStart     time.Time
+	roundBytes     uint64
+	roundResponses int
+}
+
+func newWindowSizer(fixedSize int) *windowSizer {
+	if fixedSize > 0 {
+		return &windowSizer{size: fixedSize, fixed: true}
+	}
+	return &windowSizer{size: initialWindow}
+}
+
+// responded records the response to a request sent at sentAt, carrying n bytes of chunk data.
+func (w *windowSizer) responded(sentAt time.Time, n int) {
+	if w.fixed {
+		return
+	}
+	now := time.Now()
+	if rtt := now.Sub(sentAt); w.minRtt == 0 || rtt < w.minRtt {
+		w.minRtt = rtt
+	}
+	if w.roundStart.IsZero() {
+		w.roundStart = sentAt
+	}
+	w.roundBytes += uint64(n)
+	w.roundResponses++
+	if w.roundResponses < w.size {
+		return
+	}
+	elapsed := now.Sub(w.roundStart).Seconds()
+	if elapsed > 0 && w.roundBytes > 0 {
+		throughput := float64(w.roundBytes) / elapsed
+		averageChunk := float64(w.roundBytes) / float64(w.roundResponses)
+		size := int(math.Ceil(2 * throughput * w.minRtt.Seconds() / averageChunk))
+		if size < minWindow {
+			size = minWindow
+		}
+		if size > maxWindow {
+			size = maxWindow
+		}
+		w.size = size
+	}
+	w.roundStart = now
+	w.roundBytes = 0
+	w.roundResponses = 0
+}
+
+// connection is one of the receiver's connections to the sharer, with the requests outstanding on it, oldest first.
+type connection struct {
+	conn Conn
+	// Incremented whenever conn is replaced, so that messages still arriving from the old one can be ignored
+	generation int
+	requests   []*request
+	window     *windowSizer
+}
+
+// request is an outstanding chunk request. A chunk is only requested once however many files contain it, and the data is written to every
+// target waiting for its hash.
+type request struct {
+	target chunkTarget
+	hash   string
+	sentAt time.Time
+}
+
+// chunkTarget is a chunk to be written, along with the revision of its file at the time, which tells whether the file was updated since.
+type chunkTarget struct {
+	fileId   uint32
+	index    int
+	revision int
+}
+
+// connEvent is a message or error read from a connection.
+type connEvent struct {
+	c          *connection
+	generation int
+	msg        Message
+	err        error
+}
+
+// receiveFiles downloads every chunk that isn't done yet over conn and as many other connections as the options ask for.
+func (r *receiver) receiveFiles(ctx context.Context, conn Conn) error {
+	// Each connection has at most a window of responses and an error on its way, and the one a manifest stream comes in on a window of
+	// batches and the end too, so readers never wait on a receiver busy writing requests
+	window := maxWindow
+	if r.opts.window() > window {
+		window = r.opts.window()
+	}
+	r.events = make(chan connEvent, r.opts.connections()*(window+1)+streamBatchWindow+1)
+	r.done = make(chan struct{})
+	defer close(r.done)
+	defer r.closeFiles()
+	r.addConnection(conn)
+	if r.stream == nil {
+		r.addConnections()
+	}
+	// Chunks are dropped from a pass when their file is updated or their connection drops, so keep going until a pass finds nothing missing
+	for {
+		todo := r.missingChunks()
+		r.newChunks = nil
+		if len(todo) == 0 && r.stream == nil {
+			return nil
+		}
+		// While the manifest is streamed, more files can arrive even with nothing left to request
+		for len(todo) > 0 || r.outstanding() > 0 || r.stream != nil {
+			var err error
+			todo, err = r.sendRequests(ctx, todo)
+			if err != nil {
+				return err
+			}
+			if r.outstanding() == 0 && r.stream == nil {
+				continue
+			}
+			select {
+			case ev := <-r.events:
+				err = r.handleEvent(ctx, ev)
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			if err != nil {
+				return err
+			}
+			todo = append(todo, r.newChunks...)
+			r.newChunks = nil
+		}
+	}
+}
+
+// addConnections opens the extra connections asked for by the options.
+func (r *receiver) addConnections() {
+	for len(r.connections) < r.opts.connections() {
+		conn, err := r.openConnection()
+		if err != nil {
+			r.opts.warn(fmt.Errorf("continuing with %d connections: %v", len(r.connections), err))
+			return
+		}
+		r.addConnection(conn)
+	}
+}
+
+// openConnection opens another connection to the sharer with Redial.
+func (r *receiver) openConnection() (Conn, error) {
+	redial := r.opts.redial()
+	if redial == nil {
+		return nil, errors.New("more connections need Redial to be set")
+	}
+	conn, err := redial()
+	if err != nil {
+		return nil, err
+	}
+	// The share may have changed since the first connection was made, and the new session must agree with the receiver on every file
+	err = r.syncManifest(conn)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (r *receiver) addConnection(conn Conn) {
+	c := &connection{window: newWindowSizer(r.opts.window())}
+	r.connections = append(r.connections, c)
+	r.startConnection(c, conn)
+}
+
+// startConnection makes conn the connection of c and starts reading from it.
+func (r *receiver) startConnection(c *connection, conn Conn) {
+	c.conn = conn
+	c.generation++
+	c.requests = nil
+	generation := c.generation
+	go func() {
+		for {
+			msg, err := ReadMessage(conn)
+			select {
+			case r.events <- connEvent{c: c, generation: generation, msg: msg, err: err}:
+			case <-r.done:
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+}
+
+func (r *receiver) outstanding() int {
+	n := 0
+	for _, c := range r.connections {
+		n += len(c.requests)
+	}
+	return n
+}
+
+// missingChunks lists the chunks that aren't done yet, in Walk order, leaving out files that failed.
+func (r *receiver) missingChunks() []chunkTarget {
+	var todo []chunkTarget
+	for _, fileId := range r.fileIds {
+		if r.hasFailed(fileId) {
+			continue
+		}
+		for _, chunk := range r.file(fileId).Chunks() {
+			if !r.state.isDone(fileId, chunk.Index) {
+				todo = append(todo, chunkTarget{fileId: fileId, index: chunk.Index, revision: r.revisions[fileId]})
+			}
+		}
+	}
+	return todo
+}
+
+// sendRequests works through todo until every window is full, copying chunks that were already written locally instead of requesting them.
+// It returns what is left.
+func (r *receiver) sendRequests(ctx context.Context, todo []chunkTarget) ([]chunkTarget, error) {
+	for len(todo) > 0 {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		target := todo[0]
+		if !r.isCurrent(target) {
+			// Its file was updated or failed, or a local copy already took care of it
+			todo = todo[1:]
+			continue
+		}
+		file := r.file(target.fileId)
+		chunk, _ := file.Chunk(target.index)
+		hash := string(chunk.Hash)
+		if targets, requested := r.waiting[hash]; requested {
+			r.waiting[hash] = append(targets, target)
+			todo = todo[1:]
+			continue
+		}
+		if data := r.localCopy(chunk.Hash); data != nil {
+			err := r.writeChunk(target, data)
+			if err != nil {
+				return nil, err
+			}
+			todo = todo[1:]
+			continue
+		}
+		c := r.freestConnection()
+		if c == nil {
+			break
+		}
+		err := WriteMessage(c.conn, &ChunkRequest{FileId: target.fileId, Index: target.index})
+		if err != nil {
+			err = r.connectionFailed(ctx, c, err)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		c.requests = append(c.requests, &request{target: target, hash: hash, sentAt: time.Now()})
+		r.waiting[hash] = []chunkTarget{target}
+		todo = todo[1:]
+	}
+	return todo, nil
+}
+
+// freestConnection returns the connection with the most room in its window, or nil if every window is full.
+func (r *receiver) freestConnection() *connection {
+	var freest *connection
+	room := 0
+	for _, c := range r.connections {
+		if n := c.window.size - len(c.requests); n > room {
+			freest = c
+			room = n
+		}
+	}
+	return freest
+}
+
+// isCurrent reports whether target still needs to be written: its file hasn't been updated or failed since, and the chunk isn't done.
+func (r *receiver) isCurrent(target chunkTarget) bool {
+	return r.revisions[target.fileId] == target.revision && !r.hasFailed(target.fileId) &&
+		!r.state.isDone(target.fileId, target.index)
+}
+
+func (r *receiver) handleEvent(ctx context.Context, ev connEvent) error {
+	c := ev.c
+	if ev.generation != c.generation {
+		// From a connection that dropped and was replaced
+		return nil
+	}
+	if ev.err != nil {
+		return r.connectionFailed(ctx, c, ev.err)
+	}
+	switch m := ev.msg.(type) {
+	case *ManifestBatch:
+		err := r.addBatch(m)
+		if err != nil {
+			return err
+		}
+		err = WriteMessage(c.conn, &ManifestBatchAck{Seq: m.Seq})
+		if err != nil {
+			return r.connectionFailed(ctx, c, err)
+		}
+		return nil
+	case *ManifestStreamEnd:
+		return r.endStream(m)
+	}
+	if len(c.requests) == 0 {
+		return ErrUnexpectedMessage
+	}
+	req := c.requests[0]
+	c.requests = c.requests[1:]
+	targets := r.waiting[req.hash]
+	delete(r.waiting, req.hash)
+	fileId, index := req.target.fileId, req.target.index
+	switch m := ev.msg.(type) {
+	case *ChunkData:
+		if m.FileId != fileId || m.Index != index {
+			return fmt.Errorf("requested chunk %d of file %d but got chunk %d of file %d", index, fileId, m.Index, m.FileId)
+		}
+		c.window.responded(req.sentAt, len(m.Data))
+		if r.revisions[fileId] != req.target.revision {
+			// The file was updated after the request was sent, so the data may be from either version. Its chunks are requested again.
+			return nil
+		}
+		err := r.file(fileId).VerifyChunk(index, m.Data)
+		if err != nil {
+			// Left for the next pass to request again, along with the other targets waiting for it
+			r.chunkFailed(fileId, index, err)
+			return nil
+		}
+		for _, target := range targets {
+			if !r.isCurrent(target) {
+				continue
+			}
+			err = r.writeChunk(target, m.Data)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case *FileUpdate:
+		if m.FileId != fileId {
+			return fmt.Errorf("requested file %d but got an update for file %d", fileId, m.FileId)
+		}
+		c.window.responded(req.sentAt, 0)
+		return r.applyUpdate(m)
+	case *Error:
+		c.window.responded(req.sentAt, 0)
+		if r.revisions[fileId] != req.target.revision {
+			// Requested before the file was updated, so the chunk may not exist anymore
+			return nil
+		}
+		if !r.hasFailed(fileId) {
+			r.fail(fileId, &fileAbortedError{message: m.Message})
+		}
+		return nil
+	default:
+		return ErrUnexpectedMessage
+	}
+}
+
+// chunkFailed records that the sharer sent chunk index of the file with the given id with data that doesn't match its hash, and gives up on
+// the file once too many of its chunks did.
+func (r *receiver) chunkFailed(fileId uint32, index int, err error) {
+	relPath := r.pathOf(fileId)
+	r.badChunks[fileId]++
+	if r.badChunks[fileId] > maxBadChunks {
+		r.fail(fileId, fmt.Errorf("the sharer sent more than %d bad chunks, the last being chunk %d: %v", maxBadChunks, index, err))
+		return
+	}
+	r.opts.warn(fmt.Errorf("%s: chunk %d from the sharer is bad and will be requested again: %v", relPath, index, err))
+}
+
+// connectionFailed closes the connection of c after err ended it and reconnects. The chunks requested on it are left for the next pass.
+func (r *receiver) connectionFailed(ctx context.Context, c *connection, err error) error {
+	c.conn.Close()
+	err = &connectionError{err}
+	if r.opts.redial() == nil {
+		return err
+	}
+	for _, req := range c.requests {
+		delete(r.waiting, req.hash)
+	}
+	c.requests = nil
+	conn, err := r.reconnect(ctx, err)
+	if err != nil {
+		return err
+	}
+	r.startConnection(c, conn)
+	return nil
+}
@@ -0,0 +1,232 @@
+package transfer
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pavben/Vortex/manifest"
+	"github.com/pavben/Vortex/pubkeycrypto"
+)
+
+// corruptingConn flips a bit in the data of the chunks it reads from the sharer, as long as corrupt returns true for the data.
+type corruptingConn struct {
+	Conn
+	corrupt func(data []byte) bool
+}
+
+func (c *corruptingConn) Read() ([]byte, error) {
+	b, err := c.Conn.Read()
+	if err != nil || messageType(b[0]) != typeChunkData {
+		return b, err
+	}
+	// The data comes last in the frame, and the tests only share files of a single chunk
+	if !c.corrupt(b) {
+		return b, nil
+	}
+	b = append([]byte(nil), b...)
+	b[len(b)-1] ^= 1
+	return b, nil
+}
+
+// droppingConn fails the dropAt'th chunk request written to it, and records whether it was closed.
+type droppingConn struct {
+	Conn
+	requests, dropAt int
+	closed           bool
+}
+
+func (c *droppingConn) Write(b []byte) error {
+	if messageType(b[0]) == typeChunkRequest {
+		c.requests++
+		if c.requests == c.dropAt {
+			return io.ErrClosedPipe
+		}
+	}
+	return c.Conn.Write(b)
+}
+
+func (c *droppingConn) Close() error {
+	c.closed = true
+	return c.Conn.Close()
+}
+
+// testShare generates a manifest of a folder with the given files, by name, and a sender for it.
+func testShare(t *testing.T, files map[string]string) (*Sender, string) {
+	t.Helper()
+	tempDir, err := ioutil.TempDir("", "share")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tempDir) })
+	root := filepath.Join(tempDir, "share")
+	for name, data := range files {
+		writeFile(t, filepath.Join(root, name), data)
+	}
+	m, err := manifest.GenerateManifest(context.Background(), root, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPair, err := pubkeycrypto.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender, err := NewSender(m, root, keyPair.PrivateKey, &SenderOptions{Warn: func(err error) { t.Log(err) }})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sender, keyPair.PublicKey.Sha1Hash()
+}
+
+func tempDest(t *testing.T) string {
+	t.Helper()
+	destPath, err := ioutil.TempDir("", "dest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(destPath) })
+	return destPath
+}
+
+func TestBadChunkIsRequestedAgain(t *testing.T) {
+	sender, shareKey := testShare(t, map[string]string{"a": "first file", "b": "second file"})
+	corrupted := false
+	conn, stop := serve(sender)
+	defer stop()
+	badConn := &corruptingConn{Conn: conn, corrupt: func(frame []byte) bool {
+		// Only the first response for a is bad
+		if !bytes.HasSuffix(frame, []byte("first file")) || corrupted {
+			return false
+		}
+		corrupted = true
+		return true
+	}}
+	result, err := Receive(context.Background(), badConn, shareKey, tempDest(t), &ReceiveOptions{Warn: func(err error) { t.Log(err) }})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !corrupted || len(result.Failed) != 0 {
+		t.Fatalf("corrupted: %v, failed: %v", corrupted, result.Failed)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(result.RootPath, "a"))
+	if err != nil || string(data) != "first file" {
+		t.Fatalf("got %q, %v", data, err)
+	}
+}
+
+func TestBadChunksFailOnlyTheirFile(t *testing.T) {
+	sender, shareKey := testShare(t, map[string]string{"a": "first file", "b": "second file"})
+	conn, stop := serve(sender)
+	defer stop()
+	badConn := &corruptingConn{Conn: conn, corrupt: func(frame []byte) bool { return bytes.HasSuffix(frame, []byte("first file")) }}
+	result, err := Receive(context.Background(), badConn, shareKey, tempDest(t), &ReceiveOptions{Warn: func(err error) { t.Log(err) }})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, failed := result.Failed["a"]; !failed || len(result.Failed) != 1 {
+		t.Fatalf("only a should have failed: %v", result.Failed)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(result.RootPath, "b"))
+	if err != nil || string(data) != "second file" {
+		t.Fatalf("got %q, %v", data, err)
+	}
+}
+
+func TestDroppedConnectionIsClosed(t *testing.T) {
+	files := map[string]string{"a": "first file", "b": "second file", "c": "third file"}
+	sender, shareKey := testShare(t, files)
+	conn, stop := serve(sender)
+	defer stop()
+	first := &droppingConn{Conn: conn, dropAt: 2}
+	var stops []func()
+	defer func() {
+		for _, stop := range stops {
+			stop()
+		}
+	}()
+	opts := &ReceiveOptions{
+		Warn: func(err error) { t.Log(err) },
+		Redial: func() (Conn, error) {
+			conn, stop := serve(sender)
+			stops = append(stops, stop)
+			return conn, nil
+		},
+	}
+	result, err := Receive(context.Background(), first, shareKey, tempDest(t), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !first.closed {
+		t.Error("the dropped connection wasn't closed")
+	}
+	for name, want := range files {
+		data, err := ioutil.ReadFile(filepath.Join(result.RootPath, name))
+		if err != nil || !bytes.Equal(data, []byte(want)) {
+			t.Errorf("%s: got %q, %v", name, data, err)
+		}
+	}
+}
+
+func TestReconnectRejectsEntitiesChangingKind(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(t *testing.T, root string)
+		opts   *manifest.GenerateOptions
+	}{
+		{"file to folder", func(t *testing.T, root string) {
+			// An empty folder, since the files in a folder would take the ids before it
+			os.Remove(filepath.Join(root, "a"))
+			if err := os.Mkdir(filepath.Join(root, "a"), 0755); err != nil {
+				t.Fatal(err)
+			}
+		}, nil},
+		{"file to symlink", func(t *testing.T, root string) {
+			os.Remove(filepath.Join(root, "a"))
+			if err := os.Symlink("b", filepath.Join(root, "a")); err != nil {
+				t.Fatal(err)
+			}
+		}, &manifest.GenerateOptions{SymlinkPolicy: manifest.SymlinksPreserve}},
+		{"file to hard link", func(t *testing.T, root string) {
+			os.Remove(filepath.Join(root, "b"))
+			if err := os.Link(filepath.Join(root, "a"), filepath.Join(root, "b")); err != nil {
+				t.Fatal(err)
+			}
+		}, nil},
+	}
+	for _, test := range tests {
+		sender, shareKey := testShare(t, map[string]string{"a": "first file", "b": "second file"})
+		conn, stop := serve(sender)
+		// The sharer restarts with a manifest in which an entity kept its id and path but changed kind
+		test.change(t, sender.rootPath)
+		m, err := manifest.GenerateManifest(context.Background(), sender.rootPath, test.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		changed, err := NewSender(m, sender.rootPath, sender.privateKey, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var stops []func()
+		opts := &ReceiveOptions{
+			Warn: func(err error) { t.Log(err) },
+			Redial: func() (Conn, error) {
+				conn, stop := serve(changed)
+				stops = append(stops, stop)
+				return conn, nil
+			},
+		}
+		_, err = Receive(context.Background(), &droppingConn{Conn: conn, dropAt: 1}, shareKey, tempDest(t), opts)
+		stop()
+		for _, stop := range stops {
+			stop()
+		}
+		if err == nil || !strings.Contains(err.Error(), "no longer the same kind") {
+			t.Errorf("%s: got %v, expected an error about the entity changing kind", test.name, err)
+		}
+	}
+}
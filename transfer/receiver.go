@@ -0,0 +1,777 @@
+package transfer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pavben/Vortex/manifest"
+	"github.com/pavben/Vortex/pubkeycrypto"
+	"github.com/pavben/Vortex/safename"
+)
+
+const (
+	// How many times a single file may be updated during one download before the receiver gives up on it
+	maxFileUpdates = 10
+	// How many chunks of a single file may fail verification before the receiver gives up on it. Each bad chunk is requested again.
+	maxBadChunks = 3
+	// How often the resume file is saved while chunks are being written
+	resumeSaveInterval = time.Second
+)
+
+// ReceiveOptions controls how a share is downloaded. A nil *ReceiveOptions means the defaults.
+type ReceiveOptions struct {
+	// Names decides how names from the sharer are mapped to local names
+	Names *safename.Options
+	// Progress, if non-nil, is called after every chunk written
+	Progress func(Progress)
+	// Warn, if non-nil, is called for problems that don't stop the download, such as metadata that can't be applied. If nil, they're ignored.
+	Warn func(err error)
+	// Redial, if non-nil, is called to connect to the sharer again when a connection drops, after which the download continues from the
+	// last verified chunk. It is the place to look the sharer up again in case its address changed, and to resume with a session ticket.
+	// It also opens the extra connections asked for by Connections.
+	Redial func() (Conn, error)
+	// RedialAttempts is how many times in a row Redial is tried, with growing pauses in between, before the download fails. Zero means 5.
+	RedialAttempts int
+	// Connections is how many connections to download over in parallel. The first is the one passed to Receive and the others are opened with
+	// Redial. Zero means 1.
+	Connections int
+	// Window is how many chunk requests each connection keeps outstanding. Zero means the window adapts to the measured throughput and
+	// round-trip time.
+	Window int
+	// AllowUnsafeSymlinks creates symlinks whatever their targets. Otherwise symlinks that could point outside the root folder, such as ones
+	// with absolute targets, are skipped with a warning. See manifest.Manifest.SymlinkStaysInside.
+	AllowUnsafeSymlinks bool
+	// SkipMetadata leaves out the permissions, modification times and extended attributes in the manifest, so that files and folders get the
+	// defaults of the local system
+	SkipMetadata bool
+}
+
+// Progress describes how far along a download is.
+type Progress struct {
+	// Path is the file currently being downloaded, relative to the root entity
+	Path          string
+	FileBytesDone uint64
+	FileSize      uint64
+	BytesDone     uint64
+	BytesTotal    uint64
+}
+
+// Result describes a finished download.
+type Result struct {
+	// Manifest is the manifest the download followed, including updates to files that changed on the sharer's side
+	Manifest *manifest.Manifest
+	// SignedManifest is the manifest as the sharer last signed it, which can be saved and verified again later with manifest.OpenSigned.
+	// It matches Manifest unless files were updated after it was signed, in which case their updates are missing from it.
+	SignedManifest []byte
+	// RootPath is the local path of the root entity
+	RootPath string
+	// Failed holds the files that couldn't be downloaded, by path relative to the root entity, such as files the sharer gave up on.
+	// The resume file is kept when any file failed, so that running the download again retries only those.
+	Failed map[string]error
+	// Resumed is true if the download continued one that was interrupted
+	Resumed bool
+	// Dedup tells how much of the share's content is duplicated, which is only transferred once
+	Dedup manifest.DedupReport
+}
+
+func (opts *ReceiveOptions) names() *safename.Options {
+	if opts == nil {
+		return nil
+	}
+	return opts.Names
+}
+
+func (opts *ReceiveOptions) redial() func() (Conn, error) {
+	if opts == nil {
+		return nil
+	}
+	return opts.Redial
+}
+
+func (opts *ReceiveOptions) redialAttempts() int {
+	if opts == nil || opts.RedialAttempts <= 0 {
+		return 5
+	}
+	return opts.RedialAttempts
+}
+
+func (opts *ReceiveOptions) connections() int {
+	if opts == nil || opts.Connections <= 0 {
+		return 1
+	}
+	return opts.Connections
+}
+
+func (opts *ReceiveOptions) window() int {
+	if opts == nil || opts.Window < 0 {
+		return 0
+	}
+	return opts.Window
+}
+
+func (opts *ReceiveOptions) allowUnsafeSymlinks() bool {
+	return opts != nil && opts.AllowUnsafeSymlinks
+}
+
+func (opts *ReceiveOptions) skipMetadata() bool {
+	return opts != nil && opts.SkipMetadata
+}
+
+func (opts *ReceiveOptions) progress(p Progress) {
+	if opts != nil && opts.Progress != nil {
+		opts.Progress(p)
+	}
+}
+
+func (opts *ReceiveOptions) warn(err error) {
+	if opts != nil && opts.Warn != nil {
+		opts.Warn(err)
+	}
+}
+
+// fileAbortedError is why a file the sharer can't serve failed, which doesn't stop the rest of the download.
+type fileAbortedError struct {
+	message string
+}
+
+func (e *fileAbortedError) Error() string {
+	return "sharer aborted the file: " + e.message
+}
+
+// receiver holds the state of one download.
+type receiver struct {
+	opts       *ReceiveOptions
+	signerHash string
+	publicKey  *pubkeycrypto.PublicKey
+	manifest   *manifest.Manifest
+	// The manifest as the sharer last signed it, which doesn't include file updates received since
+	signed     []byte
+	localPaths *manifest.LocalPaths
+	// The files whose content is downloaded, in Walk order. Skipped files and hard links are left out.
+	fileIds []uint32
+	// Where each chunk occurs, so that chunks already written somewhere are copied locally instead of transferred again
+	chunks manifest.ChunkIndex
+	// How many bytes of each file are done, by id
+	fileBytesDone map[uint32]uint64
+	progress      Progress
+	failed        map[string]error
+	state         *resumeState
+	resuming      bool
+	lastSave      time.Time
+	// The latest update applied to each file and how many times each file was updated, by id
+	versions map[uint32]int
+	updates  map[uint32]int
+	// Incremented whenever a file switches to new content, by id, which tells chunk targets from before the switch apart
+	revisions map[uint32]int
+	// How many chunks of each file failed verification, by id
+	badChunks map[uint32]int
+	// Files being written to, by id. They are closed once complete.
+	openFiles   map[uint32]*os.File
+	connections []*connection
+	events      chan connEvent
+	// Closed when the download stops, which releases the goroutines reading from connections
+	done chan struct{}
+	// The targets waiting for each requested chunk, by hash
+	waiting map[string][]chunkTarget
+	// The manifest stream while the sharer is still sending it, nil otherwise. The manifest is nil until it ends.
+	stream *receiverStream
+	// Updates that arrived while the manifest was streamed, which are applied once it is complete
+	heldUpdates []*FileUpdate
+	// The chunks of files received from the manifest stream that are yet to be added to those being requested
+	newChunks []chunkTarget
+}
+
+// Receive downloads the share served on conn into destPath, where the root entity is created under its (sanitized) name. The manifest must be
+// signed by the key whose hash is signerHash, normally taken from the share key. Every chunk is verified before it is written.
+// Files the sharer can't serve are listed in the result rather than failing the whole download. Connections are read from until they're closed,
+// so close them once Receive returns.
+//
+// Connections that drop are closed by Receive.
+//
+// If the sharer is still generating the manifest, files are downloaded as their entries arrive and extra connections are only opened once the
+// whole manifest has. Resuming waits for the whole manifest, and a download interrupted before it arrived starts over.
+//
+// Progress is kept in a resume file next to the root entity until the download completes. If the download is interrupted, calling Receive again
+// with the same share and destination re-verifies partially downloaded files and only requests the chunks still missing, unless the sharer
+// shares something else since, in which case everything is downloaded again. Without a resume file, the root entity must not exist yet.
+func Receive(ctx context.Context, conn Conn, signerHash, destPath string, opts *ReceiveOptions) (result *Result, err error) {
+	err = WriteMessage(conn, ManifestRequest{})
+	if err != nil {
+		return nil, err
+	}
+	msg, err := ReadMessage(conn)
+	if err != nil {
+		return nil, err
+	}
+	r := &receiver{
+		opts:          opts,
+		signerHash:    signerHash,
+		chunks:        make(manifest.ChunkIndex),
+		fileBytesDone: make(map[uint32]uint64),
+		failed:        make(map[string]error),
+		versions:      make(map[uint32]int),
+		updates:       make(map[uint32]int),
+		revisions:     make(map[uint32]int),
+		badChunks:     make(map[uint32]int),
+		openFiles:     make(map[uint32]*os.File),
+		waiting:       make(map[string][]chunkTarget),
+	}
+	var stream *manifestStream
+	var streamed []manifest.StreamEvent
+	var rootName string
+	switch msg := msg.(type) {
+	case *Manifest:
+		r.manifest, r.publicKey, err = manifest.OpenSigned(msg.Signed, signerHash)
+		if err != nil {
+			return nil, err
+		}
+		r.signed = msg.Signed
+		rootName = r.manifest.Root().Name()
+	case *ManifestStreamStart:
+		stream, err = openStream(msg, signerHash)
+		if err != nil {
+			return nil, err
+		}
+		r.publicKey = stream.publicKey
+		// The root entity, which the resume file is named after, comes first
+		for len(streamed) == 0 {
+			streamed, r.manifest, r.signed, err = stream.next(conn)
+			if err != nil {
+				return nil, err
+			}
+			if r.manifest != nil {
+				return nil, errors.New("the manifest stream ended before it began")
+			}
+		}
+		rootName = streamed[0].Entity.Name()
+	default:
+		return nil, ErrUnexpectedMessage
+	}
+	sanitized, err := opts.names().Sanitize(rootName)
+	if err != nil {
+		return nil, &safename.Error{Path: rootName, Err: err}
+	}
+	rootName = sanitized
+	rootPath := filepath.Join(destPath, rootName)
+	r.state, err = loadResumeState(resumePath(destPath, rootName), signerHash)
+	if err != nil {
+		return nil, err
+	}
+	r.resuming = r.state != nil
+	if r.resuming && stream != nil {
+		// Progress can only be checked against the whole manifest
+		r.manifest, r.signed, err = stream.readAll(conn)
+		if err != nil {
+			return nil, err
+		}
+		stream = nil
+	}
+	if stream == nil {
+		r.localPaths, err = r.manifest.SafeLocalPaths(rootPath, opts.names())
+		if err != nil {
+			return nil, err
+		}
+	}
+	if !r.resuming {
+		if _, err := os.Lstat(rootPath); err == nil {
+			return nil, fmt.Errorf("%s already exists and there is no download of this share to resume", rootPath)
+		}
+		r.state = newResumeState(resumePath(destPath, rootName), signerHash)
+	} else if len(r.state.merkleRoot) == 0 {
+		// Interrupted while the manifest was being streamed, so the progress was never tied to a manifest
+		r.state.reset()
+	} else if !bytes.Equal(r.state.merkleRoot, r.manifest.MerkleRoot()) {
+		// The sharer shares something else under the same key now, so none of the progress can be trusted
+		r.opts.warn(fmt.Errorf("the share changed since the download was interrupted, so %s is downloaded again", rootPath))
+		r.state.reset()
+	}
+	if stream == nil {
+		r.state.setManifest(r.manifest)
+		r.listFiles()
+	} else {
+		r.state.dirty = true
+	}
+	err = os.MkdirAll(destPath, 0755)
+	if err != nil {
+		return nil, err
+	}
+	// Saved before anything is created, since an existing root can only be resumed with a resume file
+	err = r.state.save()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		saveErr := r.state.save()
+		if err == nil {
+			err = saveErr
+		}
+	}()
+	if stream != nil {
+		// The download starts with the entities received so far and takes in the rest as they arrive
+		r.stream = &receiverStream{
+			manifestStream: stream,
+			localPaths:     manifest.NewStreamLocalPaths(rootPath, opts.names()),
+			files:          make(map[uint32]*manifest.ManifestFile),
+			paths:          make(map[uint32]string),
+		}
+		r.localPaths = r.stream.localPaths.LocalPaths()
+		err = r.addStreamEvents(streamed)
+	} else {
+		err = r.createTree()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if r.resuming {
+		err = r.reverifyPartialFiles(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+	r.syncWithState()
+	err = r.receiveFiles(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+	r.finishTree()
+	if len(r.failed) == 0 {
+		err = r.state.remove()
+		if err != nil {
+			return nil, err
+		}
+		r.state.dirty = false
+	}
+	return &Result{
+		Manifest:       r.manifest,
+		SignedManifest: r.signed,
+		RootPath:       rootPath,
+		Failed:         r.failed,
+		Resumed:        r.resuming,
+		Dedup:          r.manifest.DedupReport(),
+	}, nil
+}
+
+// createTree creates every folder, and every file at its full size, so that chunks can be written in any order. When resuming, whatever already
+// exists is kept, with files resized to their size in the manifest. Hard links and symlinks are created once the content is in place.
+func (r *receiver) createTree() error {
+	return r.manifest.Walk(func(relPath string, entity manifest.ManifestEntity) error {
+		localPath, ok := r.localPaths.Path(entity.Id())
+		if !ok {
+			return manifest.SkipFolder
+		}
+		switch e := entity.(type) {
+		case *manifest.ManifestFolder:
+			if r.resuming {
+				existing, err := checkExisting(localPath, true)
+				if err != nil || existing {
+					return err
+				}
+			}
+			return os.Mkdir(localPath, 0755)
+		case *manifest.ManifestFile:
+			if _, isHardLink := e.HardLinkOf(); isHardLink {
+				return nil
+			}
+			if _, tracked := r.state.files[e.Id()]; !tracked {
+				r.state.resetFile(e)
+			}
+			if !r.resuming {
+				return manifest.CreateSizedFile(localPath, e.Size())
+			}
+			existing, err := checkExisting(localPath, false)
+			if err != nil {
+				return err
+			}
+			if existing {
+				fileInfo, err := os.Lstat(localPath)
+				if err != nil {
+					return err
+				}
+				if uint64(fileInfo.Size()) == e.Size() {
+					return nil
+				}
+			}
+			// Whatever progress was recorded doesn't describe this file anymore
+			r.state.resetFile(e)
+			if existing {
+				return os.Truncate(localPath, int64(e.Size()))
+			}
+			return manifest.CreateSizedFile(localPath, e.Size())
+		}
+		return nil
+	})
+}
+
+// checkExisting looks at what a resumed download finds at localPath, reporting whether it's a folder (or a regular file, if folder is false)
+// that can be reused. Symlinks are removed rather than followed, since a previous run may have created them from names that are now folders
+// or files. Anything else in the way is an error.
+func checkExisting(localPath string, folder bool) (bool, error) {
+	fileInfo, err := os.Lstat(localPath)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	switch {
+	case fileInfo.Mode()&os.ModeSymlink != 0:
+		return false, os.Remove(localPath)
+	case folder && fileInfo.IsDir(), !folder && fileInfo.Mode().IsRegular():
+		return true, nil
+	case folder:
+		return false, fmt.Errorf("%s exists but isn't a folder", localPath)
+	default:
+		return false, fmt.Errorf("%s exists but isn't a regular file", localPath)
+	}
+}
+
+// reverifyPartialFiles checks the chunks that the resume file lists as done for every file that wasn't complete, since the last writes before an
+// interruption may not have made it to disk. Chunks that fail are downloaded again.
+func (r *receiver) reverifyPartialFiles(ctx context.Context) error {
+	for fileId := range r.state.files {
+		file := r.file(fileId)
+		numDone := r.state.numDone(file)
+		if numDone == 0 || numDone == file.NumChunks() {
+			continue
+		}
+		localPath, ok := r.localPaths.Path(fileId)
+		if !ok {
+			continue
+		}
+		f, err := os.Open(localPath)
+		if os.IsNotExist(err) {
+			// Deleted since createTree, so it's downloaded again
+			r.state.resetFile(file)
+			err = manifest.CreateSizedFile(localPath, file.Size())
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		for _, chunk := range file.Chunks() {
+			if err := ctx.Err(); err != nil {
+				f.Close()
+				return err
+			}
+			if !r.state.isDone(fileId, chunk.Index) {
+				continue
+			}
+			data := make([]byte, chunk.Length)
+			_, err := f.ReadAt(data, int64(chunk.Offset))
+			if err != nil || file.VerifyChunk(chunk.Index, data) != nil {
+				r.state.setDone(fileId, chunk.Index, false)
+			}
+		}
+		f.Close()
+	}
+	return nil
+}
+
+func (r *receiver) listFiles() {
+	r.manifest.Walk(func(relPath string, entity manifest.ManifestEntity) error {
+		if _, ok := r.localPaths.Path(entity.Id()); !ok {
+			return manifest.SkipFolder
+		}
+		if file, ok := entity.(*manifest.ManifestFile); ok {
+			if _, isHardLink := file.HardLinkOf(); !isHardLink {
+				r.fileIds = append(r.fileIds, file.Id())
+			}
+		}
+		return nil
+	})
+}
+
+// syncWithState recomputes the progress from the resume state, and the chunk index from the manifest unless it is still being streamed.
+func (r *receiver) syncWithState() {
+	if r.stream == nil {
+		r.chunks = r.manifest.ChunkIndex()
+	}
+	r.progress.BytesTotal = 0
+	r.progress.BytesDone = 0
+	r.fileBytesDone = make(map[uint32]uint64)
+	for _, fileId := range r.fileIds {
+		file := r.file(fileId)
+		r.progress.BytesTotal += file.Size()
+		for _, chunk := range file.Chunks() {
+			if !r.state.isDone(fileId, chunk.Index) {
+				continue
+			}
+			r.progress.BytesDone += uint64(chunk.Length)
+			r.fileBytesDone[fileId] += uint64(chunk.Length)
+		}
+	}
+}
+
+func (r *receiver) file(fileId uint32) *manifest.ManifestFile {
+	if r.stream != nil {
+		return r.stream.files[fileId]
+	}
+	entity, _ := r.manifest.EntityById(fileId)
+	return entity.(*manifest.ManifestFile)
+}
+
+// pathOf returns the path of the entity with the given id relative to the root entity.
+func (r *receiver) pathOf(id uint32) string {
+	if r.stream != nil {
+		return r.stream.paths[id]
+	}
+	relPath, _ := r.manifest.PathOf(id)
+	return relPath
+}
+
+func (r *receiver) hasFailed(fileId uint32) bool {
+	relPath := r.pathOf(fileId)
+	_, failed := r.failed[relPath]
+	return failed
+}
+
+// fail gives up on the file, which is reported in the result.
+func (r *receiver) fail(fileId uint32, err error) {
+	relPath := r.pathOf(fileId)
+	r.failed[relPath] = err
+	r.opts.warn(fmt.Errorf("%s: %v", relPath, err))
+	r.closeFile(fileId)
+}
+
+// writeChunk writes the verified data of target to its file.
+func (r *receiver) writeChunk(target chunkTarget, data []byte) error {
+	file := r.file(target.fileId)
+	chunk, _ := file.Chunk(target.index)
+	f, ok := r.openFiles[target.fileId]
+	if !ok {
+		localPath, _ := r.localPaths.Path(target.fileId)
+		var err error
+		f, err = os.OpenFile(localPath, os.O_WRONLY, 0)
+		if err != nil {
+			return err
+		}
+		r.openFiles[target.fileId] = f
+	}
+	_, err := f.WriteAt(data, int64(chunk.Offset))
+	if err != nil {
+		return err
+	}
+	r.state.setDone(target.fileId, target.index, true)
+	r.chunkWritten(file, chunk)
+	if r.fileBytesDone[target.fileId] == file.Size() {
+		err = r.closeFile(target.fileId)
+		if err != nil {
+			return err
+		}
+	}
+	if time.Since(r.lastSave) >= resumeSaveInterval {
+		err = r.state.save()
+		if err != nil {
+			return err
+		}
+		r.lastSave = time.Now()
+	}
+	return nil
+}
+
+func (r *receiver) chunkWritten(file *manifest.ManifestFile, chunk manifest.Chunk) {
+	r.fileBytesDone[file.Id()] += uint64(chunk.Length)
+	r.progress.Path = r.pathOf(file.Id())
+	r.progress.FileSize = file.Size()
+	r.progress.FileBytesDone = r.fileBytesDone[file.Id()]
+	r.progress.BytesDone += uint64(chunk.Length)
+	r.opts.progress(r.progress)
+}
+
+func (r *receiver) closeFile(fileId uint32) error {
+	f, ok := r.openFiles[fileId]
+	if !ok {
+		return nil
+	}
+	delete(r.openFiles, fileId)
+	return f.Close()
+}
+
+func (r *receiver) closeFiles() {
+	for fileId := range r.openFiles {
+		r.closeFile(fileId)
+	}
+}
+
+// applyUpdate applies an update the sharer sent for a file that changed on its side. Receivers with several connections can get the same
+// update more than once, and in any order, so only the latest one counts.
+func (r *receiver) applyUpdate(m *FileUpdate) error {
+	err := r.publicKey.VerifySignature(fileUpdateMessage(r.publicKey.Sha1Hash(), m.FileId, m.Version, m.Update), m.Signature)
+	if err != nil {
+		return fmt.Errorf("file update for file %d has an invalid signature", m.FileId)
+	}
+	if r.stream != nil {
+		// Updates are to the complete manifest. Until it is, the chunks of the file on their way are stale and no more are requested.
+		r.revisions[m.FileId]++
+		r.heldUpdates = append(r.heldUpdates, m)
+		return nil
+	}
+	if m.Version <= r.versions[m.FileId] || r.hasFailed(m.FileId) {
+		return nil
+	}
+	r.versions[m.FileId] = m.Version
+	updated, err := r.manifest.ApplyFileUpdate(m.Update)
+	if err != nil {
+		return err
+	}
+	current := r.file(m.FileId).MerkleRoot()
+	r.manifest = updated
+	if bytes.Equal(r.file(m.FileId).MerkleRoot(), current) {
+		// Already switched to this version when reconnecting
+		return nil
+	}
+	r.updates[m.FileId]++
+	if r.updates[m.FileId] > maxFileUpdates {
+		r.fail(m.FileId, &fileAbortedError{message: "it keeps changing"})
+		return nil
+	}
+	return r.restartFile(m.FileId)
+}
+
+// restartFile prepares for downloading a file again after an update, sizing it to match the update.
+func (r *receiver) restartFile(fileId uint32) error {
+	err := r.closeFile(fileId)
+	if err != nil {
+		return err
+	}
+	updated := r.file(fileId)
+	r.revisions[fileId]++
+	r.state.resetFile(updated)
+	r.syncWithState()
+	localPath, _ := r.localPaths.Path(fileId)
+	return os.Truncate(localPath, int64(updated.Size()))
+}
+
+// localCopy returns the chunk with the given hash if it was already written somewhere in this download and is still intact.
+func (r *receiver) localCopy(hash []byte) []byte {
+	for _, location := range r.chunks.Locations(hash) {
+		if !r.state.isDone(location.FileId, location.Index) {
+			continue
+		}
+		if data := r.readChunk(location, hash); data != nil {
+			return data
+		}
+	}
+	return nil
+}
+
+// readChunk reads a written chunk back from its file, or returns nil if it isn't the chunk with the given hash, or no longer matches it.
+func (r *receiver) readChunk(location manifest.ChunkLocation, hash []byte) []byte {
+	file := r.file(location.FileId)
+	chunk, err := file.Chunk(location.Index)
+	if err != nil || !bytes.Equal(chunk.Hash, hash) {
+		return nil
+	}
+	localPath, _ := r.localPaths.Path(location.FileId)
+	f, err := os.Open(localPath)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	data := make([]byte, chunk.Length)
+	_, err = f.ReadAt(data, int64(chunk.Offset))
+	if err != nil || file.VerifyChunk(location.Index, data) != nil {
+		return nil
+	}
+	return data
+}
+
+// finishTree creates hard links and symlinks and then applies metadata, contents before the folders holding them. Problems are only warnings.
+// Symlinks are created after every file, so that nothing is ever written through them.
+func (r *receiver) finishTree() {
+	var entities []manifest.ManifestEntity
+	r.manifest.Walk(func(relPath string, entity manifest.ManifestEntity) error {
+		localPath, ok := r.localPaths.Path(entity.Id())
+		if !ok {
+			return manifest.SkipFolder
+		}
+		if _, failed := r.failed[relPath]; failed {
+			return nil
+		}
+		var err error
+		switch e := entity.(type) {
+		case *manifest.ManifestFile:
+			if targetId, isHardLink := e.HardLinkOf(); isHardLink {
+				err = r.createHardLink(targetId, localPath)
+			}
+		case *manifest.ManifestSymlink:
+			if !r.opts.allowUnsafeSymlinks() && !r.manifest.SymlinkStaysInside(e.Id()) {
+				r.opts.warn(fmt.Errorf("%s: skipped the symlink since its target %q could point outside the download", relPath, e.Target()))
+				return nil
+			}
+			err = os.Symlink(e.Target(), localPath)
+			if target, readErr := os.Readlink(localPath); os.IsExist(err) && readErr == nil && target == e.Target() {
+				// Created before the download was interrupted
+				err = nil
+			}
+		}
+		if err != nil {
+			r.failed[relPath] = err
+			r.opts.warn(fmt.Errorf("%s: %v", relPath, err))
+			return nil
+		}
+		entities = append(entities, entity)
+		return nil
+	})
+	if r.opts.skipMetadata() {
+		return
+	}
+	for i := len(entities) - 1; i >= 0; i-- {
+		localPath, _ := r.localPaths.Path(entities[i].Id())
+		err := manifest.ApplyMetadata(localPath, entities[i])
+		if err != nil {
+			r.opts.warn(fmt.Errorf("error applying metadata to %s: %v", localPath, err))
+		}
+	}
+}
+
+// createHardLink links localPath to the downloaded file with the given id, falling back to a copy on file systems without hard links.
+func (r *receiver) createHardLink(targetId uint32, localPath string) error {
+	targetRelPath, _ := r.manifest.PathOf(targetId)
+	if _, failed := r.failed[targetRelPath]; failed {
+		return fmt.Errorf("the file it links to, %s, failed to download", targetRelPath)
+	}
+	targetPath, ok := r.localPaths.Path(targetId)
+	if !ok {
+		return fmt.Errorf("the file it links to, %s, was skipped", targetRelPath)
+	}
+	if linkInfo, err := os.Lstat(localPath); err == nil {
+		// Created before the download was interrupted, unless it's something else
+		targetInfo, err := os.Stat(targetPath)
+		if err == nil && os.SameFile(linkInfo, targetInfo) {
+			return nil
+		}
+		return fmt.Errorf("%s already exists", localPath)
+	}
+	if os.Link(targetPath, localPath) == nil {
+		return nil
+	}
+	return copyFile(targetPath, localPath)
+}
+
+func copyFile(srcPath, dstPath string) error {
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(dstPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	if err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
@@ -0,0 +1,321 @@
+package transfer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pavben/Vortex/manifest"
+	"github.com/pavben/Vortex/pubkeycrypto"
+)
+
+// pipeEnd is one end of an in-memory Conn.
+type pipeEnd struct {
+	in  chan []byte
+	out chan []byte
+}
+
+func (p *pipeEnd) Write(b []byte) error {
+	p.out <- append([]byte(nil), b...)
+	return nil
+}
+
+// Close does nothing, since pipes are closed with the function returned by serve.
+func (p *pipeEnd) Close() error {
+	return nil
+}
+
+func (p *pipeEnd) Read() ([]byte, error) {
+	b, ok := <-p.in
+	if !ok {
+		return nil, io.EOF
+	}
+	return b, nil
+}
+
+// serve runs sender on one end of an in-memory connection and returns the other end, along with a function that closes the connection and
+// waits for the sender to finish.
+func serve(sender *Sender) (Conn, func()) {
+	toSender := make(chan []byte, 1)
+	toReceiver := make(chan []byte, 1)
+	done := make(chan error)
+	go func() {
+		done <- sender.Serve(context.Background(), &pipeEnd{in: toSender, out: toReceiver})
+	}()
+	return &pipeEnd{in: toReceiver, out: toSender}, func() {
+		close(toSender)
+		<-done
+	}
+}
+
+func writeFile(t *testing.T, path, data string) {
+	t.Helper()
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err == nil {
+		err = ioutil.WriteFile(path, []byte(data), 0644)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestResumeDoesNotFollowSymlinks(t *testing.T) {
+	outside, err := ioutil.TempDir("", "outside")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outside)
+	tempDir, err := ioutil.TempDir("", "resume")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	keyPair, err := pubkeycrypto.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	shareKey := keyPair.PublicKey.Sha1Hash()
+	destPath := filepath.Join(tempDir, "dest")
+	warn := func(err error) { t.Log(err) }
+
+	// The first share has d as a symlink pointing outside the destination, and f changes after the manifest is generated so that the
+	// download fails and leaves its resume file behind.
+	root := filepath.Join(tempDir, "first", "share")
+	writeFile(t, filepath.Join(root, "f"), "before")
+	if err := os.Symlink(outside, filepath.Join(root, "d")); err != nil {
+		t.Skip("can't create symlinks:", err)
+	}
+	m, err := manifest.GenerateManifest(context.Background(), root, &manifest.GenerateOptions{SymlinkPolicy: manifest.SymlinksPreserve})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(root, "f"), "after the change")
+	sender, err := NewSender(m, root, keyPair.PrivateKey, &SenderOptions{OnChange: ChangeAbort, Warn: warn})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, stop := serve(sender)
+	result, err := Receive(context.Background(), conn, shareKey, destPath, &ReceiveOptions{Warn: warn, AllowUnsafeSymlinks: true})
+	stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Failed) == 0 {
+		t.Fatal("the first download should have failed")
+	}
+
+	// The same sharer now shares a folder named d. Resuming must replace the symlink rather than write through it.
+	root = filepath.Join(tempDir, "second", "share")
+	writeFile(t, filepath.Join(root, "f"), "fine")
+	writeFile(t, filepath.Join(root, "d", "x"), "escaped")
+	m, err = manifest.GenerateManifest(context.Background(), root, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender, err = NewSender(m, root, keyPair.PrivateKey, &SenderOptions{Warn: warn})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, stop = serve(sender)
+	_, err = Receive(context.Background(), conn, shareKey, destPath, &ReceiveOptions{Warn: warn})
+	stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(filepath.Join(outside, "x")); err == nil {
+		t.Fatal("the resumed download wrote through a symlink")
+	}
+	fileInfo, err := os.Lstat(filepath.Join(destPath, "share", "d"))
+	if err != nil || !fileInfo.IsDir() {
+		t.Fatalf("d should be a folder: %v", err)
+	}
+}
+
+// chunkedShare shares the files in a new folder under tempDir, chunked in small content-defined chunks so that they have several each.
+func chunkedShare(t *testing.T, tempDir string, keyPair *pubkeycrypto.KeyPair, files map[string]string) *Sender {
+	t.Helper()
+	root, err := ioutil.TempDir(tempDir, "share")
+	if err != nil {
+		t.Fatal(err)
+	}
+	root = filepath.Join(root, "share")
+	for name, data := range files {
+		writeFile(t, filepath.Join(root, name), data)
+	}
+	opts := &manifest.GenerateOptions{Chunking: manifest.Chunking{ContentDefined: true, MinSize: 64, AvgSize: 128, MaxSize: 256}}
+	m, err := manifest.GenerateManifest(context.Background(), root, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender, err := NewSender(m, root, keyPair.PrivateKey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sender
+}
+
+// partialDownload downloads the chunkedShare of the files into destPath while corrupting the last chunk of every file, which leaves the files
+// partially downloaded along with the resume file. It returns the sender.
+func partialDownload(t *testing.T, tempDir, destPath string, keyPair *pubkeycrypto.KeyPair, files map[string]string) *Sender {
+	t.Helper()
+	sender := chunkedShare(t, tempDir, keyPair, files)
+	conn, stop := serve(sender)
+	defer stop()
+	badConn := &corruptingConn{Conn: conn, corrupt: func(frame []byte) bool {
+		for _, data := range files {
+			if bytes.HasSuffix(frame, []byte(data[len(data)-16:])) {
+				return true
+			}
+		}
+		return false
+	}}
+	result, err := Receive(context.Background(), badConn, keyPair.PublicKey.Sha1Hash(), destPath, &ReceiveOptions{Warn: func(err error) { t.Log(err) }})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Failed) != len(files) {
+		t.Fatalf("every file should have failed: %v", result.Failed)
+	}
+	return sender
+}
+
+// testContent returns n bytes of content that differs with seed.
+func testContent(seed, n int) string {
+	var buf bytes.Buffer
+	for i := 0; buf.Len() < n; i++ {
+		fmt.Fprintf(&buf, "%d-%d ", seed, i*i)
+	}
+	return buf.String()[:n]
+}
+
+func TestResumeRedownloadsDeletedPartialFiles(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "resume")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	keyPair, err := pubkeycrypto.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	destPath := filepath.Join(tempDir, "dest")
+	files := map[string]string{"a": testContent(1, 4096)}
+	sender := partialDownload(t, tempDir, destPath, keyPair, files)
+	err = os.Remove(filepath.Join(destPath, "share", "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, stop := serve(sender)
+	result, err := Receive(context.Background(), conn, keyPair.PublicKey.Sha1Hash(), destPath, &ReceiveOptions{Warn: func(err error) { t.Log(err) }})
+	stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(result.RootPath, "a"))
+	if err != nil || string(data) != files["a"] {
+		t.Fatalf("got %d bytes, %v", len(data), err)
+	}
+}
+
+func TestResumeCopiesDuplicateChunksLocally(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "resume")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	keyPair, err := pubkeycrypto.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	destPath := filepath.Join(tempDir, "dest")
+	files := map[string]string{"a": testContent(1, 4096), "b": testContent(1, 4096)}
+	sender := partialDownload(t, tempDir, destPath, keyPair, files)
+	err = os.Remove(filepath.Join(destPath, "share", "b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Everything b needs but its last chunk is already in a
+	conn, stop := serve(sender)
+	countingConn := &droppingConn{Conn: conn}
+	result, err := Receive(context.Background(), countingConn, keyPair.PublicKey.Sha1Hash(), destPath, &ReceiveOptions{Warn: func(err error) { t.Log(err) }})
+	stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if countingConn.requests != 1 {
+		t.Errorf("%d chunks were requested, expected only the last one", countingConn.requests)
+	}
+	for name, want := range files {
+		data, err := ioutil.ReadFile(filepath.Join(result.RootPath, name))
+		if err != nil || string(data) != want {
+			t.Errorf("%s: got %d bytes, %v", name, len(data), err)
+		}
+	}
+}
+
+func TestResumeStartsOverWhenTheShareChanged(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "resume")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	keyPair, err := pubkeycrypto.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	destPath := filepath.Join(tempDir, "dest")
+	partialDownload(t, tempDir, destPath, keyPair, map[string]string{"a": testContent(1, 4096)})
+
+	// The sharer now shares the same file along with a new one
+	files := map[string]string{"a": testContent(1, 4096), "b": testContent(2, 4096)}
+	sender := chunkedShare(t, tempDir, keyPair, files)
+	conn, stop := serve(sender)
+	startedOver := false
+	warn := func(err error) {
+		t.Log(err)
+		startedOver = startedOver || strings.Contains(err.Error(), "the share changed")
+	}
+	result, err := Receive(context.Background(), conn, keyPair.PublicKey.Sha1Hash(), destPath, &ReceiveOptions{Warn: warn})
+	stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !startedOver {
+		t.Error("the progress of the previous share was kept")
+	}
+	for name, want := range files {
+		data, err := ioutil.ReadFile(filepath.Join(result.RootPath, name))
+		if err != nil || string(data) != want {
+			t.Errorf("%s: got %d bytes, %v", name, len(data), err)
+		}
+	}
+}
+
+func TestResultHoldsTheSignedManifest(t *testing.T) {
+	sender, shareKey := testShare(t, map[string]string{"a": "first file", "b": "second file"})
+	conn, stop := serve(sender)
+	result, err := Receive(context.Background(), conn, shareKey, tempDest(t), nil)
+	stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, _, err := manifest.OpenSigned(result.SignedManifest, shareKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(m.MerkleRoot(), result.Manifest.MerkleRoot()) {
+		t.Fatal("the signed manifest differs from the one the download followed")
+	}
+	report, err := m.Verify(context.Background(), result.RootPath, nil)
+	if err != nil || !report.OK() {
+		t.Fatalf("the download doesn't verify against the signed manifest: %v\n%v", err, report)
+	}
+}
@@ -0,0 +1,143 @@
+package transfer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/pavben/Vortex/manifest"
+)
+
+// The longest pause between two attempts to reconnect
+const maxRedialDelay = 30 * time.Second
+
+// connectionError wraps an error from the connection itself, which reconnecting may fix.
+type connectionError struct {
+	err error
+}
+
+func (e *connectionError) Error() string {
+	return "connection error: " + e.err.Error()
+}
+
+func (e *connectionError) Unwrap() error {
+	return e.err
+}
+
+// reconnect redials the sharer after cause ended a connection and catches up with changes to the share made in the meantime.
+func (r *receiver) reconnect(ctx context.Context, cause error) (Conn, error) {
+	err := cause
+	delay := time.Second
+	for attempt := 1; attempt <= r.opts.redialAttempts(); attempt++ {
+		r.opts.warn(fmt.Errorf("%v; reconnecting in %v (attempt %d of %d)", err, delay, attempt, r.opts.redialAttempts()))
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if delay *= 2; delay > maxRedialDelay {
+			delay = maxRedialDelay
+		}
+		var conn Conn
+		conn, err = r.opts.redial()()
+		if err != nil {
+			continue
+		}
+		err = r.syncManifest(conn)
+		var connErr *connectionError
+		if err == nil {
+			return conn, nil
+		}
+		if !errors.As(err, &connErr) {
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("giving up after %d attempts to reconnect: %v", r.opts.redialAttempts(), err)
+}
+
+// syncManifest asks the sharer for the manifest again on a new connection, since files may have been re-hashed while the receiver was
+// disconnected, and switches to it. The progress of changed files is discarded. While the manifest is being streamed, the stream is asked for
+// again instead.
+func (r *receiver) syncManifest(conn Conn) error {
+	if r.stream != nil {
+		return r.restartStream(conn)
+	}
+	m, signed, err := readManifest(conn, r.signerHash)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(m.MerkleRoot(), r.manifest.MerkleRoot()) {
+		return nil
+	}
+	// Re-hashing only ever changes file content, so anything else means this is a different share
+	err = r.manifest.Walk(func(relPath string, entity manifest.ManifestEntity) error {
+		newPath, ok := m.PathOf(entity.Id())
+		if !ok || newPath != relPath {
+			return fmt.Errorf("the share changed while reconnecting: %s is gone", relPath)
+		}
+		newEntity, _ := m.EntityById(entity.Id())
+		if !sameKind(entity, newEntity) {
+			return fmt.Errorf("the share changed while reconnecting: %s is no longer the same kind of entity", relPath)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	err = m.Walk(func(relPath string, entity manifest.ManifestEntity) error {
+		if _, ok := r.manifest.EntityById(entity.Id()); !ok {
+			return fmt.Errorf("the share changed while reconnecting: %s is new", relPath)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	r.manifest = m
+	r.signed = signed
+	r.state.setManifest(m)
+	for _, fileId := range r.fileIds {
+		if _, tracked := r.state.files[fileId]; tracked {
+			continue
+		}
+		err = r.closeFile(fileId)
+		if err != nil {
+			return err
+		}
+		file := r.file(fileId)
+		r.revisions[fileId]++
+		r.state.resetFile(file)
+		localPath, _ := r.localPaths.Path(fileId)
+		err = os.Truncate(localPath, int64(file.Size()))
+		if err != nil {
+			return err
+		}
+	}
+	r.syncWithState()
+	return nil
+}
+
+// sameKind returns whether entity is still the same kind of entity in an updated manifest: a folder, a symlink with the same target, a
+// regular file or a hard link to the same file.
+func sameKind(entity, updated manifest.ManifestEntity) bool {
+	switch entity := entity.(type) {
+	case *manifest.ManifestFolder:
+		_, ok := updated.(*manifest.ManifestFolder)
+		return ok
+	case *manifest.ManifestSymlink:
+		symlink, ok := updated.(*manifest.ManifestSymlink)
+		return ok && symlink.Target() == entity.Target()
+	case *manifest.ManifestFile:
+		file, ok := updated.(*manifest.ManifestFile)
+		if !ok {
+			return false
+		}
+		linkTarget, isHardLink := entity.HardLinkOf()
+		updatedLinkTarget, updatedIsHardLink := file.HardLinkOf()
+		return isHardLink == updatedIsHardLink && linkTarget == updatedLinkTarget
+	}
+	return false
+}
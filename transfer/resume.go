@@ -0,0 +1,221 @@
+package transfer
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/pavben/Vortex/manifest"
+)
+
+// Resume file layout:
+//
+//	magic "VXRS" | version (1 byte) | share key | manifest Merkle root | number of files | files
+//
+// Each file is its id, its Merkle root and a bitmap of its verified chunks, where chunk i is bit i%8 of byte i/8.
+// Integers are unsigned varints and everything else is length-prefixed with one.
+
+const (
+	resumeMagic   = "VXRS"
+	resumeVersion = 1
+	// Suffix of the resume file, which sits next to the root entity and is named after it
+	resumeSuffix = ".vortex-resume"
+)
+
+// ErrResumeShareMismatch means the resume file next to the destination belongs to a different share.
+var ErrResumeShareMismatch = errors.New("Resume file belongs to a different share")
+
+// resumeState records which chunks of a download have been written and verified, so that an interrupted download can continue where it left off.
+type resumeState struct {
+	path       string
+	shareKey   string
+	merkleRoot []byte
+	files      map[uint32]*fileProgress
+	dirty      bool
+}
+
+// fileProgress tracks one file of the manifest version whose Merkle root is merkleRoot.
+type fileProgress struct {
+	merkleRoot []byte
+	done       []byte
+}
+
+func resumePath(destPath, rootName string) string {
+	return filepath.Join(destPath, "."+rootName+resumeSuffix)
+}
+
+func newResumeState(path, shareKey string) *resumeState {
+	return &resumeState{
+		path:     path,
+		shareKey: shareKey,
+		files:    make(map[uint32]*fileProgress),
+	}
+}
+
+// loadResumeState reads the resume file at path, returning nil if there is none.
+func loadResumeState(path, shareKey string) (*resumeState, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	st, err := decodeResumeState(data)
+	if err != nil {
+		return nil, fmt.Errorf("error reading resume file %s: %v", path, err)
+	}
+	if st.shareKey != shareKey {
+		return nil, ErrResumeShareMismatch
+	}
+	st.path = path
+	return st, nil
+}
+
+func decodeResumeState(data []byte) (*resumeState, error) {
+	if !bytes.HasPrefix(data, []byte(resumeMagic)) || len(data) < len(resumeMagic)+1 {
+		return nil, errors.New("bad magic")
+	}
+	if data[len(resumeMagic)] != resumeVersion {
+		return nil, fmt.Errorf("unsupported version %d", data[len(resumeMagic)])
+	}
+	r := bytes.NewReader(data[len(resumeMagic)+1:])
+	shareKey, err := readBytes(r)
+	if err != nil {
+		return nil, err
+	}
+	st := newResumeState("", string(shareKey))
+	st.merkleRoot, err = readBytes(r)
+	if err != nil {
+		return nil, err
+	}
+	numFiles, err := readUint32(r)
+	if err != nil {
+		return nil, err
+	}
+	for i := uint32(0); i < numFiles; i++ {
+		fileId, err := readUint32(r)
+		if err != nil {
+			return nil, err
+		}
+		fp := &fileProgress{}
+		fp.merkleRoot, err = readBytes(r)
+		if err != nil {
+			return nil, err
+		}
+		fp.done, err = readBytes(r)
+		if err != nil {
+			return nil, err
+		}
+		st.files[fileId] = fp
+	}
+	if r.Len() != 0 {
+		return nil, fmt.Errorf("%d trailing bytes", r.Len())
+	}
+	return st, nil
+}
+
+// save writes the state to its resume file if anything changed since the last save. The file is replaced atomically.
+func (st *resumeState) save() error {
+	if !st.dirty {
+		return nil
+	}
+	var buf bytes.Buffer
+	buf.WriteString(resumeMagic)
+	buf.WriteByte(resumeVersion)
+	writeBytes(&buf, []byte(st.shareKey))
+	writeBytes(&buf, st.merkleRoot)
+	fileIds := make([]uint32, 0, len(st.files))
+	for fileId := range st.files {
+		fileIds = append(fileIds, fileId)
+	}
+	sort.Slice(fileIds, func(i, j int) bool { return fileIds[i] < fileIds[j] })
+	writeUvarint(&buf, uint64(len(fileIds)))
+	for _, fileId := range fileIds {
+		fp := st.files[fileId]
+		writeUvarint(&buf, uint64(fileId))
+		writeBytes(&buf, fp.merkleRoot)
+		writeBytes(&buf, fp.done)
+	}
+	tempPath := st.path + ".tmp"
+	err := ioutil.WriteFile(tempPath, buf.Bytes(), 0644)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tempPath, st.path)
+	if err != nil {
+		return err
+	}
+	st.dirty = false
+	return nil
+}
+
+func (st *resumeState) remove() error {
+	err := os.Remove(st.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// setManifest forgets the progress of every file that is missing from m or whose content differs from the version the progress is for.
+func (st *resumeState) setManifest(m *manifest.Manifest) {
+	st.merkleRoot = m.MerkleRoot()
+	for fileId, fp := range st.files {
+		entity, ok := m.EntityById(fileId)
+		file, isFile := entity.(*manifest.ManifestFile)
+		if !ok || !isFile || !bytes.Equal(fp.merkleRoot, file.MerkleRoot()) || len(fp.done) != (file.NumChunks()+7)/8 {
+			delete(st.files, fileId)
+		}
+	}
+	st.dirty = true
+}
+
+// reset forgets the progress of every file.
+func (st *resumeState) reset() {
+	st.files = make(map[uint32]*fileProgress)
+	st.dirty = true
+}
+
+// resetFile starts tracking file from scratch, such as after it was updated.
+func (st *resumeState) resetFile(file *manifest.ManifestFile) {
+	st.files[file.Id()] = &fileProgress{
+		merkleRoot: file.MerkleRoot(),
+		done:       make([]byte, (file.NumChunks()+7)/8),
+	}
+	st.dirty = true
+}
+
+// isDone reports whether the chunk was written and verified.
+func (st *resumeState) isDone(fileId uint32, index int) bool {
+	fp, ok := st.files[fileId]
+	if !ok || index/8 >= len(fp.done) {
+		return false
+	}
+	return fp.done[index/8]&(1<<uint(index%8)) != 0
+}
+
+func (st *resumeState) setDone(fileId uint32, index int, done bool) {
+	fp := st.files[fileId]
+	if done {
+		fp.done[index/8] |= 1 << uint(index%8)
+	} else {
+		fp.done[index/8] &^= 1 << uint(index%8)
+	}
+	st.dirty = true
+}
+
+// numDone returns how many chunks of the file are done.
+func (st *resumeState) numDone(file *manifest.ManifestFile) int {
+	n := 0
+	for i := 0; i < file.NumChunks(); i++ {
+		if st.isDone(file.Id(), i) {
+			n++
+		}
+	}
+	return n
+}
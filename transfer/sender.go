@@ -0,0 +1,333 @@
+package transfer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/pavben/Vortex/manifest"
+	"github.com/pavben/Vortex/pubkeycrypto"
+)
+
+// ChangePolicy decides what a Sender does about a file that changed after the manifest was generated.
+type ChangePolicy int
+
+const (
+	// ChangeRehash hashes the file again and sends receivers its updated entry, after which they download it from the start.
+	ChangeRehash ChangePolicy = iota
+	// ChangeAbort tells receivers the file can't be served, leaving them to give up on it.
+	ChangeAbort
+)
+
+// SenderOptions controls how a Sender serves a share. A nil *SenderOptions means the defaults.
+type SenderOptions struct {
+	// OnChange decides what happens to files that change while they are being shared
+	OnChange ChangePolicy
+	// Warn, if non-nil, is called for every chunk request that can't be served. If nil, the receiver is still told, but nothing else happens.
+	Warn func(err error)
+}
+
+func (opts *SenderOptions) onChange() ChangePolicy {
+	if opts == nil {
+		return ChangeRehash
+	}
+	return opts.OnChange
+}
+
+func (opts *SenderOptions) warn(err error) {
+	if opts != nil && opts.Warn != nil {
+		opts.Warn(err)
+	}
+}
+
+// Sender serves a share to any number of receivers, each over its own Conn.
+type Sender struct {
+	rootPath   string
+	privateKey *pubkeycrypto.PrivateKey
+	// The hash of the sharer's public key, which receivers know the share by
+	shareKey string
+	opts     *SenderOptions
+	// Serializes re-hashing so that a file changing under several receivers at once is only hashed again once
+	rehashMutex sync.Mutex
+	mutex       sync.Mutex
+	// Nil while a Sender from NewStreamingSender is still generating the manifest
+	manifest *manifest.Manifest
+	signed   []byte
+	// How many times each file has been re-hashed, by id. Sessions compare it with what they sent their receiver.
+	versions map[uint32]int
+	// The manifest stream of a Sender from NewStreamingSender, nil otherwise
+	stream *senderStream
+}
+
+// NewSender prepares to share m, generated from rootPath, signing it with the sharer's private key.
+func NewSender(m *manifest.Manifest, rootPath string, privateKey *pubkeycrypto.PrivateKey, opts *SenderOptions) (*Sender, error) {
+	signed, err := m.Sign(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	return &Sender{
+		rootPath:   rootPath,
+		privateKey: privateKey,
+		shareKey:   privateKey.GetPublicKey().Sha1Hash(),
+		opts:       opts,
+		manifest:   m,
+		signed:     signed,
+		versions:   make(map[uint32]int),
+	}, nil
+}
+
+// Manifest returns the manifest being shared, including any updates from re-hashed files, or nil if it is still being generated.
+func (s *Sender) Manifest() *manifest.Manifest {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.manifest
+}
+
+// session is the state of one receiver's connection.
+type session struct {
+	conn Conn
+	// The version of each file that this receiver knows about
+	seen map[uint32]int
+	// Passes the receiver's acknowledgements of the manifest stream's batches on to the goroutine sending the stream, nil if none was sent
+	// on this connection, and how many there were so far
+	acks  chan struct{}
+	acked int
+}
+
+// acknowledge passes on the receiver's acknowledgement of a batch of the manifest stream sent on the session.
+func (sess *session) acknowledge(ack *ManifestBatchAck) error {
+	if sess.acks == nil || ack.Seq != sess.acked {
+		return ErrUnexpectedMessage
+	}
+	select {
+	case sess.acks <- struct{}{}:
+	default:
+		// More acknowledgements than batches sent
+		return ErrUnexpectedMessage
+	}
+	sess.acked++
+	return nil
+}
+
+// lockedConn serializes writes, since a manifest stream is sent alongside the answers to requests.
+type lockedConn struct {
+	Conn
+	mutex sync.Mutex
+}
+
+func (c *lockedConn) Write(b []byte) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.Conn.Write(b)
+}
+
+// Serve answers requests from the receiver on conn until it disconnects, which is not an error. Chunks that fail to be read are reported
+// to the receiver rather than ending the session.
+func (s *Sender) Serve(ctx context.Context, conn Conn) error {
+	// Receivers start out with the manifest as it was when they connected
+	sess := &session{
+		conn: &lockedConn{Conn: conn},
+		seen: make(map[uint32]int),
+	}
+	s.mutex.Lock()
+	for fileId, version := range s.versions {
+		sess.seen[fileId] = version
+	}
+	s.mutex.Unlock()
+	stop := make(chan struct{})
+	defer close(stop)
+	streamErrs := make(chan error, 1)
+	for {
+		msg, err := ReadMessage(conn)
+		if err != nil {
+			select {
+			case streamErr := <-streamErrs:
+				return streamErr
+			default:
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch m := msg.(type) {
+		case ManifestRequest:
+			s.mutex.Lock()
+			signed := s.signed
+			for fileId, version := range s.versions {
+				sess.seen[fileId] = version
+			}
+			s.mutex.Unlock()
+			if signed == nil {
+				// Still generating, so the receiver gets what there is so far
+				err = s.startStream(sess, stop, streamErrs)
+			} else {
+				err = WriteMessage(sess.conn, &Manifest{Signed: signed})
+			}
+		case ManifestStreamRequest:
+			if s.stream == nil {
+				// Never streamed, which tells the receiver that this sharer started over since
+				s.mutex.Lock()
+				signed := s.signed
+				s.mutex.Unlock()
+				err = WriteMessage(sess.conn, &Manifest{Signed: signed})
+				break
+			}
+			err = s.startStream(sess, stop, streamErrs)
+		case *ManifestBatchAck:
+			err = sess.acknowledge(m)
+		case *ChunkRequest:
+			err = s.serveChunk(ctx, sess, m)
+		default:
+			return ErrUnexpectedMessage
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (s *Sender) serveChunk(ctx context.Context, sess *session, req *ChunkRequest) error {
+	s.mutex.Lock()
+	m := s.manifest
+	version := s.versions[req.FileId]
+	s.mutex.Unlock()
+	if version != sess.seen[req.FileId] {
+		// The file was re-hashed for another receiver since this one learned about it
+		return s.sendUpdate(sess, req.FileId)
+	}
+	data, err := s.readChunk(m, req)
+	var changed *manifest.FileChangedError
+	// Files can only be re-hashed once the manifest is complete
+	if errors.As(err, &changed) && s.opts.onChange() == ChangeRehash && m != nil {
+		s.opts.warn(err)
+		err = s.rehash(ctx, req.FileId, version)
+		if err == nil {
+			return s.sendUpdate(sess, req.FileId)
+		}
+	}
+	if err != nil {
+		s.opts.warn(err)
+		return WriteMessage(sess.conn, &Error{
+			FileId:  req.FileId,
+			Index:   req.Index,
+			Message: receiverMessage(err),
+		})
+	}
+	return WriteMessage(sess.conn, &ChunkData{
+		FileId: req.FileId,
+		Index:  req.Index,
+		Data:   data,
+	})
+}
+
+// readChunk reads the requested chunk from m, or from the files streamed so far if m is nil.
+func (s *Sender) readChunk(m *manifest.Manifest, req *ChunkRequest) ([]byte, error) {
+	if m == nil {
+		return s.readStreamedChunk(req)
+	}
+	entity, ok := m.EntityById(req.FileId)
+	if !ok {
+		return nil, requestError(fmt.Sprintf("no file with id %d", req.FileId))
+	}
+	if file, ok := entity.(*manifest.ManifestFile); ok {
+		if _, isHardLink := file.HardLinkOf(); isHardLink {
+			return nil, requestError(fmt.Sprintf("file %d is a hard link, so its content is served through the file it links to", req.FileId))
+		}
+	}
+	return m.ReadVerifiedChunk(s.rootPath, req.FileId, req.Index)
+}
+
+// rehash hashes the file with the given id again, unless that already happened since the caller read version.
+func (s *Sender) rehash(ctx context.Context, fileId uint32, version int) error {
+	s.rehashMutex.Lock()
+	defer s.rehashMutex.Unlock()
+	s.mutex.Lock()
+	m := s.manifest
+	current := s.versions[fileId]
+	s.mutex.Unlock()
+	if current != version {
+		return nil
+	}
+	updated, err := m.Rehash(ctx, s.rootPath, fileId)
+	if err != nil {
+		return err
+	}
+	signed, err := updated.Sign(s.privateKey)
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	s.manifest = updated
+	s.signed = signed
+	s.versions[fileId]++
+	s.mutex.Unlock()
+	return nil
+}
+
+// sendUpdate answers a request for a chunk of a re-hashed file with its update. Receivers that haven't got the end of the manifest stream yet
+// hold on to the update until they do, so it isn't held back here, which would keep acknowledgements from being read.
+func (s *Sender) sendUpdate(sess *session, fileId uint32) error {
+	s.mutex.Lock()
+	m := s.manifest
+	version := s.versions[fileId]
+	s.mutex.Unlock()
+	update, err := m.MarshalFileUpdate(fileId)
+	if err != nil {
+		return err
+	}
+	signature, err := s.privateKey.Sign(fileUpdateMessage(s.shareKey, fileId, version, update))
+	if err != nil {
+		return err
+	}
+	sess.seen[fileId] = version
+	return WriteMessage(sess.conn, &FileUpdate{
+		FileId:    fileId,
+		Version:   version,
+		Update:    update,
+		Signature: signature,
+	})
+}
+
+// requestError is an error about the chunk request itself, which is safe to send back as it is.
+type requestError string
+
+func (err requestError) Error() string {
+	return string(err)
+}
+
+// receiverMessage describes why a chunk can't be served without revealing where the share lives on the sharer's disk. Errors it doesn't
+// know are only described in general, so the caller should warn about the error itself.
+func receiverMessage(err error) string {
+	var reqErr requestError
+	if errors.As(err, &reqErr) || errors.Is(err, manifest.ErrChunkIndexOutOfRange) || errors.Is(err, manifest.ErrNotAFile) {
+		return err.Error()
+	}
+	var changed *manifest.FileChangedError
+	if errors.As(err, &changed) {
+		return "the file changed since the manifest was generated: " + changed.Reason
+	}
+	var pathErr *os.PathError
+	if errors.As(err, &pathErr) {
+		return "the file can't be read: " + pathErr.Err.Error()
+	}
+	return "the sharer couldn't read the chunk"
+}
+
+// fileUpdateMessage returns what the sharer signs for a file update. The prefix keeps the signature from being valid for anything else, and
+// the share key, file id and version keep an update from being replayed to receivers of another share or passed off as a later version.
+func fileUpdateMessage(shareKey string, fileId uint32, version int, update []byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("VXFU")
+	writeBytes(&buf, []byte(shareKey))
+	writeUvarint(&buf, uint64(fileId))
+	writeUvarint(&buf, uint64(version))
+	buf.Write(update)
+	return buf.Bytes()
+}
@@ -0,0 +1,121 @@
+package transfer
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pavben/Vortex/manifest"
+)
+
+// updateTamperingConn passes the file updates it reads from the sharer through tamper before the receiver sees them.
+type updateTamperingConn struct {
+	Conn
+	tamper func(update *FileUpdate)
+}
+
+func (c *updateTamperingConn) Read() ([]byte, error) {
+	msg, err := ReadMessage(c.Conn)
+	if err != nil {
+		return nil, err
+	}
+	if update, ok := msg.(*FileUpdate); ok {
+		c.tamper(update)
+	}
+	q := &frameQueue{}
+	err = WriteMessage(q, msg)
+	if err != nil {
+		return nil, err
+	}
+	return q.Read()
+}
+
+func TestFileUpdates(t *testing.T) {
+	tests := []struct {
+		name   string
+		tamper func(update *FileUpdate)
+		err    string
+	}{
+		{"untouched", func(*FileUpdate) {}, ""},
+		{"later version", func(update *FileUpdate) { update.Version++ }, "invalid signature"},
+	}
+	for _, test := range tests {
+		sender, shareKey := testShare(t, map[string]string{"a": "first file", "b": "second file"})
+		// Changing a after the manifest was generated makes the sender re-hash it and send an update
+		writeFile(t, filepath.Join(sender.rootPath, "a"), "first file, changed")
+		conn, stop := serve(sender)
+		updates := 0
+		tamperingConn := &updateTamperingConn{Conn: conn, tamper: func(update *FileUpdate) {
+			updates++
+			test.tamper(update)
+		}}
+		result, err := Receive(context.Background(), tamperingConn, shareKey, tempDest(t), &ReceiveOptions{Warn: func(err error) { t.Log(err) }})
+		stop()
+		if updates == 0 {
+			t.Fatalf("%s: the sender sent no update", test.name)
+		}
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: got %v, expected an error about an %s", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		data, err := ioutil.ReadFile(filepath.Join(result.RootPath, "a"))
+		if err != nil || string(data) != "first file, changed" {
+			t.Errorf("%s: got %q, %v", test.name, data, err)
+		}
+	}
+}
+
+func TestFileUpdatesOnlyVerifyForTheirShare(t *testing.T) {
+	sender, shareKey := testShare(t, map[string]string{"a": "first file"})
+	file, _ := sender.Manifest().EntityByPath("a")
+	update, err := sender.Manifest().MarshalFileUpdate(file.Id())
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature, err := sender.privateKey.Sign(fileUpdateMessage(shareKey, file.Id(), 1, update))
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey := sender.privateKey.GetPublicKey()
+	if err := publicKey.VerifySignature(fileUpdateMessage(shareKey, file.Id(), 1, update), signature); err != nil {
+		t.Fatal(err)
+	}
+	if err := publicKey.VerifySignature(fileUpdateMessage(shareKey, file.Id(), 2, update), signature); err == nil {
+		t.Error("an update verified as another version")
+	}
+	other, otherKey := testShare(t, map[string]string{"a": "first file"})
+	if err := publicKey.VerifySignature(fileUpdateMessage(otherKey, file.Id(), 1, update), signature); err == nil {
+		t.Error("an update signed for one share verified for another")
+	}
+	if err := other.privateKey.GetPublicKey().VerifySignature(fileUpdateMessage(otherKey, file.Id(), 1, update), signature); err == nil {
+		t.Error("an update verified with another sharer's key")
+	}
+}
+
+func TestReceiverMessagesHideSharerPaths(t *testing.T) {
+	tests := []struct {
+		err     error
+		message string
+	}{
+		{requestError("no file with id 3"), "no file with id 3"},
+		{manifest.ErrChunkIndexOutOfRange, manifest.ErrChunkIndexOutOfRange.Error()},
+		{&manifest.FileChangedError{Path: "/home/sharer/share/a", Reason: "its size changed"}, "the file changed since the manifest was generated: its size changed"},
+		{&os.PathError{Op: "open", Path: "/home/sharer/share/a", Err: os.ErrPermission}, "the file can't be read: permission denied"},
+		{fmt.Errorf("/home/sharer/share/a is no longer a regular file"), "the sharer couldn't read the chunk"},
+	}
+	for _, test := range tests {
+		message := receiverMessage(test.err)
+		if message != test.message {
+			t.Errorf("%v: got %q, expected %q", test.err, message, test.message)
+		}
+	}
+}
@@ -0,0 +1,701 @@
+package transfer
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pavben/Vortex/manifest"
+	"github.com/pavben/Vortex/pubkeycrypto"
+)
+
+// A sharer that is still generating its manifest sends it as a stream, so that receivers can start downloading before every file is hashed.
+// The stream written by manifest.StreamWriter is cut into batches, each signed along with the hash of the one before it, so a receiver can
+// trust the entities in a batch, and request the chunks of its files, as soon as the batch arrives. The stream ends with the sharer's
+// signature over the whole manifest, which the receiver checks against the manifest it assembled from the batches, so that it ends up with the
+// same signed manifest as a receiver that got it in one piece. The sharer keeps the batches in a temporary file for the receivers yet to
+// connect, and stays a window of batches ahead of what each receiver acknowledged, so neither side holds more than that window in flight.
+// Both still hold the whole manifest in memory once it is assembled.
+
+const (
+	// Records are sent in a batch once this many bytes of them are waiting, and otherwise every streamBatchInterval
+	streamBatchSize     = 64 * 1024
+	streamBatchInterval = 100 * time.Millisecond
+	// How many batches the sharer sends ahead of the receiver's acknowledgements
+	streamBatchWindow = 8
+)
+
+// batchMessage returns what the sharer signs for a batch. The prefix keeps the signature from being valid for anything else, the share key
+// keeps batches from being replayed to the receivers of another share, and the sequence number and the hash of the previous batch's message
+// chain the batches in order.
+func batchMessage(shareKey string, seq, count int, previous, data []byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("VXMB")
+	writeBytes(&buf, []byte(shareKey))
+	writeUvarint(&buf, uint64(seq))
+	writeUvarint(&buf, uint64(count))
+	writeBytes(&buf, previous)
+	buf.Write(data)
+	return buf.Bytes()
+}
+
+// senderStream is the manifest stream of a Sender from NewStreamingSender. It is guarded by the sender's mutex.
+type senderStream struct {
+	spool *batchSpool
+	// Set once the whole manifest is generated and signed
+	end *ManifestStreamEnd
+	// Set if generating the manifest failed
+	err error
+	// The regular files in the batches so far, by id, for serving chunks until the manifest is complete
+	files map[uint32]streamedFile
+	// Closed and replaced whenever a batch is added or the stream ends
+	changed chan struct{}
+	// Closed once generation is over, either way
+	done chan struct{}
+}
+
+type streamedFile struct {
+	file      *manifest.ManifestFile
+	localPath string
+}
+
+func (st *senderStream) notify() {
+	close(st.changed)
+	st.changed = make(chan struct{})
+}
+
+// batchSpool keeps the batches of a manifest stream, encoded as frames, in a temporary file, so that they don't have to stay in memory for
+// the receivers yet to connect. It is safe for concurrent use.
+type batchSpool struct {
+	mutex sync.Mutex
+	file  *os.File
+	// Where the frame of each batch ends in the file
+	ends []int64
+}
+
+func newBatchSpool() (*batchSpool, error) {
+	file, err := ioutil.TempFile("", "vortex-stream")
+	if err != nil {
+		return nil, fmt.Errorf("error creating the file for the manifest stream: %v", err)
+	}
+	return &batchSpool{file: file}, nil
+}
+
+// add appends batch, which must be the next in the stream.
+func (sp *batchSpool) add(batch *ManifestBatch) error {
+	sp.mutex.Lock()
+	defer sp.mutex.Unlock()
+	var start int64
+	if len(sp.ends) > 0 {
+		start = sp.ends[len(sp.ends)-1]
+	}
+	frame := encodeMessage(batch)
+	_, err := sp.file.WriteAt(frame, start)
+	if err != nil {
+		return fmt.Errorf("error saving manifest batch %d: %v", batch.Seq, err)
+	}
+	sp.ends = append(sp.ends, start+int64(len(frame)))
+	return nil
+}
+
+// len returns how many batches were added.
+func (sp *batchSpool) len() int {
+	sp.mutex.Lock()
+	defer sp.mutex.Unlock()
+	return len(sp.ends)
+}
+
+// frame reads back the frame of the batch numbered seq.
+func (sp *batchSpool) frame(seq int) ([]byte, error) {
+	sp.mutex.Lock()
+	var start int64
+	if seq > 0 {
+		start = sp.ends[seq-1]
+	}
+	end := sp.ends[seq]
+	sp.mutex.Unlock()
+	frame := make([]byte, end-start)
+	_, err := sp.file.ReadAt(frame, start)
+	if err != nil {
+		return nil, fmt.Errorf("error reading manifest batch %d back: %v", seq, err)
+	}
+	return frame, nil
+}
+
+// batch reads back the batch numbered seq.
+func (sp *batchSpool) batch(seq int) (*ManifestBatch, error) {
+	frame, err := sp.frame(seq)
+	if err != nil {
+		return nil, err
+	}
+	msg, err := decodeFrame(frame)
+	if err != nil {
+		return nil, err
+	}
+	return msg.(*ManifestBatch), nil
+}
+
+// remove closes and deletes the file.
+func (sp *batchSpool) remove() error {
+	sp.mutex.Lock()
+	defer sp.mutex.Unlock()
+	err := sp.file.Close()
+	removeErr := os.Remove(sp.file.Name())
+	if err == nil {
+		err = removeErr
+	}
+	return err
+}
+
+// NewStreamingSender starts generating the manifest of rootPath with genOpts and serves it while it is being generated, signing it with the
+// sharer's private key. Receivers that connect in the meantime get the manifest as a stream and can download the files streamed so far.
+// Generation stops early if ctx is canceled. Files that change before the manifest is complete can't be re-hashed, so they are served as with
+// ChangeAbort until then. Close the Sender once it is done serving, which removes the temporary file the stream is kept in.
+func NewStreamingSender(ctx context.Context, rootPath string, genOpts *manifest.GenerateOptions, privateKey *pubkeycrypto.PrivateKey, opts *SenderOptions) *Sender {
+	s := &Sender{
+		rootPath:   rootPath,
+		privateKey: privateKey,
+		shareKey:   privateKey.GetPublicKey().Sha1Hash(),
+		opts:       opts,
+		versions:   make(map[uint32]int),
+		stream: &senderStream{
+			files:   make(map[uint32]streamedFile),
+			changed: make(chan struct{}),
+			done:    make(chan struct{}),
+		},
+	}
+	spool, err := newBatchSpool()
+	if err != nil {
+		s.stream.err = err
+		close(s.stream.done)
+		return s
+	}
+	s.stream.spool = spool
+	go s.generate(ctx, genOpts)
+	return s
+}
+
+// Close removes the temporary file that a Sender from NewStreamingSender keeps the manifest stream in, after which the stream can't be
+// served. It does nothing for a Sender from NewSender.
+func (s *Sender) Close() error {
+	if s.stream == nil || s.stream.spool == nil {
+		return nil
+	}
+	return s.stream.spool.remove()
+}
+
+// Wait waits until the manifest of a Sender from NewStreamingSender is generated and returns it, or the error that stopped generation, after
+// which the Sender turns its receivers away. For a Sender from NewSender, it returns the manifest right away.
+func (s *Sender) Wait() (*manifest.Manifest, error) {
+	if s.stream != nil {
+		<-s.stream.done
+		if s.stream.err != nil {
+			return nil, s.stream.err
+		}
+	}
+	return s.Manifest(), nil
+}
+
+func (s *Sender) generate(ctx context.Context, genOpts *manifest.GenerateOptions) {
+	m, signature, signed, err := s.streamManifest(ctx, genOpts)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	st := s.stream
+	if err != nil {
+		st.err = err
+	} else {
+		s.manifest = m
+		s.signed = signed
+		st.end = &ManifestStreamEnd{Batches: st.spool.len(), Signature: signature}
+	}
+	// Chunks are served from the manifest from now on
+	st.files = nil
+	st.notify()
+	close(st.done)
+}
+
+// streamManifest generates the manifest, adding its stream to the sender's in batches, and then signs it. It returns the manifest, the
+// signature and the signed manifest.
+func (s *Sender) streamManifest(ctx context.Context, genOpts *manifest.GenerateOptions) (*manifest.Manifest, []byte, []byte, error) {
+	b := &streamBatcher{s: s}
+	writer, err := manifest.NewStreamWriterFor(&b.pending, genOpts)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	stop := make(chan struct{})
+	go b.flushPeriodically(stop)
+	err = manifest.StreamManifest(ctx, s.rootPath, genOpts, func(event manifest.StreamEvent) error {
+		return b.add(writer, event)
+	})
+	close(stop)
+	b.mutex.Lock()
+	if err == nil {
+		err = b.flush()
+	}
+	b.mutex.Unlock()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	// Assembled from the batches the way receivers do, so that both sign and check the very same encoding
+	ms := &manifestStream{publicKey: s.privateKey.GetPublicKey()}
+	spool := s.stream.spool
+	for seq := 0; seq < spool.len(); seq++ {
+		batch, err := spool.batch(seq)
+		if err == nil {
+			_, err = ms.add(batch)
+		}
+		if err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	m, err := ms.assembler.Manifest()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	signature, err := m.Signature(s.privateKey)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	signed, err := m.AttachSignature(s.privateKey.GetPublicKey(), signature)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return m, signature, signed, nil
+}
+
+// streamBatcher cuts the manifest stream into batches as the manifest is generated, signing each and adding it to the sender's stream.
+type streamBatcher struct {
+	s     *Sender
+	mutex sync.Mutex
+	// The records not yet in a batch, preceded by the stream header for the first batch
+	pending bytes.Buffer
+	count   int
+	files   map[uint32]streamedFile
+	// The sequence number of the next batch and the hash of the message signed for the previous one
+	seq       int
+	chainHash []byte
+	err       error
+}
+
+func (b *streamBatcher) add(writer *manifest.StreamWriter, event manifest.StreamEvent) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.err != nil {
+		return b.err
+	}
+	err := writer.WriteEvent(event)
+	if err != nil {
+		return err
+	}
+	b.count++
+	if file, ok := event.Entity.(*manifest.ManifestFile); ok {
+		if _, isHardLink := file.HardLinkOf(); !isHardLink {
+			if b.files == nil {
+				b.files = make(map[uint32]streamedFile)
+			}
+			b.files[file.Id()] = streamedFile{file: file, localPath: filepath.Join(b.s.rootPath, filepath.FromSlash(event.Path))}
+		}
+	}
+	if b.pending.Len() < streamBatchSize {
+		return nil
+	}
+	return b.flush()
+}
+
+// flushPeriodically sends whatever is pending every streamBatchInterval until stop is closed, so that receivers don't wait on a slow file for the
+// entities before it.
+func (b *streamBatcher) flushPeriodically(stop <-chan struct{}) {
+	ticker := time.NewTicker(streamBatchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			b.mutex.Lock()
+			b.flush()
+			b.mutex.Unlock()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// flush signs the pending records as the next batch and adds it to the sender's stream. The caller holds b.mutex. A failure is kept in b.err,
+// which stops generation.
+func (b *streamBatcher) flush() error {
+	if b.count == 0 || b.err != nil {
+		return b.err
+	}
+	data := append([]byte(nil), b.pending.Bytes()...)
+	message := batchMessage(b.s.shareKey, b.seq, b.count, b.chainHash, data)
+	signature, err := b.s.privateKey.Sign(message)
+	if err != nil {
+		b.err = err
+		return err
+	}
+	batch := &ManifestBatch{Seq: b.seq, Count: b.count, Data: data, Signature: signature}
+	chainHash := sha256.Sum256(message)
+	b.chainHash = chainHash[:]
+	b.s.mutex.Lock()
+	st := b.s.stream
+	err = st.spool.add(batch)
+	if err != nil {
+		b.s.mutex.Unlock()
+		b.err = err
+		return err
+	}
+	b.seq++
+	for fileId, file := range b.files {
+		st.files[fileId] = file
+	}
+	st.notify()
+	b.s.mutex.Unlock()
+	b.pending.Reset()
+	b.count = 0
+	b.files = nil
+	return nil
+}
+
+// startStream sends the manifest stream on the session's connection alongside the answers to its requests. If that fails, the connection is
+// closed and Serve returns the error sent to errs.
+func (s *Sender) startStream(sess *session, stop <-chan struct{}, errs chan<- error) error {
+	if sess.acks != nil {
+		return ErrUnexpectedMessage
+	}
+	// The stream describes the files as they were first hashed
+	sess.seen = make(map[uint32]int)
+	// Never more than the window of batches sent is acknowledged
+	sess.acks = make(chan struct{}, streamBatchWindow)
+	go func() {
+		err := s.sendStream(sess.conn, sess.acks, stop)
+		if err != nil {
+			errs <- err
+			sess.conn.Close()
+		}
+	}()
+	return nil
+}
+
+// sendStream sends the manifest stream on conn, waiting for batches as they're made, until the stream ends or stop is closed. It sends at most
+// streamBatchWindow batches that the receiver hasn't acknowledged on acks yet.
+func (s *Sender) sendStream(conn Conn, acks <-chan struct{}, stop <-chan struct{}) error {
+	err := WriteMessage(conn, &ManifestStreamStart{PublicKey: s.privateKey.GetPublicKey().ToBytes()})
+	if err != nil {
+		return err
+	}
+	sent, unacked := 0, 0
+	for {
+		s.mutex.Lock()
+		st := s.stream
+		end, genErr, changed := st.end, st.err, st.changed
+		s.mutex.Unlock()
+		if genErr != nil {
+			return fmt.Errorf("error generating the manifest: %v", genErr)
+		}
+		// Every batch is made by the time the stream ends
+		made := st.spool.len()
+		for ; sent < made && unacked < streamBatchWindow; sent++ {
+			frame, err := st.spool.frame(sent)
+			if err != nil {
+				return err
+			}
+			err = conn.Write(frame)
+			if err != nil {
+				return err
+			}
+			unacked++
+		}
+		if sent == made && end != nil {
+			return WriteMessage(conn, end)
+		}
+		select {
+		case <-changed:
+		case <-acks:
+			unacked--
+		case <-stop:
+			return nil
+		}
+	}
+}
+
+// readStreamedChunk reads a chunk of a file from the batches made so far, before the manifest is complete.
+func (s *Sender) readStreamedChunk(req *ChunkRequest) ([]byte, error) {
+	s.mutex.Lock()
+	m := s.manifest
+	file, ok := s.stream.files[req.FileId]
+	s.mutex.Unlock()
+	if m != nil {
+		// Completed since the caller looked
+		return s.readChunk(m, req)
+	}
+	if !ok {
+		return nil, requestError(fmt.Sprintf("no file with id %d", req.FileId))
+	}
+	return file.file.ReadVerifiedChunk(file.localPath, req.Index)
+}
+
+// manifestStream checks the batches of a manifest stream from the sharer with publicKey and decodes them, assembling the manifest.
+type manifestStream struct {
+	publicKey *pubkeycrypto.PublicKey
+	// The sequence number expected of the next batch and the hash of the message signed for the previous one
+	nextSeq   int
+	chainHash []byte
+	// The checked stream data not yet decoded, which reader reads from
+	feed      bytes.Buffer
+	reader    *manifest.StreamReader
+	assembler *manifest.StreamAssembler
+}
+
+// openStream checks the start of a manifest stream against signerHash.
+func openStream(start *ManifestStreamStart, signerHash string) (*manifestStream, error) {
+	publicKey, err := pubkeycrypto.PublicKeyFromBytes(start.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing the sharer's public key: %v", err)
+	}
+	if publicKey.Sha1Hash() != signerHash {
+		return nil, manifest.ErrUnexpectedSigner
+	}
+	return &manifestStream{publicKey: publicKey}, nil
+}
+
+// add checks batch and returns its events, or nothing if it was added before, as happens when the stream is sent again after reconnecting.
+func (ms *manifestStream) add(batch *ManifestBatch) ([]manifest.StreamEvent, error) {
+	if batch.Seq < ms.nextSeq {
+		return nil, nil
+	}
+	if batch.Seq > ms.nextSeq {
+		return nil, fmt.Errorf("manifest batch %d arrived before batch %d", batch.Seq, ms.nextSeq)
+	}
+	message := batchMessage(ms.publicKey.Sha1Hash(), batch.Seq, batch.Count, ms.chainHash, batch.Data)
+	err := ms.publicKey.VerifySignature(message, batch.Signature)
+	if err != nil {
+		return nil, fmt.Errorf("manifest batch %d has an invalid signature or doesn't follow the batches before it", batch.Seq)
+	}
+	chainHash := sha256.Sum256(message)
+	ms.chainHash = chainHash[:]
+	ms.nextSeq++
+	ms.feed.Write(batch.Data)
+	if ms.reader == nil {
+		ms.reader, err = manifest.NewStreamReader(&ms.feed)
+		if err != nil {
+			return nil, err
+		}
+		ms.assembler = manifest.NewStreamAssembler(ms.reader.HashAlgorithm(), ms.reader.Chunking())
+	}
+	events := make([]manifest.StreamEvent, 0, batch.Count)
+	for i := 0; i < batch.Count; i++ {
+		event, err := ms.reader.Next()
+		if err != nil {
+			return nil, fmt.Errorf("error decoding manifest batch %d: %v", batch.Seq, err)
+		}
+		err = ms.assembler.Add(event)
+		if err != nil {
+			return nil, fmt.Errorf("error decoding manifest batch %d: %v", batch.Seq, err)
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+// end checks the end of the stream and returns the assembled manifest along with it signed, as the sharer would have sent it in one piece.
+func (ms *manifestStream) end(end *ManifestStreamEnd) (*manifest.Manifest, []byte, error) {
+	if end.Batches != ms.nextSeq {
+		return nil, nil, fmt.Errorf("the manifest stream ended after %d batches, but %d arrived", end.Batches, ms.nextSeq)
+	}
+	if ms.assembler == nil {
+		return nil, nil, errors.New("the manifest stream ended without any batches")
+	}
+	m, err := ms.assembler.Manifest()
+	if err != nil {
+		return nil, nil, err
+	}
+	signed, err := m.AttachSignature(ms.publicKey, end.Signature)
+	if err != nil {
+		return nil, nil, err
+	}
+	return m, signed, nil
+}
+
+// next reads the next batch from conn and returns its events, or, at the end of the stream, the manifest and the signed manifest.
+func (ms *manifestStream) next(conn Conn) ([]manifest.StreamEvent, *manifest.Manifest, []byte, error) {
+	msg, err := ReadMessage(conn)
+	if err != nil {
+		return nil, nil, nil, &connectionError{err}
+	}
+	switch msg := msg.(type) {
+	case *ManifestBatch:
+		events, err := ms.add(msg)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		err = WriteMessage(conn, &ManifestBatchAck{Seq: msg.Seq})
+		if err != nil {
+			return nil, nil, nil, &connectionError{err}
+		}
+		return events, nil, nil, nil
+	case *ManifestStreamEnd:
+		m, signed, err := ms.end(msg)
+		return nil, m, signed, err
+	default:
+		return nil, nil, nil, ErrUnexpectedMessage
+	}
+}
+
+// readAll reads the rest of the stream from conn, for those who need the whole manifest before they can do anything with it.
+func (ms *manifestStream) readAll(conn Conn) (*manifest.Manifest, []byte, error) {
+	for {
+		_, m, signed, err := ms.next(conn)
+		if err != nil || m != nil {
+			return m, signed, err
+		}
+	}
+}
+
+// readManifest asks the sharer on conn for its manifest, reading all of it if the sharer is still generating it and sends it as a stream.
+// It returns the manifest and the signed manifest.
+func readManifest(conn Conn, signerHash string) (*manifest.Manifest, []byte, error) {
+	err := WriteMessage(conn, ManifestRequest{})
+	if err != nil {
+		return nil, nil, &connectionError{err}
+	}
+	msg, err := ReadMessage(conn)
+	if err != nil {
+		return nil, nil, &connectionError{err}
+	}
+	switch msg := msg.(type) {
+	case *Manifest:
+		m, _, err := manifest.OpenSigned(msg.Signed, signerHash)
+		if err != nil {
+			return nil, nil, err
+		}
+		return m, msg.Signed, nil
+	case *ManifestStreamStart:
+		ms, err := openStream(msg, signerHash)
+		if err != nil {
+			return nil, nil, err
+		}
+		return ms.readAll(conn)
+	default:
+		return nil, nil, ErrUnexpectedMessage
+	}
+}
+
+// receiverStream is the manifest stream of a download that started before the sharer finished generating the manifest. The download
+// follows the entities of the stream as they arrive, until the stream ends and the receiver switches to the assembled manifest.
+type receiverStream struct {
+	*manifestStream
+	localPaths *manifest.StreamLocalPaths
+	// The regular files received so far and the paths of the entities, by id
+	files map[uint32]*manifest.ManifestFile
+	paths map[uint32]string
+}
+
+// addStreamEvents creates the folders and files of newly received entities and queues the chunks of the files.
+func (r *receiver) addStreamEvents(events []manifest.StreamEvent) error {
+	for _, event := range events {
+		localPath, ok, err := r.stream.localPaths.Add(event)
+		if err != nil {
+			return err
+		}
+		if event.Kind != manifest.StreamFolderStart {
+			r.stream.paths[event.Entity.Id()] = event.Path
+		}
+		if !ok {
+			continue
+		}
+		switch event.Kind {
+		case manifest.StreamFolderStart:
+			err = os.Mkdir(localPath, 0755)
+		case manifest.StreamEntity:
+			file, isFile := event.Entity.(*manifest.ManifestFile)
+			if !isFile {
+				// Symlinks are created once the download is complete
+				continue
+			}
+			if _, isHardLink := file.HardLinkOf(); isHardLink {
+				continue
+			}
+			r.stream.files[file.Id()] = file
+			r.chunks.Add(file)
+			r.state.resetFile(file)
+			r.fileIds = append(r.fileIds, file.Id())
+			r.progress.BytesTotal += file.Size()
+			for _, chunk := range file.Chunks() {
+				r.newChunks = append(r.newChunks, chunkTarget{fileId: file.Id(), index: chunk.Index})
+			}
+			err = manifest.CreateSizedFile(localPath, file.Size())
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addBatch adds the entities of a batch of the manifest stream to the download.
+func (r *receiver) addBatch(batch *ManifestBatch) error {
+	if r.stream == nil {
+		return ErrUnexpectedMessage
+	}
+	events, err := r.stream.add(batch)
+	if err != nil {
+		return err
+	}
+	return r.addStreamEvents(events)
+}
+
+// endStream switches to the manifest assembled from the stream once it has ended, applies the updates held until then, and opens the extra
+// connections the options ask for.
+func (r *receiver) endStream(end *ManifestStreamEnd) error {
+	if r.stream == nil {
+		return ErrUnexpectedMessage
+	}
+	m, signed, err := r.stream.end(end)
+	if err != nil {
+		return err
+	}
+	r.manifest = m
+	r.signed = signed
+	r.stream = nil
+	r.state.setManifest(m)
+	for _, update := range r.heldUpdates {
+		err = r.applyUpdate(update)
+		if err != nil {
+			return err
+		}
+	}
+	r.heldUpdates = nil
+	r.addConnections()
+	return nil
+}
+
+// restartStream asks for the manifest stream again on a new connection made in the middle of it. The batches already received are skipped
+// when they come in again.
+func (r *receiver) restartStream(conn Conn) error {
+	err := WriteMessage(conn, ManifestStreamRequest{})
+	if err != nil {
+		return &connectionError{err}
+	}
+	msg, err := ReadMessage(conn)
+	if err != nil {
+		return &connectionError{err}
+	}
+	switch msg := msg.(type) {
+	case *ManifestStreamStart:
+		if !bytes.Equal(msg.PublicKey, r.publicKey.ToBytes()) {
+			return errors.New("the sharer's key changed while reconnecting")
+		}
+		return nil
+	case *Manifest:
+		// A sharer that started over since, which has none of the stream's batches to send again
+		return errors.New("the sharer started over while sending the manifest")
+	default:
+		return ErrUnexpectedMessage
+	}
+}
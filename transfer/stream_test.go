@@ -0,0 +1,437 @@
+package transfer
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pavben/Vortex/manifest"
+	"github.com/pavben/Vortex/pubkeycrypto"
+)
+
+// streamingShare shares the files in a new folder with a NewStreamingSender whose manifest generation waits at the last file until release
+// is closed, so that the manifest is only complete once the test lets it.
+func streamingShare(t *testing.T, files map[string]string, release <-chan struct{}) (*Sender, string) {
+	t.Helper()
+	tempDir, err := ioutil.TempDir("", "share")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tempDir) })
+	root := filepath.Join(tempDir, "share")
+	for name, data := range files {
+		writeFile(t, filepath.Join(root, name), data)
+	}
+	keyPair, err := pubkeycrypto.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	genOpts := &manifest.GenerateOptions{
+		// One file at a time, so that the last one hashed is the last one in the stream
+		Concurrency: 1,
+		Progress: func(p manifest.Progress) {
+			if p.FilesHashed == len(files) {
+				select {
+				case <-release:
+				case <-time.After(10 * time.Second):
+				}
+			}
+		},
+	}
+	sender := NewStreamingSender(context.Background(), root, genOpts, keyPair.PrivateKey, &SenderOptions{Warn: func(err error) { t.Log(err) }})
+	t.Cleanup(func() { sender.Close() })
+	return sender, keyPair.PublicKey.Sha1Hash()
+}
+
+// checkStreamedDownload checks that a download from a streaming sender ended up with the files and the manifest the sender signed.
+func checkStreamedDownload(t *testing.T, sender *Sender, shareKey string, result *Result, files map[string]string) {
+	t.Helper()
+	m, err := sender.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(result.Manifest.MerkleRoot(), m.MerkleRoot()) || !bytes.Equal(result.SignedManifest, sender.signed) {
+		t.Error("the receiver assembled a different manifest than the sender signed")
+	}
+	if _, _, err := manifest.OpenSigned(result.SignedManifest, shareKey); err != nil {
+		t.Error(err)
+	}
+	for name, want := range files {
+		data, err := ioutil.ReadFile(filepath.Join(result.RootPath, filepath.FromSlash(name)))
+		if err != nil || string(data) != want {
+			t.Errorf("%s: got %d bytes, %v", name, len(data), err)
+		}
+	}
+	if _, err := os.Stat(resumePath(filepath.Dir(result.RootPath), filepath.Base(result.RootPath))); !os.IsNotExist(err) {
+		t.Errorf("the resume file is still there: %v", err)
+	}
+}
+
+func TestStreamedDownloadStartsBeforeTheManifestIsComplete(t *testing.T) {
+	files := map[string]string{"a": "first file", "b": "second file", "sub/c": "third file", "sub/d": "fourth file", "z": "last file"}
+	release := make(chan struct{})
+	var releaseOnce sync.Once
+	sender, shareKey := streamingShare(t, files, release)
+	early := false
+	progress := func(p Progress) {
+		early = early || sender.Manifest() == nil
+		releaseOnce.Do(func() { close(release) })
+	}
+	conn, stop := serve(sender)
+	result, err := Receive(context.Background(), conn, shareKey, tempDest(t), &ReceiveOptions{Progress: progress, Warn: func(err error) { t.Log(err) }})
+	stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !early {
+		t.Error("nothing was downloaded before the manifest was complete")
+	}
+	checkStreamedDownload(t, sender, shareKey, result, files)
+}
+
+func TestStreamedDownloadReconnects(t *testing.T) {
+	files := map[string]string{"a": "first file", "b": "second file", "z": "last file"}
+	release := make(chan struct{})
+	sender, shareKey := streamingShare(t, files, release)
+	midStream := false
+	var stops []func()
+	redial := func() (Conn, error) {
+		midStream = sender.Manifest() == nil
+		close(release)
+		conn, stop := serve(sender)
+		stops = append(stops, stop)
+		return conn, nil
+	}
+	conn, stop := serve(sender)
+	stops = append(stops, stop)
+	// The first chunk request fails, which comes after the first batch and before the manifest can be complete
+	dropping := &droppingConn{Conn: conn, dropAt: 1}
+	result, err := Receive(context.Background(), dropping, shareKey, tempDest(t), &ReceiveOptions{Redial: redial, Warn: func(err error) { t.Log(err) }})
+	for _, stop := range stops {
+		stop()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !midStream {
+		t.Error("reconnected after the manifest was complete")
+	}
+	checkStreamedDownload(t, sender, shareKey, result, files)
+}
+
+// startedConn calls started when it reads the start of a manifest stream.
+type startedConn struct {
+	Conn
+	started func()
+}
+
+func (c *startedConn) Read() ([]byte, error) {
+	b, err := c.Conn.Read()
+	if err == nil && messageType(b[0]) == typeManifestStreamStart {
+		c.started()
+	}
+	return b, err
+}
+
+func TestFetcherReadsManifestStreams(t *testing.T) {
+	files := map[string]string{"a": "first file", "z": "last file"}
+	release := make(chan struct{})
+	sender, shareKey := streamingShare(t, files, release)
+	m, err := manifest.GenerateManifest(context.Background(), sender.rootPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, stop := serve(sender)
+	defer stop()
+	// The manifest is only completed once the stream has started, so the fetcher has to read all of it
+	fetcher, err := NewFetcher(&startedConn{Conn: conn, started: func() { close(release) }}, shareKey, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, _ := m.EntityByPath("a")
+	data, err := fetcher.Fetch(a.Id(), 0)
+	if err != nil || string(data) != files["a"] {
+		t.Fatalf("got %q, %v", data, err)
+	}
+}
+
+// signedBatches generates the manifest stream of the folder at root and cuts it into batches of one record each, signed by privateKey as a
+// sharer would. It also returns the signature for the end of the stream.
+func signedBatches(t *testing.T, root string, privateKey *pubkeycrypto.PrivateKey) ([]*ManifestBatch, []byte) {
+	t.Helper()
+	var buf bytes.Buffer
+	writer, err := manifest.NewStreamWriterFor(&buf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var batches []*ManifestBatch
+	var chainHash []byte
+	err = manifest.StreamManifest(context.Background(), root, nil, func(event manifest.StreamEvent) error {
+		err := writer.WriteEvent(event)
+		if err != nil {
+			return err
+		}
+		data := append([]byte(nil), buf.Bytes()...)
+		buf.Reset()
+		message := batchMessage(privateKey.GetPublicKey().Sha1Hash(), len(batches), 1, chainHash, data)
+		signature, err := privateKey.Sign(message)
+		if err != nil {
+			return err
+		}
+		batches = append(batches, &ManifestBatch{Seq: len(batches), Count: 1, Data: data, Signature: signature})
+		hash := sha256.Sum256(message)
+		chainHash = hash[:]
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := manifest.GenerateManifest(context.Background(), root, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature, err := m.Signature(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return batches, signature
+}
+
+func TestManifestStreamChecks(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	writeFile(t, filepath.Join(tempDir, "first", "share", "a"), "first file")
+	writeFile(t, filepath.Join(tempDir, "first", "share", "b"), "second file")
+	writeFile(t, filepath.Join(tempDir, "second", "share", "a"), "other file")
+	writeFile(t, filepath.Join(tempDir, "second", "share", "b"), "second file")
+	keyPair, err := pubkeycrypto.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := pubkeycrypto.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	batches, signature := signedBatches(t, filepath.Join(tempDir, "first", "share"), keyPair.PrivateKey)
+	// The same sharer's stream of another folder, and the first folder's stream from another sharer
+	otherBatches, otherSignature := signedBatches(t, filepath.Join(tempDir, "second", "share"), keyPair.PrivateKey)
+	otherSharerBatches, _ := signedBatches(t, filepath.Join(tempDir, "first", "share"), other.PrivateKey)
+	if len(batches) != 4 || len(otherBatches) != 4 {
+		t.Fatalf("expected a folder start, two files and a folder end, got %d and %d batches", len(batches), len(otherBatches))
+	}
+	end := &ManifestStreamEnd{Batches: len(batches), Signature: signature}
+	renumbered := *batches[2]
+	renumbered.Seq = 1
+	tampered := *batches[1]
+	tampered.Data = append([]byte(nil), tampered.Data...)
+	tampered.Data[len(tampered.Data)-1] ^= 1
+	tests := []struct {
+		name     string
+		messages []Message
+		ok       bool
+	}{
+		{"in order", []Message{batches[0], batches[1], batches[2], batches[3], end}, true},
+		{"repeated batches", []Message{batches[0], batches[1], batches[0], batches[1], batches[2], batches[3], batches[2], end}, true},
+		{"missing batch", []Message{batches[0], batches[2], batches[3], end}, false},
+		{"renumbered batch", []Message{batches[0], &renumbered, batches[3], end}, false},
+		{"tampered batch", []Message{batches[0], &tampered, batches[2], batches[3], end}, false},
+		{"spliced from another stream", []Message{batches[0], otherBatches[1], otherBatches[2], otherBatches[3], end}, false},
+		{"from another sharer", []Message{otherSharerBatches[0]}, false},
+		{"ended early", []Message{batches[0], batches[1], batches[2], batches[3], &ManifestStreamEnd{Batches: 3, Signature: signature}}, false},
+		{"ended late", []Message{batches[0], batches[1], batches[2], batches[3], &ManifestStreamEnd{Batches: 5, Signature: signature}}, false},
+		{"signature of another manifest", []Message{batches[0], batches[1], batches[2], batches[3], &ManifestStreamEnd{Batches: 4, Signature: otherSignature}}, false},
+		{"ended before the root", []Message{batches[0], batches[1], batches[2], &ManifestStreamEnd{Batches: 3, Signature: signature}}, false},
+	}
+	for _, test := range tests {
+		ms := &manifestStream{publicKey: keyPair.PublicKey}
+		var signed []byte
+		var err error
+		for _, msg := range test.messages {
+			switch msg := msg.(type) {
+			case *ManifestBatch:
+				_, err = ms.add(msg)
+			case *ManifestStreamEnd:
+				_, signed, err = ms.end(msg)
+			}
+			if err != nil {
+				break
+			}
+		}
+		if ok := err == nil && signed != nil; ok != test.ok {
+			t.Errorf("%s: got %v, expected ok to be %v", test.name, err, test.ok)
+			continue
+		}
+		if test.ok {
+			if _, _, err := manifest.OpenSigned(signed, keyPair.PublicKey.Sha1Hash()); err != nil {
+				t.Errorf("%s: %v", test.name, err)
+			}
+		}
+	}
+}
+
+// spooledSender returns a Sender streaming the given batches as if it had made them, without ending the stream.
+func spooledSender(t *testing.T, rootPath string, keyPair *pubkeycrypto.KeyPair, batches []*ManifestBatch) *Sender {
+	t.Helper()
+	spool, err := newBatchSpool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { spool.remove() })
+	for _, batch := range batches {
+		err = spool.add(batch)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &Sender{
+		rootPath:   rootPath,
+		privateKey: keyPair.PrivateKey,
+		shareKey:   keyPair.PublicKey.Sha1Hash(),
+		versions:   make(map[uint32]int),
+		stream: &senderStream{
+			spool:   spool,
+			changed: make(chan struct{}),
+			done:    make(chan struct{}),
+		},
+	}
+}
+
+func TestManifestStreamWaitsForAcknowledgements(t *testing.T) {
+	keyPair, err := pubkeycrypto.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The batches are only read here, so they aren't signed
+	var batches []*ManifestBatch
+	for seq := 0; seq < 3*streamBatchWindow; seq++ {
+		batches = append(batches, &ManifestBatch{Seq: seq, Count: 1, Data: []byte{byte(seq)}})
+	}
+	sender := spooledSender(t, "", keyPair, batches)
+	sender.stream.end = &ManifestStreamEnd{Batches: len(batches)}
+	conn, stop := serve(sender)
+	defer stop()
+	err = WriteMessage(conn, ManifestRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := ReadMessage(conn); err != nil {
+		t.Fatal(err)
+	} else if _, ok := msg.(*ManifestStreamStart); !ok {
+		t.Fatalf("got %#v, expected the start of the stream", msg)
+	}
+	readBatch := func(seq int) {
+		t.Helper()
+		msg, err := ReadMessage(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if batch, ok := msg.(*ManifestBatch); !ok || batch.Seq != seq || !bytes.Equal(batch.Data, []byte{byte(seq)}) {
+			t.Fatalf("got %#v, expected batch %d", msg, seq)
+		}
+	}
+
+	// Without acknowledgements, the sharer stops a window ahead
+	for seq := 0; seq < streamBatchWindow; seq++ {
+		readBatch(seq)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := len(conn.(*pipeEnd).in); n != 0 {
+		t.Fatalf("%d more messages were sent without acknowledgements", n)
+	}
+	// Then each acknowledgement lets one more batch through
+	for seq := range batches {
+		err = WriteMessage(conn, &ManifestBatchAck{Seq: seq})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seq+streamBatchWindow < len(batches) {
+			readBatch(seq + streamBatchWindow)
+		}
+	}
+	if msg, err := ReadMessage(conn); err != nil {
+		t.Fatal(err)
+	} else if end, ok := msg.(*ManifestStreamEnd); !ok || end.Batches != len(batches) {
+		t.Fatalf("got %#v, expected the end of the stream", msg)
+	}
+}
+
+// updateReadConn calls updated when it reads a file update.
+type updateReadConn struct {
+	Conn
+	updated func()
+}
+
+func (c *updateReadConn) Read() ([]byte, error) {
+	b, err := c.Conn.Read()
+	if err == nil && messageType(b[0]) == typeFileUpdate {
+		c.updated()
+	}
+	return b, err
+}
+
+func TestFileUpdatesWaitForTheEndOfTheStream(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	root := filepath.Join(tempDir, "share")
+	writeFile(t, filepath.Join(root, "a"), "first file")
+	writeFile(t, filepath.Join(root, "b"), "second file")
+	keyPair, err := pubkeycrypto.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	batches, signature := signedBatches(t, root, keyPair.PrivateKey)
+	m, err := manifest.GenerateManifest(context.Background(), root, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a changed and was re-hashed once the manifest was complete, while the receiver is still getting the stream
+	writeFile(t, filepath.Join(root, "a"), "first file, changed")
+	a, _ := m.EntityByPath("a")
+	updated, err := m.Rehash(context.Background(), root, a.Id())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender := spooledSender(t, root, keyPair, batches)
+	sender.manifest = updated
+	sender.versions[a.Id()] = 1
+	// The stream only ends once the receiver has the update
+	end := func() {
+		sender.mutex.Lock()
+		defer sender.mutex.Unlock()
+		if sender.stream.end == nil {
+			sender.stream.end = &ManifestStreamEnd{Batches: len(batches), Signature: signature}
+			sender.stream.notify()
+		}
+	}
+	conn, stop := serve(sender)
+	result, err := Receive(context.Background(), &updateReadConn{Conn: conn, updated: end}, keyPair.PublicKey.Sha1Hash(), tempDest(t),
+		&ReceiveOptions{Warn: func(err error) { t.Log(err) }})
+	stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sender.stream.end == nil || len(result.Failed) != 0 {
+		t.Fatalf("updated: %v, failed: %v", sender.stream.end != nil, result.Failed)
+	}
+	if !bytes.Equal(result.Manifest.MerkleRoot(), updated.MerkleRoot()) {
+		t.Error("the update wasn't applied to the manifest")
+	}
+	for name, want := range map[string]string{"a": "first file, changed", "b": "second file"} {
+		data, err := ioutil.ReadFile(filepath.Join(result.RootPath, name))
+		if err != nil || string(data) != want {
+			t.Errorf("%s: got %q, %v", name, data, err)
+		}
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sort"
+
+	"github.com/pavben/Vortex/manifest"
+	"github.com/pavben/Vortex/pubkeycrypto"
+	"github.com/pavben/Vortex/ratelimit"
+	"github.com/pavben/Vortex/safename"
+	"github.com/pavben/Vortex/transfer"
+	"github.com/pavben/Vortex/vortexconn"
+)
+
+var getCommand = &command{
+	summary: "download a share from the sharer's address",
+	run:     runGet,
+}
+
+func runGet(args []string) error {
+	flags := flag.NewFlagSet("get", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: vortex get [flags] [path] <share key> <address>")
+		fmt.Fprintln(flags.Output(), "The share is downloaded into path, which defaults to the current folder.")
+		flags.PrintDefaults()
+	}
+	portable := flags.Bool("portable", false, "only create names that are valid on every platform, renaming colliding names")
+	retries := flags.Int("retries", 5, "how many times in a row to try reconnecting when the connection drops")
+	downloadFlags := addLimitFlags(flags, "download", "limit on the download rate")
+	connections := flags.Int("connections", 1, "how many connections to download over in parallel")
+	window := flags.Int("window", 0, "how many chunk requests to keep outstanding per connection, or 0 to adapt to the link")
+	noMetadata := flags.Bool("no-metadata", false, "don't apply the sharer's permissions, modification times and extended attributes")
+	unsafeSymlinks := flags.Bool("unsafe-symlinks", false, "create symlinks even if they could point outside the download, such as to absolute paths")
+	saveManifest := flags.String("save-manifest", "", "save the signed manifest to this file, for vortex verify -signer <share key>")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	destPath := "."
+	switch flags.NArg() {
+	case 2:
+	case 3:
+		destPath = flags.Arg(0)
+	default:
+		flags.Usage()
+		return errors.New("expected a share key and an address")
+	}
+	shareKey := flags.Arg(flags.NArg() - 2)
+	addr := flags.Arg(flags.NArg() - 1)
+	downloadRate, downloadBurst, err := downloadFlags.parse()
+	if err != nil {
+		return err
+	}
+	keyPair, err := pubkeycrypto.GenerateKeyPair()
+	if err != nil {
+		return err
+	}
+	d := &dialer{
+		addr:     addr,
+		keyPair:  keyPair,
+		shareKey: shareKey,
+		// Shared by all connections, so that the limit applies to the download as a whole
+		downloadLimiter: ratelimit.New(downloadRate, downloadBurst),
+	}
+	fmt.Println("Connecting to share host:", addr)
+	conn, err := d.dial()
+	if err != nil {
+		return err
+	}
+	defer d.close()
+	fmt.Printf("Host's public key matches the SHA1 hash '%s'\n", shareKey)
+	fmt.Println("Download limit:", formatLimit(d.downloadLimiter.Limits()))
+	watchLimitCommands(map[string]limitSetter{"download": d.downloadLimiter})
+	opts := &transfer.ReceiveOptions{
+		Progress: printProgress(),
+		Warn:     printWarning,
+		Redial: func() (transfer.Conn, error) {
+			fmt.Println("Connecting to share host:", addr)
+			return d.dial()
+		},
+		RedialAttempts:      *retries,
+		Connections:         *connections,
+		Window:              *window,
+		AllowUnsafeSymlinks: *unsafeSymlinks,
+		SkipMetadata:        *noMetadata,
+	}
+	opts.Names = nameOptions(*portable)
+	result, err := transfer.Receive(context.Background(), conn, shareKey, destPath, opts)
+	if err != nil {
+		return err
+	}
+	if result.Resumed {
+		fmt.Println("Resumed an interrupted download")
+	}
+	fmt.Println("Downloaded to", result.RootPath)
+	if result.Dedup.BytesSaved() > 0 {
+		fmt.Println("Duplicate chunks:", result.Dedup)
+	}
+	if *saveManifest != "" {
+		err := saveSignedManifest(*saveManifest, shareKey, result)
+		if err != nil {
+			return err
+		}
+	}
+	if len(result.Failed) == 0 {
+		return nil
+	}
+	failedPaths := make([]string, 0, len(result.Failed))
+	for relPath := range result.Failed {
+		failedPaths = append(failedPaths, relPath)
+	}
+	sort.Strings(failedPaths)
+	for _, relPath := range failedPaths {
+		fmt.Printf("Failed: %s: %v\n", relPath, result.Failed[relPath])
+	}
+	return fmt.Errorf("%d entries could not be downloaded; run the same command again to retry them", len(failedPaths))
+}
+
+// saveSignedManifest writes the signed manifest of the download to filePath, warning if it doesn't cover files that were updated after the
+// sharer signed it, since vortex verify would then find those files don't match.
+func saveSignedManifest(filePath, shareKey string, result *transfer.Result) error {
+	err := ioutil.WriteFile(filePath, result.SignedManifest, 0644)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Saved the signed manifest to", filePath)
+	signed, _, err := manifest.OpenSigned(result.SignedManifest, shareKey)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(signed.MerkleRoot(), result.Manifest.MerkleRoot()) {
+		printWarning(errors.New("files changed on the sharer's side after it signed the manifest, so the saved manifest doesn't match them"))
+	}
+	return nil
+}
+
+// nameOptions returns how names from the sharer are mapped to local names, which vortex verify must agree on with vortex get.
+func nameOptions(portable bool) *safename.Options {
+	if !portable {
+		return nil
+	}
+	return &safename.Options{
+		Portable:   true,
+		Collisions: safename.CollisionRename,
+	}
+}
+
+// dialer connects to the sharer, skipping the RSA handshake with session tickets from earlier connections when it can.
+type dialer struct {
+	// addr is the sharer's address as given on the command line
+	addr string
+	// resolve returns the address to connect to, given the one the last connection went to, or "" before the first connection. It is
+	// called for every connection, so that reconnecting follows a sharer that moved. If nil, the host name of addr is looked up every time.
+	resolve  func(previousAddr string) (string, error)
+	lastAddr string
+	keyPair  *pubkeycrypto.KeyPair
+	shareKey string
+	conns    []*vortexconn.Connection
+	// downloadLimiter paces reads from every connection
+	downloadLimiter *ratelimit.Limiter
+	// Connections to listeners that issue session tickets come with one, which can be used once for any later connection
+	tickets []*vortexconn.SessionTicket
+}
+
+func (d *dialer) dial() (*vortexconn.Connection, error) {
+	resolve := d.resolve
+	if resolve == nil {
+		resolve = d.lookupHost
+	}
+	addr, err := resolve(d.lastAddr)
+	if err != nil {
+		return nil, err
+	}
+	if d.lastAddr != "" && addr != d.lastAddr {
+		fmt.Println("Share host moved to", addr)
+	}
+	d.lastAddr = addr
+	var conn *vortexconn.Connection
+	for conn == nil && len(d.tickets) > 0 {
+		ticket := d.tickets[len(d.tickets)-1]
+		d.tickets = d.tickets[:len(d.tickets)-1]
+		conn, err = vortexconn.ConnectWithTicket(addr, ticket)
+		if err != nil && err != vortexconn.ErrTicketRejected {
+			// The listener may never have seen the ticket
+			d.tickets = append(d.tickets, ticket)
+			return nil, err
+		}
+	}
+	if conn == nil {
+		conn, err = vortexconn.Connect(addr, d.keyPair)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if conn.TheirPublicKey().Sha1Hash() != d.shareKey {
+		conn.Close()
+		return nil, errors.New("host's public key doesn't match the share key")
+	}
+	conn.LimitReads(d.downloadLimiter)
+	d.conns = append(d.conns, conn)
+	if conn.Ticket() != nil {
+		d.tickets = append(d.tickets, conn.Ticket())
+	}
+	return conn, nil
+}
+
+// lookupHost looks up the host name of d.addr and returns one of its addresses with the port. It keeps to previousAddr while the name still
+// leads there, since the sharer is most likely still listening on it.
+func (d *dialer) lookupHost(previousAddr string) (string, error) {
+	host, port, err := net.SplitHostPort(d.addr)
+	if err != nil {
+		return "", err
+	}
+	if net.ParseIP(host) != nil {
+		return d.addr, nil
+	}
+	hostAddrs, err := net.LookupHost(host)
+	if err != nil {
+		return "", err
+	}
+	for _, hostAddr := range hostAddrs {
+		if net.JoinHostPort(hostAddr, port) == previousAddr {
+			return previousAddr, nil
+		}
+	}
+	return net.JoinHostPort(hostAddrs[0], port), nil
+}
+
+// close closes every connection made, including ones that dropped.
+func (d *dialer) close() {
+	for _, conn := range d.conns {
+		conn.Close()
+	}
+}
+
+// printProgress returns a progress function printing a line whenever a file completes or another percent of the total is done.
+func printProgress() func(transfer.Progress) {
+	lastPercent := uint64(0)
+	return func(p transfer.Progress) {
+		percent := uint64(100)
+		if p.BytesTotal > 0 {
+			percent = p.BytesDone * 100 / p.BytesTotal
+		}
+		if p.FileBytesDone < p.FileSize && percent == lastPercent {
+			return
+		}
+		lastPercent = percent
+		fmt.Printf("[%s] [%s / %s (%d%%)] [total %d%%]\n", p.Path, manifest.FormatSize(p.FileBytesDone), manifest.FormatSize(p.FileSize),
+			p.FileBytesDone*100/p.FileSize, percent)
+	}
+}
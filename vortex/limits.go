@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/pavben/Vortex/manifest"
+	"github.com/pavben/Vortex/ratelimit"
+)
+
+// limitSetter is a bandwidth limit that can be changed while a command runs.
+type limitSetter interface {
+	SetLimits(rate, burst int)
+	Limits() (rate, burst int)
+}
+
+// limitFlags registers the -<name>-limit and -<name>-burst flags.
+type limitFlags struct {
+	rate  *string
+	burst *string
+}
+
+func addLimitFlags(flags *flag.FlagSet, name, description string) *limitFlags {
+	return &limitFlags{
+		rate:  flags.String(name+"-limit", "off", description+" in bytes per second, such as 500K or 2M"),
+		burst: flags.String(name+"-burst", "0", "how many bytes may go at once under -"+name+"-limit after a pause (0 for a tenth of a second's worth)"),
+	}
+}
+
+func (lf *limitFlags) parse() (rate, burst int, err error) {
+	rate, err = ratelimit.ParseRate(*lf.rate)
+	if err != nil {
+		return 0, 0, err
+	}
+	burst, err = ratelimit.ParseRate(*lf.burst)
+	if err != nil {
+		return 0, 0, err
+	}
+	return rate, burst, nil
+}
+
+// limitNames lists the names of limits for messages, such as "receiver or upload".
+func limitNames(limits map[string]limitSetter) string {
+	names := make([]string, 0, len(limits))
+	for name := range limits {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, " or ")
+}
+
+func formatLimit(rate, burst int) string {
+	if rate == 0 {
+		return "off"
+	}
+	return fmt.Sprintf("%s/s with bursts of %s", manifest.FormatSize(uint64(rate)), manifest.FormatSize(uint64(burst)))
+}
+
+// watchLimitCommands lets the limits be changed by typing lines such as "upload 1M" or "upload 1M 256K" on standard input,
+// where the first word is the name in limits, followed by the rate and optionally the burst.
+func watchLimitCommands(limits map[string]limitSetter) {
+	fmt.Printf("To change a limit while running, type %s followed by a rate such as 2M or off, and optionally a burst\n", limitNames(limits))
+	go func() {
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) == 0 {
+				continue
+			}
+			err := applyLimitCommand(limits, fields)
+			if err != nil {
+				fmt.Println("Error:", err)
+			}
+		}
+	}()
+}
+
+func applyLimitCommand(limits map[string]limitSetter, fields []string) error {
+	limit, ok := limits[fields[0]]
+	if !ok || len(fields) < 2 || len(fields) > 3 {
+		return fmt.Errorf("expected %s followed by a rate and optionally a burst", limitNames(limits))
+	}
+	rate, err := ratelimit.ParseRate(fields[1])
+	if err != nil {
+		return err
+	}
+	burst := 0
+	if len(fields) == 3 {
+		burst, err = ratelimit.ParseRate(fields[2])
+		if err != nil {
+			return err
+		}
+	}
+	limit.SetLimits(rate, burst)
+	fmt.Printf("The %s limit is now %s\n", fields[0], formatLimit(limit.Limits()))
+	return nil
+}
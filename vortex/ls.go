@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/pavben/Vortex/manifest"
+)
+
+var lsCommand = &command{
+	summary: "list the contents of a share as a tree, JSON or a checksum file",
+	run:     runLs,
+}
+
+func runLs(args []string) error {
+	flags := flag.NewFlagSet("ls", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: vortex ls [flags] [path]")
+		fmt.Fprintln(flags.Output(), "The path is the shared file or folder. With -manifest, it is only needed for checksum formats.")
+		flags.PrintDefaults()
+	}
+	format := flags.String("format", "tree", "output format: tree, json, sha256sum, b3sum, binary (the encoded manifest, for -manifest and vortex verify) "+
+		"or stream (like binary, but written while generating, for trees too large to hold in memory)")
+	mf := addManifestFlags(flags)
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() > 1 {
+		flags.Usage()
+		return fmt.Errorf("unexpected arguments %v", flags.Args()[1:])
+	}
+	localPath := flags.Arg(0)
+	if *format == "stream" {
+		w := bufio.NewWriter(os.Stdout)
+		err := mf.writeStream(localPath, w)
+		if err != nil {
+			return err
+		}
+		return w.Flush()
+	}
+	m, err := mf.load(localPath)
+	if err != nil {
+		return err
+	}
+	switch *format {
+	case "tree":
+		err := m.WriteTree(os.Stdout)
+		if err != nil {
+			return err
+		}
+		fmt.Println(m.DedupReport())
+		return nil
+	case "json":
+		return m.WriteJSON(os.Stdout)
+	case "binary":
+		_, err := os.Stdout.Write(m.Marshal())
+		return err
+	case "sha256sum", "b3sum":
+		if localPath == "" {
+			return fmt.Errorf("the %s format reads the files, so it needs their path", *format)
+		}
+		alg := manifest.HashSHA256
+		if *format == "b3sum" {
+			alg = manifest.HashBLAKE3
+		}
+		return m.WriteChecksums(os.Stdout, localPath, alg)
+	default:
+		return fmt.Errorf("unknown format %q", *format)
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/pavben/Vortex/manifest"
+)
+
+// manifestFlags are the flags shared by commands that work on a manifest, which is either generated from a local path or loaded from a file.
+type manifestFlags struct {
+	manifestFile  *string
+	signer        *string
+	hashAlgorithm *string
+	cdc           *bool
+	hashCache     *bool
+	exclude       stringsFlag
+	include       stringsFlag
+	gitignore     *bool
+	// If non-nil, reports the progress of hashing while generating. Commands writing the manifest to stdout leave it nil.
+	progress func(manifest.Progress)
+}
+
+// stringsFlag is a flag that can be given several times, collecting every value.
+type stringsFlag []string
+
+func (sf *stringsFlag) String() string {
+	return strings.Join(*sf, " ")
+}
+
+func (sf *stringsFlag) Set(value string) error {
+	*sf = append(*sf, value)
+	return nil
+}
+
+func addManifestFlags(flags *flag.FlagSet) *manifestFlags {
+	mf := &manifestFlags{
+		manifestFile:  flags.String("manifest", "", "read the manifest from this file instead of generating it"),
+		signer:        flags.String("signer", "", "the manifest file is signed; require this signer public key hash"),
+		hashAlgorithm: flags.String("hash", manifest.DefaultHashAlgorithm.String(), "chunk hash algorithm when generating (sha256 or blake3)"),
+		cdc:           flags.Bool("cdc", false, "use content-defined chunking when generating"),
+		hashCache:     flags.Bool("hash-cache", false, "keep a per-user cache of file hashes and reuse those of files that haven't changed since they were last hashed"),
+		gitignore:     flags.Bool("gitignore", false, "leave out what .gitignore files ignore, and .git folders, when generating"),
+	}
+	flags.Var(&mf.exclude, "exclude", "leave out paths matching this gitignore-style pattern when generating (repeatable)")
+	flags.Var(&mf.include, "include", "keep paths matching this gitignore-style pattern even if excluded otherwise (repeatable)")
+	return mf
+}
+
+// load returns the manifest from the -manifest file if given, and otherwise generates it for localPath.
+func (mf *manifestFlags) load(localPath string) (*manifest.Manifest, error) {
+	if *mf.manifestFile != "" {
+		return readManifestFile(*mf.manifestFile, *mf.signer)
+	}
+	opts, err := mf.generateOptions(localPath)
+	if err != nil {
+		return nil, err
+	}
+	m, err := manifest.GenerateManifest(context.Background(), localPath, opts)
+	if err != nil {
+		return nil, err
+	}
+	saveHashCache(opts)
+	return m, nil
+}
+
+// writeStream generates the manifest for localPath as a manifest stream written to w, which only holds a bounded part of the tree in memory.
+func (mf *manifestFlags) writeStream(localPath string, w io.Writer) error {
+	if *mf.manifestFile != "" {
+		return errors.New("manifest streams are written while generating, so they can't be made from -manifest")
+	}
+	opts, err := mf.generateOptions(localPath)
+	if err != nil {
+		return err
+	}
+	err = manifest.WriteManifestStream(context.Background(), localPath, opts, w)
+	if err != nil {
+		return err
+	}
+	saveHashCache(opts)
+	return nil
+}
+
+// generateOptions returns the options for generating the manifest of localPath as the flags ask, opening the per-user hash cache if
+// -hash-cache is given. Problems with the cache are only warnings, since it merely saves hashing files again.
+func (mf *manifestFlags) generateOptions(localPath string) (*manifest.GenerateOptions, error) {
+	if localPath == "" {
+		return nil, errors.New("a path or -manifest is required")
+	}
+	hashAlgorithm, err := manifest.ParseHashAlgorithm(*mf.hashAlgorithm)
+	if err != nil {
+		return nil, err
+	}
+	opts := &manifest.GenerateOptions{
+		HashAlgorithm: hashAlgorithm,
+		Progress:      mf.progress,
+		Exclude:       mf.exclude,
+		Include:       mf.include,
+		UseGitignore:  *mf.gitignore,
+		Warn: func(relPath string, err error) {
+			printWarning(fmt.Errorf("skipping %s: %v", relPath, err))
+		},
+	}
+	if *mf.cdc {
+		opts.Chunking = manifest.DefaultContentDefinedChunking
+	}
+	if *mf.hashCache {
+		opts.HashCache, err = manifest.OpenDefaultHashCache()
+		if err != nil {
+			printWarning(fmt.Errorf("not using the hash cache: %v", err))
+		}
+	}
+	return opts, nil
+}
+
+// saveHashCache prunes and saves the hash cache used with opts, if any.
+func saveHashCache(opts *manifest.GenerateOptions) {
+	if opts.HashCache == nil {
+		return
+	}
+	opts.HashCache.Prune()
+	err := opts.HashCache.Save()
+	if err != nil {
+		printWarning(fmt.Errorf("couldn't save the hash cache: %v", err))
+	}
+}
+
+// printHashProgress returns a progress function printing a line whenever another percent of the files' content has been hashed, and once
+// the last file is done.
+func printHashProgress() func(manifest.Progress) {
+	lastPercent := uint64(0)
+	finished := false
+	return func(p manifest.Progress) {
+		percent := uint64(100)
+		if p.BytesTotal > 0 {
+			percent = p.BytesHashed * 100 / p.BytesTotal
+		}
+		if p.FilesHashed == p.FilesTotal {
+			if finished {
+				return
+			}
+			finished = true
+		} else if percent == lastPercent {
+			return
+		}
+		lastPercent = percent
+		fmt.Printf("[hashed %s / %s (%d%%)] [files %d / %d]\n", manifest.FormatSize(p.BytesHashed), manifest.FormatSize(p.BytesTotal), percent,
+			p.FilesHashed, p.FilesTotal)
+	}
+}
+
+// readManifestFile reads a manifest saved with Marshal or as a manifest stream, or with Sign if signer is not empty, in which case it must be
+// the signer's public key hash.
+func readManifestFile(filePath, signer string) (*manifest.Manifest, error) {
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	if signer != "" {
+		m, _, err := manifest.OpenSigned(data, signer)
+		return m, err
+	}
+	m, err := manifest.Unmarshal(data)
+	if err == manifest.ErrBadManifestMagic {
+		m, err = manifest.ReadManifestStream(bytes.NewReader(data))
+		if err == manifest.ErrBadStreamMagic {
+			return nil, fmt.Errorf("%s isn't a manifest or a manifest stream (signed manifests need -signer)", filePath)
+		}
+	}
+	return m, err
+}
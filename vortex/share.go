@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"path/filepath"
+	"sync"
+
+	"github.com/pavben/Vortex/manifest"
+	"github.com/pavben/Vortex/pubkeycrypto"
+	"github.com/pavben/Vortex/ratelimit"
+	"github.com/pavben/Vortex/transfer"
+	"github.com/pavben/Vortex/vortexconn"
+)
+
+var shareCommand = &command{
+	summary: "share a file or folder with receivers connecting directly to this machine",
+	run:     runShare,
+}
+
+func runShare(args []string) error {
+	flags := flag.NewFlagSet("share", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: vortex share [flags] <path>")
+		flags.PrintDefaults()
+	}
+	listenAddr := flags.String("listen", ":27806", "address to accept receivers on")
+	mf := addManifestFlags(flags)
+	mf.progress = printHashProgress()
+	stream := flags.Bool("stream", false, "serve the manifest while it is being generated, so receivers can download files as soon as they're hashed")
+	onChange := flags.String("on-change", "rehash", "what to do about files that change while shared: rehash or abort")
+	uploadFlags := addLimitFlags(flags, "upload", "limit on the total upload rate")
+	receiverFlags := addLimitFlags(flags, "receiver", "limit on the upload rate to each receiver")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return errors.New("expected the path to share")
+	}
+	localPath := flags.Arg(0)
+	senderOpts := &transfer.SenderOptions{Warn: printWarning}
+	switch *onChange {
+	case "rehash":
+		senderOpts.OnChange = transfer.ChangeRehash
+	case "abort":
+		senderOpts.OnChange = transfer.ChangeAbort
+	default:
+		return fmt.Errorf("unknown -on-change policy %q", *onChange)
+	}
+	uploadRate, uploadBurst, err := uploadFlags.parse()
+	if err != nil {
+		return err
+	}
+	receiverRate, receiverBurst, err := receiverFlags.parse()
+	if err != nil {
+		return err
+	}
+	uploadLimiter := ratelimit.New(uploadRate, uploadBurst)
+	receiverLimits := newReceiverLimits(receiverRate, receiverBurst)
+	ctx := context.Background()
+	if *stream && *mf.manifestFile != "" {
+		return errors.New("-stream serves the manifest while generating it, so it can't be used with -manifest")
+	}
+	if *mf.manifestFile == "" {
+		fmt.Println("Generating the manifest for", localPath)
+	}
+	keyPair, err := pubkeycrypto.GenerateKeyPair()
+	if err != nil {
+		return err
+	}
+	var sender *transfer.Sender
+	var rootName string
+	var genOpts *manifest.GenerateOptions
+	if *stream {
+		genOpts, err = mf.generateOptions(localPath)
+		if err != nil {
+			return err
+		}
+		sender = transfer.NewStreamingSender(ctx, localPath, genOpts, keyPair.PrivateKey, senderOpts)
+		defer sender.Close()
+		rootName = filepath.Base(localPath)
+	} else {
+		m, err := mf.load(localPath)
+		if err != nil {
+			return err
+		}
+		sender, err = transfer.NewSender(m, localPath, keyPair.PrivateKey, senderOpts)
+		if err != nil {
+			return err
+		}
+		rootName = m.Root().Name()
+	}
+	listener, err := vortexconn.Listen(*listenAddr, keyPair)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	// A failure to generate the manifest stops sharing
+	genErr := make(chan error, 1)
+	if *stream {
+		go func() {
+			_, err := sender.Wait()
+			if err != nil {
+				genErr <- err
+				listener.Close()
+				return
+			}
+			saveHashCache(genOpts)
+			fmt.Println("The manifest is complete")
+		}()
+	}
+	shareKey := keyPair.PublicKey.Sha1Hash()
+	fmt.Printf("Secret share key for '%s': %s\n", rootName, shareKey)
+	fmt.Println("Ready to transfer")
+	fmt.Println()
+	_, port, err := net.SplitHostPort(*listenAddr)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Receiver command: vortex get [path] %s <this machine's address>:%s\n", shareKey, port)
+	fmt.Println("Upload limit:", formatLimit(uploadLimiter.Limits()))
+	fmt.Println("Limit per receiver:", formatLimit(receiverLimits.Limits()))
+	watchLimitCommands(map[string]limitSetter{
+		"upload":   uploadLimiter,
+		"receiver": receiverLimits,
+	})
+	for {
+		conn := listener.Accept()
+		if conn == nil {
+			select {
+			case err := <-genErr:
+				return fmt.Errorf("error generating the manifest: %v", err)
+			default:
+				return nil
+			}
+		}
+		go func() {
+			defer conn.Close()
+			// Every connection of a receiver shares its limit
+			receiver := conn.TheirPublicKey().Sha1Hash()
+			conn.LimitWrites(uploadLimiter, receiverLimits.acquire(receiver))
+			defer receiverLimits.release(receiver)
+			fmt.Println("Receiver connected")
+			err := sender.Serve(ctx, conn)
+			if err != nil {
+				fmt.Println("Receiver session ended with an error:", err)
+				return
+			}
+			fmt.Println("Receiver disconnected")
+		}()
+	}
+}
+
+// receiverLimits gives every receiver a limiter of its own, all with the same limits.
+type receiverLimits struct {
+	mutex sync.Mutex
+	// Holds the limits for new receivers, without limiting anything itself
+	settings *ratelimit.Limiter
+	limiters map[string]*receiverLimiter
+}
+
+// receiverLimiter is the limiter of one receiver and how many of its connections use it.
+type receiverLimiter struct {
+	limiter *ratelimit.Limiter
+	conns   int
+}
+
+func newReceiverLimits(rate, burst int) *receiverLimits {
+	return &receiverLimits{
+		settings: ratelimit.New(rate, burst),
+		limiters: make(map[string]*receiverLimiter),
+	}
+}
+
+// acquire returns the limiter of the receiver with the given public key hash. Call release once the connection is closed.
+func (rl *receiverLimits) acquire(receiver string) *ratelimit.Limiter {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	rlim, ok := rl.limiters[receiver]
+	if !ok {
+		rlim = &receiverLimiter{limiter: ratelimit.New(rl.settings.Limits())}
+		rl.limiters[receiver] = rlim
+	}
+	rlim.conns++
+	return rlim.limiter
+}
+
+func (rl *receiverLimits) release(receiver string) {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	rlim := rl.limiters[receiver]
+	if rlim.conns--; rlim.conns == 0 {
+		delete(rl.limiters, receiver)
+	}
+}
+
+// SetLimits changes the limits of every receiver, including those already connected.
+func (rl *receiverLimits) SetLimits(rate, burst int) {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	rl.settings.SetLimits(rate, burst)
+	for _, rlim := range rl.limiters {
+		rlim.limiter.SetLimits(rate, burst)
+	}
+}
+
+func (rl *receiverLimits) Limits() (rate, burst int) {
+	return rl.settings.Limits()
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+
+	"github.com/pavben/Vortex/manifest"
+	"github.com/pavben/Vortex/pubkeycrypto"
+	"github.com/pavben/Vortex/transfer"
+)
+
+var verifyCommand = &command{
+	summary: "check a local copy of a share against its manifest and optionally repair it",
+	run:     runVerify,
+}
+
+func runVerify(args []string) error {
+	flags := flag.NewFlagSet("verify", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: vortex verify [flags] <path> <manifest>")
+		fmt.Fprintln(flags.Output(), "The manifest is a file saved by vortex get -save-manifest, which needs -signer <share key>, or by vortex ls -format binary.")
+		flags.PrintDefaults()
+	}
+	signer := flags.String("signer", "", "the manifest file is signed; require this signer public key hash")
+	portable := flags.Bool("portable", false, "the local copy was downloaded with vortex get -portable")
+	repairAddr := flags.String("repair-addr", "", "repair the local copy with chunks from the sharer at this address")
+	shareKey := flags.String("share-key", "", "the share key of the sharer at -repair-addr (defaults to -signer)")
+	repairFrom := flags.String("repair-from", "", "repair the local copy with chunks read from another copy of the share at this path")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() != 2 {
+		flags.Usage()
+		return errors.New("expected a path and a manifest file")
+	}
+	localPath := flags.Arg(0)
+	if *repairAddr != "" && *repairFrom != "" {
+		return errors.New("-repair-addr and -repair-from can't be used together")
+	}
+	if *shareKey == "" {
+		*shareKey = *signer
+	}
+	if *repairAddr != "" && *shareKey == "" {
+		return errors.New("-repair-addr needs -share-key or -signer")
+	}
+	m, err := readManifestFile(flags.Arg(1), *signer)
+	if err != nil {
+		return err
+	}
+	names := nameOptions(*portable)
+	ctx := context.Background()
+	report, err := m.Verify(ctx, localPath, names)
+	if err != nil {
+		return err
+	}
+	fmt.Print(report)
+	if report.OK() {
+		return nil
+	}
+	var fetch manifest.FetchFunc
+	switch {
+	case *repairAddr != "":
+		d := &dialer{addr: *repairAddr, shareKey: *shareKey}
+		d.keyPair, err = pubkeycrypto.GenerateKeyPair()
+		if err != nil {
+			return err
+		}
+		fmt.Println("Connecting to share host:", *repairAddr)
+		conn, err := d.dial()
+		if err != nil {
+			return err
+		}
+		defer d.close()
+		fetcher, err := transfer.NewFetcher(conn, *shareKey, m)
+		if err != nil {
+			return err
+		}
+		fmt.Println("Repairing from the sharer")
+		fetch = fetcher.Fetch
+	case *repairFrom != "":
+		fmt.Println("Repairing from", *repairFrom)
+		fetch = func(fileId uint32, index int) ([]byte, error) {
+			return m.ReadChunk(*repairFrom, fileId, index)
+		}
+	default:
+		return errors.New("verification failed")
+	}
+	err = m.Repair(ctx, localPath, names, report, fetch)
+	if err != nil {
+		return err
+	}
+	report, err = m.Verify(ctx, localPath, names)
+	if err != nil {
+		return err
+	}
+	fmt.Print(report)
+	if !report.OK() {
+		return errors.New("problems remain after repair")
+	}
+	return nil
+}
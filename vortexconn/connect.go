@@ -5,18 +5,42 @@ import (
 	"fmt"
 	"net"
 
-	"github.com/pavben/Vortex/aesstream"
 	"github.com/pavben/Vortex/pubkeycrypto"
 )
 
-// Connect establishes an encrypted connection and returns it.
+// Connect establishes an encrypted connection and returns it. The connection carries a session ticket for reconnecting with ConnectWithTicket,
+// unless the listener is from before session tickets.
 func Connect(addr string, keyPair *pubkeycrypto.KeyPair) (*Connection, error) {
 	tcpConn, err := net.Dial("tcp", addr)
 	if err != nil {
 		return nil, fmt.Errorf("dial error: %v", err)
 	}
+	conn, err := initConnectionAsClient(tcpConn, keyPair, true)
+	if err == nil {
+		return conn, nil
+	}
+	tcpConn.Close()
+	// Listeners from before session tickets can't parse a public key sent with the ticket request magic and drop the connection, so start
+	// over without it
+	tcpConn, err = net.Dial("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("dial error: %v", err)
+	}
+	conn, err = initConnectionAsClient(tcpConn, keyPair, false)
+	if err != nil {
+		tcpConn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func initConnectionAsClient(tcpConn net.Conn, keyPair *pubkeycrypto.KeyPair, requestTicket bool) (*Connection, error) {
 	// Send the server our public key
-	err = writeByteChunkPlain(tcpConn, keyPair.PublicKey.ToBytes())
+	publicKeyBytes := keyPair.PublicKey.ToBytes()
+	if requestTicket {
+		publicKeyBytes = append([]byte(ticketRequestMagic), publicKeyBytes...)
+	}
+	err := writeByteChunkPlain(tcpConn, publicKeyBytes)
 	if err != nil {
 		return nil, fmt.Errorf("error sending our public key: %v", err)
 	}
@@ -51,13 +75,15 @@ func Connect(addr string, keyPair *pubkeycrypto.KeyPair) (*Connection, error) {
 		return nil, fmt.Errorf("IV length %d must equal to the AES block size %d", len(iv), aes.BlockSize)
 	}
 	// Create the AES stream
-	aesStream, err := aesstream.NewAesStream(tcpConn, aesKey, iv)
+	conn, err := newConnection(tcpConn, aesKey, iv, serverPublicKey)
 	if err != nil {
 		return nil, err
 	}
-	return &Connection{
-		tcpConn:        tcpConn,
-		aesStream:      aesStream,
-		theirPublicKey: serverPublicKey,
-	}, nil
+	if requestTicket {
+		err = receiveTicket(conn)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return conn, nil
 }
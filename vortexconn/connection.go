@@ -9,11 +9,14 @@ import (
 	"github.com/pavben/Vortex/pubkeycrypto"
 )
 
-// Connection is an AES-encrypted TCP connection.
+// Connection is an AES-encrypted TCP connection, optionally rate limited.
 type Connection struct {
 	tcpConn        net.Conn
+	stream         *limitedStream
 	aesStream      *aesstream.AesStream
 	theirPublicKey *pubkeycrypto.PublicKey
+	// Only set on the connecting side
+	ticket *SessionTicket
 }
 
 func (c *Connection) Write(b []byte) error {
@@ -24,6 +27,22 @@ func (c *Connection) Read() ([]byte, error) {
 	return readByteChunkPlain(c.aesStream)
 }
 
+// TheirPublicKey returns the public key the other side presented during the handshake.
+// Check its hash before trusting the connection, since anybody can present a key.
+func (c *Connection) TheirPublicKey() *pubkeycrypto.PublicKey {
+	return c.theirPublicKey
+}
+
+// Ticket returns the session ticket the listener issued for this connection, or nil on the listening side.
+func (c *Connection) Ticket() *SessionTicket {
+	return c.ticket
+}
+
+// Close closes the underlying TCP connection.
+func (c *Connection) Close() error {
+	return c.tcpConn.Close()
+}
+
 func writeByteChunkPlain(writer io.Writer, b []byte) error {
 	chunkLen := uint32(len(b))
 	if int(chunkLen) != len(b) {
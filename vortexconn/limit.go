@@ -0,0 +1,99 @@
+package vortexconn
+
+import (
+	"net"
+	"sync"
+
+	"github.com/pavben/Vortex/aesstream"
+	"github.com/pavben/Vortex/pubkeycrypto"
+	"github.com/pavben/Vortex/ratelimit"
+)
+
+// Bytes pass the limiters in pieces of at most this size, so that a large frame doesn't go out in one burst
+const limitedPieceSize = 16 * 1024
+
+// limitedStream sits between the TCP connection and the AES stream, pacing bytes through the connection's limiters.
+type limitedStream struct {
+	tcpConn       net.Conn
+	mutex         sync.Mutex
+	readLimiters  []*ratelimit.Limiter
+	writeLimiters []*ratelimit.Limiter
+}
+
+func (s *limitedStream) limiters(write bool) []*ratelimit.Limiter {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if write {
+		return s.writeLimiters
+	}
+	return s.readLimiters
+}
+
+func (s *limitedStream) Read(p []byte) (int, error) {
+	limiters := s.limiters(false)
+	if len(limiters) == 0 {
+		return s.tcpConn.Read(p)
+	}
+	if len(p) > limitedPieceSize {
+		p = p[:limitedPieceSize]
+	}
+	n, err := s.tcpConn.Read(p)
+	// Waiting after the read holds off the next one, which lets TCP flow control slow down the other side
+	for _, limiter := range limiters {
+		limiter.Wait(n)
+	}
+	return n, err
+}
+
+func (s *limitedStream) Write(p []byte) (int, error) {
+	limiters := s.limiters(true)
+	if len(limiters) == 0 {
+		return s.tcpConn.Write(p)
+	}
+	written := 0
+	for written < len(p) {
+		piece := p[written:]
+		if len(piece) > limitedPieceSize {
+			piece = piece[:limitedPieceSize]
+		}
+		for _, limiter := range limiters {
+			limiter.Wait(len(piece))
+		}
+		n, err := s.tcpConn.Write(piece)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// LimitReads paces the bytes read from the connection through every one of limiters, such as one of its own and one shared by all
+// connections. It replaces any limiters set before, and can be called at any time. Call it with no limiters to remove the limits.
+func (c *Connection) LimitReads(limiters ...*ratelimit.Limiter) {
+	c.stream.mutex.Lock()
+	defer c.stream.mutex.Unlock()
+	c.stream.readLimiters = limiters
+}
+
+// LimitWrites is LimitReads for the bytes written to the connection.
+func (c *Connection) LimitWrites(limiters ...*ratelimit.Limiter) {
+	c.stream.mutex.Lock()
+	defer c.stream.mutex.Unlock()
+	c.stream.writeLimiters = limiters
+}
+
+// newConnection sets up the AES stream of a connection whose handshake is complete.
+func newConnection(tcpConn net.Conn, aesKey, iv []byte, theirPublicKey *pubkeycrypto.PublicKey) (*Connection, error) {
+	stream := &limitedStream{tcpConn: tcpConn}
+	aesStream, err := aesstream.NewAesStream(stream, aesKey, iv)
+	if err != nil {
+		return nil, err
+	}
+	return &Connection{
+		tcpConn:        tcpConn,
+		stream:         stream,
+		aesStream:      aesStream,
+		theirPublicKey: theirPublicKey,
+	}, nil
+}
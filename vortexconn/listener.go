@@ -1,11 +1,11 @@
 package vortexconn
 
 import (
+	"bytes"
 	"crypto/aes"
 	"fmt"
 	"net"
 
-	"github.com/pavben/Vortex/aesstream"
 	"github.com/pavben/Vortex/pubkeycrypto"
 )
 
@@ -15,6 +15,7 @@ type Listener struct {
 	keyPair                    *pubkeycrypto.KeyPair
 	establishedConnectionsChan chan *Connection
 	shutdownChan               chan struct{}
+	tickets                    ticketStore
 }
 
 // Listen creates and returns the Listener.
@@ -47,6 +48,7 @@ func (l *Listener) handleNewConnection(tcpConn net.Conn) {
 	conn, err := initConnectionAsListener(tcpConn, l)
 	if err != nil {
 		fmt.Println("initConnectionAsListener failed:", err)
+		tcpConn.Close()
 		return
 	}
 	l.establishedConnectionsChan <- conn
@@ -68,11 +70,18 @@ func initConnectionAsListener(tcpConn net.Conn, listener *Listener) (*Connection
 	if err != nil {
 		return nil, err
 	}
-	// Receive and parse the client's public key
+	// Receive and parse the client's public key, unless it is resuming a session with a ticket instead
 	clientPublicKeyBytes, err := readByteChunkPlain(tcpConn)
 	if err != nil {
 		return nil, fmt.Errorf("error reading client public key: %v", err)
 	}
+	if bytes.HasPrefix(clientPublicKeyBytes, []byte(ticketMagic)) {
+		return listener.resumeAsListener(tcpConn, clientPublicKeyBytes[len(ticketMagic):])
+	}
+	wantsTicket := bytes.HasPrefix(clientPublicKeyBytes, []byte(ticketRequestMagic))
+	if wantsTicket {
+		clientPublicKeyBytes = clientPublicKeyBytes[len(ticketRequestMagic):]
+	}
 	clientPublicKey, err := pubkeycrypto.PublicKeyFromBytes(clientPublicKeyBytes)
 	if err != nil {
 		return nil, fmt.Errorf("error parsing client public key: %v", err)
@@ -102,15 +111,17 @@ func initConnectionAsListener(tcpConn net.Conn, listener *Listener) (*Connection
 		return nil, err
 	}
 	// Create the AES stream
-	aesStream, err := aesstream.NewAesStream(tcpConn, aesKey, iv)
+	conn, err := newConnection(tcpConn, aesKey, iv, clientPublicKey)
 	if err != nil {
 		return nil, err
 	}
-	return &Connection{
-		tcpConn:        tcpConn,
-		aesStream:      aesStream,
-		theirPublicKey: clientPublicKey,
-	}, nil
+	if wantsTicket {
+		err = listener.issueTicket(conn)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return conn, nil
 }
 
 // Close closes this listener. It will not implicitly close existing connections.
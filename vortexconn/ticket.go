@@ -0,0 +1,237 @@
+package vortexconn
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pavben/Vortex/pubkeycrypto"
+)
+
+// Session resumption:
+//
+// A client that wants a ticket sends its public key prefixed with the ticket request magic, and at the end of the handshake the listener sends
+// it a ticket over the encrypted stream: a random id and a random secret. Clients from before session tickets send no prefix and get no
+// ticket, while listeners from before session tickets fail the handshake on the prefix, after which Connect starts over without it.
+//
+// To reconnect, the client sends the ticket magic, the id and a random nonce in place of its public key. If the listener still has the ticket,
+// it replies with 1, its own random nonce and a confirmation, and both sides derive the AES key and IV from the secret and the two nonces
+// with HMAC-SHA256. Otherwise it replies with 0. Tickets can only be used once, and a resumed connection is issued a new one.
+
+const (
+	ticketMagic        = "VXTK"
+	ticketRequestMagic = "VXTR"
+	ticketIdSize       = 16
+	ticketSecretSize   = 32
+	ticketNonceSize    = 32
+	// How long a listener accepts a ticket after issuing it
+	ticketLifetime = time.Hour
+)
+
+// ErrTicketRejected means the listener doesn't know the session ticket, for example because it restarted or the ticket expired.
+// Connect with the full handshake instead.
+var ErrTicketRejected = errors.New("Session ticket rejected by the listener")
+
+// SessionTicket lets a client reconnect to the listener that issued it without another RSA handshake. See ConnectWithTicket.
+type SessionTicket struct {
+	id              []byte
+	secret          []byte
+	serverPublicKey *pubkeycrypto.PublicKey
+}
+
+// listenerTicket is a ticket as remembered by the listener that issued it.
+type listenerTicket struct {
+	secret          []byte
+	clientPublicKey *pubkeycrypto.PublicKey
+	expires         time.Time
+}
+
+// ticketStore holds the tickets a listener has issued and not seen used yet.
+type ticketStore struct {
+	mutex   sync.Mutex
+	tickets map[string]*listenerTicket
+}
+
+func (ts *ticketStore) add(id []byte, ticket *listenerTicket) {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+	if ts.tickets == nil {
+		ts.tickets = make(map[string]*listenerTicket)
+	}
+	now := time.Now()
+	for key, t := range ts.tickets {
+		if now.After(t.expires) {
+			delete(ts.tickets, key)
+		}
+	}
+	ts.tickets[string(id)] = ticket
+}
+
+// take removes and returns the ticket with the given id, or nil if there is no such ticket or it expired.
+func (ts *ticketStore) take(id []byte) *listenerTicket {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+	ticket, ok := ts.tickets[string(id)]
+	if !ok {
+		return nil
+	}
+	delete(ts.tickets, string(id))
+	if time.Now().After(ticket.expires) {
+		return nil
+	}
+	return ticket
+}
+
+// issueTicket sends a new ticket to the client over conn and remembers it.
+func (l *Listener) issueTicket(conn *Connection) error {
+	id, err := generateRandomBytes(ticketIdSize)
+	if err != nil {
+		return err
+	}
+	secret, err := generateRandomBytes(ticketSecretSize)
+	if err != nil {
+		return err
+	}
+	err = conn.Write(append(append([]byte(nil), id...), secret...))
+	if err != nil {
+		return fmt.Errorf("error sending session ticket: %v", err)
+	}
+	l.tickets.add(id, &listenerTicket{
+		secret:          secret,
+		clientPublicKey: conn.theirPublicKey,
+		expires:         time.Now().Add(ticketLifetime),
+	})
+	return nil
+}
+
+// receiveTicket reads the ticket the listener sends at the end of the handshake and keeps it on conn.
+func receiveTicket(conn *Connection) error {
+	b, err := conn.Read()
+	if err != nil {
+		return fmt.Errorf("error reading session ticket: %v", err)
+	}
+	if len(b) != ticketIdSize+ticketSecretSize {
+		return fmt.Errorf("session ticket has unexpected length %d", len(b))
+	}
+	conn.ticket = &SessionTicket{
+		id:              b[:ticketIdSize],
+		secret:          b[ticketIdSize:],
+		serverPublicKey: conn.theirPublicKey,
+	}
+	return nil
+}
+
+// ConnectWithTicket reconnects to the listener that issued ticket, skipping the RSA handshake. The ticket can't be used again, but the new
+// connection carries a fresh one. If the listener no longer accepts the ticket, ErrTicketRejected is returned and Connect should be used.
+func ConnectWithTicket(addr string, ticket *SessionTicket) (*Connection, error) {
+	tcpConn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("dial error: %v", err)
+	}
+	conn, err := resumeAsClient(tcpConn, ticket)
+	if err != nil {
+		tcpConn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func resumeAsClient(tcpConn net.Conn, ticket *SessionTicket) (*Connection, error) {
+	clientNonce, err := generateRandomBytes(ticketNonceSize)
+	if err != nil {
+		return nil, err
+	}
+	request := append([]byte(ticketMagic), ticket.id...)
+	err = writeByteChunkPlain(tcpConn, append(request, clientNonce...))
+	if err != nil {
+		return nil, fmt.Errorf("error sending session ticket: %v", err)
+	}
+	// The listener always starts by sending its public key, which must be the one the ticket came from
+	serverPublicKeyBytes, err := readByteChunkPlain(tcpConn)
+	if err != nil {
+		return nil, fmt.Errorf("error reading server public key: %v", err)
+	}
+	if !bytes.Equal(serverPublicKeyBytes, ticket.serverPublicKey.ToBytes()) {
+		return nil, errors.New("server public key differs from the one the session ticket was issued with")
+	}
+	reply, err := readByteChunkPlain(tcpConn)
+	if err != nil {
+		return nil, fmt.Errorf("error reading session ticket reply: %v", err)
+	}
+	if len(reply) == 1 && reply[0] == 0 {
+		return nil, ErrTicketRejected
+	}
+	if len(reply) != 1+ticketNonceSize+sha256.Size || reply[0] != 1 {
+		return nil, fmt.Errorf("session ticket reply has unexpected length %d", len(reply))
+	}
+	serverNonce := reply[1 : 1+ticketNonceSize]
+	confirmation := reply[1+ticketNonceSize:]
+	if !hmac.Equal(confirmation, sessionHmac(ticket.secret, "confirm", clientNonce, serverNonce)) {
+		return nil, errors.New("server failed to prove it holds the session ticket")
+	}
+	conn, err := newResumedConnection(tcpConn, ticket.secret, clientNonce, serverNonce, ticket.serverPublicKey)
+	if err != nil {
+		return nil, err
+	}
+	err = receiveTicket(conn)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// resumeAsListener handles a client reconnecting with a ticket, where request is its first message after the ticket magic.
+func (l *Listener) resumeAsListener(tcpConn net.Conn, request []byte) (*Connection, error) {
+	if len(request) != ticketIdSize+ticketNonceSize {
+		return nil, fmt.Errorf("session ticket request has unexpected length %d", len(request))
+	}
+	clientNonce := request[ticketIdSize:]
+	ticket := l.tickets.take(request[:ticketIdSize])
+	if ticket == nil {
+		err := writeByteChunkPlain(tcpConn, []byte{0})
+		if err != nil {
+			return nil, err
+		}
+		return nil, errors.New("client sent an unknown or expired session ticket")
+	}
+	serverNonce, err := generateRandomBytes(ticketNonceSize)
+	if err != nil {
+		return nil, err
+	}
+	reply := append([]byte{1}, serverNonce...)
+	reply = append(reply, sessionHmac(ticket.secret, "confirm", clientNonce, serverNonce)...)
+	err = writeByteChunkPlain(tcpConn, reply)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := newResumedConnection(tcpConn, ticket.secret, clientNonce, serverNonce, ticket.clientPublicKey)
+	if err != nil {
+		return nil, err
+	}
+	err = l.issueTicket(conn)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+func newResumedConnection(tcpConn net.Conn, secret, clientNonce, serverNonce []byte, theirPublicKey *pubkeycrypto.PublicKey) (*Connection, error) {
+	aesKey := sessionHmac(secret, "key", clientNonce, serverNonce)
+	iv := sessionHmac(secret, "iv", clientNonce, serverNonce)[:aes.BlockSize]
+	return newConnection(tcpConn, aesKey, iv, theirPublicKey)
+}
+
+// sessionHmac derives a value for the given purpose from a ticket secret and the nonces of one resumption.
+func sessionHmac(secret []byte, purpose string, clientNonce, serverNonce []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("vortex session " + purpose))
+	mac.Write(clientNonce)
+	mac.Write(serverNonce)
+	return mac.Sum(nil)
+}
@@ -0,0 +1,224 @@
+package vortexconn
+
+import (
+	"crypto/aes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pavben/Vortex/pubkeycrypto"
+)
+
+// echoOnce accepts a connection on l and answers its first frame with the frame and the hash of the client's public key.
+func echoOnce(l *Listener) {
+	conn := l.Accept()
+	if conn == nil {
+		return
+	}
+	defer conn.Close()
+	b, err := conn.Read()
+	if err != nil {
+		return
+	}
+	conn.Write(append(b, " from "+conn.TheirPublicKey().Sha1Hash()...))
+}
+
+func roundTrip(t *testing.T, conn *Connection, message string) string {
+	t.Helper()
+	err := conn.Write([]byte(message))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := conn.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestTicketResumption(t *testing.T) {
+	serverKeys, err := pubkeycrypto.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientKeys, err := pubkeycrypto.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := Listen("127.0.0.1:0", serverKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	addr := l.tcpListener.Addr().String()
+	want := func(message string) string {
+		return message + " from " + clientKeys.PublicKey.Sha1Hash()
+	}
+	go echoOnce(l)
+	conn, err := Connect(addr, clientKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := roundTrip(t, conn, "first"); got != want("first") {
+		t.Fatalf("got %q", got)
+	}
+	conn.Close()
+	ticket := conn.Ticket()
+	if ticket == nil {
+		t.Fatal("no ticket issued")
+	}
+	// The listener still knows the client by the public key from the full handshake
+	go echoOnce(l)
+	resumed, err := ConnectWithTicket(addr, ticket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := roundTrip(t, resumed, "second"); got != want("second") {
+		t.Fatalf("got %q", got)
+	}
+	if resumed.TheirPublicKey().Sha1Hash() != serverKeys.PublicKey.Sha1Hash() {
+		t.Error("the resumed connection doesn't know the listener's public key")
+	}
+	resumed.Close()
+	_, err = ConnectWithTicket(addr, ticket)
+	if err != ErrTicketRejected {
+		t.Errorf("reusing a ticket: got %v, expected ErrTicketRejected", err)
+	}
+	// Resumed connections carry a fresh ticket of their own
+	go echoOnce(l)
+	again, err := ConnectWithTicket(addr, resumed.Ticket())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer again.Close()
+	if got := roundTrip(t, again, "third"); got != want("third") {
+		t.Fatalf("got %q", got)
+	}
+}
+
+// listenBeforeTickets accepts connections with the handshake of listeners from before session tickets, answering the first frame of each like
+// echoOnce, and returns the address it listens on.
+func listenBeforeTickets(t *testing.T, keyPair *pubkeycrypto.KeyPair) string {
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { tcpListener.Close() })
+	go func() {
+		for {
+			tcpConn, err := tcpListener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer tcpConn.Close()
+				conn, err := handshakeBeforeTickets(tcpConn, keyPair)
+				if err != nil {
+					return
+				}
+				b, err := conn.Read()
+				if err == nil {
+					conn.Write(append(b, " from "+conn.TheirPublicKey().Sha1Hash()...))
+				}
+			}()
+		}
+	}()
+	return tcpListener.Addr().String()
+}
+
+func handshakeBeforeTickets(tcpConn net.Conn, keyPair *pubkeycrypto.KeyPair) (*Connection, error) {
+	err := writeByteChunkPlain(tcpConn, keyPair.PublicKey.ToBytes())
+	if err != nil {
+		return nil, err
+	}
+	clientPublicKeyBytes, err := readByteChunkPlain(tcpConn)
+	if err != nil {
+		return nil, err
+	}
+	clientPublicKey, err := pubkeycrypto.PublicKeyFromBytes(clientPublicKeyBytes)
+	if err != nil {
+		return nil, err
+	}
+	aesKey, err := generateRandomBytes(32)
+	if err != nil {
+		return nil, err
+	}
+	aesKeyForClient, err := clientPublicKey.EncryptOAEP(aesKey)
+	if err == nil {
+		err = writeByteChunkPlain(tcpConn, aesKeyForClient)
+	}
+	if err != nil {
+		return nil, err
+	}
+	iv, err := generateRandomBytes(aes.BlockSize)
+	if err == nil {
+		err = writeByteChunkPlain(tcpConn, iv)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newConnection(tcpConn, aesKey, iv, clientPublicKey)
+}
+
+func TestTicketsAreOptional(t *testing.T) {
+	serverKeys, err := pubkeycrypto.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientKeys, err := pubkeycrypto.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "hello from " + clientKeys.PublicKey.Sha1Hash()
+
+	// Clients from before session tickets don't ask for one, so the first frame they read must be the listener's answer
+	l, err := Listen("127.0.0.1:0", serverKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go echoOnce(l)
+	tcpConn, err := net.Dial("tcp", l.tcpListener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := initConnectionAsClient(tcpConn, clientKeys, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := roundTrip(t, conn, "hello"); got != want {
+		t.Errorf("client without tickets: got %q", got)
+	}
+	conn.Close()
+
+	// Listeners from before session tickets never send one
+	conn, err = Connect(listenBeforeTickets(t, serverKeys), clientKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if conn.Ticket() != nil {
+		t.Error("got a ticket from a listener without tickets")
+	}
+	if got := roundTrip(t, conn, "hello"); got != want {
+		t.Errorf("listener without tickets: got %q", got)
+	}
+}
+
+func TestTicketStore(t *testing.T) {
+	var ts ticketStore
+	ts.add([]byte("live"), &listenerTicket{expires: time.Now().Add(time.Hour)})
+	ts.add([]byte("expired"), &listenerTicket{expires: time.Now().Add(-time.Second)})
+	if ts.take([]byte("expired")) != nil {
+		t.Error("took an expired ticket")
+	}
+	if ts.take([]byte("unknown")) != nil {
+		t.Error("took a ticket that was never added")
+	}
+	if ts.take([]byte("live")) == nil {
+		t.Fatal("couldn't take a live ticket")
+	}
+	if ts.take([]byte("live")) != nil {
+		t.Error("took a ticket twice")
+	}
+}